@@ -36,14 +36,29 @@ package csrand // import "gitlab.com/yawning/obfs4.git/common/csrand"
 import (
 	cryptRand "crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
+	"syscall"
+	"time"
+)
+
+const (
+	// maxReadRetries is the number of times a read from the system entropy
+	// source that failed with a transient error is retried, with the delay
+	// starting at readRetryBackoff and doubling after each attempt.
+	maxReadRetries   = 5
+	readRetryBackoff = 10 * time.Millisecond
 )
 
 var (
 	csRandSourceInstance csRandSource
 
+	// randReader is the entropy source used by Bytes, and is only
+	// overridden by the tests.
+	randReader = cryptRand.Reader
+
 	// Rand is a math/rand instance backed by crypto/rand CSPRNG.
 	Rand = rand.New(csRandSourceInstance) //nolint:gosec
 )
@@ -88,14 +103,45 @@ func IntRange(min, max int) int {
 	return ret + min
 }
 
-// Bytes fills the slice with random data.
+// Bytes fills the slice with random data.  Transient failures of the system
+// entropy source (eg: getrandom returning EAGAIN early in boot) are retried
+// with backoff, and an error is only returned once the retries are
+// exhausted, or for any other failure.
 func Bytes(buf []byte) error {
-	if _, err := io.ReadFull(cryptRand.Reader, buf); err != nil {
-		return err
+	backoff := readRetryBackoff
+	for retries := 0; ; retries++ {
+		n, err := io.ReadFull(randReader, buf)
+		if err == nil {
+			return nil
+		}
+		if retries >= maxReadRetries || !isTransientReadError(err) {
+			return err
+		}
+
+		// Keep whatever was read, and only retry for the rest.
+		buf = buf[n:]
+		time.Sleep(backoff)
+		backoff *= 2
 	}
+}
 
-	return nil
+func isTransientReadError(err error) bool {
+	if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+		return true
+	}
+	var tempErr interface{ Temporary() bool }
+	return errors.As(err, &tempErr) && tempErr.Temporary()
 }
 
-// Reader is a alias of rand.Reader.
-var Reader = cryptRand.Reader
+// Reader is a io.Reader backed by Bytes, that retries transient failures
+// of crypto/rand's Reader.
+var Reader io.Reader = retryReader{}
+
+type retryReader struct{}
+
+func (retryReader) Read(b []byte) (int, error) {
+	if err := Bytes(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package csrand
+
+import (
+	"bytes"
+	cryptRand "crypto/rand"
+	"errors"
+	"io"
+	"syscall"
+	"testing"
+)
+
+// flakyReader fails the first failures reads with err, after returning
+// part of the requested data, and then behaves like io.Reader r.
+type flakyReader struct {
+	r        io.Reader
+	err      error
+	failures int
+	reads    int
+}
+
+func (f *flakyReader) Read(b []byte) (int, error) {
+	f.reads++
+	if f.reads <= f.failures {
+		n, _ := f.r.Read(b[:len(b)/2])
+		return n, f.err
+	}
+	return f.r.Read(b)
+}
+
+func TestBytesRetry(t *testing.T) {
+	defer func() {
+		randReader = cryptRand.Reader
+	}()
+
+	src := make([]byte, 256)
+	for i := range src {
+		src[i] = byte(i)
+	}
+	for _, v := range []struct {
+		name     string
+		err      error
+		failures int
+		ok       bool
+	}{
+		{"EAGAIN", syscall.EAGAIN, 3, true},
+		{"EINTR", syscall.EINTR, 1, true},
+		{"exhausted", syscall.EAGAIN, maxReadRetries + 1, false},
+		{"fatal", errors.New("csrand: test failure"), 1, false},
+	} {
+		f := &flakyReader{r: bytes.NewReader(src), err: v.err, failures: v.failures}
+		randReader = f
+
+		buf := make([]byte, 64)
+		err := Bytes(buf)
+		if !v.ok {
+			if !errors.Is(err, v.err) {
+				t.Fatalf("%s: Bytes() returned %v, expected %v", v.name, err, v.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: Bytes() failed: %s", v.name, err)
+		}
+		if f.reads != v.failures+1 {
+			t.Fatalf("%s: %d reads, expected %d", v.name, f.reads, v.failures+1)
+		}
+
+		// The partial reads are kept, so the output is the prefix of the
+		// source.
+		if !bytes.Equal(buf, src[:len(buf)]) {
+			t.Fatalf("%s: unexpected output: %x", v.name, buf)
+		}
+	}
+}
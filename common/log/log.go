@@ -30,6 +30,10 @@
 package log // import "gitlab.com/yawning/obfs4.git/common/log"
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -37,11 +41,30 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
 	elidedAddr = "[scrubbed]"
 
+	// ScrubNone logs addresses as is, like the unsafe logging option.
+	ScrubNone = "none"
+
+	// ScrubPort scrubs the host, but keeps the port, so that connections
+	// can be tracked in the logs (the default).
+	ScrubPort = "port"
+
+	// ScrubFull scrubs both the host and the port.
+	ScrubFull = "full"
+
+	// ScrubHash replaces the host with a hash keyed by a random per-process
+	// salt, so that connections from the same host can be correlated
+	// within a run, but not across runs, without logging addresses.
+	ScrubHash = "hash"
+
+	hashedAddrLength = 8
+
 	// LevelError is the ERROR log level (NOTICE/ERROR).
 	LevelError = iota
 
@@ -59,8 +82,105 @@ var (
 	logLevel      = LevelInfo
 	enableLogging bool
 	unsafeLogging bool
+
+	scrubMode = ScrubPort
+	scrubHost = scrubHostPort
+	scrubSalt []byte
+
+	limiter rateLimiter
+	timeNow = time.Now
 )
 
+// rateLimiter is a token bucket rate limiter, keyed by the message format
+// string, so that a burst of the same message (eg: a handshake failure per
+// connection from an active prober) does not drown out everything else.
+type rateLimiter struct {
+	sync.Mutex
+
+	rate    float64
+	burst   int
+	buckets map[string]*rateBucket
+}
+
+type rateBucket struct {
+	prefix     string
+	tokens     float64
+	last       time.Time
+	suppressed int
+}
+
+// allow returns true iff a message with the given level prefix and format
+// string may be logged, along with the number of such messages that were
+// suppressed since the last one that was allowed.
+func (l *rateLimiter) allow(prefix, format string) (bool, int) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.rate == 0 {
+		return true, 0
+	}
+
+	now := timeNow()
+	key := prefix + format
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rateBucket{prefix: prefix, tokens: float64(l.burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > float64(l.burst) {
+		b.tokens = float64(l.burst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		// Report the suppressed messages once the bucket refills, even if
+		// the burst is over by then, and no message gets through.
+		if b.suppressed == 0 {
+			time.AfterFunc(time.Duration((1-b.tokens)/l.rate*float64(time.Second)), func() {
+				l.flush(b)
+			})
+		}
+		b.suppressed++
+		return false, 0
+	}
+	b.tokens--
+	suppressed := b.suppressed
+	b.suppressed = 0
+
+	return true, suppressed
+}
+
+// flush logs the number of messages suppressed by the bucket, unless they
+// were already reported (including by flushAll when the limit was changed).
+func (l *rateLimiter) flush(b *rateBucket) {
+	l.Lock()
+	if b.suppressed == 0 {
+		l.Unlock()
+		return
+	}
+	suppressed := b.suppressed
+	b.suppressed = 0
+	l.Unlock()
+
+	printSuppressed(b.prefix, suppressed)
+}
+
+// flushAll logs the number of messages suppressed by every bucket.  The
+// caller must hold the lock.
+func (l *rateLimiter) flushAll() {
+	for _, b := range l.buckets {
+		if b.suppressed > 0 {
+			printSuppressed(b.prefix, b.suppressed)
+			b.suppressed = 0
+		}
+	}
+}
+
+func printSuppressed(prefix string, suppressed int) {
+	log.Printf("%s%d similar messages suppressed", prefix, suppressed)
+}
+
 // Init initializes logging with the given path, and log safety options.
 func Init(enable bool, logFilePath string, unsafe bool) error {
 	if enable {
@@ -111,6 +231,39 @@ func SetLogLevel(logLevelStr string) error {
 	return nil
 }
 
+// SetRateLimit limits the ERROR and WARN log messages to rate messages per
+// second, with bursts of up to burst messages, for each format string.  The
+// number of messages suppressed is logged once the limit allows another
+// message with the same format string, and when the limit is changed.  A
+// rate of 0 disables the limit.
+func SetRateLimit(rate float64, burst int) error {
+	if rate < 0 || (rate > 0 && burst < 1) {
+		return fmt.Errorf("invalid log rate limit (%v/s, burst %d)", rate, burst)
+	}
+
+	limiter.Lock()
+	defer limiter.Unlock()
+	limiter.flushAll()
+	limiter.rate, limiter.burst = rate, burst
+	limiter.buckets = make(map[string]*rateBucket)
+
+	return nil
+}
+
+// printLimited logs the given format string/arguments with the level prefix,
+// subject to the rate limit.
+func printLimited(prefix, format string, a ...interface{}) {
+	ok, suppressed := limiter.allow(prefix, format)
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		printSuppressed(prefix, suppressed)
+	}
+	msg := fmt.Sprintf(format, a...)
+	log.Print(prefix + msg)
+}
+
 // Noticef logs the given format string/arguments at the NOTICE log level.
 // Unless logging is disabled, Noticef logs are always emitted.
 func Noticef(format string, a ...interface{}) {
@@ -120,19 +273,19 @@ func Noticef(format string, a ...interface{}) {
 	}
 }
 
-// Errorf logs the given format string/arguments at the ERROR log level.
+// Errorf logs the given format string/arguments at the ERROR log level,
+// subject to the rate limit (See SetRateLimit).
 func Errorf(format string, a ...interface{}) {
 	if enableLogging && logLevel >= LevelError {
-		msg := fmt.Sprintf(format, a...)
-		log.Print("[ERROR]: " + msg)
+		printLimited("[ERROR]: ", format, a...)
 	}
 }
 
-// Warnf logs the given format string/arguments at the WARN log level.
+// Warnf logs the given format string/arguments at the WARN log level,
+// subject to the rate limit (See SetRateLimit).
 func Warnf(format string, a ...interface{}) {
 	if enableLogging && logLevel >= LevelWarn {
-		msg := fmt.Sprintf(format, a...)
-		log.Print("[WARN]: " + msg)
+		printLimited("[WARN]: ", format, a...)
 	}
 }
 
@@ -152,6 +305,53 @@ func Debugf(format string, a ...interface{}) {
 	}
 }
 
+// SetScrubMode sets how ElideAddr scrubs addresses (ScrubNone, ScrubPort,
+// ScrubFull, or ScrubHash).  Each call with ScrubHash generates a new salt.
+func SetScrubMode(mode string) error {
+	switch mode {
+	case ScrubNone:
+		scrubHost = func(addrStr string) string { return addrStr }
+	case ScrubPort:
+		scrubHost = scrubHostPort
+	case ScrubFull:
+		scrubHost = func(string) string { return elidedAddr }
+	case ScrubHash:
+		salt := make([]byte, sha256.Size)
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+		scrubSalt = salt
+		scrubHost = scrubHostHash
+	default:
+		return fmt.Errorf("invalid scrub mode: %s", mode)
+	}
+	scrubMode = mode
+	return nil
+}
+
+func scrubHostPort(addrStr string) string {
+	// Only scrub off the address so that it's easier to track connections
+	// in logs by looking at the port.
+	if _, port, err := net.SplitHostPort(addrStr); err == nil {
+		return elidedAddr + ":" + port
+	}
+	return elidedAddr
+}
+
+func scrubHostHash(addrStr string) string {
+	host, port, err := net.SplitHostPort(addrStr)
+	if err != nil {
+		host = addrStr
+	}
+	m := hmac.New(sha256.New, scrubSalt)
+	_, _ = m.Write([]byte(host))
+	hashed := "[" + hex.EncodeToString(m.Sum(nil)[:hashedAddrLength]) + "]"
+	if err != nil {
+		return hashed
+	}
+	return hashed + ":" + port
+}
+
 // ElideError transforms the string representation of the provided error
 // based on the unsafeLogging setting.  Callers that wish to log errors
 // returned from Go's net package should use ElideError to sanitize the
@@ -160,7 +360,7 @@ func ElideError(err error) string {
 	// Go's net package is somewhat rude and includes IP address and port
 	// information in the string representation of net.Errors.  Figure out if
 	// this is the case here, and sanitize the error messages as needed.
-	if unsafeLogging {
+	if unsafeLogging || scrubMode == ScrubNone {
 		return err.Error()
 	}
 
@@ -191,17 +391,11 @@ func ElideError(err error) string {
 }
 
 // ElideAddr transforms the string representation of the provided address based
-// on the unsafeLogging setting.  Callers that wish to log IP addreses should
-// use ElideAddr to sanitize the contents first.
+// on the unsafeLogging setting and the scrub mode.  Callers that wish to log IP
+// addreses should use ElideAddr to sanitize the contents first.
 func ElideAddr(addrStr string) string {
 	if unsafeLogging {
 		return addrStr
 	}
-
-	// Only scrub off the address so that it's easier to track connections
-	// in logs by looking at the port.
-	if _, port, err := net.SplitHostPort(addrStr); err == nil {
-		return elidedAddr + ":" + port
-	}
-	return elidedAddr
+	return scrubHost(addrStr)
 }
@@ -0,0 +1,198 @@
+/*
+ * Copyright (c) 2014-2015, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "test.log")
+	if err := Init(true, logPath, false); err != nil {
+		t.Fatalf("Init() failed: %s", err)
+	}
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() {
+		_ = Init(false, "", false)
+		_ = SetRateLimit(0, 0)
+		timeNow = time.Now
+	}()
+
+	const burst = 5
+	if err := SetRateLimit(1, burst); err != nil {
+		t.Fatalf("SetRateLimit() failed: %s", err)
+	}
+	if err := SetRateLimit(1, 0); err == nil {
+		t.Fatalf("SetRateLimit() accepted a burst of 0")
+	}
+
+	// A flood of identical failures is limited to the burst, without
+	// affecting other messages.
+	for i := 0; i < 1000; i++ {
+		Warnf("probe %d - handshake failed", i)
+	}
+	Errorf("something else")
+
+	// Once tokens are available, the suppressed count is logged.
+	now = now.Add(time.Second)
+	Warnf("probe %d - handshake failed", 1000)
+
+	b, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("ReadFile() failed: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != burst+3 {
+		t.Fatalf("logged %d lines, expected %d: %s", len(lines), burst+3, b)
+	}
+	if !strings.HasSuffix(lines[burst], "[ERROR]: something else") {
+		t.Fatalf("unrelated message suppressed: %s", b)
+	}
+	if !strings.HasSuffix(lines[burst+1], "[WARN]: 995 similar messages suppressed") {
+		t.Fatalf("missing suppression count: %s", b)
+	}
+	if !strings.HasSuffix(lines[burst+2], "[WARN]: probe 1000 - handshake failed") {
+		t.Fatalf("message not logged after the limit: %s", b)
+	}
+}
+
+func TestRateLimitFlush(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "test.log")
+	if err := Init(true, logPath, false); err != nil {
+		t.Fatalf("Init() failed: %s", err)
+	}
+	defer func() {
+		_ = Init(false, "", false)
+		_ = SetRateLimit(0, 0)
+	}()
+
+	readLines := func() []string {
+		b, err := os.ReadFile(logPath)
+		if err != nil {
+			t.Fatalf("ReadFile() failed: %s", err)
+		}
+		return strings.Split(strings.TrimSpace(string(b)), "\n")
+	}
+
+	// The suppressed count of a burst that ends is still logged, once the
+	// limit would have allowed another message.
+	if err := SetRateLimit(20, 1); err != nil {
+		t.Fatalf("SetRateLimit() failed: %s", err)
+	}
+	for i := 0; i < 100; i++ {
+		Warnf("probe %d - handshake failed", i)
+	}
+	var lines []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if lines = readLines(); strings.HasSuffix(lines[len(lines)-1], "similar messages suppressed") {
+			break
+		}
+	}
+	var logged, suppressed int
+	for _, line := range lines {
+		var n int
+		if _, err := fmt.Sscanf(line[strings.Index(line, "[WARN]: ")+8:], "%d similar messages suppressed", &n); err == nil {
+			suppressed += n
+		} else {
+			logged++
+		}
+	}
+	if suppressed == 0 || logged+suppressed != 100 {
+		t.Fatalf("logged %d, reported %d suppressed: %q", logged, suppressed, lines)
+	}
+
+	// Changing the limit reports the pending counts.
+	for i := 0; i < 10; i++ {
+		Errorf("another burst")
+	}
+	if err := SetRateLimit(20, 1); err != nil {
+		t.Fatalf("SetRateLimit() failed: %s", err)
+	}
+	if lines = readLines(); !strings.HasSuffix(lines[len(lines)-1], "[ERROR]: 9 similar messages suppressed") {
+		t.Fatalf("pending count not reported: %q", lines[len(lines)-1])
+	}
+}
+
+func TestScrubMode(t *testing.T) {
+	defer func() {
+		_ = SetScrubMode(ScrubPort)
+	}()
+
+	const (
+		addr      = "192.0.2.1:443"
+		otherAddr = "192.0.2.2:443"
+	)
+	for _, v := range []struct {
+		mode     string
+		expected string
+	}{
+		{ScrubNone, addr},
+		{ScrubPort, "[scrubbed]:443"},
+		{ScrubFull, "[scrubbed]"},
+	} {
+		if err := SetScrubMode(v.mode); err != nil {
+			t.Fatalf("SetScrubMode(%s) failed: %s", v.mode, err)
+		}
+		if s := ElideAddr(addr); s != v.expected {
+			t.Fatalf("[%s]: ElideAddr() = %q, expected %q", v.mode, s, v.expected)
+		}
+	}
+	if err := SetScrubMode("bogus"); err == nil {
+		t.Fatalf("SetScrubMode() accepted an invalid mode")
+	}
+
+	// Hashes are stable per host within a run (regardless of the port),
+	// distinct for different hosts, and do not include the address.
+	if err := SetScrubMode(ScrubHash); err != nil {
+		t.Fatalf("SetScrubMode(%s) failed: %s", ScrubHash, err)
+	}
+	hashed := ElideAddr(addr)
+	if strings.Contains(hashed, "192.0.2.1") || !strings.HasSuffix(hashed, ":443") {
+		t.Fatalf("ElideAddr() = %q, expected a hashed host", hashed)
+	}
+	if s := ElideAddr("192.0.2.1:9001"); strings.TrimSuffix(s, ":9001") != strings.TrimSuffix(hashed, ":443") {
+		t.Fatalf("ElideAddr() is not stable per host: %q != %q", s, hashed)
+	}
+	if s := ElideAddr(otherAddr); s == hashed {
+		t.Fatalf("ElideAddr() hashed different hosts to %q", s)
+	}
+
+	// A new run (salt) hashes the same host differently.
+	if err := SetScrubMode(ScrubHash); err != nil {
+		t.Fatalf("SetScrubMode(%s) failed: %s", ScrubHash, err)
+	}
+	if s := ElideAddr(addr); s == hashed {
+		t.Fatalf("ElideAddr() is not salted: %q", s)
+	}
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package metrics implements simple process-wide latency histograms, that
+// can be exported as JSON.
+package metrics // import "gitlab.com/yawning/obfs4.git/common/metrics"
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultLatencyBuckets are the default histogram bucket upper bounds, in
+// milliseconds.
+var DefaultLatencyBuckets = []int64{10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000}
+
+var (
+	registryLock sync.Mutex
+	registry     = make(map[string]*Histogram)
+)
+
+// Histogram is a latency histogram with fixed millisecond buckets.  It is
+// safe for concurrent use.
+type Histogram struct {
+	bounds []int64
+	counts []atomic.Uint64
+	sumMs  atomic.Int64
+}
+
+// Snapshot is a point in time copy of a Histogram.
+type Snapshot struct {
+	// BoundsMs are the bucket upper bounds (inclusive) in milliseconds.
+	BoundsMs []int64 `json:"bounds_ms"`
+
+	// Counts are the per-bucket counts, with one more entry than BoundsMs
+	// for observations that are larger than the last bound.
+	Counts []uint64 `json:"counts"`
+
+	// Count is the total number of observations.
+	Count uint64 `json:"count"`
+
+	// SumMs is the sum of all observations in milliseconds.
+	SumMs int64 `json:"sum_ms"`
+}
+
+// NewHistogram creates a new Histogram with the provided bucket upper bounds
+// in milliseconds, and registers it under name for export.  It panics if a
+// histogram is already registered under name.
+func NewHistogram(name string, boundsMs []int64) *Histogram {
+	bounds := append([]int64{}, boundsMs...)
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+
+	h := &Histogram{
+		bounds: bounds,
+		counts: make([]atomic.Uint64, len(bounds)+1),
+	}
+
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, ok := registry[name]; ok {
+		panic("metrics: duplicate histogram: " + name)
+	}
+	registry[name] = h
+
+	return h
+}
+
+// Observe records a duration.
+func (h *Histogram) Observe(d time.Duration) {
+	ms := d.Milliseconds()
+	idx := sort.Search(len(h.bounds), func(i int) bool { return ms <= h.bounds[i] })
+	h.counts[idx].Add(1)
+	h.sumMs.Add(ms)
+}
+
+// Snapshot returns a copy of the current state of the histogram.
+func (h *Histogram) Snapshot() *Snapshot {
+	s := &Snapshot{
+		BoundsMs: append([]int64{}, h.bounds...),
+		Counts:   make([]uint64, len(h.counts)),
+		SumMs:    h.sumMs.Load(),
+	}
+	for i := range h.counts {
+		s.Counts[i] = h.counts[i].Load()
+		s.Count += s.Counts[i]
+	}
+	return s
+}
+
+// Snapshots returns snapshots of all registered histograms, by name.
+func Snapshots() map[string]*Snapshot {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	m := make(map[string]*Snapshot, len(registry))
+	for name, h := range registry {
+		m[name] = h.Snapshot()
+	}
+	return m
+}
+
+// Handler returns a http.Handler that serves all registered histograms as
+// JSON.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		_ = json.NewEncoder(w).Encode(Snapshots())
+	})
+}
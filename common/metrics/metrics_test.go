@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package metrics
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram("test_histogram", []int64{100, 10, 50})
+
+	for _, d := range []time.Duration{
+		5 * time.Millisecond,   // <= 10
+		10 * time.Millisecond,  // <= 10
+		42 * time.Millisecond,  // <= 50
+		100 * time.Millisecond, // <= 100
+		3 * time.Second,        // overflow
+	} {
+		h.Observe(d)
+	}
+
+	s := h.Snapshot()
+	expectedCounts := []uint64{2, 1, 1, 1}
+	if len(s.BoundsMs) != 3 || s.BoundsMs[0] != 10 || s.BoundsMs[2] != 100 {
+		t.Fatalf("unexpected bounds: %v", s.BoundsMs)
+	}
+	for i, c := range expectedCounts {
+		if s.Counts[i] != c {
+			t.Fatalf("counts: got %v, expected %v", s.Counts, expectedCounts)
+		}
+	}
+	if s.Count != 5 || s.SumMs != 5+10+42+100+3000 {
+		t.Fatalf("unexpected count/sum: %d/%d", s.Count, s.SumMs)
+	}
+
+	// Read it back via the handler.
+	rr := httptest.NewRecorder()
+	Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	var m map[string]*Snapshot
+	if err := json.Unmarshal(rr.Body.Bytes(), &m); err != nil {
+		t.Fatalf("failed to decode metrics: %s", err)
+	}
+	if got := m["test_histogram"]; got == nil || got.Count != 5 {
+		t.Fatalf("histogram not exported: %v", got)
+	}
+}
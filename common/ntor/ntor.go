@@ -72,6 +72,12 @@ const (
 
 	// AuthLength is the length of the derived AUTH.
 	AuthLength = sha256.Size
+
+	// TweakMask is the mask of the bits of an Elligator tweak that are
+	// used.  The low bit selects which of the two representatives of the
+	// public key is used, and the two high bits are the random padding of
+	// the representative.
+	TweakMask = 0xc1
 )
 
 var (
@@ -80,6 +86,7 @@ var (
 	tKey    = append(protoID, []byte(":key_extract")...)
 	tVerify = append(protoID, []byte(":key_verify")...)
 	mExpand = append(protoID, []byte(":key_expand")...)
+	tNodeID = append(protoID, []byte(":node_id")...)
 )
 
 // PublicKeyLengthError is the error returned when the public key being
@@ -139,6 +146,24 @@ func NewNodeID(raw []byte) (*NodeID, error) {
 	return nodeID, nil
 }
 
+// NodeIDFromPublicKey deterministically derives a NodeID from a public key,
+// as the truncated domain separated SHA256 digest of the key.
+//
+// Note: This links the node ID to the key, so anyone that knows one can
+// trivially check if it matches the other.  Randomly generated node IDs
+// should be used unless reproducibility is required.
+func NodeIDFromPublicKey(pub *PublicKey) *NodeID {
+	h := sha256.New()
+	_, _ = h.Write(tNodeID)
+	_, _ = h.Write(pub.Bytes()[:])
+	digest := h.Sum(nil)
+
+	nodeID := new(NodeID)
+	copy(nodeID[:], digest[:NodeIDLength])
+
+	return nodeID
+}
+
 // NodeIDFromHex creates a new NodeID from the hexdecimal representation.
 func NodeIDFromHex(encoded string) (*NodeID, error) {
 	raw, err := hex.DecodeString(encoded)
@@ -257,6 +282,33 @@ func (keypair *Keypair) HasElligator() bool {
 // NewKeypair generates a new Curve25519 keypair, and optionally also generates
 // an Elligator representative of the public key.
 func NewKeypair(elligator bool) (*Keypair, error) {
+	return NewKeypairFromReader(csrand.Reader, elligator)
+}
+
+// NewKeypairFromReader generates a new Curve25519 keypair with entropy from
+// r, and optionally also generates an Elligator representative of the public
+// key.  Unless r is a CSPRNG (eg: for testing), this is insecure.
+func NewKeypairFromReader(r io.Reader, elligator bool) (*Keypair, error) {
+	return newKeypairFromReader(r, elligator, nil)
+}
+
+// NewKeypairWithTweak generates a new Curve25519 keypair with entropy from
+// r, and an Elligator representative of the public key, using the supplied
+// tweak instead of one derived from the private key.  Only the TweakMask
+// bits of the tweak may be set.  As about half of the private keys do not
+// have a representative, more than one private key may be read from r.
+//
+// Reusing a tweak makes the padding bits of the representatives
+// predictable, so this is only intended for testing, or for callers that
+// otherwise ensure that the tweak is random.
+func NewKeypairWithTweak(r io.Reader, tweak byte) (*Keypair, error) {
+	if tweak&^TweakMask != 0 {
+		return nil, fmt.Errorf("ntor: Invalid Elligator tweak: %#02x", tweak)
+	}
+	return newKeypairFromReader(r, true, &tweak)
+}
+
+func newKeypairFromReader(r io.Reader, elligator bool, fixedTweak *byte) (*Keypair, error) {
 	keypair := new(Keypair)
 	keypair.private = new(PrivateKey)
 	keypair.public = new(PublicKey)
@@ -271,7 +323,7 @@ func NewKeypair(elligator bool) (*Keypair, error) {
 		// Also use part of the digest that gets truncated off for the
 		// obfuscation tweak.
 		priv := keypair.private.Bytes()[:]
-		if err := csrand.Bytes(priv); err != nil {
+		if _, err := io.ReadFull(r, priv); err != nil {
 			return nil, err
 		}
 		digest := sha512.Sum512(priv)
@@ -279,6 +331,9 @@ func NewKeypair(elligator bool) (*Keypair, error) {
 
 		if elligator {
 			tweak := digest[63]
+			if fixedTweak != nil {
+				tweak = *fixedTweak
+			}
 
 			// Apply the Elligator transform.  This fails ~50% of the time.
 			if !x25519ell2.ScalarBaseMult(keypair.public.Bytes(),
@@ -320,9 +375,40 @@ func KeypairFromHex(encoded string) (*Keypair, error) {
 	return keypair, nil
 }
 
+// SharedSecret returns the Curve25519 shared secret between the Keypair's
+// private key and peer.  It never fails.
+func (keypair *Keypair) SharedSecret(peer *PublicKey) (*[SharedSecretLength]byte, error) {
+	exp := new([SharedSecretLength]byte)
+	curve25519.ScalarMult(exp, keypair.private.Bytes(), peer.Bytes()) //nolint:staticcheck
+	return exp, nil
+}
+
+// IdentityKey is a server's long term identity key, as used by the server
+// side of the handshake.  Implementations may keep the private key outside
+// of the process (eg: in a PKCS#11 token, or behind a local key server), as
+// the only private key operation required is the Curve25519 shared secret
+// computation.  *Keypair is the in-memory implementation.
+type IdentityKey interface {
+	// Public returns the identity public key.
+	Public() *PublicKey
+
+	// SharedSecret returns the Curve25519 shared secret between the
+	// identity private key and peer, ie: EXP(peer, b).
+	SharedSecret(peer *PublicKey) (*[SharedSecretLength]byte, error)
+}
+
 // ServerHandshake does the server side of a ntor handshake and returns status,
 // KEY_SEED, and AUTH.  If status is not true, the handshake MUST be aborted.
 func ServerHandshake(clientPublic *PublicKey, serverKeypair *Keypair, idKeypair *Keypair, id *NodeID) (bool, *KeySeed, *Auth) {
+	ok, keySeed, auth, _ := ServerHandshakeWithIdentity(clientPublic, serverKeypair, idKeypair, id)
+	return ok, keySeed, auth
+}
+
+// ServerHandshakeWithIdentity is ServerHandshake, with the identity key
+// operation delegated to idKey.  Errors from idKey are returned as is, and
+// the handshake MUST be aborted if the error is non-nil or the status is not
+// true.
+func ServerHandshakeWithIdentity(clientPublic *PublicKey, serverKeypair *Keypair, idKey IdentityKey, id *NodeID) (bool, *KeySeed, *Auth, error) {
 	var notOk int
 	var secretInput bytes.Buffer
 
@@ -332,13 +418,16 @@ func ServerHandshake(clientPublic *PublicKey, serverKeypair *Keypair, idKeypair
 	notOk |= constantTimeIsZero(exp[:])
 	secretInput.Write(exp[:])
 
-	curve25519.ScalarMult(&exp, idKeypair.private.Bytes(), clientPublic.Bytes()) //nolint:staticcheck
-	notOk |= constantTimeIsZero(exp[:])
-	secretInput.Write(exp[:])
+	idExp, err := idKey.SharedSecret(clientPublic)
+	if err != nil {
+		return false, nil, nil, err
+	}
+	notOk |= constantTimeIsZero(idExp[:])
+	secretInput.Write(idExp[:])
 
-	keySeed, auth := ntorCommon(secretInput, id, idKeypair.public,
+	keySeed, auth := ntorCommon(secretInput, id, idKey.Public(),
 		clientPublic, serverKeypair.public)
-	return notOk == 0, keySeed, auth
+	return notOk == 0, keySeed, auth, nil
 }
 
 // ClientHandshake does the client side of a ntor handshake and returnes
@@ -408,6 +497,8 @@ func ntorCommon(secretInput bytes.Buffer, id *NodeID, b *PublicKey, x *PublicKey
 	return keySeed, auth
 }
 
+var _ IdentityKey = (*Keypair)(nil)
+
 func constantTimeIsZero(x []byte) int {
 	var ret byte
 	for _, v := range x {
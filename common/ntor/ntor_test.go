@@ -29,6 +29,11 @@ package ntor
 
 import (
 	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
 	"testing"
 
 	"filippo.io/edwards25519"
@@ -36,6 +41,32 @@ import (
 	"gitlab.com/yawning/edwards25519-extra/elligator2"
 )
 
+// TestNodeIDFromPublicKey tests NodeID derivation from a public key.
+func TestNodeIDFromPublicKey(t *testing.T) {
+	keypair, err := NewKeypair(false)
+	if err != nil {
+		t.Fatal("NewKeypair(false) failed:", err)
+	}
+	otherKeypair, err := NewKeypair(false)
+	if err != nil {
+		t.Fatal("NewKeypair(false) failed:", err)
+	}
+
+	nodeID := NodeIDFromPublicKey(keypair.Public())
+	if !bytes.Equal(nodeID[:], NodeIDFromPublicKey(keypair.Public())[:]) {
+		t.Fatal("NodeIDFromPublicKey() is not deterministic")
+	}
+	if bytes.Equal(nodeID[:], NodeIDFromPublicKey(otherKeypair.Public())[:]) {
+		t.Fatal("NodeIDFromPublicKey() collision for different keys")
+	}
+
+	// Known answer, to catch accidental changes to the derivation.
+	pub, _ := PublicKeyFromHex("0000000000000000000000000000000000000000000000000000000000000000")
+	if got := NodeIDFromPublicKey(pub).Hex(); got != "d7f57dc836e17abf371762392aa92c8b4d006885" {
+		t.Fatalf("NodeIDFromPublicKey(0): %s", got)
+	}
+}
+
 // TestNewKeypair tests Curve25519/Elligator keypair generation.
 func TestNewKeypair(t *testing.T) {
 	// Test standard Curve25519 first.
@@ -63,6 +94,63 @@ func TestNewKeypair(t *testing.T) {
 	}
 }
 
+// TestNewKeypairWithTweak tests Elligator keypair generation with a caller
+// supplied tweak.
+func TestNewKeypairWithTweak(t *testing.T) {
+	const expectedTweakRepresentative = "8d70b4e25b7aebb890e98251f73e2a376d66e3590d825e2a91b083db8718a606"
+
+	// The private keys are read from a fixed stream, so that the
+	// representatives are deterministic.
+	fixedReader := func() io.Reader {
+		var buf bytes.Buffer
+		for i := 0; i < 64; i++ {
+			buf.Write(bytes.Repeat([]byte{byte(i)}, PrivateKeyLength))
+		}
+		return &buf
+	}
+	newKeypair := func(tweak byte) *Keypair {
+		keypair, err := NewKeypairWithTweak(fixedReader(), tweak)
+		if err != nil {
+			t.Fatalf("NewKeypairWithTweak(%#02x) failed: %s", tweak, err)
+		}
+		if !bytes.Equal(keypair.Representative().ToPublic().Bytes()[:], keypair.Public().Bytes()[:]) {
+			t.Fatalf("NewKeypairWithTweak(%#02x): representative does not map to the public key", tweak)
+		}
+		return keypair
+	}
+
+	keypair := newKeypair(0x00)
+	if repr := keypair.Representative().Bytes(); hex.EncodeToString(repr[:]) != expectedTweakRepresentative {
+		t.Fatalf("NewKeypairWithTweak(): unexpected representative: %x", repr[:])
+	}
+	if !bytes.Equal(newKeypair(0x00).Representative().Bytes()[:], keypair.Representative().Bytes()[:]) {
+		t.Fatalf("NewKeypairWithTweak(): representative is not deterministic")
+	}
+
+	// The low bit selects the other representative of the same public key.
+	other := newKeypair(0x01)
+	if !bytes.Equal(other.Public().Bytes()[:], keypair.Public().Bytes()[:]) {
+		t.Fatalf("NewKeypairWithTweak(0x01): public key changed")
+	}
+	if bytes.Equal(other.Representative().Bytes()[:], keypair.Representative().Bytes()[:]) {
+		t.Fatalf("NewKeypairWithTweak(0x01): representative did not change")
+	}
+
+	// The high bits are the padding bits, and nothing else changes.
+	padded := newKeypair(0xc0).Representative().Bytes()
+	expected := *keypair.Representative().Bytes()
+	expected[RepresentativeLength-1] |= 0xc0
+	if *padded != expected {
+		t.Fatalf("NewKeypairWithTweak(0xc0): unexpected representative: %x", padded[:])
+	}
+
+	for _, tweak := range []byte{0x02, 0x3e, 0xff} {
+		if _, err := NewKeypairWithTweak(fixedReader(), tweak); err == nil {
+			t.Fatalf("NewKeypairWithTweak(%#02x) accepted an invalid tweak", tweak)
+		}
+	}
+}
+
 // Test Client/Server handshake.
 func TestHandshake(t *testing.T) {
 	clientKeypair, err := NewKeypair(true)
@@ -130,12 +218,126 @@ func TestHandshake(t *testing.T) {
 	}
 }
 
+// remoteIdentity is an IdentityKey that only exposes the shared secret
+// computation, like a hardware token would.
+type remoteIdentity struct {
+	public *PublicKey
+	secret func(*PublicKey) (*[SharedSecretLength]byte, error)
+}
+
+func (id *remoteIdentity) Public() *PublicKey {
+	return id.public
+}
+
+func (id *remoteIdentity) SharedSecret(peer *PublicKey) (*[SharedSecretLength]byte, error) {
+	return id.secret(peer)
+}
+
+// TestServerHandshakeWithIdentity tests the server handshake with the
+// identity key operation delegated.
+func TestServerHandshakeWithIdentity(t *testing.T) {
+	clientKeypair, _ := NewKeypair(true)
+	serverKeypair, _ := NewKeypair(true)
+	idKeypair, _ := NewKeypair(false)
+	nodeID := NodeIDFromPublicKey(idKeypair.Public())
+
+	var calls int
+	idKey := &remoteIdentity{
+		public: idKeypair.Public(),
+		secret: func(peer *PublicKey) (*[SharedSecretLength]byte, error) {
+			calls++
+			return idKeypair.SharedSecret(peer)
+		},
+	}
+
+	clientPublic := clientKeypair.Representative().ToPublic()
+	ok, serverSeed, serverAuth, err := ServerHandshakeWithIdentity(clientPublic, serverKeypair, idKey, nodeID)
+	if err != nil || !ok {
+		t.Fatalf("ServerHandshakeWithIdentity failed: %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("identity key used %d times, expected 1", calls)
+	}
+	ok, clientSeed, clientAuth := ClientHandshake(clientKeypair, serverKeypair.Public(), idKeypair.Public(), nodeID)
+	if !ok {
+		t.Fatal("ClientHandshake failed")
+	}
+	if !bytes.Equal(clientSeed.Bytes()[:], serverSeed.Bytes()[:]) {
+		t.Fatal("KEY_SEED mismatched between client/server")
+	}
+	if !bytes.Equal(clientAuth.Bytes()[:], serverAuth.Bytes()[:]) {
+		t.Fatal("AUTH mismatched between client/server")
+	}
+
+	// Failures of the identity key abort the handshake.
+	errUnavailable := errors.New("token unavailable")
+	idKey.secret = func(*PublicKey) (*[SharedSecretLength]byte, error) {
+		return nil, errUnavailable
+	}
+	if ok, _, _, err = ServerHandshakeWithIdentity(clientPublic, serverKeypair, idKey, nodeID); ok || !errors.Is(err, errUnavailable) {
+		t.Fatalf("ServerHandshakeWithIdentity returned %v, %v", ok, err)
+	}
+}
+
 // TestPublicKeySubgroup tests that Elligator representatives produced by
 // NewKeypair map to public keys that are not always on the prime-order subgroup
 // of Curve25519. (And incidentally that Elligator representatives agree with
 // the public key stored in the Keypair.)
 //
 // See discussion under "Step 2" at https://elligator.org/key-exchange.
+// TestRepresentativeUniformity tests that the Elligator representatives are
+// indistinguishable from uniform random bit strings.
+func TestRepresentativeUniformity(t *testing.T) {
+	// The Elligator 2 representatives sent on the wire must be
+	// indistinguishable from uniform random 256-bit strings.  Each
+	// representative is a field element r in [0, (p-1)/2], which is 254 bits
+	// wide (uniformly distributed, as the private keys are, and as the
+	// representative of each point is chosen as the "non-negative" root),
+	// padded with the two random high bits of the tweak.  Each of the 256
+	// bits should therefore be set with probability 1/2, independently of
+	// the others, and in particular the two padding bits should take on all
+	// four combinations equally often.
+	//
+	// The test checks that the number of times each bit is set (and that
+	// each combination of the padding bits occurs) is within 6 standard
+	// deviations of the expected value, which fails spuriously with
+	// negligible probability, but catches regressions such as dropping or
+	// mis-masking the padding bits, or the representative being biased.
+	const nrKeypairs = 4096
+
+	var (
+		bitCounts [RepresentativeLength * 8]int
+		padCounts [4]int
+	)
+	for i := 0; i < nrKeypairs; i++ {
+		kp, err := NewKeypair(true)
+		if err != nil {
+			t.Fatalf("NewKeypair() failed: %s", err)
+		}
+		repr := kp.Representative().Bytes()
+		for j := range bitCounts {
+			if repr[j/8]&(1<<(j%8)) != 0 {
+				bitCounts[j]++
+			}
+		}
+		padCounts[repr[RepresentativeLength-1]>>6]++
+	}
+
+	checkCount := func(what string, count int, p float64) {
+		expected := nrKeypairs * p
+		tolerance := 6 * math.Sqrt(nrKeypairs*p*(1-p))
+		if math.Abs(float64(count)-expected) > tolerance {
+			t.Errorf("%s occurred %d times, expected %.0f +/- %.0f", what, count, expected, tolerance)
+		}
+	}
+	for j, count := range bitCounts {
+		checkCount(fmt.Sprintf("bit %d", j), count, 0.5)
+	}
+	for v, count := range padCounts {
+		checkCount(fmt.Sprintf("padding bits %02b", v), count, 0.25)
+	}
+}
+
 func TestPublicKeySubgroup(t *testing.T) {
 	// We will test the public keys that comes out of NewKeypair by
 	// multiplying each one by L, the order of the prime-order subgroup of
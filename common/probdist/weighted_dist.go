@@ -58,6 +58,8 @@ type WeightedDist struct {
 
 	alias []int
 	prob  []float64
+
+	sampleHook func(int)
 }
 
 // New creates a weighted distribution of values ranging from min to max
@@ -213,7 +215,6 @@ func (w *WeightedDist) Sample() int {
 	var idx int
 
 	w.Lock()
-	defer w.Unlock()
 
 	// Generate a fair die roll from an $n$-sided die; call the side $i$.
 	i := csrand.Intn(len(w.values))
@@ -225,8 +226,46 @@ func (w *WeightedDist) Sample() int {
 		// Otherwise, return $Alias[i]$.
 		idx = w.alias[i]
 	}
+	value := w.minValue + w.values[idx]
+	hook := w.sampleHook
+
+	w.Unlock()
+
+	if hook != nil {
+		hook(value)
+	}
+	return value
+}
+
+// SetSampleHook sets a function that is called with each value returned by
+// Sample (eg: to build a histogram of the realized values), or clears it if
+// fn is nil.  fn is called without the distribution's lock held, and may be
+// called concurrently.
+func (w *WeightedDist) SetSampleHook(fn func(value int)) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.sampleHook = fn
+}
 
-	return w.minValue + w.values[idx]
+// Probabilities returns each of the values in the distribution, along with
+// the probability of it being sampled.
+func (w *WeightedDist) Probabilities() ([]int, []float64) {
+	w.Lock()
+	defer w.Unlock()
+
+	var sum float64
+	for _, weight := range w.weights {
+		sum += weight
+	}
+
+	values := make([]int, len(w.values))
+	probs := make([]float64, len(w.weights))
+	for i, v := range w.values {
+		values[i] = w.minValue + v
+		probs[i] = w.weights[i] / sum
+	}
+	return values, probs
 }
 
 // String returns a dump of the distribution table.
@@ -28,6 +28,8 @@
 package probdist
 
 import (
+	"math"
+	"reflect"
 	"testing"
 
 	"gitlab.com/yawning/obfs4.git/common/drbg"
@@ -35,6 +37,128 @@ import (
 
 const debug = false
 
+func TestSampleHook(t *testing.T) {
+	seed, err := drbg.NewSeed()
+	if err != nil {
+		t.Fatal("failed to generate a DRBG seed:", err)
+	}
+
+	w := New(seed, 0, 999, false)
+	values, _ := w.Probabilities()
+	valueSet := make(map[int]bool)
+	for _, v := range values {
+		valueSet[v] = true
+	}
+
+	var recorded []int
+	w.SetSampleHook(func(value int) {
+		recorded = append(recorded, value)
+	})
+	const nrSamples = 1000
+	for i := 0; i < nrSamples; i++ {
+		if v := w.Sample(); v != recorded[len(recorded)-1] {
+			t.Fatalf("recorded %d, Sample() returned %d", recorded[len(recorded)-1], v)
+		}
+	}
+	if len(recorded) != nrSamples {
+		t.Fatalf("recorded %d samples, expected %d", len(recorded), nrSamples)
+	}
+	for _, v := range recorded {
+		if !valueSet[v] {
+			t.Fatalf("recorded value %d is not in the distribution", v)
+		}
+	}
+
+	w.SetSampleHook(nil)
+	_ = w.Sample()
+	if len(recorded) != nrSamples {
+		t.Fatalf("sample recorded after the hook was cleared")
+	}
+}
+
+func TestProbabilities(t *testing.T) {
+	seed, err := drbg.NewSeed()
+	if err != nil {
+		t.Fatal("failed to generate a DRBG seed:", err)
+	}
+
+	for _, biased := range []bool{false, true} {
+		w := New(seed, 100, 199, biased)
+		values, probs := w.Probabilities()
+		if len(values) == 0 || len(values) != len(probs) {
+			t.Fatalf("biased=%v: %d values, %d probabilities", biased, len(values), len(probs))
+		}
+		var sum float64
+		for i, v := range values {
+			if v < 100 || v > 199 {
+				t.Fatalf("biased=%v: value %d out of range", biased, v)
+			}
+			sum += probs[i]
+		}
+		if math.Abs(sum-1.0) > 1e-9 {
+			t.Fatalf("biased=%v: probabilities sum to %f", biased, sum)
+		}
+	}
+}
+
+// TestWeightedDistVectors locks the distribution generated from a fixed seed,
+// as changing it changes the traffic profile of every deployed bridge.
+func TestWeightedDistVectors(t *testing.T) {
+	var rawSeed [drbg.SeedLength]byte
+	for i := range rawSeed {
+		rawSeed[i] = byte(i)
+	}
+	seed, err := drbg.SeedFromBytes(rawSeed[:])
+	if err != nil {
+		t.Fatal("failed to create the DRBG seed:", err)
+	}
+
+	for _, v := range []struct {
+		min, max int
+		biased   bool
+
+		values []int
+		alias  []int
+		prob   []float64
+	}{
+		{
+			5, 20, false,
+			[]int{14, 12, 4, 11, 15, 2, 10, 7, 0, 3},
+			[]int{8, 0, 0, 8, 2, 3, 0, 6, 0, 8},
+			[]float64{0.8178216595725858, 0.5834359848139592, 0.6421238692494706, 0.781659702803629, 0.08546643348028923, 0.6738117093065782, 0.521914278445514, 0.31590247448813225, 1, 0.24073426658399005},
+		},
+		{
+			5, 20, true,
+			[]int{14, 12, 4, 11, 15, 2, 10, 7, 0, 3},
+			[]int{0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			[]float64{1, 0.1754826068882875, 0.34506356489736895, 0.07325118516064527, 0.0028289175556896794, 0.02144373253146533, 0.02672282779860108, 0.003194335822520028, 0.018729264155295394, 5.511833444380698e-05},
+		},
+		{
+			0, 1448, false,
+			[]int{1090, 1347, 1007, 551, 1021, 517, 1065, 1321, 251, 102, 143, 1024, 134},
+			[]int{2, 4, 7, 6, 9, 7, 9, 9, 9, 0, 12, 6, 6},
+			[]float64{0.6465086702367149, 0.3004188150125385, 0.7375637550073717, 0.6028911211104736, 0.39884299221194897, 0.9406114357388373, 0.532374008323172, 0.7943610161207559, 0.8232575821995339, 1, 0.18759762211050107, 0.9041502750682462, 0.39502410734458127},
+		},
+	} {
+		w := New(seed, v.min, v.max, v.biased)
+		if !reflect.DeepEqual(w.values, v.values) {
+			t.Fatalf("[%d,%d,%v]: values %v, expected %v", v.min, v.max, v.biased, w.values, v.values)
+		}
+		if !reflect.DeepEqual(w.alias, v.alias) {
+			t.Fatalf("[%d,%d,%v]: alias %v, expected %v", v.min, v.max, v.biased, w.alias, v.alias)
+		}
+		if !reflect.DeepEqual(w.prob, v.prob) {
+			t.Fatalf("[%d,%d,%v]: prob %v, expected %v", v.min, v.max, v.biased, w.prob, v.prob)
+		}
+
+		// Reset to the same seed regenerates the same tables.
+		w.Reset(seed)
+		if !reflect.DeepEqual(w.values, v.values) || !reflect.DeepEqual(w.alias, v.alias) || !reflect.DeepEqual(w.prob, v.prob) {
+			t.Fatalf("[%d,%d,%v]: Reset() changed the tables", v.min, v.max, v.biased)
+		}
+	}
+}
+
 func TestWeightedDist(t *testing.T) {
 	seed, err := drbg.NewSeed()
 	if err != nil {
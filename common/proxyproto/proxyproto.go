@@ -0,0 +1,229 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package proxyproto implements server side parsing of the HAProxy PROXY
+// protocol (versions 1 and 2), so that the real client address is available
+// when running behind a load balancer or proxy.
+package proxyproto // import "gitlab.com/yawning/obfs4.git/common/proxyproto"
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	v1Prefix    = "PROXY "
+	v1MaxLength = 107
+
+	v2HeaderLength = 16
+	v2Version      = 0x20
+	v2CmdLocal     = 0x00
+	v2CmdProxy     = 0x01
+	v2FamTCP4      = 0x11
+	v2FamTCP6      = 0x21
+	v2AddrLenTCP4  = 12
+	v2AddrLenTCP6  = 36
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ErrInvalidHeader is the error returned when the PROXY protocol header is
+// missing or malformed.
+var ErrInvalidHeader = errors.New("proxyproto: invalid header")
+
+// Conn is a net.Conn that has had the PROXY protocol header consumed, and
+// reports the client address from the header as the remote address.
+type Conn struct {
+	net.Conn
+
+	r          *bufio.Reader
+	remoteAddr net.Addr
+}
+
+// Read reads data from the connection.
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client address from the PROXY protocol header if
+// present, or the address of the peer otherwise (eg: "LOCAL" health checks).
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// NewConn reads the PROXY protocol header from conn, and returns a wrapped
+// connection.  The caller is responsible for setting a deadline.
+func NewConn(conn net.Conn) (*Conn, error) {
+	c := &Conn{
+		Conn:       conn,
+		r:          bufio.NewReader(conn),
+		remoteAddr: conn.RemoteAddr(),
+	}
+
+	addr, err := readHeader(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if addr != nil {
+		c.remoteAddr = addr
+	}
+
+	return c, nil
+}
+
+// readHeader reads a PROXY protocol header, and returns the source address
+// if any.
+func readHeader(r *bufio.Reader) (net.Addr, error) {
+	// Both versions start with at least 6 bytes.
+	b, err := r.Peek(len(v1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if string(b) == v1Prefix {
+		return readV1Header(r)
+	}
+	if b, err = r.Peek(len(v2Signature)); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(b, v2Signature) {
+		return readV2Header(r)
+	}
+
+	return nil, ErrInvalidHeader
+}
+
+func readV1Header(r *bufio.Reader) (net.Addr, error) {
+	// The header is a single CRLF terminated line.
+	var line []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+		if len(line) >= v1MaxLength {
+			return nil, ErrInvalidHeader
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 {
+		return nil, ErrInvalidHeader
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		// The rest of the line is to be ignored.
+		return nil, nil //nolint:nilnil
+	case "TCP4", "TCP6":
+	default:
+		return nil, ErrInvalidHeader
+	}
+	if len(fields) != 6 {
+		return nil, ErrInvalidHeader
+	}
+
+	srcIP := net.ParseIP(fields[2])
+	if srcIP == nil || net.ParseIP(fields[3]) == nil {
+		return nil, ErrInvalidHeader
+	}
+	if (fields[1] == "TCP4") != (srcIP.To4() != nil) {
+		return nil, ErrInvalidHeader
+	}
+	srcPort, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, ErrInvalidHeader
+	}
+	if _, err = strconv.ParseUint(fields[5], 10, 16); err != nil {
+		return nil, ErrInvalidHeader
+	}
+
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, nil
+}
+
+func readV2Header(r *bufio.Reader) (net.Addr, error) {
+	var hdr [v2HeaderLength]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	verCmd, fam := hdr[12], hdr[13]
+	if verCmd&0xf0 != v2Version {
+		return nil, fmt.Errorf("proxyproto: unsupported version: %x", verCmd>>4)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch verCmd & 0x0f {
+	case v2CmdLocal:
+		// Connection established by the proxy itself.
+		return nil, nil //nolint:nilnil
+	case v2CmdProxy:
+	default:
+		return nil, ErrInvalidHeader
+	}
+
+	// Any trailing TLVs are ignored.
+	switch fam {
+	case v2FamTCP4:
+		if len(body) < v2AddrLenTCP4 {
+			return nil, ErrInvalidHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(bytes.Clone(body[0:4])),
+			Port: int(binary.BigEndian.Uint16(body[8:])),
+		}, nil
+	case v2FamTCP6:
+		if len(body) < v2AddrLenTCP6 {
+			return nil, ErrInvalidHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(bytes.Clone(body[0:16])),
+			Port: int(binary.BigEndian.Uint16(body[32:])),
+		}, nil
+	default:
+		// Unsupported/unspecified address family, use the real address.
+		return nil, nil //nolint:nilnil
+	}
+}
+
+var _ net.Conn = (*Conn)(nil)
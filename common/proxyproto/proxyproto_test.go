@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package proxyproto
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func makeV2Header(cmd, fam byte, addrs []byte) []byte {
+	b := append([]byte{}, v2Signature...)
+	b = append(b, v2Version|cmd, fam)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(addrs)))
+	return append(b, addrs...)
+}
+
+func TestNewConn(t *testing.T) {
+	const payload = "obfs4 handshake bytes"
+
+	v2TCP4 := []byte{
+		192, 0, 2, 1, // Source
+		198, 51, 100, 1, // Destination
+		0x30, 0x39, // Source port (12345)
+		0x01, 0xbb, // Destination port (443)
+	}
+	v2TCP6 := make([]byte, v2AddrLenTCP6)
+	copy(v2TCP6[0:], net.ParseIP("2001:db8::1"))
+	copy(v2TCP6[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(v2TCP6[32:], 12345)
+	binary.BigEndian.PutUint16(v2TCP6[34:], 443)
+
+	for _, v := range []struct {
+		name   string
+		header []byte
+		addr   string // "" for the real peer address.
+		ok     bool
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\r\n"), "192.0.2.1:12345", true},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\n"), "[2001:db8::1]:12345", true},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), "", true},
+		{"v1 family mismatch", []byte("PROXY TCP4 2001:db8::1 2001:db8::2 12345 443\r\n"), "", false},
+		{"v1 bad port", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 123456 443\r\n"), "", false},
+		{"v1 no CRLF", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\n"), "", false},
+		{"v2 TCP4", makeV2Header(v2CmdProxy, v2FamTCP4, v2TCP4), "192.0.2.1:12345", true},
+		{"v2 TCP6", makeV2Header(v2CmdProxy, v2FamTCP6, v2TCP6), "[2001:db8::1]:12345", true},
+		{"v2 TCP4 with TLVs", makeV2Header(v2CmdProxy, v2FamTCP4, append(v2TCP4, 0x04, 0x00, 0x01, 0xff)), "192.0.2.1:12345", true},
+		{"v2 LOCAL", makeV2Header(v2CmdLocal, 0x00, nil), "", true},
+		{"v2 truncated", makeV2Header(v2CmdProxy, v2FamTCP4, v2TCP4[:8]), "", false},
+		{"no header", []byte("GET / HTTP/1.1\r\n\r\n"), "", false},
+	} {
+		clientConn, serverConn := net.Pipe()
+		go func() {
+			_, _ = clientConn.Write(append(v.header, payload...))
+		}()
+
+		conn, err := NewConn(serverConn)
+		if !v.ok {
+			if err == nil {
+				t.Fatalf("[%s]: NewConn() succeeded", v.name)
+			}
+			clientConn.Close()
+			serverConn.Close()
+			continue
+		}
+		if err != nil {
+			t.Fatalf("[%s]: NewConn() failed: %s", v.name, err)
+		}
+
+		expectedAddr := v.addr
+		if expectedAddr == "" {
+			expectedAddr = serverConn.RemoteAddr().String()
+		}
+		if got := conn.RemoteAddr().String(); got != expectedAddr {
+			t.Fatalf("[%s]: RemoteAddr(): got %s, expected %s", v.name, got, expectedAddr)
+		}
+
+		// The data following the header must be intact.
+		buf := make([]byte, len(payload))
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("[%s]: Read() failed: %s", v.name, err)
+		}
+		if string(buf) != payload {
+			t.Fatalf("[%s]: payload mismatch: %q", v.name, buf)
+		}
+
+		clientConn.Close()
+		conn.Close()
+	}
+}
@@ -29,12 +29,14 @@
 // caller specifiable time-to-live.  It only detects if a given byte sequence
 // has been seen before based on the SipHash-2-4 digest of the sequence.
 // Collisions are treated as positive matches, though the probability of this
-// happening is negligible.
+// happening is negligible.  Filters created with New128 use a 128-bit digest
+// instead, for those that would rather not rely on that.
 package replayfilter // import "gitlab.com/yawning/obfs4.git/common/replayfilter"
 
 import (
 	"container/list"
 	"encoding/binary"
+	"math"
 	"sync"
 	"time"
 
@@ -49,26 +51,76 @@ import (
 // bridge sees in one day, so in practice should never be reached.
 const maxFilterSize = 100 * 1024
 
+// digest is the key of a filter entry.  hi is always 0, unless the filter
+// uses 128-bit digests.
+type digest struct {
+	lo, hi uint64
+}
+
 type entry struct {
-	digest    uint64
+	digest    digest
+	check     uint64
 	firstSeen time.Time
 	element   *list.Element
 }
 
+// Stats is a snapshot of the replay filter statistics, that allows operators
+// to judge whether the digest size is adequate for their volume.
+type Stats struct {
+	// DigestBits is the size of the digest used to key the filter (64 or
+	// 128).
+	DigestBits int
+
+	// Entries is the number of entries currently in the filter.
+	Entries int
+
+	// Queries is the total number of TestAndSet calls.
+	Queries uint64
+
+	// Hits is the total number of TestAndSet calls that returned true.
+	Hits uint64
+
+	// Collisions is the number of hits that were caused by distinct byte
+	// sequences with the same 64-bit digest, rather than a replay.  These
+	// are detected with a second, independent 64-bit check value, and are
+	// always 0 with 128-bit digests.
+	Collisions uint64
+
+	// FalsePositiveProbability is the estimated probability that a new byte
+	// sequence is a false positive, given the current number of entries.
+	FalsePositiveProbability float64
+}
+
 // ReplayFilter is a simple filter designed only to detect if a given byte
 // sequence has been seen before.
 type ReplayFilter struct {
 	sync.Mutex
 
-	filter map[uint64]*entry
+	filter map[digest]*entry
 	fifo   *list.List
 
-	key [2]uint64
-	ttl time.Duration
+	key    [2]uint64
+	ttl    time.Duration
+	wide   bool
+	hashFn func(k0, k1 uint64, p []byte) (uint64, uint64)
+
+	queries    uint64
+	hits       uint64
+	collisions uint64
 }
 
 // New creates a new ReplayFilter instance.
 func New(ttl time.Duration) (*ReplayFilter, error) {
+	return newFilter(ttl, false)
+}
+
+// New128 creates a new ReplayFilter instance, that uses 128-bit digests, so
+// that collisions are never treated as positive matches in practice.
+func New128(ttl time.Duration) (*ReplayFilter, error) {
+	return newFilter(ttl, true)
+}
+
+func newFilter(ttl time.Duration, wide bool) (*ReplayFilter, error) {
 	// Initialize the SipHash-2-4 instance with a random key.
 	var key [16]byte
 	if err := csrand.Bytes(key[:]); err != nil {
@@ -76,11 +128,13 @@ func New(ttl time.Duration) (*ReplayFilter, error) {
 	}
 
 	filter := new(ReplayFilter)
-	filter.filter = make(map[uint64]*entry)
+	filter.filter = make(map[digest]*entry)
 	filter.fifo = list.New()
 	filter.key[0] = binary.BigEndian.Uint64(key[0:8])
 	filter.key[1] = binary.BigEndian.Uint64(key[8:16])
 	filter.ttl = ttl
+	filter.wide = wide
+	filter.hashFn = siphash.Hash128
 
 	return filter, nil
 }
@@ -88,28 +142,58 @@ func New(ttl time.Duration) (*ReplayFilter, error) {
 // TestAndSet queries the filter for a given byte sequence, inserts the
 // sequence, and returns if it was present before the insertion operation.
 func (f *ReplayFilter) TestAndSet(now time.Time, buf []byte) bool {
-	digest := siphash.Hash(f.key[0], f.key[1], buf)
+	lo, hi := f.hashFn(f.key[0], f.key[1], buf)
+	d, check := digest{lo: lo, hi: hi}, uint64(0)
+	if !f.wide {
+		d, check = digest{lo: lo}, hi
+	}
 
 	f.Lock()
 	defer f.Unlock()
 
 	f.compactFilter(now)
+	f.queries++
 
-	if e := f.filter[digest]; e != nil {
-		// Hit.  Just return.
+	if e := f.filter[d]; e != nil {
+		// Hit.  Just return, after noting if this is a collision.
+		f.hits++
+		if e.check != check {
+			f.collisions++
+		}
 		return true
 	}
 
 	// Miss.  Add a new entry.
 	e := new(entry)
-	e.digest = digest
+	e.digest = d
+	e.check = check
 	e.firstSeen = now
 	e.element = f.fifo.PushBack(e)
-	f.filter[digest] = e
+	f.filter[d] = e
 
 	return false
 }
 
+// Stats returns the current filter statistics.
+func (f *ReplayFilter) Stats() Stats {
+	f.Lock()
+	defer f.Unlock()
+
+	digestBits := 64
+	if f.wide {
+		digestBits = 128
+	}
+
+	return Stats{
+		DigestBits:               digestBits,
+		Entries:                  len(f.filter),
+		Queries:                  f.queries,
+		Hits:                     f.hits,
+		Collisions:               f.collisions,
+		FalsePositiveProbability: float64(len(f.filter)) / math.Exp2(float64(digestBits)),
+	}
+}
+
 func (f *ReplayFilter) compactFilter(now time.Time) {
 	e := f.fifo.Front()
 	for e != nil {
@@ -142,6 +226,6 @@ func (f *ReplayFilter) compactFilter(now time.Time) {
 }
 
 func (f *ReplayFilter) reset() {
-	f.filter = make(map[uint64]*entry)
+	f.filter = make(map[digest]*entry)
 	f.fifo = list.New()
 }
@@ -33,9 +33,23 @@ import (
 )
 
 func TestReplayFilter(t *testing.T) {
+	for _, v := range []struct {
+		name string
+		ctor func(time.Duration) (*ReplayFilter, error)
+	}{
+		{"64-bit", New},
+		{"128-bit", New128},
+	} {
+		t.Run(v.name, func(t *testing.T) {
+			testReplayFilter(t, v.ctor)
+		})
+	}
+}
+
+func testReplayFilter(t *testing.T, ctor func(time.Duration) (*ReplayFilter, error)) {
 	ttl := 10 * time.Second
 
-	f, err := New(ttl)
+	f, err := ctor(ttl)
 	if err != nil {
 		t.Fatal("newReplayFilter failed:", err)
 	}
@@ -93,3 +107,54 @@ func TestReplayFilter(t *testing.T) {
 		t.Fatal("testAndSet populated filter, post-backward clock jump (replayed) returned false")
 	}
 }
+
+func TestReplayFilterCollisions(t *testing.T) {
+	// Force every byte sequence to the same 64-bit digest, with a distinct
+	// check value.
+	collidingHash := func(_, _ uint64, p []byte) (uint64, uint64) {
+		return 0x0123456789abcdef, uint64(len(p))
+	}
+
+	f, err := New(time.Hour)
+	if err != nil {
+		t.Fatal("New failed:", err)
+	}
+	f.hashFn = collidingHash
+
+	now := time.Now()
+	if f.TestAndSet(now, []byte("a")) {
+		t.Fatal("TestAndSet empty filter returned true")
+	}
+	if !f.TestAndSet(now, []byte("a")) {
+		t.Fatal("TestAndSet (replayed) returned false")
+	}
+	if !f.TestAndSet(now, []byte("bb")) {
+		t.Fatal("TestAndSet (colliding) returned false")
+	}
+	st := f.Stats()
+	if st.DigestBits != 64 || st.Entries != 1 || st.Queries != 3 || st.Hits != 2 || st.Collisions != 1 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+	if st.FalsePositiveProbability <= 0 {
+		t.Fatalf("unexpected false positive probability: %v", st.FalsePositiveProbability)
+	}
+
+	// With 128-bit digests, the same inputs do not collide.
+	f, err = New128(time.Hour)
+	if err != nil {
+		t.Fatal("New128 failed:", err)
+	}
+	f.hashFn = collidingHash
+	if f.TestAndSet(now, []byte("a")) {
+		t.Fatal("TestAndSet empty filter returned true")
+	}
+	if f.TestAndSet(now, []byte("bb")) {
+		t.Fatal("TestAndSet (128-bit, distinct) returned true")
+	}
+	if !f.TestAndSet(now, []byte("bb")) {
+		t.Fatal("TestAndSet (128-bit, replayed) returned false")
+	}
+	if st = f.Stats(); st.DigestBits != 128 || st.Entries != 2 || st.Hits != 1 || st.Collisions != 0 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
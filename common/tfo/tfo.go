@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package tfo provides a net.Dialer that attempts to use TCP Fast Open for
+// outgoing connections where the platform supports it.
+//
+// When TCP Fast Open is used, the data from the first Write on a new
+// connection is sent in the SYN (assuming the peer has previously handed out
+// a cookie), saving a round trip.  Platforms, kernels or peers that do not
+// support TCP Fast Open transparently fall back to a normal connect.
+package tfo // import "gitlab.com/yawning/obfs4.git/common/tfo"
+
+import (
+	"net"
+	"syscall"
+)
+
+// NewDialer returns a new net.Dialer that will attempt to use TCP Fast Open.
+func NewDialer() *net.Dialer {
+	return WrapDialer(&net.Dialer{})
+}
+
+// WrapDialer returns a copy of d that will additionally attempt to use TCP
+// Fast Open.  d's Control callback, if any, is called first, so that callers
+// can still set other socket options before the connect.
+func WrapDialer(d *net.Dialer) *net.Dialer {
+	wrapped := *d
+	if dialerControl == nil {
+		return &wrapped
+	}
+	if d.Control == nil {
+		wrapped.Control = dialerControl
+		return &wrapped
+	}
+	wrapped.Control = func(network, address string, c syscall.RawConn) error {
+		if err := d.Control(network, address, c); err != nil {
+			return err
+		}
+		return dialerControl(network, address, c)
+	}
+	return &wrapped
+}
+
+// Supported returns true iff TCP Fast Open for outgoing connections may be
+// used on this platform.
+func Supported() bool {
+	return dialerControl != nil
+}
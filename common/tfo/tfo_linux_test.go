@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tfo
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestWrapDialerLinux(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() failed: %s", err)
+	}
+	defer ln.Close()
+
+	// The caller's Control callback must run, before TCP Fast Open is
+	// enabled on the same socket.
+	var (
+		called   bool
+		tfoOnCtl int
+	)
+	d := WrapDialer(&net.Dialer{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			called = true
+			return c.Control(func(fd uintptr) {
+				tfoOnCtl, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect)
+			})
+		},
+	})
+	conn, err := d.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() failed: %s", err)
+	}
+	defer conn.Close()
+	if !called {
+		t.Fatalf("Control callback not called")
+	}
+	if tfoOnCtl != 0 {
+		t.Fatalf("TCP_FASTOPEN_CONNECT set before the Control callback")
+	}
+}
+
+func TestDialerControlLinux(t *testing.T) {
+	if !Supported() {
+		t.Fatalf("Supported() returned false on Linux")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() failed: %s", err)
+	}
+	defer ln.Close()
+
+	conn, err := NewDialer().Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() failed: %s", err)
+	}
+	defer conn.Close()
+
+	rawConn, err := conn.(*net.TCPConn).SyscallConn() //nolint:forcetypeassert
+	if err != nil {
+		t.Fatalf("SyscallConn() failed: %s", err)
+	}
+	var (
+		v      int
+		optErr error
+	)
+	if err = rawConn.Control(func(fd uintptr) {
+		v, optErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect)
+	}); err != nil {
+		t.Fatalf("Control() failed: %s", err)
+	}
+	if optErr != nil {
+		t.Skipf("kernel does not support TCP_FASTOPEN_CONNECT: %s", optErr)
+	}
+	if v != 1 {
+		t.Fatalf("TCP_FASTOPEN_CONNECT not set on the socket")
+	}
+}
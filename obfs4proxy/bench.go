@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"gitlab.com/yawning/obfs4.git/transports/base"
+	"gitlab.com/yawning/obfs4.git/transports/obfs4"
+)
+
+const (
+	defaultBenchHandshakes = 10
+	defaultBenchBytes      = 16 * 1024 * 1024
+
+	benchChunkSize = 32 * 1024
+)
+
+// benchResult is the outcome of benchmarking a bridge.
+type benchResult struct {
+	handshakes    int
+	handshakeTime time.Duration
+	latencies     []time.Duration
+
+	bytes        int64
+	transferTime time.Duration
+	transferErr  error
+}
+
+// runBench benchmarks the obfs4 bridge described by the bridge line, by
+// sequentially performing n handshakes, followed by sending size bytes over
+// a fresh connection.  Any data sent back by the bridge is discarded.
+//
+// Failing handshakes abort the benchmark, while the transfer being cut short
+// (eg: by the ORPort rejecting the garbage it receives) is recorded in the
+// result, along with the amount of data sent until then.
+func runBench(line string, n int, size int64, dialFn base.DialFunc) (*benchResult, error) {
+	b, err := obfs4.ParseBridgeLine(line)
+	if err != nil {
+		return nil, err
+	}
+	d, err := obfs4.NewMultiDialer([]obfs4.Bridge{*b}, dialFn, false)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &benchResult{
+		latencies: make([]time.Duration, 0, n),
+	}
+	for i := 0; i < n; i++ {
+		start := time.Now()
+		conn, err := d.Dial()
+		if err != nil {
+			return nil, fmt.Errorf("handshake %d: %w", i, err)
+		}
+		lat := time.Since(start)
+		conn.Close()
+
+		res.handshakes++
+		res.handshakeTime += lat
+		res.latencies = append(res.latencies, lat)
+	}
+	sort.Slice(res.latencies, func(i, j int) bool { return res.latencies[i] < res.latencies[j] })
+
+	if size <= 0 {
+		return res, nil
+	}
+	conn, err := d.Dial()
+	if err != nil {
+		return nil, fmt.Errorf("bulk transfer: %w", err)
+	}
+	defer conn.Close()
+	go func() {
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	buf := make([]byte, benchChunkSize)
+	if _, err = rand.Read(buf); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	for res.bytes < size {
+		toWrite := buf
+		if rem := size - res.bytes; rem < int64(len(toWrite)) {
+			toWrite = toWrite[:rem]
+		}
+		wrLen, err := conn.Write(toWrite)
+		res.bytes += int64(wrLen)
+		if err != nil {
+			res.transferErr = err
+			break
+		}
+	}
+	res.transferTime = time.Since(start)
+
+	return res, nil
+}
+
+// percentile returns the p-th percentile (nearest rank) of the sorted
+// durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
+
+// writeBenchReport writes the human readable form of res to w.
+func writeBenchReport(w io.Writer, res *benchResult) error {
+	var hsRate float64
+	if res.handshakeTime > 0 {
+		hsRate = float64(res.handshakes) / res.handshakeTime.Seconds()
+	}
+	if _, err := fmt.Fprintf(w, "handshakes: %d (%.2f handshakes/sec)\n", res.handshakes, hsRate); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "connect latency: p50 %s, p90 %s, p99 %s, max %s\n",
+		percentile(res.latencies, 50), percentile(res.latencies, 90),
+		percentile(res.latencies, 99), percentile(res.latencies, 100)); err != nil {
+		return err
+	}
+
+	var mbRate float64
+	if res.transferTime > 0 {
+		mbRate = float64(res.bytes) / (1024 * 1024) / res.transferTime.Seconds()
+	}
+	if _, err := fmt.Fprintf(w, "transfer: %d bytes in %s (%.2f MB/s)\n", res.bytes, res.transferTime, mbRate); err != nil {
+		return err
+	}
+	if res.transferErr != nil {
+		if _, err := fmt.Fprintf(w, "transfer cut short: %s\n", res.transferErr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/yawning/obfs4.git/common/drbg"
+	"gitlab.com/yawning/obfs4.git/common/ntor"
+	"gitlab.com/yawning/obfs4.git/transports/obfs4"
+)
+
+func TestRunBench(t *testing.T) {
+	identityKey, err := ntor.NewKeypair(false)
+	if err != nil {
+		t.Fatalf("ntor.NewKeypair() failed: %s", err)
+	}
+	seed, err := drbg.NewSeed()
+	if err != nil {
+		t.Fatalf("drbg.NewSeed() failed: %s", err)
+	}
+	sf, err := obfs4.NewServerFactory(&obfs4.ServerConfig{
+		NodeID:      ntor.NodeIDFromPublicKey(identityKey.Public()),
+		IdentityKey: identityKey,
+		DrbgSeed:    seed,
+	})
+	if err != nil {
+		t.Fatalf("obfs4.NewServerFactory() failed: %s", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() failed: %s", err)
+	}
+	defer ln.Close()
+	received := make(chan int64, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				c, err := sf.WrapConn(conn)
+				if err != nil {
+					return
+				}
+				n, _ := io.Copy(io.Discard, c)
+				if n > 0 {
+					received <- n
+				}
+			}()
+		}
+	}()
+
+	cert, _ := sf.Args().Get("cert")
+	line := "obfs4 " + ln.Addr().String() + " cert=" + cert + " iat-mode=0"
+	const size = 1024 * 1024
+	res, err := runBench(line, 5, size, net.Dial)
+	if err != nil {
+		t.Fatalf("runBench() failed: %s", err)
+	}
+	if res.handshakes != 5 || len(res.latencies) != 5 {
+		t.Fatalf("runBench(): handshakes %d, latencies %d", res.handshakes, len(res.latencies))
+	}
+	if res.bytes != size || res.transferErr != nil {
+		t.Fatalf("runBench(): sent %d bytes: %v", res.bytes, res.transferErr)
+	}
+	select {
+	case n := <-received:
+		if n != size {
+			t.Fatalf("server received %d bytes, expected %d", n, size)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("server did not receive the transfer")
+	}
+
+	var buf bytes.Buffer
+	if err = writeBenchReport(&buf, res); err != nil {
+		t.Fatalf("writeBenchReport() failed: %s", err)
+	}
+	for _, s := range []string{"handshakes/sec", "p50", "p99", "MB/s"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Fatalf("writeBenchReport(): %q missing from %q", s, buf.String())
+		}
+	}
+
+	if _, err = runBench("obfs4 "+ln.Addr().String(), 1, 0, net.Dial); err == nil {
+		t.Fatalf("runBench() accepted a bridge line without a cert")
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var d []time.Duration
+	if percentile(d, 50) != 0 {
+		t.Fatalf("percentile(): non-zero for no samples")
+	}
+	for i := 1; i <= 100; i++ {
+		d = append(d, time.Duration(i))
+	}
+	for _, v := range []struct {
+		p        float64
+		expected time.Duration
+	}{
+		{0, 1},
+		{50, 50},
+		{90, 90},
+		{99, 99},
+		{100, 100},
+	} {
+		if got := percentile(d, v.p); got != v.expected {
+			t.Fatalf("percentile(%v) = %d, expected %d", v.p, got, v.expected)
+		}
+	}
+}
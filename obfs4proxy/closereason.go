@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"gitlab.com/yawning/obfs4.git/transports/base"
+)
+
+// The connection close reasons, included in the log messages so that
+// operators can tell why a connection was torn down without needing to
+// interpret the (possibly elided) error.
+const (
+	closeReasonHandshakeFail = "handshake-fail"
+	closeReasonNormalEOF     = "normal-eof"
+	closeReasonPeerReset     = "peer-reset"
+	closeReasonTimeout       = "timeout"
+	closeReasonProbeDetected = "probe-detected"
+	closeReasonError         = "error"
+)
+
+// closeReason classifies the error that caused a connection to be closed.
+func closeReason(err error) string {
+	var hsErr *base.HandshakeError
+	if errors.As(err, &hsErr) {
+		if hsErr.Probe {
+			return closeReasonProbeDetected
+		}
+		return closeReasonHandshakeFail
+	}
+
+	switch {
+	case err == nil, errors.Is(err, io.EOF):
+		// io.Copy() swallows EOF, so a clean close is normally nil.
+		return closeReasonNormalEOF
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return closeReasonTimeout
+	case errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNABORTED),
+		errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		return closeReasonPeerReset
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return closeReasonTimeout
+	}
+
+	return closeReasonError
+}
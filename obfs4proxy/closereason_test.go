@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"gitlab.com/yawning/obfs4.git/transports/base"
+	"gitlab.com/yawning/obfs4.git/transports/obfs4"
+)
+
+func TestCloseReason(t *testing.T) {
+	opErr := func(err error) error {
+		return &net.OpError{Op: "read", Net: "tcp", Err: &os.SyscallError{Syscall: "read", Err: err}}
+	}
+
+	for _, v := range []struct {
+		err    error
+		reason string
+	}{
+		{nil, closeReasonNormalEOF},
+		{io.EOF, closeReasonNormalEOF},
+		{opErr(syscall.ECONNRESET), closeReasonPeerReset},
+		{opErr(syscall.EPIPE), closeReasonPeerReset},
+		{io.ErrUnexpectedEOF, closeReasonPeerReset},
+		{&net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}, closeReasonTimeout},
+		{&base.HandshakeError{Err: io.EOF}, closeReasonHandshakeFail},
+		{&base.HandshakeError{Err: os.ErrDeadlineExceeded}, closeReasonHandshakeFail},
+		{&base.HandshakeError{Err: obfs4.ErrReplayedHandshake, Probe: true}, closeReasonProbeDetected},
+		{fmt.Errorf("wrapped: %w", &base.HandshakeError{Err: obfs4.ErrInvalidHandshake, Probe: true}), closeReasonProbeDetected},
+		{errors.New("something else"), closeReasonError},
+	} {
+		if reason := closeReason(v.err); reason != v.reason {
+			t.Errorf("closeReason(%v): got '%s', expected '%s'", v.err, reason, v.reason)
+		}
+	}
+}
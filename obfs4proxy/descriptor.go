@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+)
+
+const (
+	descriptorFormatJSON = "json"
+	descriptorFile       = "obfs4proxy_descriptor.json"
+)
+
+// bridgeDescriptor is the machine readable description of a server
+// transport listener, derived from the same data that is reported to tor
+// via SMETHOD.
+type bridgeDescriptor struct {
+	Transport string            `json:"transport"`
+	BindAddr  string            `json:"bind_addr"`
+	Args      map[string]string `json:"args"`
+}
+
+// descriptorDocument is the top level descriptor object, so that fields other
+// than the listeners can be added without breaking consumers.
+type descriptorDocument struct {
+	Listeners []*bridgeDescriptor `json:"listeners"`
+}
+
+func newBridgeDescriptor(name string, addr net.Addr, args *pt.Args) *bridgeDescriptor {
+	desc := &bridgeDescriptor{
+		Transport: name,
+		BindAddr:  addr.String(),
+		Args:      make(map[string]string),
+	}
+	if args != nil {
+		for k := range *args {
+			desc.Args[k], _ = args.Get(k)
+		}
+	}
+	return desc
+}
+
+func validateDescriptorFormat(format string) error {
+	switch format {
+	case "", descriptorFormatJSON:
+		return nil
+	default:
+		return fmt.Errorf("unsupported descriptor format '%s'", format)
+	}
+}
+
+func writeDescriptors(w io.Writer, format string, descs []*bridgeDescriptor) error {
+	if err := validateDescriptorFormat(format); err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&descriptorDocument{Listeners: descs})
+}
+
+// emitDescriptors writes the descriptors to the configured file, which is in
+// the state directory by default.  The descriptors are never written to
+// stdout, as tor reads it as the pluggable transport configuration protocol.
+func emitDescriptors(format, dest string, descs []*bridgeDescriptor) error {
+	if dest == "" {
+		dest = path.Join(stateDir, descriptorFile)
+	}
+
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if err = writeDescriptors(f, format, descs); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
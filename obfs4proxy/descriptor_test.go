@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+
+	"gitlab.com/yawning/obfs4.git/transports/obfs4"
+)
+
+func TestBridgeDescriptor(t *testing.T) {
+	tr := &obfs4.Transport{}
+	sf, err := tr.ServerFactory(t.TempDir(), &pt.Args{})
+	if err != nil {
+		t.Fatalf("ServerFactory() failed: %s", err)
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}
+
+	descs := []*bridgeDescriptor{
+		newBridgeDescriptor(tr.Name(), addr, sf.Args()),
+	}
+	var buf bytes.Buffer
+	if err = writeDescriptors(&buf, descriptorFormatJSON, descs); err != nil {
+		t.Fatalf("writeDescriptors() failed: %s", err)
+	}
+
+	// Validate the schema, without relying on the Go type.
+	var decoded map[string]any
+	if err = json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("failed to decode descriptor: %s", err)
+	}
+	if len(decoded) != 1 {
+		t.Fatalf("unexpected top level fields: %v", decoded)
+	}
+	listeners, ok := decoded["listeners"].([]any)
+	if !ok || len(listeners) != 1 {
+		t.Fatalf("listeners: %v", decoded["listeners"])
+	}
+	desc, ok := listeners[0].(map[string]any)
+	if !ok {
+		t.Fatalf("listener: %v", listeners[0])
+	}
+	if len(desc) != 3 {
+		t.Fatalf("unexpected fields: %v", desc)
+	}
+	if v, ok := desc["transport"].(string); !ok || v != "obfs4" {
+		t.Fatalf("transport: %v", desc["transport"])
+	}
+	if v, ok := desc["bind_addr"].(string); !ok || v != "192.0.2.1:443" {
+		t.Fatalf("bind_addr: %v", desc["bind_addr"])
+	}
+	args, ok := desc["args"].(map[string]any)
+	if !ok {
+		t.Fatalf("args: %v", desc["args"])
+	}
+	expectedArgs := sf.Args()
+	if len(args) != len(*expectedArgs) {
+		t.Fatalf("args: got %v, expected %v", args, *expectedArgs)
+	}
+	for _, k := range []string{"cert", "iat-mode"} {
+		expected, _ := expectedArgs.Get(k)
+		if v, ok := args[k].(string); !ok || v != expected {
+			t.Fatalf("args[%s]: got %v, expected '%s'", k, args[k], expected)
+		}
+	}
+
+	if err = writeDescriptors(&buf, "xml", descs); err == nil {
+		t.Fatalf("writeDescriptors(xml) succeeded")
+	}
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// fwmarkSupported returns true iff setting the firewall mark on outgoing
+// sockets is supported on this platform.
+func fwmarkSupported() bool {
+	return fwmarkControl != nil
+}
+
+// withFwmark returns a copy of d that additionally sets the firewall mark
+// on each socket, after d's Control callback, if any.  The dial fails if
+// the mark can not be set (eg: due to lacking CAP_NET_ADMIN), rather than
+// silently bypassing the policy routing.
+func withFwmark(d *net.Dialer, mark uint32) *net.Dialer {
+	wrapped := *d
+	if fwmarkControl == nil {
+		return &wrapped
+	}
+	wrapped.Control = func(network, address string, c syscall.RawConn) error {
+		if d.Control != nil {
+			if err := d.Control(network, address, c); err != nil {
+				return err
+			}
+		}
+		return fwmarkControl(mark, c)
+	}
+	return &wrapped
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestWithFwmarkLinux(t *testing.T) {
+	if !fwmarkSupported() {
+		t.Fatalf("fwmarkSupported() returned false on Linux")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() failed: %s", err)
+	}
+	defer ln.Close()
+
+	// The existing Control callback must still be called.
+	var called bool
+	d := withFwmark(&net.Dialer{
+		Control: func(_, _ string, _ syscall.RawConn) error {
+			called = true
+			return nil
+		},
+	}, 0x2a)
+	conn, err := d.Dial("tcp", ln.Addr().String())
+	if errors.Is(err, syscall.EPERM) {
+		t.Skipf("setting SO_MARK requires CAP_NET_ADMIN: %s", err)
+	} else if err != nil {
+		t.Fatalf("Dial() failed: %s", err)
+	}
+	defer conn.Close()
+	if !called {
+		t.Fatalf("Control callback not called")
+	}
+
+	rawConn, err := conn.(*net.TCPConn).SyscallConn() //nolint:forcetypeassert
+	if err != nil {
+		t.Fatalf("SyscallConn() failed: %s", err)
+	}
+	var (
+		v      int
+		optErr error
+	)
+	if err = rawConn.Control(func(fd uintptr) {
+		v, optErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK)
+	}); err != nil {
+		t.Fatalf("Control() failed: %s", err)
+	}
+	if optErr != nil {
+		t.Fatalf("getsockopt(SO_MARK) failed: %s", optErr)
+	}
+	if v != 0x2a {
+		t.Fatalf("SO_MARK = %#x, expected 0x2a", v)
+	}
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"gitlab.com/yawning/obfs4.git/transports/obfs4"
+)
+
+// serverParamKeys is the order in which the server parameters are printed.
+var serverParamKeys = []string{"node-id", "private-key", "public-key", "drbg-seed", "iat-mode"}
+
+// writeServerParams writes the parameters of a freshly generated obfs4
+// server state to w, as the torrc ServerTransportOptions that configure a
+// server with it (without a state directory), and the client bridge line.
+func writeServerParams(w io.Writer) error {
+	st, err := obfs4.GenerateServerState()
+	if err != nil {
+		return fmt.Errorf("failed to generate server state: %w", err)
+	}
+	args, err := st.ServerArgs()
+	if err != nil {
+		return err
+	}
+
+	var opts []string
+	for _, k := range serverParamKeys {
+		v, _ := args.Get(k)
+		opts = append(opts, k+"="+v)
+	}
+
+	_, err = fmt.Fprintf(w, "# obfs4 torrc server configuration\n"+
+		"ServerTransportOptions obfs4 %s\n\n"+
+		"# obfs4 torrc client bridge line\n"+
+		"#\n"+
+		"# Before distributing this Bridge, edit the placeholder fields\n"+
+		"# to contain the actual values.\n"+
+		"Bridge %s\n",
+		strings.Join(opts, " "), st.BridgeLine("<IP ADDRESS>:<PORT> <FINGERPRINT>"))
+	return err
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+
+	"gitlab.com/yawning/obfs4.git/transports/obfs4"
+)
+
+func TestWriteServerParams(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeServerParams(&buf); err != nil {
+		t.Fatalf("writeServerParams() failed: %s", err)
+	}
+
+	var serverOpts, bridgeLine string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if rest, ok := strings.CutPrefix(line, "ServerTransportOptions obfs4 "); ok {
+			serverOpts = rest
+		}
+		if rest, ok := strings.CutPrefix(line, "Bridge "); ok {
+			bridgeLine = rest
+		}
+	}
+	if serverOpts == "" || bridgeLine == "" {
+		t.Fatalf("missing server options or bridge line: %q", buf.String())
+	}
+
+	// A server configured with the printed options, and no prior state,
+	// must use the printed parameters, and match the printed bridge line.
+	args := pt.Args{}
+	for _, kv := range strings.Fields(serverOpts) {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			t.Fatalf("malformed server option %q", kv)
+		}
+		args.Add(k, v)
+	}
+	sf, err := new(obfs4.Transport).ServerFactory(t.TempDir(), &args)
+	if err != nil {
+		t.Fatalf("ServerFactory() failed: %s", err)
+	}
+	cert, _ := sf.Args().Get("cert")
+	if !strings.Contains(bridgeLine, "cert="+cert+" ") {
+		t.Fatalf("bridge line %q does not match the server cert %s", bridgeLine, cert)
+	}
+
+	// Each run generates fresh parameters.
+	var again bytes.Buffer
+	if err = writeServerParams(&again); err != nil {
+		t.Fatalf("writeServerParams() failed: %s", err)
+	}
+	if bytes.Equal(buf.Bytes(), again.Bytes()) {
+		t.Fatalf("writeServerParams() output repeated")
+	}
+}
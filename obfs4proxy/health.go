@@ -0,0 +1,173 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gitlab.com/yawning/obfs4.git/common/metrics"
+)
+
+const (
+	healthPath        = "/health"
+	metricsPath       = "/metrics"
+	healthDefaultHost = "127.0.0.1"
+
+	listenerListening = "listening"
+	listenerFailed    = "failed"
+	listenerClosed    = "closed"
+)
+
+// healthMonitor tracks the process state reported by the health-check
+// endpoint.  Only coarse grained information is exposed, in particular no
+// addresses or key material are ever included.
+type healthMonitor struct {
+	sync.Mutex
+
+	startTime   time.Time
+	activeConns atomic.Int64
+	listeners   []*listenerHealth
+}
+
+type listenerHealth struct {
+	Transport string `json:"transport"`
+	Status    string `json:"status"`
+}
+
+type healthStatus struct {
+	UptimeSeconds     int64            `json:"uptime_seconds"`
+	ActiveConnections int64            `json:"active_connections"`
+	Listeners         []listenerHealth `json:"listeners"`
+}
+
+func newHealthMonitor() *healthMonitor {
+	return &healthMonitor{
+		startTime: time.Now(),
+	}
+}
+
+func (m *healthMonitor) onConnStart() {
+	m.activeConns.Add(1)
+}
+
+func (m *healthMonitor) onConnFinish() {
+	m.activeConns.Add(-1)
+}
+
+// addListener registers a transport listener with the initial status, and
+// returns the handle used to update the status.
+func (m *healthMonitor) addListener(name, status string) *listenerHealth {
+	m.Lock()
+	defer m.Unlock()
+
+	l := &listenerHealth{
+		Transport: name,
+		Status:    status,
+	}
+	m.listeners = append(m.listeners, l)
+	return l
+}
+
+func (m *healthMonitor) setListenerStatus(l *listenerHealth, status string) {
+	m.Lock()
+	defer m.Unlock()
+
+	l.Status = status
+}
+
+func (m *healthMonitor) status() *healthStatus {
+	m.Lock()
+	defer m.Unlock()
+
+	st := &healthStatus{
+		UptimeSeconds:     int64(time.Since(m.startTime) / time.Second),
+		ActiveConnections: m.activeConns.Load(),
+		Listeners:         make([]listenerHealth, 0, len(m.listeners)),
+	}
+	for _, l := range m.listeners {
+		st.Listeners = append(st.Listeners, *l)
+	}
+	return st
+}
+
+func (m *healthMonitor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(m.status())
+}
+
+// healthListenAddr returns the address that the health-check endpoint
+// should bind to, defaulting to localhost if no host is specified.
+func healthListenAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		host = healthDefaultHost
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// startHealthServer launches the health-check HTTP server on addr, which
+// also serves the latency metrics.
+func (m *healthMonitor) startHealthServer(addr string) (net.Listener, error) {
+	addr, err := healthListenAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(healthPath, m)
+	mux.Handle(metricsPath, metrics.Handler())
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+
+	return ln, nil
+}
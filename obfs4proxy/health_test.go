@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestHealthListenAddr(t *testing.T) {
+	for _, v := range []struct {
+		addr     string
+		expected string
+		ok       bool
+	}{
+		{":9090", "127.0.0.1:9090", true},
+		{"127.0.0.1:9090", "127.0.0.1:9090", true},
+		{"[::1]:9090", "[::1]:9090", true},
+		{"0.0.0.0:9090", "0.0.0.0:9090", true},
+		{"9090", "", false},
+	} {
+		addr, err := healthListenAddr(v.addr)
+		if (err == nil) != v.ok {
+			t.Fatalf("healthListenAddr(%q): unexpected error state: %v", v.addr, err)
+		}
+		if addr != v.expected {
+			t.Fatalf("healthListenAddr(%q): got '%s', expected '%s'", v.addr, addr, v.expected)
+		}
+	}
+}
+
+func TestHealthEndpoint(t *testing.T) {
+	m := newHealthMonitor()
+	m.addListener("obfs4", listenerListening)
+	failed := m.addListener("meek_lite", listenerListening)
+	m.setListenerStatus(failed, listenerFailed)
+	m.onConnStart()
+	m.onConnStart()
+	m.onConnFinish()
+
+	ln, err := m.startHealthServer(":0")
+	if err != nil {
+		t.Fatalf("startHealthServer() failed: %s", err)
+	}
+	defer ln.Close()
+
+	resp, err := http.Get("http://" + ln.Addr().String() + healthPath) //nolint:noctx
+	if err != nil {
+		t.Fatalf("http.Get() failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("unexpected Content-Type: %s", ct)
+	}
+
+	var raw map[string]json.RawMessage
+	if err = json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+	for _, k := range []string{"uptime_seconds", "active_connections", "listeners"} {
+		if _, ok := raw[k]; !ok {
+			t.Fatalf("response missing field '%s'", k)
+		}
+	}
+
+	var st healthStatus
+	if err = json.Unmarshal(raw["active_connections"], &st.ActiveConnections); err != nil {
+		t.Fatalf("failed to decode active_connections: %s", err)
+	}
+	if st.ActiveConnections != 1 {
+		t.Fatalf("active_connections: got %d, expected 1", st.ActiveConnections)
+	}
+	if err = json.Unmarshal(raw["listeners"], &st.Listeners); err != nil {
+		t.Fatalf("failed to decode listeners: %s", err)
+	}
+	expected := []listenerHealth{
+		{"obfs4", listenerListening},
+		{"meek_lite", listenerFailed},
+	}
+	if len(st.Listeners) != len(expected) {
+		t.Fatalf("listeners: got %d, expected %d", len(st.Listeners), len(expected))
+	}
+	for i, l := range st.Listeners {
+		if l != expected[i] {
+			t.Fatalf("listeners[%d]: got %+v, expected %+v", i, l, expected[i])
+		}
+	}
+
+	// The metrics are served as well.
+	metricsResp, err := http.Get("http://" + ln.Addr().String() + metricsPath) //nolint:noctx
+	if err != nil {
+		t.Fatalf("http.Get(metrics) failed: %s", err)
+	}
+	var snapshots map[string]json.RawMessage
+	err = json.NewDecoder(metricsResp.Body).Decode(&snapshots)
+	metricsResp.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to decode metrics: %s", err)
+	}
+
+	// Only GET/HEAD are supported.
+	postResp, err := http.Post("http://"+ln.Addr().String()+healthPath, "text/plain", nil) //nolint:noctx
+	if err != nil {
+		t.Fatalf("http.Post() failed: %s", err)
+	}
+	postResp.Body.Close()
+	if postResp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected POST status code: %d", postResp.StatusCode)
+	}
+}
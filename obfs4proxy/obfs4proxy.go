@@ -30,35 +30,91 @@
 package main
 
 import (
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	golog "log"
+	"math"
 	"net"
 	"net/url"
 	"os"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
 	"golang.org/x/net/proxy"
 
+	"gitlab.com/yawning/obfs4.git/common/csrand"
 	"gitlab.com/yawning/obfs4.git/common/log"
+	"gitlab.com/yawning/obfs4.git/common/proxyproto"
 	"gitlab.com/yawning/obfs4.git/common/socks5"
+	"gitlab.com/yawning/obfs4.git/common/tfo"
 	"gitlab.com/yawning/obfs4.git/transports"
 	"gitlab.com/yawning/obfs4.git/transports/base"
+	"gitlab.com/yawning/obfs4.git/transports/obfs4"
+	"gitlab.com/yawning/obfs4.git/transports/obfs4/framing"
 )
 
 const (
 	obfs4proxyVersion = "0.0.15-dev"
 	obfs4proxyLogFile = "obfs4proxy.log"
-	socksAddr         = "127.0.0.1:0"
+	defaultSocksAddr  = "127.0.0.1:0"
+	unixSocksPrefix   = "unix:"
+
+	extraBindAddrArg   = "extra-bindaddr"
+	proxyProtocolArg   = "proxy-protocol"
+	proxyHeaderTimeout = 30 * time.Second
+
+	defaultLogRateLimit = 1.0
+	logRateBurst        = 10
+
+	defaultRelayBufSize = 8 * framing.MaximumFramePayloadLength
 )
 
 var (
-	stateDir string
-	termMon  *termMonitor
+	stateDir  string
+	termMon   *termMonitor
+	health    *healthMonitor
+	enableTFO bool
+
+	// idleTimeout is how long a relayed session may go without data in
+	// either direction before it is torn down, if non-zero.
+	idleTimeout time.Duration
+
+	// dialTimeout bounds how long establishing an outgoing client
+	// connection (or the connection to the upstream proxy) may take, if
+	// non-zero.  This is distinct from the transport handshake timeout.
+	dialTimeout time.Duration
+
+	// relayBufSize is the size of the buffer used to relay data into the
+	// transport connection, which bounds the size of each write to it.
+	relayBufSize = defaultRelayBufSize
+
+	emitDescriptor string
+	descriptorPath string
+	socksAddr      string
+
+	// clientDialer is the template for the dialer used to make outgoing
+	// client connections, that the socket options from the command line
+	// (eg: -fwmark) are applied to.
+	clientDialer = &net.Dialer{}
+
+	// orDialer is the template for the dialer used to connect to the
+	// (Extended) ORPort by the server, and like clientDialer, carries the
+	// socket options from the command line.
+	orDialer = &net.Dialer{}
+
+	// fwmark is the firewall mark (SO_MARK) set on outgoing sockets, for
+	// policy routing.  0 disables setting the mark.
+	fwmark uint
 )
 
 func clientSetup() (bool, []net.Listener) {
@@ -81,23 +137,28 @@ func clientSetup() (bool, []net.Listener) {
 		t := transports.Get(name)
 		if t == nil {
 			_ = pt.CmethodError(name, "no such transport is supported")
+			health.addListener(name, listenerFailed)
 			continue
 		}
 
 		f, err := t.ClientFactory(stateDir)
 		if err != nil {
 			_ = pt.CmethodError(name, "failed to get ClientFactory")
+			health.addListener(name, listenerFailed)
 			continue
 		}
 
-		ln, err := net.Listen("tcp", socksAddr)
+		ln, err := listenSocks(socksAddr)
 		if err != nil {
 			_ = pt.CmethodError(name, err.Error())
+			health.addListener(name, listenerFailed)
 			continue
 		}
 
+		lh := health.addListener(name, listenerListening)
 		go func() {
 			_ = clientAcceptLoop(f, ln, ptClientProxy)
+			health.setListenerStatus(lh, listenerClosed)
 		}()
 		pt.Cmethod(name, socks5.Version(), ln.Addr())
 
@@ -111,6 +172,38 @@ func clientSetup() (bool, []net.Listener) {
 	return launched, listeners
 }
 
+// parseSocksAddr splits the SOCKS listener address into the network and
+// address passed to net.Listen.  The address is either a "host:port" with
+// a literal IP address, or "unix:" followed by the path of a unix socket.
+func parseSocksAddr(addr string) (string, string, error) {
+	if path := strings.TrimPrefix(addr, unixSocksPrefix); path != addr {
+		if path == "" {
+			return "", "", fmt.Errorf("invalid SOCKS address '%s': empty path", addr)
+		}
+		return "unix", path, nil
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid SOCKS address '%s': %w", addr, err)
+	}
+	if net.ParseIP(host) == nil {
+		return "", "", fmt.Errorf("invalid SOCKS address '%s': host must be an IP address", addr)
+	}
+	if _, err = strconv.ParseUint(portStr, 10, 16); err != nil {
+		return "", "", fmt.Errorf("invalid SOCKS address '%s': invalid port", addr)
+	}
+	return "tcp", addr, nil
+}
+
+func listenSocks(addr string) (net.Listener, error) {
+	network, address, err := parseSocksAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.Listen(network, address)
+}
+
 func clientAcceptLoop(f base.ClientFactory, ln net.Listener, proxyURI *url.URL) error {
 	defer ln.Close()
 	for {
@@ -122,17 +215,36 @@ func clientAcceptLoop(f base.ClientFactory, ln net.Listener, proxyURI *url.URL)
 	}
 }
 
+// newForwardDialer returns the dialer for outgoing client connections (or
+// the connection to the upstream proxy), based on clientDialer.
+func newForwardDialer() proxy.Dialer {
+	var d *net.Dialer
+	if enableTFO {
+		d = tfo.WrapDialer(clientDialer)
+	} else {
+		dd := *clientDialer
+		d = &dd
+	}
+	if dialTimeout > 0 {
+		d.Timeout = dialTimeout
+	}
+	return d
+}
+
 func clientHandler(f base.ClientFactory, conn net.Conn, proxyURI *url.URL) {
 	defer conn.Close()
 	termMon.onHandlerStart()
 	defer termMon.onHandlerFinish()
+	health.onConnStart()
+	defer health.onConnFinish()
 
 	name := f.Transport().Name()
+	tag := newConnTag()
 
 	// Read the client's SOCKS handshake.
 	socksReq, err := socks5.Handshake(conn)
 	if err != nil {
-		log.Errorf("%s - client failed socks handshake: %s", name, err)
+		log.Errorf("%s#%s - client failed socks handshake: %s", name, tag, err)
 		return
 	}
 	addrStr := log.ElideAddr(socksReq.Target)
@@ -140,19 +252,20 @@ func clientHandler(f base.ClientFactory, conn net.Conn, proxyURI *url.URL) {
 	// Deal with arguments.
 	args, err := f.ParseArgs(&socksReq.Args)
 	if err != nil {
-		log.Errorf("%s(%s) - invalid arguments: %s", name, addrStr, err)
+		log.Errorf("%s(%s)#%s - invalid arguments: %s", name, addrStr, tag, err)
 		_ = socksReq.Reply(socks5.ReplyGeneralFailure)
 		return
 	}
 
 	// Obtain the proxy dialer if any, and create the outgoing TCP connection.
-	dialFn := proxy.Direct.Dial
+	forward := newForwardDialer()
+	dialFn := forward.Dial
 	if proxyURI != nil {
-		dialer, err := proxy.FromURL(proxyURI, proxy.Direct)
+		dialer, err := proxy.FromURL(proxyURI, forward)
 		if err != nil {
 			// This should basically never happen, since config protocol
 			// verifies this.
-			log.Errorf("%s(%s) - failed to obtain proxy dialer: %s", name, addrStr, log.ElideError(err))
+			log.Errorf("%s(%s)#%s - failed to obtain proxy dialer: %s", name, addrStr, tag, log.ElideError(err))
 			_ = socksReq.Reply(socks5.ReplyGeneralFailure)
 			return
 		}
@@ -160,21 +273,21 @@ func clientHandler(f base.ClientFactory, conn net.Conn, proxyURI *url.URL) {
 	}
 	remote, err := f.Dial("tcp", socksReq.Target, dialFn, args)
 	if err != nil {
-		log.Errorf("%s(%s) - outgoing connection failed: %s", name, addrStr, log.ElideError(err))
+		log.Errorf("%s(%s)#%s - outgoing connection failed [%s]: %s", name, addrStr, tag, closeReason(err), log.ElideError(err))
 		_ = socksReq.Reply(socks5.ErrorToReplyCode(err))
 		return
 	}
 	defer remote.Close()
 	err = socksReq.Reply(socks5.ReplySucceeded)
 	if err != nil {
-		log.Errorf("%s(%s) - SOCKS reply failed: %s", name, addrStr, log.ElideError(err))
+		log.Errorf("%s(%s)#%s - SOCKS reply failed: %s", name, addrStr, tag, log.ElideError(err))
 		return
 	}
 
 	if err = copyLoop(conn, remote); err != nil {
-		log.Warnf("%s(%s) - closed connection: %s", name, addrStr, log.ElideError(err))
+		log.Warnf("%s(%s)#%s - closed connection [%s]: %s", name, addrStr, tag, closeReason(err), log.ElideError(err))
 	} else {
-		log.Infof("%s(%s) - closed connection", name, addrStr)
+		log.Infof("%s(%s)#%s - closed connection [%s]", name, addrStr, tag, closeReason(nil))
 	}
 }
 
@@ -185,92 +298,214 @@ func serverSetup() (bool, []net.Listener) {
 	}
 
 	var launched bool
+	var descs []*bridgeDescriptor
 	listeners := make([]net.Listener, 0, len(ptServerInfo.Bindaddrs))
 	for _, bindaddr := range ptServerInfo.Bindaddrs {
 		name := bindaddr.MethodName
 		t := transports.Get(name)
 		if t == nil {
 			_ = pt.SmethodError(name, "no such transport is supported")
+			health.addListener(name, listenerFailed)
+			continue
+		}
+
+		extraAddrs, err := extraBindAddrs(&bindaddr.Options)
+		if err != nil {
+			_ = pt.SmethodError(name, err.Error())
+			health.addListener(name, listenerFailed)
+			continue
+		}
+		proxyProto, err := proxyProtocolEnabled(&bindaddr.Options)
+		if err != nil {
+			_ = pt.SmethodError(name, err.Error())
+			health.addListener(name, listenerFailed)
 			continue
 		}
 
 		f, err := t.ServerFactory(stateDir, &bindaddr.Options)
 		if err != nil {
 			_ = pt.SmethodError(name, err.Error())
+			health.addListener(name, listenerFailed)
 			continue
 		}
 
 		ln, err := net.ListenTCP("tcp", bindaddr.Addr)
 		if err != nil {
 			_ = pt.SmethodError(name, err.Error())
+			health.addListener(name, listenerFailed)
 			continue
 		}
 
-		go func() {
-			_ = serverAcceptLoop(f, ln, &ptServerInfo)
-		}()
+		launchServerListener(f, ln, &ptServerInfo, proxyProto)
 		if args := f.Args(); args != nil {
 			pt.SmethodArgs(name, ln.Addr(), *args)
 		} else {
 			pt.SmethodArgs(name, ln.Addr(), nil)
 		}
+		descs = append(descs, newBridgeDescriptor(name, ln.Addr(), f.Args()))
 
 		log.Infof("%s - registered listener: %s", name, log.ElideAddr(ln.Addr().String()))
 
 		listeners = append(listeners, ln)
 		launched = true
+
+		// Open listeners on the additional bind addresses, sharing the
+		// factory (and state).  tor only knows about the primary address.
+		for _, addr := range extraAddrs {
+			ln, err := net.ListenTCP("tcp", addr)
+			if err != nil {
+				log.Errorf("%s - failed to listen on additional address: %s", name, log.ElideError(err))
+				health.addListener(name, listenerFailed)
+				continue
+			}
+
+			launchServerListener(f, ln, &ptServerInfo, proxyProto)
+			descs = append(descs, newBridgeDescriptor(name, ln.Addr(), f.Args()))
+			log.Infof("%s - registered additional listener: %s", name, log.ElideAddr(ln.Addr().String()))
+
+			listeners = append(listeners, ln)
+		}
 	}
 	pt.SmethodsDone()
 
+	if emitDescriptor != "" && launched {
+		if err = emitDescriptors(emitDescriptor, descriptorPath, descs); err != nil {
+			log.Errorf("failed to write the bridge descriptor: %s", log.ElideError(err))
+		}
+	}
+
 	return launched, listeners
 }
 
-func serverAcceptLoop(f base.ServerFactory, ln net.Listener, info *pt.ServerInfo) error {
+// extraBindAddrs returns the additional bind addresses for a server
+// transport, specified as one or more "extra-bindaddr" options.
+func extraBindAddrs(args *pt.Args) ([]*net.TCPAddr, error) {
+	strs := (*args)[extraBindAddrArg]
+	addrs := make([]*net.TCPAddr, 0, len(strs))
+	for _, str := range strs {
+		addr, err := net.ResolveTCPAddr("tcp", str)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s '%s': %w", extraBindAddrArg, str, err)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// proxyProtocolEnabled returns true iff the "proxy-protocol" option is set,
+// indicating that inbound connections are prefixed with a PROXY protocol
+// header containing the real client address.
+func proxyProtocolEnabled(args *pt.Args) (bool, error) {
+	str, ok := args.Get(proxyProtocolArg)
+	if !ok {
+		return false, nil
+	}
+	enabled, err := strconv.ParseBool(str)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s '%s'", proxyProtocolArg, str)
+	}
+	return enabled, nil
+}
+
+func launchServerListener(f base.ServerFactory, ln net.Listener, info *pt.ServerInfo, proxyProto bool) {
+	lh := health.addListener(f.Transport().Name(), listenerListening)
+	go func() {
+		_ = serverAcceptLoop(f, ln, info, proxyProto)
+		health.setListenerStatus(lh, listenerClosed)
+	}()
+}
+
+func serverAcceptLoop(f base.ServerFactory, ln net.Listener, info *pt.ServerInfo, proxyProto bool) error {
 	defer ln.Close()
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			return err
 		}
-		go serverHandler(f, conn, info)
+		go serverHandler(f, conn, info, proxyProto)
 	}
 }
 
-func serverHandler(f base.ServerFactory, conn net.Conn, info *pt.ServerInfo) {
-	defer conn.Close()
+func serverHandler(f base.ServerFactory, conn net.Conn, info *pt.ServerInfo, proxyProto bool) {
+	rawConn, detached := conn, false
+	defer func() {
+		if !detached {
+			rawConn.Close()
+		}
+	}()
 	termMon.onHandlerStart()
 	defer termMon.onHandlerFinish()
+	health.onConnStart()
+	defer health.onConnFinish()
 
 	name := f.Transport().Name()
+	tag := newConnTag()
+	if proxyProto {
+		// Consume the PROXY protocol header, so that the real client
+		// address is what gets logged and reported to the ORPort.
+		if err := conn.SetDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+			return
+		}
+		pc, err := proxyproto.NewConn(conn)
+		if err != nil {
+			log.Warnf("%s(%s)#%s - invalid PROXY protocol header: %s", name, log.ElideAddr(conn.RemoteAddr().String()), tag, log.ElideError(err))
+			return
+		}
+		if err = conn.SetDeadline(time.Time{}); err != nil {
+			return
+		}
+		conn = pc
+	}
 	addrStr := log.ElideAddr(conn.RemoteAddr().String())
-	log.Infof("%s(%s) - new connection", name, addrStr)
+	log.Infof("%s(%s)#%s - new connection", name, addrStr, tag)
 
 	// Instantiate the server transport method and handshake.
 	remote, err := f.WrapConn(conn)
 	if err != nil {
-		log.Warnf("%s(%s) - handshake failed: %s", name, addrStr, log.ElideError(err))
+		log.Warnf("%s(%s)#%s - handshake failed [%s]: %s", name, addrStr, tag, closeReason(err), log.ElideError(err))
+		var hsErr *base.HandshakeError
+		detached = errors.As(err, &hsErr) && hsErr.Detached
 		return
 	}
 
 	// Connect to the orport.
-	orConn, err := pt.DialOr(info, conn.RemoteAddr().String(), name)
+	orConn, err := ptDialOr(info, conn.RemoteAddr().String(), name)
 	if err != nil {
-		log.Errorf("%s(%s) - failed to connect to ORPort: %s", name, addrStr, log.ElideError(err))
+		log.Errorf("%s(%s)#%s - failed to connect to ORPort: %s", name, addrStr, tag, log.ElideError(err))
 		return
 	}
 	defer orConn.Close()
 
 	if err = copyLoop(orConn, remote); err != nil {
-		log.Warnf("%s(%s) - closed connection: %s", name, addrStr, log.ElideError(err))
+		log.Warnf("%s(%s)#%s - closed connection [%s]: %s", name, addrStr, tag, closeReason(err), log.ElideError(err))
 	} else {
-		log.Infof("%s(%s) - closed connection", name, addrStr)
+		log.Infof("%s(%s)#%s - closed connection [%s]", name, addrStr, tag, closeReason(nil))
 	}
 }
 
+// newConnTag returns a short random identifier for a handled connection,
+// that is included in every log message pertaining to it, so that the
+// messages can be correlated without revealing addresses.
+func newConnTag() string {
+	var b [4]byte
+	if err := csrand.Bytes(b[:]); err != nil {
+		return "00000000"
+	}
+	return hex.EncodeToString(b[:])
+}
+
 func copyLoop(a net.Conn, b net.Conn) error {
 	// Note: b is always the pt connection.  a is the SOCKS/ORPort connection.
 	errChan := make(chan error, 2)
 
+	var srcA, srcB io.Reader = a, b
+	if idleTimeout > 0 {
+		activity := new(atomic.Int64)
+		activity.Store(time.Now().UnixNano())
+		srcA = &idleReader{conn: a, activity: activity, timeout: idleTimeout}
+		srcB = &idleReader{conn: b, activity: activity, timeout: idleTimeout}
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(2)
 
@@ -278,14 +513,24 @@ func copyLoop(a net.Conn, b net.Conn) error {
 		defer wg.Done()
 		defer b.Close()
 		defer a.Close()
-		_, err := io.Copy(b, a)
+
+		// Relay into the transport through a buffer of relayBufSize, hiding
+		// any io.WriterTo/io.ReaderFrom implementations that would bypass
+		// it, as the buffer size determines the size of the writes, and
+		// thus the framing/padding overhead of the transport.
+		buf := make([]byte, relayBufSize)
+		_, err := io.CopyBuffer(struct{ io.Writer }{b}, struct{ io.Reader }{srcA}, buf)
 		errChan <- err
 	}()
 	go func() {
 		defer wg.Done()
 		defer a.Close()
 		defer b.Close()
-		_, err := io.Copy(a, b)
+
+		// Relay out of the transport via its io.WriterTo implementation if
+		// any (eg: obfs4), which writes the decoded data directly out of
+		// the receive buffer, as the write sizes don't matter here.
+		_, err := io.Copy(a, srcB)
 		errChan <- err
 	}()
 
@@ -301,29 +546,201 @@ func copyLoop(a net.Conn, b net.Conn) error {
 	return nil
 }
 
+// idleReader reads from a relayed connection, and fails with
+// os.ErrDeadlineExceeded once neither direction of the session has seen data
+// for the timeout, via the read deadline.  If the connection does not
+// support read deadlines, reads block as normal, and the session is reaped
+// by the idleReader for the other direction.
+type idleReader struct {
+	conn net.Conn
+
+	// activity is the time of the last read with data, in either direction,
+	// in Unix nanoseconds.
+	activity *atomic.Int64
+	timeout  time.Duration
+
+	noDeadline bool
+}
+
+func (r *idleReader) idleDeadline() time.Time {
+	return time.Unix(0, r.activity.Load()).Add(r.timeout)
+}
+
+func (r *idleReader) Read(b []byte) (int, error) {
+	for {
+		if !r.noDeadline {
+			if err := r.conn.SetReadDeadline(r.idleDeadline()); err != nil {
+				r.noDeadline = true
+			}
+		}
+
+		n, err := r.conn.Read(b)
+		if n > 0 {
+			r.activity.Store(time.Now().UnixNano())
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) && time.Now().Before(r.idleDeadline()) {
+			// The other direction has seen data since the deadline was
+			// set, so the session is not idle.
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// WriteTo relays the connection to w via the connection's io.WriterTo
+// implementation, if any, so that the idle timeout does not cost the copy
+// through an intermediate buffer.
+func (r *idleReader) WriteTo(w io.Writer) (int64, error) {
+	wt, ok := r.conn.(io.WriterTo)
+	if !ok {
+		return io.Copy(w, struct{ io.Reader }{r})
+	}
+
+	aw := &activityWriter{w: w, activity: r.activity}
+	var n int64
+	for {
+		if !r.noDeadline {
+			if err := r.conn.SetReadDeadline(r.idleDeadline()); err != nil {
+				r.noDeadline = true
+			}
+		}
+
+		wrLen, err := wt.WriteTo(aw)
+		n += wrLen
+		if errors.Is(err, os.ErrDeadlineExceeded) && time.Now().Before(r.idleDeadline()) {
+			// Not idle, as with Read.
+			continue
+		}
+		return n, err
+	}
+}
+
+// activityWriter records the time of each write with data as the activity
+// of an idleReader.
+type activityWriter struct {
+	w        io.Writer
+	activity *atomic.Int64
+}
+
+func (w *activityWriter) Write(b []byte) (int, error) {
+	if len(b) > 0 {
+		w.activity.Store(time.Now().UnixNano())
+	}
+	return w.w.Write(b)
+}
+
 func getVersion() string {
 	return fmt.Sprintf("obfs4proxy-%s", obfs4proxyVersion)
 }
 
+// writeTransportList writes the names of the registered transports to w,
+// one per line, in sorted order.
+func writeTransportList(w io.Writer) error {
+	names := transports.Transports()
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := fmt.Fprintln(w, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func main() {
 	// Initialize the termination state monitor as soon as possible.
 	termMon = newTermMonitor()
+	health = newHealthMonitor()
 
 	// Handle the command line arguments.
 	_, execName := path.Split(os.Args[0])
 	showVer := flag.Bool("version", false, "Print version and exit")
+	listTransports := flag.Bool("listTransports", false, "Print the supported transports and exit")
 	logLevelStr := flag.String("logLevel", "ERROR", "Log level (ERROR/WARN/INFO/DEBUG)")
 	enableLogging := flag.Bool("enableLogging", false, "Log to TOR_PT_STATE_LOCATION/"+obfs4proxyLogFile)
 	unsafeLogging := flag.Bool("unsafeLogging", false, "Disable the address scrubber")
+	scrubMode := flag.String("scrubMode", log.ScrubPort, "Address scrubbing mode (none/port/full/hash)")
+	logRateLimit := flag.Float64("logRateLimit", defaultLogRateLimit, "Limit each ERROR/WARN message to the specified rate per second (0 disables)")
+	flag.BoolVar(&enableTFO, "enableTFO", false, "Use TCP Fast Open for outgoing client connections if supported")
+	flag.DurationVar(&dialTimeout, "dialTimeout", 0, "Abandon outgoing client connections that are not established within the specified duration (0 uses the OS default)")
+	flag.IntVar(&relayBufSize, "relayBufSize", defaultRelayBufSize, "Size of the buffer used to relay data into the transport (larger values reduce overhead at the cost of memory)")
+	flag.DurationVar(&idleTimeout, "idleTimeout", 0, "Close relayed sessions with no data in either direction for the specified duration (0 disables)")
+	flag.StringVar(&emitDescriptor, "emitDescriptor", "", "Write a descriptor of the server listeners in the specified format (json)")
+	flag.StringVar(&descriptorPath, "descriptorFile", "", "Write the descriptor to the specified file")
+	flag.StringVar(&socksAddr, "socksAddr", defaultSocksAddr, "Bind the client SOCKS listeners to the specified address (host:port or unix:path)")
+	healthAddr := flag.String("healthAddr", "", "Serve a health-check endpoint on the specified address (host defaults to localhost)")
+	flag.UintVar(&fwmark, "fwmark", 0, "Set the specified firewall mark (SO_MARK) on outgoing client and ORPort connections (Linux only, 0 disables)")
+	benchLine := flag.String("bench", "", "Benchmark the obfs4 bridge described by the specified bridge line and exit")
+	benchHandshakes := flag.Int("benchHandshakes", defaultBenchHandshakes, "Number of handshakes performed by -bench")
+	benchBytes := flag.Int64("benchBytes", defaultBenchBytes, "Number of bytes sent by the -bench bulk transfer (0 disables)")
+	genServerParams := flag.Bool("genServerParams", false, "Print freshly generated obfs4 server parameters and bridge line, and exit")
 	flag.Parse()
 
 	if *showVer {
 		fmt.Printf("%s\n", getVersion()) //nolint:forbidigo
 		os.Exit(0)
 	}
+	if *genServerParams {
+		if err := writeServerParams(os.Stdout); err != nil {
+			golog.Fatalf("[ERROR]: %s - %s", execName, err)
+		}
+		os.Exit(0)
+	}
+	if *listTransports {
+		if err := transports.Init(); err != nil {
+			golog.Fatalf("[ERROR]: %s - failed to initialize transports: %s", execName, err)
+		}
+		if err := writeTransportList(os.Stdout); err != nil {
+			golog.Fatalf("[ERROR]: %s - %s", execName, err)
+		}
+		os.Exit(0)
+	}
 	if err := log.SetLogLevel(*logLevelStr); err != nil {
 		golog.Fatalf("[ERROR]: %s - failed to set log level: %s", execName, err)
 	}
+	if err := log.SetRateLimit(*logRateLimit, logRateBurst); err != nil {
+		golog.Fatalf("[ERROR]: %s - %s", execName, err)
+	}
+	if err := log.SetScrubMode(*scrubMode); err != nil {
+		golog.Fatalf("[ERROR]: %s - %s", execName, err)
+	}
+	if err := validateDescriptorFormat(emitDescriptor); err != nil {
+		golog.Fatalf("[ERROR]: %s - %s", execName, err)
+	}
+	if _, _, err := parseSocksAddr(socksAddr); err != nil {
+		golog.Fatalf("[ERROR]: %s - %s", execName, err)
+	}
+	if dialTimeout < 0 {
+		golog.Fatalf("[ERROR]: %s - invalid dial timeout: %s", execName, dialTimeout)
+	}
+	if relayBufSize <= 0 {
+		golog.Fatalf("[ERROR]: %s - invalid relay buffer size: %d", execName, relayBufSize)
+	}
+	if idleTimeout < 0 {
+		golog.Fatalf("[ERROR]: %s - invalid idle timeout: %s", execName, idleTimeout)
+	}
+	if fwmark > math.MaxUint32 {
+		golog.Fatalf("[ERROR]: %s - invalid fwmark: %d", execName, fwmark)
+	}
+	if fwmark != 0 && fwmarkSupported() {
+		clientDialer = withFwmark(clientDialer, uint32(fwmark))
+		orDialer = withFwmark(orDialer, uint32(fwmark))
+	}
+	if *benchLine != "" {
+		if *benchHandshakes <= 0 || *benchBytes < 0 {
+			golog.Fatalf("[ERROR]: %s - invalid benchmark parameters", execName)
+		}
+		res, err := runBench(*benchLine, *benchHandshakes, *benchBytes, newForwardDialer().Dial)
+		if err != nil {
+			golog.Fatalf("[ERROR]: %s - benchmark failed: %s", execName, err)
+		}
+		if err = writeBenchReport(os.Stdout, res); err != nil {
+			golog.Fatalf("[ERROR]: %s - %s", execName, err)
+		}
+		os.Exit(0)
+	}
 
 	// Determine if this is a client or server, initialize the common state.
 	var ptListeners []net.Listener
@@ -338,12 +755,29 @@ func main() {
 	if err = log.Init(*enableLogging, path.Join(stateDir, obfs4proxyLogFile), *unsafeLogging); err != nil {
 		golog.Fatalf("[ERROR]: %s - failed to initialize logging", execName)
 	}
+	obfs4.ReportedVersion = getVersion()
 	if err = transports.Init(); err != nil {
 		log.Errorf("%s - failed to initialize transports: %s", execName, err)
 		os.Exit(-1)
 	}
 
 	log.Noticef("%s - launched", getVersion())
+	if enableTFO && !tfo.Supported() {
+		log.Warnf("%s - TCP Fast Open is not supported on this platform", execName)
+	}
+	if fwmark != 0 && !fwmarkSupported() {
+		log.Warnf("%s - fwmark is not supported on this platform", execName)
+	}
+
+	if *healthAddr != "" {
+		ln, err := health.startHealthServer(*healthAddr)
+		if err != nil {
+			log.Errorf("%s - failed to start health-check endpoint: %s", execName, err)
+			os.Exit(-1)
+		}
+		defer ln.Close()
+		log.Infof("%s - health-check endpoint: %s", execName, ln.Addr())
+	}
 
 	// Do the managed pluggable transport protocol configuration.
 	if isClient {
@@ -0,0 +1,853 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+
+	"gitlab.com/yawning/obfs4.git/common/log"
+	"gitlab.com/yawning/obfs4.git/transports"
+	"gitlab.com/yawning/obfs4.git/transports/base"
+	"gitlab.com/yawning/obfs4.git/transports/obfs4"
+	"gitlab.com/yawning/obfs4.git/transports/obfs4/framing"
+)
+
+func TestExtraBindAddrs(t *testing.T) {
+	args := &pt.Args{}
+	addrs, err := extraBindAddrs(args)
+	if err != nil || len(addrs) != 0 {
+		t.Fatalf("extraBindAddrs(empty): %v, %v", addrs, err)
+	}
+
+	args.Add(extraBindAddrArg, "127.0.0.1:80")
+	args.Add(extraBindAddrArg, "[::1]:443")
+	if addrs, err = extraBindAddrs(args); err != nil {
+		t.Fatalf("extraBindAddrs() failed: %s", err)
+	}
+	if len(addrs) != 2 || addrs[0].Port != 80 || addrs[1].Port != 443 {
+		t.Fatalf("extraBindAddrs(): unexpected addresses: %v", addrs)
+	}
+
+	args.Add(extraBindAddrArg, "bogus")
+	if _, err = extraBindAddrs(args); err == nil {
+		t.Fatalf("extraBindAddrs(bogus) succeeded")
+	}
+}
+
+func TestSharedServerFactory(t *testing.T) {
+	tr := &obfs4.Transport{}
+	sf, err := tr.ServerFactory(t.TempDir(), &pt.Args{})
+	if err != nil {
+		t.Fatalf("ServerFactory() failed: %s", err)
+	}
+	cf, err := tr.ClientFactory("")
+	if err != nil {
+		t.Fatalf("ClientFactory() failed: %s", err)
+	}
+
+	// Bind the one factory to two loopback ports.
+	args := &pt.Args{}
+	args.Add(extraBindAddrArg, "127.0.0.1:0")
+	args.Add(extraBindAddrArg, "127.0.0.1:0")
+	addrs, err := extraBindAddrs(args)
+	if err != nil {
+		t.Fatalf("extraBindAddrs() failed: %s", err)
+	}
+	for _, addr := range addrs {
+		ln, err := net.ListenTCP("tcp", addr)
+		if err != nil {
+			t.Fatalf("ListenTCP() failed: %s", err)
+		}
+		defer ln.Close()
+
+		// Echo server.
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					remote, err := sf.WrapConn(conn)
+					if err != nil {
+						return
+					}
+					_, _ = io.Copy(remote, remote)
+				}()
+			}
+		}()
+
+		clientArgs, err := cf.ParseArgs(sf.Args())
+		if err != nil {
+			t.Fatalf("ParseArgs() failed: %s", err)
+		}
+		conn, err := cf.Dial("tcp", ln.Addr().String(), net.Dial, clientArgs)
+		if err != nil {
+			t.Fatalf("[%s]: Dial() failed: %s", ln.Addr(), err)
+		}
+		defer conn.Close()
+
+		msg := []byte("hello from " + ln.Addr().String())
+		if _, err = conn.Write(msg); err != nil {
+			t.Fatalf("[%s]: Write() failed: %s", ln.Addr(), err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("[%s]: Read() failed: %s", ln.Addr(), err)
+		}
+		if !bytes.Equal(buf, msg) {
+			t.Fatalf("[%s]: echo mismatch", ln.Addr())
+		}
+	}
+}
+
+func TestProxyProtocolEnabled(t *testing.T) {
+	for _, v := range []struct {
+		arg     string
+		enabled bool
+		ok      bool
+	}{
+		{"", false, true},
+		{"true", true, true},
+		{"0", false, true},
+		{"bogus", false, false},
+	} {
+		args := &pt.Args{}
+		if v.arg != "" {
+			args.Add(proxyProtocolArg, v.arg)
+		}
+		enabled, err := proxyProtocolEnabled(args)
+		if (err == nil) != v.ok || enabled != v.enabled {
+			t.Fatalf("proxyProtocolEnabled(%q): %v, %v", v.arg, enabled, err)
+		}
+	}
+}
+
+func TestParseSocksAddr(t *testing.T) {
+	for _, v := range []struct {
+		addr    string
+		network string
+		ok      bool
+	}{
+		{defaultSocksAddr, "tcp", true},
+		{"0.0.0.0:1080", "tcp", true},
+		{"[::1]:1080", "tcp", true},
+		{"unix:/run/obfs4proxy/socks.sock", "unix", true},
+		{"unix:", "", false},
+		{"localhost:1080", "", false},
+		{"127.0.0.1", "", false},
+		{"127.0.0.1:socks", "", false},
+		{"127.0.0.1:65536", "", false},
+	} {
+		network, _, err := parseSocksAddr(v.addr)
+		if (err == nil) != v.ok || network != v.network {
+			t.Errorf("parseSocksAddr(%q): %q, %v", v.addr, network, err)
+		}
+	}
+}
+
+func TestListenSocks(t *testing.T) {
+	ln, err := listenSocks("127.0.0.2:0")
+	if err != nil {
+		t.Skipf("listenSocks(127.0.0.2:0) failed: %s", err)
+	}
+	ln.Close()
+	if addr, ok := ln.Addr().(*net.TCPAddr); !ok || !addr.IP.Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Fatalf("listener bound to %s, expected 127.0.0.2", ln.Addr())
+	}
+
+	path := filepath.Join(t.TempDir(), "socks.sock")
+	if ln, err = listenSocks(unixSocksPrefix + path); err != nil {
+		t.Fatalf("listenSocks(unix) failed: %s", err)
+	}
+	defer ln.Close()
+	if ln.Addr().Network() != "unix" || ln.Addr().String() != path {
+		t.Fatalf("listener bound to %s:%s, expected unix:%s", ln.Addr().Network(), ln.Addr(), path)
+	}
+}
+
+func TestWriteTransportList(t *testing.T) {
+	if err := transports.Init(); err != nil {
+		t.Fatalf("transports.Init() failed: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeTransportList(&buf); err != nil {
+		t.Fatalf("writeTransportList() failed: %s", err)
+	}
+	const expected = "meek_lite\nobfs2\nobfs3\nobfs4\nscramblesuit\n"
+	if buf.String() != expected {
+		t.Fatalf("writeTransportList() wrote %q, expected %q", buf.String(), expected)
+	}
+}
+
+func TestForwardDialerControl(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() failed: %s", err)
+	}
+	defer ln.Close()
+
+	oldDialer, oldTFO := clientDialer, enableTFO
+	defer func() {
+		clientDialer, enableTFO = oldDialer, oldTFO
+	}()
+
+	for _, tfoEnabled := range []bool{false, true} {
+		var (
+			address string
+			fd      uintptr
+		)
+		clientDialer = &net.Dialer{
+			Control: func(_, addr string, c syscall.RawConn) error {
+				address = addr
+				return c.Control(func(s uintptr) {
+					fd = s
+				})
+			},
+		}
+		enableTFO = tfoEnabled
+
+		conn, err := newForwardDialer().Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("tfo=%v: Dial() failed: %s", tfoEnabled, err)
+		}
+		conn.Close()
+		if address != ln.Addr().String() || fd == 0 {
+			t.Fatalf("tfo=%v: Control called with %q, fd %d", tfoEnabled, address, fd)
+		}
+	}
+}
+
+func TestForwardDialerTimeout(t *testing.T) {
+	oldDialer, oldTimeout := clientDialer, dialTimeout
+	defer func() {
+		clientDialer, dialTimeout = oldDialer, oldTimeout
+	}()
+
+	// Stall the connect long enough for the timeout to expire, since
+	// whether a given unreachable address times out or is refused depends
+	// on the network.
+	clientDialer = &net.Dialer{
+		Control: func(_, _ string, _ syscall.RawConn) error {
+			time.Sleep(250 * time.Millisecond)
+			return nil
+		},
+	}
+	dialTimeout = 50 * time.Millisecond
+
+	// 192.0.2.0/24 is TEST-NET-1 (RFC 5737), so nothing will answer.
+	conn, err := newForwardDialer().Dial("tcp", "192.0.2.1:443")
+	if err == nil {
+		conn.Close()
+		t.Fatalf("Dial() succeeded")
+	}
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("Dial() returned a non-timeout error: %s", err)
+	}
+
+	// Without a timeout, the OS default applies.
+	dialTimeout = 0
+	if d := newForwardDialer().(*net.Dialer); d.Timeout != 0 {
+		t.Fatalf("unexpected dial timeout: %s", d.Timeout)
+	}
+}
+
+type passthroughServerFactory struct{}
+
+func (sf *passthroughServerFactory) Transport() base.Transport {
+	return &obfs4.Transport{}
+}
+
+func (sf *passthroughServerFactory) Args() *pt.Args {
+	return &pt.Args{}
+}
+
+func (sf *passthroughServerFactory) WrapConn(conn net.Conn) (net.Conn, error) {
+	return conn, nil
+}
+
+func TestSmethodArgsOrder(t *testing.T) {
+	serverArgs := &pt.Args{}
+	serverArgs.Add("password", "hunter2")
+	serverArgs.Add("bulk", "true")
+	serverArgs.Add("compress", "true")
+	serverArgs.Add("early-padding", "true")
+	f, err := new(obfs4.Transport).ServerFactory(t.TempDir(), serverArgs)
+	if err != nil {
+		t.Fatalf("ServerFactory() failed: %s", err)
+	}
+
+	var buf bytes.Buffer
+	oldStdout := pt.Stdout
+	pt.Stdout = &buf
+	defer func() {
+		pt.Stdout = oldStdout
+	}()
+
+	// The SMETHOD line must be identical every time, regardless of the map
+	// iteration order, with the arguments sorted by key.
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 443}
+	pt.SmethodArgs("obfs4", addr, *f.Args())
+	expected := buf.String()
+	for i := 0; i < 32; i++ {
+		buf.Reset()
+		pt.SmethodArgs("obfs4", addr, *f.Args())
+		if buf.String() != expected {
+			t.Fatalf("SMETHOD line changed: %q != %q", buf.String(), expected)
+		}
+	}
+
+	_, encoded, ok := strings.Cut(strings.TrimSpace(expected), " ARGS:")
+	if !ok {
+		t.Fatalf("SMETHOD line without ARGS: %q", expected)
+	}
+	var keys []string
+	for _, kv := range strings.Split(encoded, ",") {
+		k, _, _ := strings.Cut(kv, "=")
+		keys = append(keys, k)
+	}
+	if !sort.StringsAreSorted(keys) || len(keys) != 6 {
+		t.Fatalf("SMETHOD ARGS keys not sorted: %v", keys)
+	}
+	if strings.Index(encoded, "cert=") > strings.Index(encoded, "iat-mode=") {
+		t.Fatalf("SMETHOD ARGS has iat-mode before cert: %q", encoded)
+	}
+}
+
+func TestServerHandlerConnTag(t *testing.T) {
+	oldTermMon, oldHealth := termMon, health
+	termMon = &termMonitor{handlerChan: make(chan int, 2)}
+	health = newHealthMonitor()
+	logPath := filepath.Join(t.TempDir(), obfs4proxyLogFile)
+	if err := log.Init(true, logPath, false); err != nil {
+		t.Fatalf("log.Init() failed: %s", err)
+	}
+	defer func() {
+		termMon, health = oldTermMon, oldHealth
+		_ = log.Init(false, "", false)
+	}()
+
+	// The "ORPort" consumes everything, and closes when the peer does.
+	orLn, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenTCP() failed: %s", err)
+	}
+	defer orLn.Close()
+	go func() {
+		conn, err := orLn.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+	info := &pt.ServerInfo{OrAddr: orLn.Addr().(*net.TCPAddr)} //nolint:forcetypeassert
+
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		_, _ = clientConn.Write([]byte("hello"))
+		clientConn.Close()
+	}()
+	serverHandler(&passthroughServerFactory{}, serverConn, info, false)
+
+	b, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("ReadFile() failed: %s", err)
+	}
+	tagRe := regexp.MustCompile(`#([0-9a-f]{8}) - (new|closed) connection`)
+	matches := tagRe.FindAllSubmatch(b, -1)
+	if len(matches) != 2 {
+		t.Fatalf("expected 2 tagged log lines, got: %s", b)
+	}
+	if !bytes.Equal(matches[0][1], matches[1][1]) {
+		t.Fatalf("connection tags differ: %s != %s", matches[0][1], matches[1][1])
+	}
+}
+
+type failingServerFactory struct {
+	passthroughServerFactory
+	detached bool
+}
+
+func (sf *failingServerFactory) WrapConn(_ net.Conn) (net.Conn, error) {
+	return nil, &base.HandshakeError{Err: errors.New("test failure"), Detached: sf.detached}
+}
+
+type closeTrackingConn struct {
+	net.Conn
+	closed atomic.Bool
+}
+
+func (c *closeTrackingConn) Close() error {
+	c.closed.Store(true)
+	return c.Conn.Close()
+}
+
+func TestServerHandlerDetached(t *testing.T) {
+	oldTermMon, oldHealth := termMon, health
+	termMon = &termMonitor{handlerChan: make(chan int, 4)}
+	health = newHealthMonitor()
+	defer func() {
+		termMon, health = oldTermMon, oldHealth
+	}()
+
+	// The connection must only be closed if the transport did not retain
+	// it.
+	for _, detached := range []bool{false, true} {
+		clientConn, serverConn := net.Pipe()
+		conn := &closeTrackingConn{Conn: serverConn}
+		serverHandler(&failingServerFactory{detached: detached}, conn, &pt.ServerInfo{}, false)
+		if conn.closed.Load() == detached {
+			t.Fatalf("detached: %v, closed: %v", detached, conn.closed.Load())
+		}
+		clientConn.Close()
+		serverConn.Close()
+	}
+}
+
+func writeAuthCookieFile(t *testing.T, path string, cookie []byte) {
+	t.Helper()
+	b := append([]byte("! Extended ORPort Auth Cookie !\x0a"), cookie...)
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatalf("WriteFile() failed: %s", err)
+	}
+}
+
+// serveExtOrPort accepts connections on ln, and authenticates them with the
+// (current) SAFE_COOKIE returned by cookieFn, per ext-orport-spec.txt.
+func serveExtOrPort(ln net.Listener, cookieFn func(int) []byte) {
+	for nr := 1; ; nr++ {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func(nr int, conn net.Conn) {
+			defer conn.Close()
+			cookie := cookieFn(nr)
+			computeHash := func(label string, clientNonce, serverNonce []byte) []byte {
+				h := hmac.New(sha256.New, cookie)
+				_, _ = h.Write([]byte(label))
+				_, _ = h.Write(clientNonce)
+				_, _ = h.Write(serverNonce)
+				return h.Sum(nil)
+			}
+
+			var authType [1]byte
+			clientNonce, serverNonce, clientHash := make([]byte, 32), make([]byte, 32), make([]byte, 32)
+			_, _ = rand.Read(serverNonce)
+			if _, err := conn.Write([]byte{1, 0}); err != nil {
+				return
+			}
+			if _, err := io.ReadFull(conn, authType[:]); err != nil || authType[0] != 1 {
+				return
+			}
+			if _, err := io.ReadFull(conn, clientNonce); err != nil {
+				return
+			}
+			_, _ = conn.Write(computeHash("ExtORPort authentication server-to-client hash", clientNonce, serverNonce))
+			_, _ = conn.Write(serverNonce)
+			if _, err := io.ReadFull(conn, clientHash); err != nil {
+				return
+			}
+			if !hmac.Equal(clientHash, computeHash("ExtORPort authentication client-to-server hash", clientNonce, serverNonce)) {
+				_, _ = conn.Write([]byte{0})
+				return
+			}
+			_, _ = conn.Write([]byte{1})
+
+			// Consume the metadata commands till DONE, and reply OKAY.
+			for {
+				var hdr [4]byte
+				if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+					return
+				}
+				if _, err := io.CopyN(io.Discard, conn, int64(binary.BigEndian.Uint16(hdr[2:]))); err != nil {
+					return
+				}
+				if binary.BigEndian.Uint16(hdr[:2]) == 0 {
+					break
+				}
+			}
+			_, _ = conn.Write([]byte{0x10, 0x00, 0x00, 0x00})
+			_, _ = io.Copy(conn, conn)
+		}(nr, conn)
+	}
+}
+
+func TestPtDialOrCookieRotation(t *testing.T) {
+	oldCookie, newCookie := make([]byte, 32), make([]byte, 32)
+	_, _ = rand.Read(oldCookie)
+	_, _ = rand.Read(newCookie)
+	cookiePath := filepath.Join(t.TempDir(), "extended_orport_auth_cookie")
+	writeAuthCookieFile(t, cookiePath, oldCookie)
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenTCP() failed: %s", err)
+	}
+	defer ln.Close()
+
+	// tor has rotated the cookie, but the file is only rewritten after the
+	// first connection attempt.
+	var nrConns atomic.Int32
+	go serveExtOrPort(ln, func(nr int) []byte {
+		nrConns.Store(int32(nr))
+		if nr == 2 {
+			writeAuthCookieFile(t, cookiePath, newCookie)
+		}
+		return newCookie
+	})
+	info := &pt.ServerInfo{
+		ExtendedOrAddr: ln.Addr().(*net.TCPAddr), //nolint:forcetypeassert
+		AuthCookiePath: cookiePath,
+	}
+
+	conn, err := ptDialOr(info, "192.0.2.1:1234", "obfs4")
+	if err != nil {
+		t.Fatalf("ptDialOr() failed: %s", err)
+	}
+	defer conn.Close()
+	if nrConns.Load() != 2 {
+		t.Fatalf("ptDialOr() connected %d times, expected 2", nrConns.Load())
+	}
+	msg := []byte("hello")
+	if _, err = conn.Write(msg); err != nil {
+		t.Fatalf("Write() failed: %s", err)
+	}
+	echoed := make([]byte, len(msg))
+	if _, err = io.ReadFull(conn, echoed); err != nil || !bytes.Equal(msg, echoed) {
+		t.Fatalf("Read() failed: %q, %v", echoed, err)
+	}
+
+	// A cookie that never matches is only retried a limited number of times.
+	writeAuthCookieFile(t, cookiePath, oldCookie)
+	nrConns.Store(0)
+	ln2, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenTCP() failed: %s", err)
+	}
+	defer ln2.Close()
+	go serveExtOrPort(ln2, func(nr int) []byte {
+		nrConns.Store(int32(nr))
+		return newCookie
+	})
+	info.ExtendedOrAddr = ln2.Addr().(*net.TCPAddr) //nolint:forcetypeassert
+	if _, err = ptDialOr(info, "192.0.2.1:1234", "obfs4"); err == nil || !isExtOrAuthError(err) {
+		t.Fatalf("ptDialOr() returned %v, expected an authentication error", err)
+	}
+	if nrConns.Load() != extOrAuthRetries+1 {
+		t.Fatalf("ptDialOr() connected %d times, expected %d", nrConns.Load(), extOrAuthRetries+1)
+	}
+}
+
+// noDeadlineConn is a net.Conn that does not support deadlines, like most
+// of the transports.
+type noDeadlineConn struct {
+	net.Conn
+}
+
+func (c *noDeadlineConn) SetReadDeadline(_ time.Time) error {
+	return syscall.ENOTSUP
+}
+
+func TestCopyLoopIdleTimeout(t *testing.T) {
+	oldIdleTimeout := idleTimeout
+	idleTimeout = 100 * time.Millisecond
+	defer func() {
+		idleTimeout = oldIdleTimeout
+	}()
+
+	orConn, orPeer := net.Pipe()
+	ptConn, ptPeer := net.Pipe()
+	go func() {
+		_, _ = io.Copy(io.Discard, orPeer)
+	}()
+
+	doneCh := make(chan error, 1)
+	go func() {
+		doneCh <- copyLoop(orConn, &noDeadlineConn{ptConn})
+	}()
+
+	// Data only flowing from the transport (which can't time out reads)
+	// keeps the session alive past the idle timeout.
+	start := time.Now()
+	for time.Since(start) < 3*idleTimeout {
+		if _, err := ptPeer.Write([]byte("keep me alive")); err != nil {
+			t.Fatalf("Write() failed: %s", err)
+		}
+		time.Sleep(idleTimeout / 4)
+	}
+	select {
+	case err := <-doneCh:
+		t.Fatalf("active session reaped: %v", err)
+	default:
+	}
+
+	// Going idle tears the session down.
+	select {
+	case err := <-doneCh:
+		if reason := closeReason(err); reason != closeReasonTimeout {
+			t.Fatalf("idle session closed with %v (%s), expected a timeout", err, reason)
+		}
+	case <-time.After(10 * idleTimeout):
+		t.Fatalf("idle session not reaped")
+	}
+	if _, err := ptPeer.Write([]byte("dead")); err == nil {
+		t.Fatalf("Write() to a reaped session succeeded")
+	}
+}
+
+// writerToConn is a net.Conn that implements io.WriterTo, like obfs4.
+type writerToConn struct {
+	net.Conn
+
+	calls atomic.Int32
+}
+
+func (c *writerToConn) WriteTo(w io.Writer) (int64, error) {
+	c.calls.Add(1)
+	return io.Copy(w, struct{ io.Reader }{c.Conn})
+}
+
+func TestCopyLoopIdleTimeoutWriterTo(t *testing.T) {
+	oldIdleTimeout := idleTimeout
+	idleTimeout = 100 * time.Millisecond
+	defer func() {
+		idleTimeout = oldIdleTimeout
+	}()
+
+	orConn, orPeer := net.Pipe()
+	ptConn, ptPeer := net.Pipe()
+	go func() {
+		_, _ = io.Copy(io.Discard, orPeer)
+	}()
+
+	wtConn := &writerToConn{Conn: ptConn}
+	doneCh := make(chan error, 1)
+	go func() {
+		doneCh <- copyLoop(orConn, wtConn)
+	}()
+
+	// Data relayed via WriteTo keeps the session alive past the idle
+	// timeout, even though the read deadline expires under it.
+	start := time.Now()
+	for time.Since(start) < 3*idleTimeout {
+		if _, err := ptPeer.Write([]byte("keep me alive")); err != nil {
+			t.Fatalf("Write() failed: %s", err)
+		}
+		time.Sleep(idleTimeout / 4)
+	}
+	select {
+	case err := <-doneCh:
+		t.Fatalf("active session reaped: %v", err)
+	default:
+	}
+	if wtConn.calls.Load() == 0 {
+		t.Fatalf("transport not relayed via WriteTo")
+	}
+
+	select {
+	case err := <-doneCh:
+		if reason := closeReason(err); reason != closeReasonTimeout {
+			t.Fatalf("idle session closed with %v (%s), expected a timeout", err, reason)
+		}
+	case <-time.After(10 * idleTimeout):
+		t.Fatalf("idle session not reaped")
+	}
+}
+
+func newLoopbackPair(tb testing.TB) (net.Conn, net.Conn) {
+	tb.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("net.Listen() failed: %s", err)
+	}
+	defer ln.Close()
+
+	acceptCh := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		acceptCh <- conn
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		tb.Fatalf("net.Dial() failed: %s", err)
+	}
+	peer := <-acceptCh
+	if peer == nil {
+		tb.Fatalf("Accept() failed")
+	}
+	return conn, peer
+}
+
+// newBenchRelay returns the ORPort connection and its peer, and the server
+// and client sides of a fresh obfs4 session, over loopback TCP.
+func newBenchRelay(b *testing.B) (net.Conn, net.Conn, net.Conn, net.Conn) {
+	b.Helper()
+
+	tr := &obfs4.Transport{}
+	sf, err := tr.ServerFactory(b.TempDir(), &pt.Args{})
+	if err != nil {
+		b.Fatalf("ServerFactory() failed: %s", err)
+	}
+	cf, err := tr.ClientFactory("")
+	if err != nil {
+		b.Fatalf("ClientFactory() failed: %s", err)
+	}
+	clientArgs, err := cf.ParseArgs(sf.Args())
+	if err != nil {
+		b.Fatalf("ParseArgs() failed: %s", err)
+	}
+
+	orConn, orPeer := newLoopbackPair(b)
+	clientRaw, serverRaw := newLoopbackPair(b)
+
+	serverCh := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := sf.WrapConn(serverRaw)
+		serverCh <- conn
+	}()
+	dialFn := func(string, string) (net.Conn, error) {
+		return clientRaw, nil
+	}
+	client, err := cf.Dial("tcp", "loopback", dialFn, clientArgs)
+	if err != nil {
+		b.Fatalf("Dial() failed: %s", err)
+	}
+	server := <-serverCh
+	if server == nil {
+		b.Fatalf("WrapConn() failed")
+	}
+	b.Cleanup(func() {
+		orPeer.Close()
+		client.Close()
+	})
+
+	return orConn, orPeer, server, client
+}
+
+func BenchmarkCopyLoop(b *testing.B) {
+	const chunkSize = 64 * 1024
+
+	oldRelayBufSize := relayBufSize
+	defer func() {
+		relayBufSize = oldRelayBufSize
+	}()
+
+	for _, size := range []int{
+		framing.MaximumFramePayloadLength,
+		defaultRelayBufSize,
+		32 * 1024,
+		chunkSize,
+	} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			relayBufSize = size
+
+			orConn, orPeer, server, client := newBenchRelay(b)
+			go func() {
+				_ = copyLoop(orConn, server)
+			}()
+
+			chunk := make([]byte, chunkSize)
+			go func() {
+				for i := 0; i < b.N; i++ {
+					if _, err := orPeer.Write(chunk); err != nil {
+						return
+					}
+				}
+			}()
+
+			b.SetBytes(chunkSize)
+			b.ResetTimer()
+			if _, err := io.CopyN(io.Discard, client, int64(b.N)*chunkSize); err != nil {
+				b.Fatalf("CopyN() failed: %s", err)
+			}
+		})
+	}
+}
+
+// BenchmarkCopyLoop_ToORPort measures the server relay from the obfs4
+// session to the ORPort, with and without the idle timeout, which should
+// both relay via obfs4's io.WriterTo.
+func BenchmarkCopyLoop_ToORPort(b *testing.B) {
+	const chunkSize = 64 * 1024
+
+	oldIdleTimeout := idleTimeout
+	defer func() {
+		idleTimeout = oldIdleTimeout
+	}()
+
+	for _, timeout := range []time.Duration{0, time.Minute} {
+		b.Run(timeout.String(), func(b *testing.B) {
+			idleTimeout = timeout
+
+			orConn, orPeer, server, client := newBenchRelay(b)
+			go func() {
+				_ = copyLoop(orConn, server)
+			}()
+
+			chunk := make([]byte, chunkSize)
+			go func() {
+				for i := 0; i < b.N; i++ {
+					if _, err := client.Write(chunk); err != nil {
+						return
+					}
+				}
+			}()
+
+			b.SetBytes(chunkSize)
+			b.ResetTimer()
+			if _, err := io.CopyN(io.Discard, orPeer, int64(b.N)*chunkSize); err != nil {
+				b.Fatalf("CopyN() failed: %s", err)
+			}
+		})
+	}
+}
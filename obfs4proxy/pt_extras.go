@@ -34,6 +34,8 @@ import (
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
 )
@@ -131,6 +133,45 @@ func resolveAddrStr(addrStr string) (*net.TCPAddr, error) {
 	return &net.TCPAddr{IP: ip, Port: int(port), Zone: ""}, nil
 }
 
+const (
+	extOrAuthRetries    = 2
+	extOrAuthRetryDelay = 100 * time.Millisecond
+)
+
+// ptDialOr connects to the (Extended) ORPort like pt.DialOr, except that
+// ExtORPort authentication failures are retried.  goptlib re-reads the auth
+// cookie on every attempt, but an attempt that races tor rewriting the
+// cookie file on rotation will see a stale or truncated cookie.
+//
+// This also avoids pt.DialOr, which panics if the dial fails, and allows
+// the connection to be customized via orDialer.
+func ptDialOr(info *pt.ServerInfo, addr, methodName string) (net.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		conn, err := pt.DialOrWithDialer(orDialer, info, addr, methodName)
+		if err == nil || attempt >= extOrAuthRetries || !isExtOrAuthError(err) {
+			return conn, err
+		}
+		time.Sleep(extOrAuthRetryDelay)
+	}
+}
+
+// isExtOrAuthError returns true iff err is a goptlib ExtORPort
+// authentication failure.  goptlib does not export these, so this relies on
+// the error messages.
+func isExtOrAuthError(err error) bool {
+	msg := err.Error()
+	for _, s := range []string{
+		"TOR_PT_AUTH_COOKIE_FILE",
+		"mismatch in server hash",
+		"server rejected authentication",
+	} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
 // Feature #15435 adds a new env var for determining if Tor keeps stdin
 // open for use in termination detection.
 func ptShouldExitOnStdinClose() bool {
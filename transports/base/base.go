@@ -35,6 +35,34 @@ import (
 	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
 )
 
+// HandshakeError is the error returned when a transport protocol handshake
+// fails.  Transports should wrap the underlying error with this so that
+// callers can distinguish handshake failures from relay errors.
+type HandshakeError struct {
+	// Err is the underlying error.
+	Err error
+
+	// Probe is set if the handshake failure is indicative of active probing
+	// (eg: a replayed or malformed handshake).
+	Probe bool
+
+	// Detached is set if the transport retained the connection (eg: to
+	// close it after a delay), in which case it is responsible for closing
+	// it, and the caller must not.
+	Detached bool
+}
+
+// Error returns the string representation of the underlying error, as the
+// type itself conveys that the handshake failed.
+func (e *HandshakeError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
 type DialFunc func(string, string) (net.Conn, error)
 
 // ClientFactory is the interface that defines the factory for creating
@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package base
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+)
+
+// ErrChainRedial is the error returned when the inner transport of a chain
+// attempts to dial more than one connection, as each chained connection is
+// carried by exactly one outer connection.
+var ErrChainRedial = errors.New("base: chained transport dialed more than once")
+
+// ChainClient returns a ClientFactory that layers the inner transport over
+// the outer one, eg: obfs4 (inner) inside meek (outer).  The outer transport
+// produces the connection that is sent on the wire, which the inner
+// transport uses in place of a network connection.
+//
+// The returned ClientFactory belongs to the inner transport, so ParseArgs
+// and Dial take the inner transport's arguments.  The outer transport's
+// arguments are parsed for each Dial from outerArgs.  The network, address
+// and dialFn passed to Dial are used by the outer transport to establish
+// the underlying connection.
+//
+// Not all transports support deadlines on their connections (eg: meek), so
+// if setting a deadline on the outer connection fails, it is instead
+// enforced by closing the connection when the deadline expires.  This is
+// sufficient for the handshake timeouts that transports apply.
+func ChainClient(outer, inner ClientFactory, outerArgs *pt.Args) ClientFactory {
+	return &chainedClientFactory{
+		outer:     outer,
+		inner:     inner,
+		outerArgs: outerArgs,
+	}
+}
+
+type chainedClientFactory struct {
+	outer     ClientFactory
+	inner     ClientFactory
+	outerArgs *pt.Args
+}
+
+func (cf *chainedClientFactory) Transport() Transport {
+	return cf.inner.Transport()
+}
+
+func (cf *chainedClientFactory) ParseArgs(args *pt.Args) (any, error) {
+	return cf.inner.ParseArgs(args)
+}
+
+func (cf *chainedClientFactory) Dial(network, address string, dialFn DialFunc, args any) (net.Conn, error) {
+	outerArgs, err := cf.outer.ParseArgs(cf.outerArgs)
+	if err != nil {
+		return nil, err
+	}
+	outerConn, err := cf.outer.Dial(network, address, dialFn, outerArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	outerConn = &chainedConn{Conn: outerConn}
+
+	var dialed atomic.Bool
+	innerDialFn := func(string, string) (net.Conn, error) {
+		if dialed.Swap(true) {
+			return nil, ErrChainRedial
+		}
+		return outerConn, nil
+	}
+	conn, err := cf.inner.Dial(network, address, innerDialFn, args)
+	if err != nil {
+		outerConn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+type chainedConn struct {
+	net.Conn
+
+	lock  sync.Mutex
+	timer *time.Timer
+}
+
+func (c *chainedConn) SetDeadline(t time.Time) error {
+	if err := c.Conn.SetDeadline(t); err == nil {
+		return nil
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if !t.IsZero() {
+		c.timer = time.AfterFunc(time.Until(t), func() {
+			_ = c.Conn.Close()
+		})
+	}
+	return nil
+}
+
+func (c *chainedConn) Close() error {
+	c.lock.Lock()
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.lock.Unlock()
+
+	return c.Conn.Close()
+}
+
+var _ ClientFactory = (*chainedClientFactory)(nil)
@@ -0,0 +1,200 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package base_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+
+	"gitlab.com/yawning/obfs4.git/transports/base"
+	"gitlab.com/yawning/obfs4.git/transports/meeklite"
+	"gitlab.com/yawning/obfs4.git/transports/obfs4"
+)
+
+// noneTransport is a passthrough transport, that does nothing beyond
+// dialing the connection.
+type noneTransport struct{}
+
+func (t *noneTransport) Name() string {
+	return "none"
+}
+
+func (t *noneTransport) ClientFactory(_ string) (base.ClientFactory, error) {
+	return t, nil
+}
+
+func (t *noneTransport) ServerFactory(_ string, _ *pt.Args) (base.ServerFactory, error) {
+	return nil, nil
+}
+
+func (t *noneTransport) Transport() base.Transport {
+	return t
+}
+
+func (t *noneTransport) ParseArgs(_ *pt.Args) (any, error) {
+	return nil, nil
+}
+
+func (t *noneTransport) Dial(network, address string, dialFn base.DialFunc, _ any) (net.Conn, error) {
+	return dialFn(network, address)
+}
+
+// newEchoServer starts an obfs4 server that echoes back everything it
+// receives, and returns the listener and the client arguments.
+func newEchoServer(t *testing.T) (net.Listener, *pt.Args) {
+	sf, err := new(obfs4.Transport).ServerFactory(t.TempDir(), &pt.Args{})
+	if err != nil {
+		t.Fatalf("ServerFactory() failed: %s", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() failed: %s", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				c, err := sf.WrapConn(conn)
+				if err != nil {
+					return
+				}
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+
+	return ln, sf.Args()
+}
+
+func testChainEcho(t *testing.T, cf base.ClientFactory, serverArgs *pt.Args, address string) {
+	args, err := cf.ParseArgs(serverArgs)
+	if err != nil {
+		t.Fatalf("ParseArgs() failed: %s", err)
+	}
+	conn, err := cf.Dial("tcp", address, net.Dial, args)
+	if err != nil {
+		t.Fatalf("Dial() failed: %s", err)
+	}
+	defer conn.Close()
+
+	msg := []byte("This is a test of the Emergency Broadcast System.")
+	if _, err = conn.Write(msg); err != nil {
+		t.Fatalf("Write() failed: %s", err)
+	}
+	echoed := make([]byte, len(msg))
+	if _, err = io.ReadFull(conn, echoed); err != nil {
+		t.Fatalf("Read() failed: %s", err)
+	}
+	if !bytes.Equal(msg, echoed) {
+		t.Fatalf("echoed data mismatch")
+	}
+}
+
+func newObfs4ClientFactory(t *testing.T) base.ClientFactory {
+	cf, err := new(obfs4.Transport).ClientFactory("")
+	if err != nil {
+		t.Fatalf("ClientFactory() failed: %s", err)
+	}
+	return cf
+}
+
+func TestChainClientNone(t *testing.T) {
+	ln, serverArgs := newEchoServer(t)
+
+	cf := base.ChainClient(&noneTransport{}, newObfs4ClientFactory(t), &pt.Args{})
+	if cf.Transport().Name() != "obfs4" {
+		t.Fatalf("chained transport is %s, expected obfs4", cf.Transport().Name())
+	}
+	testChainEcho(t, cf, serverArgs, ln.Addr().String())
+}
+
+func TestChainClientMeek(t *testing.T) {
+	ln, serverArgs := newEchoServer(t)
+
+	// A minimal meek server, that relays each session to the obfs4 server.
+	var (
+		lock     sync.Mutex
+		sessions = make(map[string]net.Conn)
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Session-Id")
+		lock.Lock()
+		conn, ok := sessions[id]
+		if !ok {
+			var err error
+			if conn, err = net.Dial("tcp", ln.Addr().String()); err != nil {
+				lock.Unlock()
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			sessions[id] = conn
+		}
+		lock.Unlock()
+
+		if _, err := io.Copy(conn, r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		var buf [4096]byte
+		_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		n, _ := conn.Read(buf[:])
+		_, _ = w.Write(buf[:n])
+	}))
+	defer srv.Close()
+	defer func() {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, conn := range sessions {
+			conn.Close()
+		}
+	}()
+
+	meekArgs := &pt.Args{}
+	meekArgs.Add("url", srv.URL+"/")
+	meekCf, err := new(meeklite.Transport).ClientFactory("")
+	if err != nil {
+		t.Fatalf("ClientFactory() failed: %s", err)
+	}
+
+	cf := base.ChainClient(meekCf, newObfs4ClientFactory(t), meekArgs)
+	testChainEcho(t, cf, serverArgs, srv.Listener.Addr().String())
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package meeklite
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	gourl "net/url"
+
+	"gitlab.com/yawning/obfs4.git/common/csrand"
+)
+
+// AMP cache request shaping.
+//
+// AMP caches only support GET requests, and will only serve responses that
+// are valid AMP HTML documents, so when enabled:
+//
+//   - The session ID and payload are sent in the URL path, as
+//     "<url>/<session ID>/<nonce>/<base64url(payload)>", where the nonce is
+//     random per request, so that polls with no (or a repeated) payload do
+//     not share a URL, and are not served a cached response, losing or
+//     repeating the downstream data.  Servers MUST accept any nonce, and
+//     take the session ID and payload from the first and last path elements
+//     past the configured URL.
+//   - The response payload is base64 encoded in the body of a <pre> element
+//     of a HTML document.
+//
+// Even so, the server's responses MUST NOT be cacheable (eg: they should
+// be sent with "Cache-Control: no-store"), as every response carries data
+// that is only delivered once.
+//
+// As many caches and intermediaries reject URLs longer than ~8 KiB, the
+// payload per request is limited to maxAMPPayloadLength, which is vastly
+// smaller than the POST limit, and larger writes are split across multiple
+// requests.
+
+const (
+	ampArg = "amp"
+
+	maxAMPPayloadLength = 4096
+	ampNonceLength      = 12
+
+	ampPreStart = "<pre>"
+	ampPreEnd   = "</pre>"
+)
+
+var ampEncoding = base64.RawURLEncoding
+
+func makeAMPURL(url gourl.URL, sessionID string, sndBuf []byte) (string, error) {
+	var nonce [ampNonceLength]byte
+	if err := csrand.Bytes(nonce[:]); err != nil {
+		return "", err
+	}
+	// The payload is appended by hand, as JoinPath drops it if empty.
+	u := url.JoinPath(sessionID, ampEncoding.EncodeToString(nonce[:]))
+	u.Path += "/" + ampEncoding.EncodeToString(sndBuf)
+	return u.String(), nil
+}
+
+func decodeAMPResponse(r io.Reader) ([]byte, error) {
+	// The base64 expansion of the payload, plus some slack for the
+	// surrounding document.
+	const maxEnvelopeLength = (maxPayloadLength/3+1)*4 + 0x1000
+
+	doc, err := io.ReadAll(io.LimitReader(r, maxEnvelopeLength))
+	if err != nil {
+		return nil, err
+	}
+
+	start := bytes.Index(doc, []byte(ampPreStart))
+	if start < 0 {
+		return nil, fmt.Errorf("amp: missing %s element", ampPreStart)
+	}
+	doc = doc[start+len(ampPreStart):]
+	end := bytes.Index(doc, []byte(ampPreEnd))
+	if end < 0 {
+		return nil, fmt.Errorf("amp: unterminated %s element", ampPreStart)
+	}
+
+	// Tolerate the encoded payload being split across lines.
+	enc := bytes.Join(bytes.Fields(doc[:end]), nil)
+	b := make([]byte, base64.StdEncoding.DecodedLen(len(enc)))
+	n, err := base64.StdEncoding.Decode(b, enc)
+	if err != nil {
+		return nil, fmt.Errorf("amp: malformed payload: %w", err)
+	}
+	if n > maxPayloadLength {
+		return nil, fmt.Errorf("amp: oversized payload: %d", n)
+	}
+	return b[:n], nil
+}
@@ -0,0 +1,201 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package meeklite
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	gourl "net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func writeAMPResponse(w io.Writer, b []byte) {
+	enc := base64.StdEncoding.EncodeToString(b)
+
+	_, _ = io.WriteString(w, "<!doctype html>\n<html amp>\n<body>\n<pre>\n")
+	for len(enc) > 76 {
+		_, _ = io.WriteString(w, enc[:76]+"\n")
+		enc = enc[76:]
+	}
+	_, _ = io.WriteString(w, enc+"\n</pre>\n</body>\n</html>\n")
+}
+
+// parseAMPPath returns the session ID and payload of an AMP request, given
+// the URL path past the server's prefix, discarding the nonce, as the AMP
+// server in the tests does.
+func parseAMPPath(path string) (string, []byte, error) {
+	parts := strings.Split(path, "/")
+	if len(parts) != 3 || parts[0] == "" {
+		return "", nil, fmt.Errorf("amp: malformed path")
+	}
+	if nonce, err := ampEncoding.DecodeString(parts[1]); err != nil || len(nonce) != ampNonceLength {
+		return "", nil, fmt.Errorf("amp: malformed nonce")
+	}
+	b, err := ampEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, fmt.Errorf("amp: malformed payload: %w", err)
+	}
+	if len(b) > maxAMPPayloadLength {
+		return "", nil, fmt.Errorf("amp: oversized payload: %d", len(b))
+	}
+	return parts[0], b, nil
+}
+
+func TestDecodeAMPResponse(t *testing.T) {
+	payload := make([]byte, 1000)
+	_, _ = rand.Read(payload)
+
+	var buf bytes.Buffer
+	writeAMPResponse(&buf, payload)
+	b, err := decodeAMPResponse(&buf)
+	if err != nil {
+		t.Fatalf("decodeAMPResponse() failed: %s", err)
+	}
+	if !bytes.Equal(b, payload) {
+		t.Fatalf("decodeAMPResponse() payload mismatch")
+	}
+
+	for _, v := range []string{
+		"",
+		"<html><body></body></html>",
+		"<html><body><pre>AAAA",
+		"<html><body><pre>!!!!</pre></body></html>",
+	} {
+		if _, err = decodeAMPResponse(strings.NewReader(v)); err == nil {
+			t.Fatalf("decodeAMPResponse(%q) succeeded", v)
+		}
+	}
+}
+
+func TestAMPMode(t *testing.T) {
+	var (
+		badRequests atomic.Int32
+		urlsLock    sync.Mutex
+		polls       int
+	)
+	urls := make(map[string]bool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Echo the payload back, in the AMP envelope.
+		_, b, err := parseAMPPath(strings.TrimPrefix(r.URL.Path, "/amp/"))
+		if r.Method != http.MethodGet || err != nil || r.Header.Get("X-Session-Id") != "" {
+			badRequests.Add(1)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// A cache would serve repeated URLs from the cache.
+		urlsLock.Lock()
+		if urls[r.URL.Path] {
+			badRequests.Add(1)
+		}
+		urls[r.URL.Path] = true
+		if len(b) == 0 {
+			polls++
+		}
+		urlsLock.Unlock()
+
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Cache-Control", "no-store")
+		writeAMPResponse(w, b)
+	}))
+	defer srv.Close()
+
+	ca := newTestClientArgs(t, srv.URL+"/amp/", map[string]string{
+		ampArg:        "true",
+		retryDelayArg: "1ms",
+	})
+	conn, err := newMeekConn(net.Dial, ca)
+	if err != nil {
+		t.Fatalf("newMeekConn() failed: %s", err)
+	}
+	defer conn.Close()
+
+	// Larger than a single AMP request can carry.
+	payload := make([]byte, 3*maxAMPPayloadLength+123)
+	_, _ = rand.Read(payload)
+	if _, err = conn.Write(payload); err != nil {
+		t.Fatalf("Write() failed: %s", err)
+	}
+
+	received := make([]byte, len(payload))
+	if _, err = io.ReadFull(conn, received); err != nil {
+		t.Fatalf("Read() failed: %s", err)
+	}
+	if !bytes.Equal(payload, received) {
+		t.Fatalf("payload mismatch")
+	}
+
+	// Wait for a few empty polls, which must also have distinct URLs.
+	for i := 0; i < 100; i++ {
+		urlsLock.Lock()
+		n := polls
+		urlsLock.Unlock()
+		if n >= 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := badRequests.Load(); n != 0 {
+		t.Fatalf("server received %d malformed or repeated requests", n)
+	}
+}
+
+func TestMakeAMPURL(t *testing.T) {
+	u, _ := gourl.Parse("https://example.com/amp/")
+	urlStr, err := makeAMPURL(*u, "session", []byte("payload"))
+	if err != nil {
+		t.Fatalf("makeAMPURL() failed: %s", err)
+	}
+	again, _ := makeAMPURL(*u, "session", []byte("payload"))
+	if urlStr == again {
+		t.Fatalf("makeAMPURL() repeated a URL: %s", urlStr)
+	}
+
+	parsed, _ := gourl.Parse(urlStr)
+	sessionID, b, err := parseAMPPath(strings.TrimPrefix(parsed.Path, "/amp/"))
+	if err != nil || sessionID != "session" || string(b) != "payload" {
+		t.Fatalf("parseAMPPath() returned %q, %q, %v", sessionID, b, err)
+	}
+
+	// Polls carry an empty payload.
+	urlStr, _ = makeAMPURL(*u, "session", nil)
+	parsed, _ = gourl.Parse(urlStr)
+	if _, b, err = parseAMPPath(strings.TrimPrefix(parsed.Path, "/amp/")); err != nil || len(b) != 0 {
+		t.Fatalf("parseAMPPath() of a poll returned %q, %v", b, err)
+	}
+}
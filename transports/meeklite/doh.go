@@ -0,0 +1,262 @@
+/*
+ * Copyright (c) 2015, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package meeklite
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	gourl "net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"gitlab.com/yawning/obfs4.git/transports/base"
+)
+
+// DNS over HTTPS (RFC 8484) resolution of the front host.
+//
+// When enabled, the host that meek connects to is resolved by querying the
+// DoH endpoint instead of the system resolver, which may be observed or
+// poisoned by the censor.  Only IPv4 (A) records are queried.  The DoH
+// endpoint itself is reached via the same dialer as meek, so using an IP
+// literal for the endpoint host avoids any local resolution entirely.
+
+const (
+	dohArg = "doh"
+
+	dohContentType       = "application/dns-message"
+	dohTimeout           = 10 * time.Second
+	maxDoHResponseLength = 65535
+
+	// Answer TTLs are clamped to this range, so that a lying (or broken)
+	// server can neither force a query per connection, nor pin an address
+	// indefinitely.
+	minDoHCacheTTL = 60 * time.Second
+	maxDoHCacheTTL = 24 * time.Hour
+)
+
+// ErrNoDoHAnswer is the error returned when a DoH query returns no
+// addresses.
+var ErrNoDoHAnswer = errors.New("meek_lite: no addresses in DoH response")
+
+// dohCache is shared between all connections, since a new set of client
+// arguments is parsed for each.
+var dohCache = &dohCacheMap{entries: make(map[string]*dohCacheEntry)}
+
+type dohCacheEntry struct {
+	addrs  []net.IP
+	expiry time.Time
+}
+
+type dohCacheMap struct {
+	sync.Mutex
+	entries map[string]*dohCacheEntry
+}
+
+func (m *dohCacheMap) get(key string, now time.Time) []net.IP {
+	m.Lock()
+	defer m.Unlock()
+
+	e, ok := m.entries[key]
+	if !ok {
+		return nil
+	}
+	if !now.Before(e.expiry) {
+		delete(m.entries, key)
+		return nil
+	}
+	return e.addrs
+}
+
+func (m *dohCacheMap) put(key string, addrs []net.IP, expiry time.Time) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.entries[key] = &dohCacheEntry{addrs: addrs, expiry: expiry}
+}
+
+func parseDoHEndpoint(str string) (*gourl.URL, error) {
+	u, err := gourl.Parse(str)
+	if err != nil {
+		return nil, fmt.Errorf("malformed doh url: '%s'", str)
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid doh scheme: '%s'", u.Scheme)
+	}
+	if u.Hostname() == "" || u.User != nil || u.Fragment != "" {
+		return nil, fmt.Errorf("invalid doh url: '%s'", str)
+	}
+	return u, nil
+}
+
+type dohResolver struct {
+	endpoint *gourl.URL
+	client   *http.Client
+}
+
+func newDoHResolver(endpoint *gourl.URL, dialFn base.DialFunc) *dohResolver {
+	return &dohResolver{
+		endpoint: endpoint,
+		client: &http.Client{
+			Transport: &http.Transport{Dial: dialFn},
+			Timeout:   dohTimeout,
+		},
+	}
+}
+
+// dialFunc returns a base.DialFunc that resolves host names via the
+// resolver, before dialing the resulting addresses in turn with dialFn.
+func (r *dohResolver) dialFunc(dialFn base.DialFunc) base.DialFunc {
+	return func(network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) != nil {
+			return dialFn(network, addr)
+		}
+
+		addrs, err := r.lookup(host)
+		if err != nil {
+			return nil, err
+		}
+		var conn net.Conn
+		for _, ip := range addrs {
+			if conn, err = dialFn(network, net.JoinHostPort(ip.String(), port)); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+func (r *dohResolver) lookup(host string) ([]net.IP, error) {
+	key := r.endpoint.String() + " " + strings.ToLower(host)
+	now := time.Now()
+	if addrs := dohCache.get(key, now); addrs != nil {
+		return addrs, nil
+	}
+
+	addrs, ttl, err := r.query(host)
+	if err != nil {
+		return nil, err
+	}
+	if ttl < minDoHCacheTTL {
+		ttl = minDoHCacheTTL
+	} else if ttl > maxDoHCacheTTL {
+		ttl = maxDoHCacheTTL
+	}
+	dohCache.put(key, addrs, now.Add(ttl))
+
+	return addrs, nil
+}
+
+func (r *dohResolver) query(host string) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, 0, fmt.Errorf("doh: invalid host '%s': %w", host, err)
+	}
+
+	// The query ID is always 0, per RFC 8484 Section 4.1.
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		},
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	u := *r.endpoint
+	q := u.Query()
+	q.Set("dns", base64.RawURLEncoding.EncodeToString(b))
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Accept", dohContentType)
+	req.Header.Set("User-Agent", "")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("doh: status code was %d, not %d", resp.StatusCode, http.StatusOK)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != dohContentType {
+		return nil, 0, fmt.Errorf("doh: unexpected content type: '%s'", ct)
+	}
+	if b, err = io.ReadAll(io.LimitReader(resp.Body, maxDoHResponseLength)); err != nil {
+		return nil, 0, err
+	}
+
+	return parseDoHResponse(b)
+}
+
+func parseDoHResponse(b []byte) ([]net.IP, time.Duration, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(b); err != nil {
+		return nil, 0, fmt.Errorf("doh: malformed response: %w", err)
+	}
+	if !msg.Response || msg.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, fmt.Errorf("doh: query failed: %v", msg.RCode)
+	}
+
+	var (
+		addrs []net.IP
+		ttl   time.Duration
+	)
+	for _, rr := range msg.Answers {
+		a, ok := rr.Body.(*dnsmessage.AResource)
+		if !ok {
+			// CNAMEs etc.  The recursive resolver does the chasing.
+			continue
+		}
+		rrTTL := time.Duration(rr.Header.TTL) * time.Second
+		if addrs == nil || rrTTL < ttl {
+			ttl = rrTTL
+		}
+		addrs = append(addrs, net.IP(append([]byte{}, a.A[:]...)))
+	}
+	if len(addrs) == 0 {
+		return nil, 0, ErrNoDoHAnswer
+	}
+	return addrs, ttl, nil
+}
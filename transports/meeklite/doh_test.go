@@ -0,0 +1,190 @@
+/*
+ * Copyright (c) 2015, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package meeklite
+
+import (
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func newTestDoHServer(t *testing.T, addr [4]byte, ttl uint32) (*httptest.Server, *atomic.Int32) {
+	var nrQueries atomic.Int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nrQueries.Add(1)
+
+		b, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil {
+			http.Error(w, "bad dns param", http.StatusBadRequest)
+			return
+		}
+		var msg dnsmessage.Message
+		if err = msg.Unpack(b); err != nil || len(msg.Questions) != 1 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		q := msg.Questions[0]
+
+		msg.Response = true
+		msg.Answers = []dnsmessage.Resource{
+			{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: ttl},
+				Body:   &dnsmessage.AResource{A: addr},
+			},
+		}
+		if b, err = msg.Pack(); err != nil {
+			http.Error(w, "pack failed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", dohContentType)
+		_, _ = w.Write(b)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, &nrQueries
+}
+
+func newTestDoHResolver(t *testing.T, srv *httptest.Server) *dohResolver {
+	endpoint, err := parseDoHEndpoint(srv.URL + "/dns-query")
+	if err != nil {
+		t.Fatalf("parseDoHEndpoint() failed: %s", err)
+	}
+	r := newDoHResolver(endpoint, net.Dial)
+	r.client = srv.Client()
+	return r
+}
+
+func TestParseDoHEndpoint(t *testing.T) {
+	if _, err := parseDoHEndpoint("https://1.1.1.1/dns-query"); err != nil {
+		t.Fatalf("parseDoHEndpoint() failed: %s", err)
+	}
+	for _, v := range []string{
+		"http://1.1.1.1/dns-query",
+		"https:///dns-query",
+		"https://user@1.1.1.1/dns-query",
+		"1.1.1.1",
+		"%",
+	} {
+		if _, err := parseDoHEndpoint(v); err == nil {
+			t.Errorf("parseDoHEndpoint(%s) succeeded", v)
+		}
+	}
+
+	ca := newTestClientArgs(t, "https://example.com/", map[string]string{dohArg: "https://1.1.1.1/dns-query"})
+	if ca.doh == nil || ca.doh.Host != "1.1.1.1" {
+		t.Fatalf("doh endpoint not parsed: %v", ca.doh)
+	}
+}
+
+func TestDoHResolver(t *testing.T) {
+	srv, nrQueries := newTestDoHServer(t, [4]byte{127, 0, 0, 1}, 300)
+	r := newTestDoHResolver(t, srv)
+
+	addrs, err := r.lookup("front.example")
+	if err != nil {
+		t.Fatalf("lookup() failed: %s", err)
+	}
+	if len(addrs) != 1 || !addrs[0].Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("lookup() returned %v", addrs)
+	}
+
+	// The second lookup should be served from the cache.
+	if _, err = r.lookup("FRONT.example"); err != nil {
+		t.Fatalf("lookup() failed: %s", err)
+	}
+	if n := nrQueries.Load(); n != 1 {
+		t.Fatalf("made %d queries, expected 1", n)
+	}
+
+	// Expired entries should be re-queried.
+	key := r.endpoint.String() + " front.example"
+	dohCache.put(key, addrs, time.Now().Add(-time.Second))
+	if _, err = r.lookup("front.example"); err != nil {
+		t.Fatalf("lookup() failed: %s", err)
+	}
+	if n := nrQueries.Load(); n != 2 {
+		t.Fatalf("made %d queries, expected 2", n)
+	}
+}
+
+func TestDoHResolverDial(t *testing.T) {
+	srv, _ := newTestDoHServer(t, [4]byte{127, 0, 0, 1}, 0)
+	r := newTestDoHResolver(t, srv)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() failed: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, aErr := ln.Accept(); aErr == nil {
+			conn.Close()
+		}
+	}()
+
+	var dialed string
+	dialFn := r.dialFunc(func(network, addr string) (net.Conn, error) {
+		dialed = addr
+		return net.Dial(network, addr)
+	})
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	conn, err := dialFn("tcp", net.JoinHostPort("dial.example", port))
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	conn.Close()
+	if dialed != ln.Addr().String() {
+		t.Fatalf("dialed %s, expected %s", dialed, ln.Addr())
+	}
+}
+
+func TestDoHResolverNoAnswer(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		var msg dnsmessage.Message
+		_ = msg.Unpack(b)
+		msg.Response = true
+		msg.RCode = dnsmessage.RCodeNameError
+		b, _ = msg.Pack()
+		w.Header().Set("Content-Type", dohContentType)
+		_, _ = w.Write(b)
+	}))
+	defer srv.Close()
+
+	r := newTestDoHResolver(t, srv)
+	if _, err := r.lookup("nxdomain.example"); err == nil {
+		t.Fatalf("lookup() succeeded for a NXDOMAIN")
+	}
+}
@@ -31,6 +31,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -40,17 +41,22 @@ import (
 	gourl "net/url"
 	"os"
 	"runtime"
+	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
 	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
 
+	"gitlab.com/yawning/obfs4.git/common/csrand"
+	"gitlab.com/yawning/obfs4.git/common/log"
 	"gitlab.com/yawning/obfs4.git/transports/base"
 )
 
 const (
-	urlArg   = "url"
-	frontArg = "front"
+	urlArg        = "url"
+	frontArg      = "front"
+	retryDelayArg = "retry-delay"
 
 	maxChanBacklog = 16
 
@@ -60,19 +66,39 @@ const (
 	maxPollInterval        = 5 * time.Second
 	pollIntervalMultiplier = 1.5
 	maxRetries             = 10
-	retryDelay             = 30 * time.Second
+	defaultRetryDelay      = 30 * time.Second
+
+	// The retry delay is exponentially increased from the base delay, up
+	// to this cap, and full jitter is applied to the result, so that
+	// clients that fail at the same time do not retry in lockstep.
+	maxRetryDelay = 5 * time.Minute
 )
 
 var (
 	// ErrNotSupported is the error returned for a unsupported operation.
 	ErrNotSupported = errors.New("meek_lite: operation not supported")
 
+	// ErrFrontBlocked is the error returned (wrapping the underlying error)
+	// when the front can not be reached at the network level: the
+	// connection is refused, reset, or times out, or the TLS handshake
+	// fails.  This is what a censored front looks like, so callers may
+	// want to try a different front.
+	ErrFrontBlocked = errors.New("meek_lite: front unreachable, possibly blocked")
+
+	// ErrFrontResponse is the error returned when the front (or the meek
+	// server behind it) keeps responding to requests with an error status.
+	ErrFrontResponse = errors.New("meek_lite: front returned an error")
+
 	loopbackAddr = net.IPv4(127, 0, 0, 1)
 )
 
 type meekClientArgs struct {
-	url   *gourl.URL
-	front string
+	url        *gourl.URL
+	front      string
+	retryDelay time.Duration
+	amp        bool
+	doh        *gourl.URL
+	expectSPKI spkiPins
 }
 
 func (ca *meekClientArgs) Network() string {
@@ -107,14 +133,72 @@ func newClientArgs(args *pt.Args) (*meekClientArgs, error) {
 	// Parse the (optional) front argument.
 	ca.front, _ = args.Get(frontArg)
 
+	// Parse the (optional) AMP cache request shaping argument.
+	if str, ok = args.Get(ampArg); ok {
+		ca.amp, err = strconv.ParseBool(str)
+		if err != nil {
+			return nil, fmt.Errorf("invalid amp: '%s'", str)
+		}
+	}
+
+	// Parse the (optional) DoH endpoint argument.
+	if str, ok = args.Get(dohArg); ok {
+		if ca.doh, err = parseDoHEndpoint(str); err != nil {
+			return nil, err
+		}
+	}
+
+	// Parse the (optional) expected SPKI pins argument.
+	if str, ok = args.Get(expectSPKIArg); ok {
+		if ca.expectSPKI, err = parseSPKIPins(str); err != nil {
+			return nil, err
+		}
+	}
+
+	// Parse the (optional) retry delay argument.
+	ca.retryDelay = defaultRetryDelay
+	if str, ok = args.Get(retryDelayArg); ok {
+		ca.retryDelay, err = time.ParseDuration(str)
+		if err != nil || ca.retryDelay <= 0 {
+			return nil, fmt.Errorf("invalid retry delay: '%s'", str)
+		}
+	}
+
 	return &ca, nil
 }
 
+// LinkState is a snapshot of the meek polling state.
+type LinkState struct {
+	// PollInterval is the current delay before the next poll request is
+	// issued, if there is no data to send.
+	PollInterval time.Duration
+
+	// LastActivity is the time when data was last sent or received.
+	LastActivity time.Time
+}
+
+// LinkStateConn is a net.Conn that can report the meek polling state,
+// so that a supervising component can detect and tear down stalled
+// sessions.
+type LinkStateConn interface {
+	net.Conn
+
+	// LinkState returns the current polling state.  It is safe to call
+	// concurrently with the other methods.
+	LinkState() LinkState
+}
+
 type meekConn struct {
 	args      *meekClientArgs
 	sessionID string
 	transport *http.Transport
 
+	stateLock sync.Mutex
+	state     LinkState
+	workerErr error
+
+	protoOnce sync.Once
+
 	closeOnce       sync.Once
 	workerWrChan    chan []byte
 	workerRdChan    chan []byte
@@ -139,8 +223,9 @@ func (c *meekConn) Read(p []byte) (int, error) {
 	// Wait for the worker to enqueue more incoming data.
 	b, ok := <-c.workerRdChan
 	if !ok {
-		// Close() was called and the worker's shutting down.
-		return 0, io.ErrClosedPipe
+		// Close() was called or a request failed, and the worker's
+		// shutting down.
+		return 0, c.closedErr()
 	}
 
 	// Ew, an extra copy, but who am I kidding, it's meek.
@@ -158,7 +243,7 @@ func (c *meekConn) Write(b []byte) (int, error) {
 	// Check to see if the connection is actually open.
 	select {
 	case <-c.workerCloseChan:
-		return 0, io.ErrClosedPipe
+		return 0, c.closedErr()
 	default:
 	}
 
@@ -173,7 +258,7 @@ func (c *meekConn) Write(b []byte) (int, error) {
 	if ok := c.enqueueWrite(b2); !ok {
 		// Technically we did enqueue data, but the worker's
 		// got closed out from under us.
-		return 0, io.ErrClosedPipe
+		return 0, c.closedErr()
 	}
 	runtime.Gosched()
 	return len(b), nil
@@ -211,6 +296,36 @@ func (c *meekConn) SetWriteDeadline(_ time.Time) error {
 	return ErrNotSupported
 }
 
+// LinkState returns the current polling state.
+func (c *meekConn) LinkState() LinkState {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	return c.state
+}
+
+// closedErr returns the error that shut down the worker, if any, or
+// io.ErrClosedPipe if it was shut down by Close.
+func (c *meekConn) closedErr() error {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	if c.workerErr != nil {
+		return c.workerErr
+	}
+	return io.ErrClosedPipe
+}
+
+func (c *meekConn) updateLinkState(interval time.Duration, active bool) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	c.state.PollInterval = interval
+	if active {
+		c.state.LastActivity = time.Now()
+	}
+}
+
 func (c *meekConn) enqueueWrite(b []byte) (ok bool) { //nolint:nonamedreturns
 	defer func() {
 		if err := recover(); err != nil {
@@ -234,43 +349,134 @@ func (c *meekConn) roundTrip(sndBuf []byte) ([]byte, error) {
 		url.Host = c.args.front
 	}
 	urlStr := url.String()
+	if c.args.amp {
+		if urlStr, err = makeAMPURL(url, c.sessionID, sndBuf); err != nil {
+			return nil, err
+		}
+	}
 
 	for retries := 0; retries < maxRetries; retries++ {
-		var body io.Reader
-		if len(sndBuf) > 0 {
-			body = bytes.NewReader(sndBuf)
+		if c.args.amp {
+			req, err = http.NewRequest(http.MethodGet, urlStr, nil)
+		} else {
+			var body io.Reader
+			if len(sndBuf) > 0 {
+				body = bytes.NewReader(sndBuf)
+			}
+			req, err = http.NewRequest(http.MethodPost, urlStr, body)
 		}
-		req, err = http.NewRequest(http.MethodPost, urlStr, body)
 		if err != nil {
 			return nil, err
 		}
 		if c.args.front != "" {
 			req.Host = host
 		}
-		req.Header.Set("X-Session-Id", c.sessionID)
+		if !c.args.amp {
+			req.Header.Set("X-Session-Id", c.sessionID)
+		}
 		req.Header.Set("User-Agent", "")
 
 		resp, err = c.transport.RoundTrip(req)
 		if err != nil {
+			if isBlockedError(err) {
+				err = fmt.Errorf("%w: %w", ErrFrontBlocked, err)
+			}
 			return nil, err
 		}
+		c.protoOnce.Do(func() {
+			log.Infof("%s(%s) - %s", transportName, log.ElideAddr(url.Host), describeProtocol(resp))
+		})
 
 		if resp.StatusCode == http.StatusOK {
 			var recvBuf []byte
-			recvBuf, err = io.ReadAll(io.LimitReader(resp.Body, maxPayloadLength))
+			if c.args.amp {
+				recvBuf, err = decodeAMPResponse(resp.Body)
+			} else {
+				recvBuf, err = io.ReadAll(io.LimitReader(resp.Body, maxPayloadLength))
+			}
 			resp.Body.Close()
 			return recvBuf, err
 		}
 
 		resp.Body.Close()
-		err = fmt.Errorf("status code was %d, not %d", resp.StatusCode, http.StatusOK)
-		time.Sleep(retryDelay)
+		err = fmt.Errorf("%w: status code was %d, not %d", ErrFrontResponse, resp.StatusCode, http.StatusOK)
+		if retries+1 < maxRetries {
+			time.Sleep(jitteredRetryDelay(c.args.retryDelay, retries))
+		}
 	}
 	return nil, err
 }
 
+// describeProtocol returns a description of the ALPN protocol negotiated
+// with the front, and the HTTP version used for resp, including why HTTP/2
+// was not used if that is the case.
+func describeProtocol(resp *http.Response) string {
+	alpn := "none"
+	if resp.TLS != nil && resp.TLS.NegotiatedProtocol != "" {
+		alpn = resp.TLS.NegotiatedProtocol
+	}
+	desc := fmt.Sprintf("negotiated ALPN %s, using %s", alpn, resp.Proto)
+	switch {
+	case resp.ProtoMajor >= 2:
+		return desc
+	case resp.TLS == nil:
+		return desc + " (plain HTTP)"
+	case resp.TLS.NegotiatedProtocol == "":
+		return desc + " (no ALPN protocol negotiated)"
+	default:
+		return desc + " (front selected " + resp.TLS.NegotiatedProtocol + ")"
+	}
+}
+
+// isBlockedError returns true iff err is a failure to reach the front at the
+// network level, as opposed to an error response from it.
+func isBlockedError(err error) bool {
+	var (
+		opErr     *net.OpError
+		recordErr tls.RecordHeaderError
+		certErr   *tls.CertificateVerificationError
+	)
+	switch {
+	case errors.As(err, &opErr), errors.As(err, &recordErr), errors.As(err, &certErr):
+		// Dial failures, resets, timeouts, and TLS alerts are all reported
+		// as net.OpErrors, the rest are TLS handshake failures.
+		return true
+	case errors.Is(err, ErrSPKIMismatch):
+		return true
+	}
+	for _, blockedErr := range []error{
+		io.EOF,
+		io.ErrUnexpectedEOF,
+		syscall.ECONNREFUSED,
+		syscall.ECONNRESET,
+	} {
+		if errors.Is(err, blockedErr) {
+			return true
+		}
+	}
+	return false
+}
+
+// jitteredRetryDelay returns the delay before the next retry, sampled
+// uniformly from [0, backoff), where the backoff is the base delay doubled
+// each retry, up to maxRetryDelay.
+func jitteredRetryDelay(base time.Duration, retries int) time.Duration {
+	backoff := base
+	for i := 0; i < retries && backoff < maxRetryDelay; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRetryDelay {
+		backoff = maxRetryDelay
+	}
+	return time.Duration(csrand.Float64() * float64(backoff))
+}
+
 func (c *meekConn) ioWorker() {
 	interval := initPollInterval
+	maxSndLength := maxPayloadLength
+	if c.args.amp {
+		maxSndLength = maxAMPPayloadLength
+	}
 	var sndBuf, leftBuf []byte
 
 loop:
@@ -291,19 +497,23 @@ loop:
 		// as the next request).
 		sndBuf = append(leftBuf, sndBuf...)
 		wrSz := len(sndBuf)
-		for len(c.workerWrChan) > 0 && wrSz < maxPayloadLength {
+		for len(c.workerWrChan) > 0 && wrSz < maxSndLength {
 			b := <-c.workerWrChan
 			sndBuf = append(sndBuf, b...)
 			wrSz = len(sndBuf)
 		}
-		if wrSz > maxPayloadLength {
-			wrSz = maxPayloadLength
+		if wrSz > maxSndLength {
+			wrSz = maxSndLength
 		}
 
 		// Issue a request.
 		rdBuf, err := c.roundTrip(sndBuf[:wrSz])
 		if err != nil {
-			// Welp, something went horrifically wrong.
+			// Welp, something went horrifically wrong.  Stash the error
+			// so that it is returned by Read() and Write().
+			c.stateLock.Lock()
+			c.workerErr = err
+			c.stateLock.Unlock()
 			break loop
 		}
 
@@ -334,6 +544,7 @@ loop:
 				interval = maxPollInterval
 			}
 		}
+		c.updateLinkState(interval, len(rdBuf) > 0 || wrSz > 0)
 
 		runtime.Gosched()
 	}
@@ -353,13 +564,24 @@ func newMeekConn(dialFn base.DialFunc, ca *meekClientArgs) (net.Conn, error) {
 		return nil, err
 	}
 
+	if ca.doh != nil {
+		dialFn = newDoHResolver(ca.doh, dialFn).dialFunc(dialFn)
+	}
+
 	conn := &meekConn{
 		args:            ca,
 		sessionID:       id,
-		transport:       &http.Transport{Dial: dialFn},
+		transport:       newMeekTransport(dialFn),
 		workerWrChan:    make(chan []byte, maxChanBacklog),
 		workerRdChan:    make(chan []byte, maxChanBacklog),
 		workerCloseChan: make(chan struct{}),
+		state: LinkState{
+			PollInterval: initPollInterval,
+			LastActivity: time.Now(),
+		},
+	}
+	if ca.expectSPKI != nil {
+		conn.transport.TLSClientConfig = ca.expectSPKI.tlsConfig()
 	}
 
 	// Start the I/O worker.
@@ -368,6 +590,19 @@ func newMeekConn(dialFn base.DialFunc, ca *meekClientArgs) (net.Conn, error) {
 	return conn, nil
 }
 
+// newMeekTransport returns the http.Transport used for a meek session.
+//
+// All outgoing connections are established via dialFn, for both plain HTTP
+// and HTTPS (TLS is layered on top of the returned net.Conn), so embedders
+// can run meek over any net.Conn source, such as an existing tunnel.  dialFn
+// is called with "tcp" and the "host:port" of the front (or url) host, may
+// be called concurrently, and may be called more than once per session, as
+// idle connections are closed and re-established.  HTTP/2 is not attempted,
+// as that requires the TLS handshake to be done by the transport.
+func newMeekTransport(dialFn base.DialFunc) *http.Transport {
+	return &http.Transport{Dial: dialFn}
+}
+
 func newSessionID() (string, error) {
 	var b [64]byte
 	if _, err := rand.Read(b[:]); err != nil {
@@ -378,6 +613,6 @@ func newSessionID() (string, error) {
 }
 
 var (
-	_ net.Conn = (*meekConn)(nil)
-	_ net.Addr = (*meekClientArgs)(nil)
+	_ LinkStateConn = (*meekConn)(nil)
+	_ net.Addr      = (*meekClientArgs)(nil)
 )
@@ -0,0 +1,404 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package meeklite
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	gourl "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+
+	"gitlab.com/yawning/obfs4.git/common/log"
+)
+
+func newTestClientArgs(t *testing.T, url string, extra map[string]string) *meekClientArgs {
+	args := &pt.Args{}
+	args.Add(urlArg, url)
+	for k, v := range extra {
+		args.Add(k, v)
+	}
+	ca, err := newClientArgs(args)
+	if err != nil {
+		t.Fatalf("newClientArgs() failed: %s", err)
+	}
+	return ca
+}
+
+func TestJitteredRetryDelay(t *testing.T) {
+	const base = 30 * time.Second
+
+	for retries := 0; retries < maxRetries; retries++ {
+		backoff := base << retries
+		if backoff > maxRetryDelay {
+			backoff = maxRetryDelay
+		}
+		for i := 0; i < 1000; i++ {
+			d := jitteredRetryDelay(base, retries)
+			if d < 0 || d >= backoff {
+				t.Fatalf("[%d]: delay %v out of range [0, %v)", retries, d, backoff)
+			}
+		}
+	}
+}
+
+func TestRetryDelayArg(t *testing.T) {
+	ca := newTestClientArgs(t, "https://example.com/", nil)
+	if ca.retryDelay != defaultRetryDelay {
+		t.Fatalf("default retry delay: got %v, expected %v", ca.retryDelay, defaultRetryDelay)
+	}
+	ca = newTestClientArgs(t, "https://example.com/", map[string]string{retryDelayArg: "5s"})
+	if ca.retryDelay != 5*time.Second {
+		t.Fatalf("retry delay: got %v, expected 5s", ca.retryDelay)
+	}
+
+	for _, v := range []string{"bogus", "0s", "-1s"} {
+		args := &pt.Args{}
+		args.Add(urlArg, "https://example.com/")
+		args.Add(retryDelayArg, v)
+		if _, err := newClientArgs(args); err == nil {
+			t.Fatalf("newClientArgs(%s=%s) succeeded", retryDelayArg, v)
+		}
+	}
+}
+
+func TestRoundTripRetries(t *testing.T) {
+	var nrRequests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		nrRequests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	ca := newTestClientArgs(t, srv.URL, map[string]string{retryDelayArg: "1ms"})
+	c := &meekConn{
+		args:      ca,
+		sessionID: "test",
+		transport: &http.Transport{Dial: net.Dial},
+	}
+	defer c.transport.CloseIdleConnections()
+
+	if _, err := c.roundTrip([]byte("hello")); !errors.Is(err, ErrFrontResponse) {
+		t.Fatalf("roundTrip() returned %v, expected ErrFrontResponse", err)
+	}
+	if n := nrRequests.Load(); n != maxRetries {
+		t.Fatalf("roundTrip() made %d requests, expected %d", n, maxRetries)
+	}
+}
+
+func TestLinkState(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	ca := newTestClientArgs(t, srv.URL, nil)
+	conn, err := newMeekConn(net.Dial, ca)
+	if err != nil {
+		t.Fatalf("newMeekConn() failed: %s", err)
+	}
+	defer conn.Close()
+	c := conn.(LinkStateConn) //nolint:forcetypeassert
+
+	waitFor := func(what string, fn func(LinkState) bool) LinkState {
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			if st := c.LinkState(); fn(st) {
+				return st
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("timed out waiting for %s", what)
+		return LinkState{}
+	}
+
+	// The poll interval should grow while the link is idle.
+	idle := waitFor("the poll interval to grow", func(st LinkState) bool {
+		return st.PollInterval > initPollInterval
+	})
+
+	// Sending data should reset the interval, and update the activity time.
+	if _, err = c.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write() failed: %s", err)
+	}
+	active := waitFor("activity", func(st LinkState) bool {
+		return st.LastActivity.After(idle.LastActivity)
+	})
+	if active.PollInterval > initPollInterval {
+		t.Fatalf("poll interval not reset after activity: %v", active.PollInterval)
+	}
+}
+
+func TestMeekTransportDialer(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	for _, v := range []struct {
+		name string
+		srv  *httptest.Server
+	}{
+		{"http", httptest.NewServer(handler)},
+		{"https", httptest.NewTLSServer(handler)},
+	} {
+		defer v.srv.Close()
+
+		var (
+			lock   sync.Mutex
+			dialed []string
+		)
+		dialFn := func(network, addr string) (net.Conn, error) {
+			lock.Lock()
+			dialed = append(dialed, addr)
+			lock.Unlock()
+			return net.Dial(network, addr)
+		}
+
+		// Use a front, so that the dialed address differs from the URL.
+		srvURL, _ := gourl.Parse(v.srv.URL)
+		ca := newTestClientArgs(t, v.srv.URL, map[string]string{frontArg: srvURL.Host})
+		ca.url.Host = "origin.example"
+
+		tr := newMeekTransport(dialFn)
+		if tlsTr, ok := v.srv.Client().Transport.(*http.Transport); ok {
+			tr.TLSClientConfig = tlsTr.TLSClientConfig
+		}
+		defer tr.CloseIdleConnections()
+		c := &meekConn{
+			args:      ca,
+			sessionID: "test",
+			transport: tr,
+		}
+
+		if _, err := c.roundTrip([]byte("hello")); err != nil {
+			t.Fatalf("%s: roundTrip() failed: %s", v.name, err)
+		}
+		lock.Lock()
+		if len(dialed) != 1 || dialed[0] != srvURL.Host {
+			t.Fatalf("%s: dialed %v, expected [%s]", v.name, dialed, srvURL.Host)
+		}
+		lock.Unlock()
+	}
+}
+
+func TestMeekProtocolLogging(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "meek.log")
+	if err := log.Init(true, logPath, false); err != nil {
+		t.Fatalf("log.Init() failed: %s", err)
+	}
+	defer func() {
+		_ = log.Init(false, "", false)
+	}()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	})
+	h1Srv := httptest.NewTLSServer(handler)
+	defer h1Srv.Close()
+	h2Srv := httptest.NewUnstartedServer(handler)
+	h2Srv.EnableHTTP2 = true
+	h2Srv.StartTLS()
+	defer h2Srv.Close()
+
+	for _, v := range []struct {
+		name      string
+		srv       *httptest.Server
+		nextProto []string
+		expected  string
+	}{
+		{"h1", h1Srv, nil, "negotiated ALPN none, using HTTP/1.1 (no ALPN protocol negotiated)"},
+		{"h1 ALPN", h1Srv, []string{"http/1.1"}, "negotiated ALPN http/1.1, using HTTP/1.1 (front selected http/1.1)"},
+		{"h2", h2Srv, nil, "negotiated ALPN none, using HTTP/1.1 (no ALPN protocol negotiated)"},
+	} {
+		tr := newMeekTransport(net.Dial)
+		tr.TLSClientConfig = v.srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone() //nolint:forcetypeassert
+		tr.TLSClientConfig.NextProtos = v.nextProto
+		c := &meekConn{
+			args:      newTestClientArgs(t, v.srv.URL, nil),
+			sessionID: "test",
+			transport: tr,
+		}
+
+		// Only the first response is logged.
+		for i := 0; i < 2; i++ {
+			if _, err := c.roundTrip([]byte("hello")); err != nil {
+				t.Fatalf("%s: roundTrip() failed: %s", v.name, err)
+			}
+		}
+		tr.CloseIdleConnections()
+
+		b, err := os.ReadFile(logPath)
+		if err != nil {
+			t.Fatalf("ReadFile() failed: %s", err)
+		}
+		if n := strings.Count(string(b), v.expected); n != 1 {
+			t.Fatalf("%s: protocol logged %d times: %q", v.name, n, b)
+		}
+		if strings.Contains(string(b), c.args.url.Host) {
+			t.Fatalf("%s: front address not scrubbed: %q", v.name, b)
+		}
+		if err = os.Truncate(logPath, 0); err != nil {
+			t.Fatalf("Truncate() failed: %s", err)
+		}
+	}
+
+	// The transport never attempts HTTP/2 itself, but a front that
+	// negotiated it is reported as such.
+	resp := &http.Response{
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		TLS:        &tls.ConnectionState{NegotiatedProtocol: "h2"},
+	}
+	if desc := describeProtocol(resp); desc != "negotiated ALPN h2, using HTTP/2.0" {
+		t.Fatalf("describeProtocol(h2): %q", desc)
+	}
+}
+
+func TestFrontErrors(t *testing.T) {
+	okSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer okSrv.Close()
+	errSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer errSrv.Close()
+	rootCAs := okSrv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs //nolint:forcetypeassert
+
+	// A port that nothing is listening on.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() failed: %s", err)
+	}
+	refusedAddr := ln.Addr().String()
+	ln.Close()
+
+	// A listener that resets every connection, and one that speaks
+	// plaintext instead of TLS.
+	newListener := func(handler func(net.Conn)) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("net.Listen() failed: %s", err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go handler(conn)
+			}
+		}()
+		return ln.Addr().String()
+	}
+	resetAddr := newListener(func(conn net.Conn) {
+		_ = conn.(*net.TCPConn).SetLinger(0) //nolint:forcetypeassert
+		conn.Close()
+	})
+	plainAddr := newListener(func(conn net.Conn) {
+		defer conn.Close()
+		_, _ = io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\n\r\n")
+	})
+
+	otherDigest := sha256.Sum256([]byte("some other key"))
+	for _, v := range []struct {
+		name     string
+		url      string
+		roots    bool
+		pins     spkiPins
+		expected error
+	}{
+		{"ok", okSrv.URL, true, nil, nil},
+		{"refused", "https://" + refusedAddr, true, nil, ErrFrontBlocked},
+		{"reset", "https://" + resetAddr, true, nil, ErrFrontBlocked},
+		{"not TLS", "https://" + plainAddr, true, nil, ErrFrontBlocked},
+		{"untrusted certificate", okSrv.URL, false, nil, ErrFrontBlocked},
+		{"SPKI mismatch", okSrv.URL, true, spkiPins{otherDigest}, ErrFrontBlocked},
+		{"error status", errSrv.URL, true, nil, ErrFrontResponse},
+	} {
+		ca := newTestClientArgs(t, v.url, map[string]string{retryDelayArg: "1ms"})
+		tr := newMeekTransport(net.Dial)
+		tr.TLSClientConfig = &tls.Config{} //nolint:gosec
+		if v.pins != nil {
+			tr.TLSClientConfig = v.pins.tlsConfig()
+		}
+		if v.roots {
+			tr.TLSClientConfig.RootCAs = rootCAs
+		}
+		c := &meekConn{
+			args:      ca,
+			sessionID: "test",
+			transport: tr,
+		}
+
+		_, err := c.roundTrip([]byte("hello"))
+		tr.CloseIdleConnections()
+		switch {
+		case v.expected == nil:
+			if err != nil {
+				t.Fatalf("%s: roundTrip() failed: %s", v.name, err)
+			}
+		case !errors.Is(err, v.expected):
+			t.Fatalf("%s: roundTrip() returned %v, expected %v", v.name, err, v.expected)
+		}
+		if v.expected == ErrFrontResponse && errors.Is(err, ErrFrontBlocked) {
+			t.Fatalf("%s: error response reported as blocked", v.name)
+		}
+	}
+
+	// The error that shut down the connection is returned by Read and
+	// Write, instead of a generic one.
+	conn, err := newMeekConn(net.Dial, newTestClientArgs(t, "https://"+refusedAddr, nil))
+	if err != nil {
+		t.Fatalf("newMeekConn() failed: %s", err)
+	}
+	defer conn.Close()
+	if _, err = conn.Read(make([]byte, 16)); !errors.Is(err, ErrFrontBlocked) {
+		t.Fatalf("Read() returned %v, expected ErrFrontBlocked", err)
+	}
+	if _, err = conn.Write([]byte("hello")); !errors.Is(err, ErrFrontBlocked) {
+		t.Fatalf("Write() returned %v, expected ErrFrontBlocked", err)
+	}
+}
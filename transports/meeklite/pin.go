@@ -0,0 +1,132 @@
+/*
+ * Copyright (c) 2015, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package meeklite
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gitlab.com/yawning/obfs4.git/common/log"
+)
+
+// Public key pinning for custom fronts.
+//
+// A front that intercepts TLS (or a censor with a mis-issued certificate)
+// can complete the handshake with a certificate that chains to a trusted
+// root, which is not detected by the normal certificate verification.  The
+// optional "expect-spki" argument is a comma separated list of Base64
+// encoded SHA-256 digests of acceptable SubjectPublicKeyInfos (the HPKP
+// "pin-sha256" format), at least one of which must appear in the verified
+// chain.
+//
+// Unlike the static pin database that used to be compiled in for the
+// default bridges, the pins are supplied per bridge line, and apply to
+// whatever host is being connected to.  The normal verification is still
+// performed, so the pins only ever narrow the set of accepted certificates.
+
+const expectSPKIArg = "expect-spki"
+
+// ErrSPKIMismatch is the error returned when the peer's certificate chain
+// does not contain any of the expected public keys.
+var ErrSPKIMismatch = errors.New("meek_lite: no expected SPKI in certificate chain")
+
+type spkiPins [][sha256.Size]byte
+
+func parseSPKIPins(str string) (spkiPins, error) {
+	var pins spkiPins
+	for _, s := range strings.Split(str, ",") {
+		b, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid %s: '%s'", expectSPKIArg, s)
+		}
+		var pin [sha256.Size]byte
+		copy(pin[:], b)
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+func (pins spkiPins) contains(cert *x509.Certificate) bool {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	for _, pin := range pins {
+		if pin == digest {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyPeerCertificate is a tls.Config VerifyPeerCertificate callback that
+// requires at least one certificate in a verified chain to match a pin.
+func (pins spkiPins) verifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			if pins.contains(cert) {
+				return nil
+			}
+		}
+	}
+
+	// The certificates are public, so it is safe to log the digests of the
+	// ones the peer presented, which lets operators tell a legitimate key
+	// rotation by the CDN apart from interception, and update the pins.
+	if log.Level() >= log.LevelDebug {
+		log.Debugf("%s - no expected SPKI in certificate chain, observed: %s", transportName, strings.Join(spkiDigests(rawCerts), ","))
+	}
+
+	return ErrSPKIMismatch
+}
+
+// spkiDigests returns the pin formatted SPKI digests of the certificates,
+// in the order presented by the peer (leaf first).
+func spkiDigests(rawCerts [][]byte) []string {
+	digests := make([]string, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			digests = append(digests, "[unparsable]")
+			continue
+		}
+		digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		digests = append(digests, base64.StdEncoding.EncodeToString(digest[:]))
+	}
+	return digests
+}
+
+// tlsConfig returns a tls.Config that enforces the pins, suitable for use
+// as the meek http.Transport's TLSClientConfig.
+func (pins spkiPins) tlsConfig() *tls.Config {
+	return &tls.Config{
+		VerifyPeerCertificate: pins.verifyPeerCertificate,
+	}
+}
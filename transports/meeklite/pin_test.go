@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package meeklite
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.com/yawning/obfs4.git/common/log"
+)
+
+func TestParseSPKIPins(t *testing.T) {
+	digest := sha256.Sum256([]byte("test"))
+	padded := base64.StdEncoding.EncodeToString(digest[:])
+	unpadded := base64.RawStdEncoding.EncodeToString(digest[:])
+
+	for _, v := range []struct {
+		str    string
+		nrPins int
+	}{
+		{padded, 1},
+		{unpadded, 1},
+		{padded + "," + unpadded, 2},
+		{"", 0},
+		{padded + ",", 0},
+		{"not-base64!", 0},
+		{base64.StdEncoding.EncodeToString(digest[:16]), 0},
+	} {
+		pins, err := parseSPKIPins(v.str)
+		if v.nrPins == 0 {
+			if err == nil {
+				t.Fatalf("parseSPKIPins(%q) succeeded", v.str)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("parseSPKIPins(%q) failed: %s", v.str, err)
+		}
+		if len(pins) != v.nrPins || pins[0] != digest {
+			t.Fatalf("parseSPKIPins(%q) returned %v", v.str, pins)
+		}
+	}
+
+	ca := newTestClientArgs(t, "https://example.com/", map[string]string{expectSPKIArg: unpadded})
+	if len(ca.expectSPKI) != 1 || ca.expectSPKI[0] != digest {
+		t.Fatalf("newClientArgs() returned pins %v", ca.expectSPKI)
+	}
+}
+
+func TestExpectSPKI(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+
+	srvDigest := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	otherDigest := sha256.Sum256([]byte("some other key"))
+	encode := func(digests ...[sha256.Size]byte) string {
+		var strs []string
+		for _, d := range digests {
+			strs = append(strs, base64.StdEncoding.EncodeToString(d[:]))
+		}
+		return strings.Join(strs, ",")
+	}
+
+	for _, v := range []struct {
+		name    string
+		pins    string
+		matches bool
+	}{
+		{"match", encode(srvDigest), true},
+		{"match-any", encode(otherDigest, srvDigest), true},
+		{"mismatch", encode(otherDigest), false},
+	} {
+		pins, err := parseSPKIPins(v.pins)
+		if err != nil {
+			t.Fatalf("%s: parseSPKIPins() failed: %s", v.name, err)
+		}
+
+		// Trust the test server's certificate, so that only the pins
+		// determine the outcome.
+		tr := newMeekTransport(net.Dial)
+		tr.TLSClientConfig = pins.tlsConfig()
+		tr.TLSClientConfig.RootCAs = srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+		client := &http.Client{Transport: tr}
+
+		resp, err := client.Get(srv.URL)
+		if v.matches {
+			if err != nil {
+				t.Fatalf("%s: Get() failed: %s", v.name, err)
+			}
+			resp.Body.Close()
+		} else if !errors.Is(err, ErrSPKIMismatch) {
+			t.Fatalf("%s: Get() returned %v, expected ErrSPKIMismatch", v.name, err)
+		}
+		tr.CloseIdleConnections()
+	}
+}
+
+func TestExpectSPKIMismatchLogging(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	srvDigest := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	srvPin := base64.StdEncoding.EncodeToString(srvDigest[:])
+	otherDigest := sha256.Sum256([]byte("some other key"))
+	pins := spkiPins{otherDigest}
+
+	logPath := filepath.Join(t.TempDir(), "meek.log")
+	if err := log.Init(true, logPath, false); err != nil {
+		t.Fatalf("log.Init() failed: %s", err)
+	}
+	defer func() {
+		_ = log.Init(false, "", false)
+		_ = log.SetLogLevel("INFO")
+	}()
+
+	for _, level := range []string{"INFO", "DEBUG"} {
+		if err := log.SetLogLevel(level); err != nil {
+			t.Fatalf("log.SetLogLevel() failed: %s", err)
+		}
+		err := pins.verifyPeerCertificate([][]byte{srv.Certificate().Raw}, [][]*x509.Certificate{{srv.Certificate()}})
+		if !errors.Is(err, ErrSPKIMismatch) {
+			t.Fatalf("%s: verifyPeerCertificate() returned %v", level, err)
+		}
+
+		b, err := os.ReadFile(logPath)
+		if err != nil {
+			t.Fatalf("ReadFile() failed: %s", err)
+		}
+		logged := strings.Contains(string(b), "observed: "+srvPin)
+		if logged != (level == "DEBUG") {
+			t.Fatalf("%s: observed SPKI logged: %v (%q)", level, logged, b)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package obfs4
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"gitlab.com/yawning/obfs4.git/transports/obfs4/framing"
+)
+
+// closeDelaySlice is the longest a close delay pool worker spends draining
+// a single connection before moving on to the next one.
+const closeDelaySlice = 10 * time.Millisecond
+
+// delayedConn is a failed connection held open by a closeDelayPool.
+type delayedConn struct {
+	conn     net.Conn
+	deadline time.Time
+	onClose  func()
+}
+
+// closeDelayPool drains and closes failed connections after their close
+// delay with a fixed number of worker goroutines, instead of holding a
+// goroutine per connection for the entire delay.  Each worker repeatedly
+// takes the connection at the head of the queue, discards what was received
+// on it for up to closeDelaySlice, and either closes it if the delay has
+// passed (or the peer hung up), or puts it back at the tail of the queue.
+//
+// Data is only consumed while a worker is servicing a connection, and each
+// connection is closed once a worker gets to it after the delay, so with
+// many connections queued per worker, the teardown timing is less precise
+// than with closeAfterDelay.
+//
+// Workers are started as connections are queued, and exit once the queue is
+// empty, so an idle pool holds no goroutines, and does not need to be shut
+// down with the server factory.
+type closeDelayPool struct {
+	sync.Mutex
+	queue      []*delayedConn
+	workers    int
+	maxWorkers int
+}
+
+func newCloseDelayPool(maxWorkers int) *closeDelayPool {
+	return &closeDelayPool{maxWorkers: maxWorkers}
+}
+
+// add queues conn to be closed at startTime + delay, after which onClose is
+// called.
+func (p *closeDelayPool) add(conn *obfs4Conn, delay time.Duration, startTime time.Time, onClose func()) {
+	dc := &delayedConn{
+		conn:     conn.rawConn(),
+		deadline: startTime.Add(delay),
+		onClose:  onClose,
+	}
+	if !time.Now().Before(dc.deadline) {
+		dc.close()
+		return
+	}
+	p.push(dc)
+}
+
+func (p *closeDelayPool) push(dc *delayedConn) {
+	p.Lock()
+	defer p.Unlock()
+	p.queue = append(p.queue, dc)
+	if p.workers < p.maxWorkers {
+		p.workers++
+		go p.worker()
+	}
+}
+
+// pop returns the connection at the head of the queue, or nil if the queue
+// is empty, in which case the calling worker MUST exit.
+func (p *closeDelayPool) pop() *delayedConn {
+	p.Lock()
+	defer p.Unlock()
+	if len(p.queue) == 0 {
+		p.workers--
+		return nil
+	}
+	dc := p.queue[0]
+	p.queue[0] = nil
+	p.queue = p.queue[1:]
+	return dc
+}
+
+func (p *closeDelayPool) worker() {
+	buf := make([]byte, framing.MaximumSegmentLength)
+	for {
+		dc := p.pop()
+		if dc == nil {
+			return
+		}
+		if dc.drain(buf) {
+			p.push(dc)
+		} else {
+			dc.close()
+		}
+	}
+}
+
+// drain discards the data received on the connection for up to
+// closeDelaySlice, and returns true iff the connection should remain open.
+func (dc *delayedConn) drain(buf []byte) bool {
+	deadline := time.Now().Add(closeDelaySlice)
+	if deadline.After(dc.deadline) {
+		deadline = dc.deadline
+	}
+	if err := dc.conn.SetReadDeadline(deadline); err != nil {
+		return false
+	}
+	for {
+		if _, err := dc.conn.Read(buf); err != nil {
+			return errors.Is(err, os.ErrDeadlineExceeded) && time.Now().Before(dc.deadline)
+		}
+	}
+}
+
+func (dc *delayedConn) close() {
+	dc.conn.Close()
+	dc.onClose()
+}
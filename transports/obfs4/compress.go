@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package obfs4
+
+// Payload compression.
+//
+// When enabled via the "compress=true" server argument (which is included in
+// the bridge line) and negotiated via protocolVersionCompression, the payload
+// of each Write is DEFLATE compressed before it is packetized.  Clients that
+// do not support compression ignore the argument and are unaffected.  The plaintext is
+// compressed in independent chunks of at most compressChunkLength bytes,
+// each of which is sent as a record:
+//
+//	uint16_t length   Length of the data (Big Endian), with the high bit set
+//	                  if the data is stored uncompressed.
+//	uint8_t[] data    Raw DEFLATE (RFC 1951) compressed data, or the chunk
+//	                  as is, if it does not compress.
+//
+// Records are carried by packetTypeCompressedPayload packets, and may span
+// several of them.
+//
+// WARNING: Compressing data before encrypting it leaks information about the
+// plaintext via the length of the ciphertext.  If the tunneled traffic mixes
+// attacker controlled data with secrets (eg: HTTP requests with cookies, where
+// the attacker can cause requests to be made), the secrets can be recovered
+// by observing how the length changes with the attacker controlled data
+// (CRIME/BREACH).  The length obfuscation does not reliably hide this.  Only
+// enable compression for traffic where this is known to be safe.
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	compressedHeaderLength = 2
+	compressedStoredFlag   = 0x8000
+
+	// compressChunkLength is the maximum amount of plaintext compressed into
+	// a single record, and thus is also the maximum amount that a record may
+	// decompress to.
+	compressChunkLength = 16384
+)
+
+// ErrInvalidCompressedPayload is the error returned when a compressed record
+// fails to decompress, or decompresses to more than compressChunkLength bytes.
+var ErrInvalidCompressedPayload = errors.New("packet: Invalid compressed payload")
+
+// makeCompressedPackets compresses b, and chops the resulting records into
+// packets.
+func (conn *obfs4Conn) makeCompressedPackets(w *bytes.Buffer, b []byte) error {
+	var record bytes.Buffer
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > compressChunkLength {
+			chunk = chunk[:compressChunkLength]
+		}
+		b = b[len(chunk):]
+
+		record.Reset()
+		record.Write([]byte{0, 0})
+		if conn.compressor == nil {
+			var err error
+			if conn.compressor, err = flate.NewWriter(&record, flate.BestSpeed); err != nil {
+				return err
+			}
+		} else {
+			conn.compressor.Reset(&record)
+		}
+		if _, err := conn.compressor.Write(chunk); err != nil {
+			return err
+		}
+		if err := conn.compressor.Close(); err != nil {
+			return err
+		}
+
+		recLen := record.Len() - compressedHeaderLength
+		if recLen >= len(chunk) {
+			// Incompressible, so store the chunk as is.
+			record.Truncate(compressedHeaderLength)
+			record.Write(chunk)
+			recLen = len(chunk) | compressedStoredFlag
+		}
+		binary.BigEndian.PutUint16(record.Bytes(), uint16(recLen))
+		if err := conn.makePackets(w, packetTypeCompressedPayload, record.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// inflateRecords decompresses the complete records in the compressed receive
+// buffer, into the decoded receive buffer.  To bound the amount of memory
+// that a peer can cause to be used by sending highly compressible data, this
+// stops once there is at least compressChunkLength bytes of decoded data
+// buffered, though at least one record is always decompressed so that
+// callers waiting for more data make progress.  It returns true iff any
+// records were decompressed.
+func (conn *obfs4Conn) inflateRecords() (bool, error) {
+	var inflated bool
+	for conn.compressedBuffer.Len() >= compressedHeaderLength {
+		if inflated && conn.receiveDecodedBuffer.Len() >= compressChunkLength {
+			break
+		}
+		hdr := int(binary.BigEndian.Uint16(conn.compressedBuffer.Bytes()))
+		recLen := hdr &^ compressedStoredFlag
+		if recLen > compressChunkLength {
+			return inflated, ErrInvalidCompressedPayload
+		}
+		if conn.compressedBuffer.Len() < compressedHeaderLength+recLen {
+			break
+		}
+		_ = conn.compressedBuffer.Next(compressedHeaderLength)
+		record := conn.compressedBuffer.Next(recLen)
+		if hdr&compressedStoredFlag != 0 {
+			conn.receiveDecodedBuffer.Write(record)
+		} else if err := conn.inflateRecord(record); err != nil {
+			return inflated, err
+		}
+		inflated = true
+	}
+
+	return inflated, nil
+}
+
+func (conn *obfs4Conn) inflateRecord(record []byte) error {
+	src := bytes.NewReader(record)
+	if conn.decompressor == nil {
+		conn.decompressor = flate.NewReader(src)
+	} else if err := conn.decompressor.(flate.Resetter).Reset(src, nil); err != nil { //nolint:forcetypeassert
+		return err
+	}
+
+	// io.CopyN returns io.EOF iff the record ended cleanly before the limit.
+	_, err := io.CopyN(conn.receiveDecodedBuffer, conn.decompressor, compressChunkLength+1)
+	if !errors.Is(err, io.EOF) {
+		return ErrInvalidCompressedPayload
+	}
+
+	return nil
+}
@@ -0,0 +1,202 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package obfs4
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+
+	"gitlab.com/yawning/obfs4.git/common/ntor"
+	"gitlab.com/yawning/obfs4.git/common/replayfilter"
+)
+
+func TestCompressDisabledByDefault(t *testing.T) {
+	client, server := newTestConnPair(t, iatNone, nil)
+	if client.compress || server.compress {
+		t.Fatalf("compression enabled by default")
+	}
+	if client.version != protocolVersion1 || server.version != protocolVersion1 {
+		t.Fatalf("negotiated version %d/%d, expected %d", client.version, server.version, protocolVersion1)
+	}
+}
+
+func TestCompressNegotiation(t *testing.T) {
+	nodeID, _ := ntor.NewNodeID([]byte("\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10\x11\x12\x13"))
+	idKeypair, _ := ntor.NewKeypair(false)
+	serverFilter, _ := replayfilter.New(epochReplayTTL(defaultEpochTolerance, defaultEpochPeriod))
+
+	for _, v := range []struct {
+		client, server, expected bool
+	}{
+		{false, false, false},
+		{true, false, false},
+		{false, true, false},
+		{true, true, true},
+	} {
+		clientKeypair, _ := ntor.NewKeypair(true)
+		serverKeypair, _ := ntor.NewKeypair(true)
+
+		clientHs := newClientHandshake(nodeID, idKeypair.Public(), clientKeypair)
+		if v.client {
+			clientHs.setCompression()
+		}
+		clientBlob, err := clientHs.generateHandshake()
+		if err != nil {
+			t.Fatalf("[%v:%v] clientHandshake.generateHandshake() failed: %s", v.client, v.server, err)
+		}
+
+		serverHs := newServerHandshake(nodeID, idKeypair, serverKeypair)
+		if v.server {
+			serverHs.setCompression()
+		}
+		if _, err = serverHs.parseClientHandshake(serverFilter, clientBlob); err != nil {
+			t.Fatalf("[%v:%v] serverHandshake.parseClientHandshake() failed: %s", v.client, v.server, err)
+		}
+		serverBlob, err := serverHs.generateHandshake()
+		if err != nil {
+			t.Fatalf("[%v:%v] serverHandshake.generateHandshake() failed: %s", v.client, v.server, err)
+		}
+		if _, _, err = clientHs.parseServerHandshake(serverBlob); err != nil {
+			t.Fatalf("[%v:%v] clientHandshake.parseServerHandshake() failed: %s", v.client, v.server, err)
+		}
+
+		if (clientHs.version >= protocolVersionCompression) != v.expected || clientHs.version != serverHs.version {
+			t.Fatalf("[%v:%v] negotiated version %d/%d", v.client, v.server, clientHs.version, serverHs.version)
+		}
+	}
+}
+
+func TestObfs4Conn_Compress(t *testing.T) {
+	serverArgs := &pt.Args{}
+	serverArgs.Add(compressArg, "true")
+
+	compressible := bytes.Repeat([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), 2048)
+	incompressible := make([]byte, 3*compressChunkLength/2)
+	_, _ = rand.Read(incompressible)
+
+	for _, iatMode := range []int{iatNone, iatEnabled} {
+		client, server := newTestConnPair(t, iatMode, serverArgs)
+		if !client.compress || !server.compress {
+			t.Fatalf("[%d]: compression not negotiated", iatMode)
+		}
+
+		msgs := [][]byte{compressible, incompressible, []byte("hello")}
+		errCh := make(chan error, 1)
+		go func() {
+			for _, msg := range msgs {
+				if _, err := client.Write(msg); err != nil {
+					errCh <- err
+					return
+				}
+			}
+			errCh <- nil
+		}()
+		for _, msg := range msgs {
+			received := make([]byte, len(msg))
+			if _, err := io.ReadFull(server, received); err != nil {
+				t.Fatalf("[%d]: Read() failed: %s", iatMode, err)
+			}
+			if !bytes.Equal(msg, received) {
+				t.Fatalf("[%d]: payload mismatch", iatMode)
+			}
+		}
+
+		// Consume the trailing padding, if any.
+		go func() {
+			_, _ = io.Copy(io.Discard, server)
+		}()
+		if err := <-errCh; err != nil {
+			t.Fatalf("[%d]: Write() failed: %s", iatMode, err)
+		}
+	}
+
+	// Compressible data is actually compressed.
+	client, _ := newTestConnPair(t, iatNone, serverArgs)
+	var frameBuf bytes.Buffer
+	if err := client.makeCompressedPackets(&frameBuf, compressible); err != nil {
+		t.Fatalf("makeCompressedPackets() failed: %s", err)
+	}
+	if frameBuf.Len() > len(compressible)/10 {
+		t.Fatalf("%d bytes compressed to %d bytes", len(compressible), frameBuf.Len())
+	}
+}
+
+func TestInflateRecords_Invalid(t *testing.T) {
+	client, _ := newTestConnPair(t, iatNone, nil)
+	client.compress = true
+
+	var bomb bytes.Buffer
+	fw, _ := flate.NewWriter(&bomb, flate.BestCompression)
+	_, _ = fw.Write(make([]byte, compressChunkLength+1))
+	_ = fw.Close()
+
+	for _, record := range [][]byte{
+		bomb.Bytes(),                        // Decompresses to too much data.
+		{0xff, 0xff, 0xff},                  // Not DEFLATE.
+		make([]byte, compressChunkLength+1), // Too long.
+	} {
+		client.compressedBuffer.Reset()
+		client.receiveDecodedBuffer.Reset()
+		var hdr [compressedHeaderLength]byte
+		binary.BigEndian.PutUint16(hdr[:], uint16(len(record)))
+		client.compressedBuffer.Write(hdr[:])
+		client.compressedBuffer.Write(record)
+		if _, err := client.inflateRecords(); !errors.Is(err, ErrInvalidCompressedPayload) {
+			t.Fatalf("inflateRecords() returned %v, expected ErrInvalidCompressedPayload", err)
+		}
+	}
+}
+
+func TestObfs4Conn_CompressMessageMode(t *testing.T) {
+	serverArgs := &pt.Args{}
+	serverArgs.Add(compressArg, "true")
+	serverArgs.Add(messageArg, "1")
+	client, server := newTestConnPair(t, iatNone, serverArgs)
+	client.messageMode = true
+
+	// Messages larger than the amount decompressed at once are returned
+	// whole.
+	msg := bytes.Repeat([]byte("compress me "), 4*compressChunkLength)
+	go func() {
+		_, _ = client.Write(msg)
+	}()
+	received, err := server.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage() failed: %s", err)
+	}
+	if !bytes.Equal(msg, received) {
+		t.Fatalf("message mismatch")
+	}
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package obfs4_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+
+	"gitlab.com/yawning/obfs4.git/common/drbg"
+	"gitlab.com/yawning/obfs4.git/common/ntor"
+	"gitlab.com/yawning/obfs4.git/transports/base"
+	"gitlab.com/yawning/obfs4.git/transports/obfs4"
+)
+
+// This example uses obfs4 as a library, without the pluggable transport
+// environment or a state directory.
+func ExampleNewServerFactory() {
+	// Generate the server's long term state.  A real server would persist
+	// this, so that the clients can continue to connect.
+	identityKey, err := ntor.NewKeypair(false)
+	if err != nil {
+		panic(err)
+	}
+	nodeID := ntor.NodeIDFromPublicKey(identityKey.Public())
+	seed, err := drbg.NewSeed()
+	if err != nil {
+		panic(err)
+	}
+
+	sf, err := obfs4.NewServerFactory(&obfs4.ServerConfig{
+		NodeID:      nodeID,
+		IdentityKey: identityKey,
+		DrbgSeed:    seed,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	// Run an echo server.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		remote, err := sf.WrapConn(conn)
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(remote, remote)
+	}()
+
+	// The client is configured with the server's arguments (the bridge line).
+	cf, err := new(obfs4.Transport).ClientFactory("")
+	if err != nil {
+		panic(err)
+	}
+	args, err := cf.ParseArgs(sf.Args())
+	if err != nil {
+		panic(err)
+	}
+	conn, err := cf.Dial("tcp", ln.Addr().String(), net.Dial, args)
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		panic(err)
+	}
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		panic(err)
+	}
+	fmt.Println(string(buf))
+	// Output: hello
+}
+
+// This example customizes the outgoing TCP connection, eg: to bind a
+// specific source address or port, or to set socket options before the
+// connect.  The client factory dials via the supplied base.DialFunc, so a
+// net.Dialer's Dial method is all that is needed.
+func Example_dialer() {
+	sf, ln := newExampleEchoServer()
+	defer ln.Close()
+
+	cf, err := new(obfs4.Transport).ClientFactory("")
+	if err != nil {
+		panic(err)
+	}
+	args, err := cf.ParseArgs(sf.Args())
+	if err != nil {
+		panic(err)
+	}
+
+	var sawSocket bool
+	dialer := &net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		Control: func(_, _ string, c syscall.RawConn) error {
+			// Socket options (eg: SO_REUSEADDR) would be set here.
+			return c.Control(func(fd uintptr) {
+				sawSocket = fd != 0
+			})
+		},
+	}
+	conn, err := cf.Dial("tcp", ln.Addr().String(), dialer.Dial, args)
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+	fmt.Println(sawSocket)
+	// Output: true
+}
+
+// newExampleEchoServer returns an obfs4 server factory with fresh state, and
+// a listener that echoes the first connection made to it.
+func newExampleEchoServer() (base.ServerFactory, net.Listener) {
+	identityKey, err := ntor.NewKeypair(false)
+	if err != nil {
+		panic(err)
+	}
+	seed, err := drbg.NewSeed()
+	if err != nil {
+		panic(err)
+	}
+	sf, err := obfs4.NewServerFactory(&obfs4.ServerConfig{
+		NodeID:      ntor.NodeIDFromPublicKey(identityKey.Public()),
+		IdentityKey: identityKey,
+		DrbgSeed:    seed,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		remote, err := sf.WrapConn(conn)
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(remote, remote)
+	}()
+	return sf, ln
+}
@@ -72,6 +72,7 @@ import (
 
 	"gitlab.com/yawning/obfs4.git/common/csrand"
 	"gitlab.com/yawning/obfs4.git/common/drbg"
+	"gitlab.com/yawning/obfs4.git/common/ntor"
 )
 
 const (
@@ -86,11 +87,20 @@ const (
 	// per frame.
 	MaximumFramePayloadLength = MaximumSegmentLength - FrameOverhead
 
+	// MaximumBulkSegmentLength is the length of the largest possible segment
+	// including overhead, when bulk mode is enabled.
+	MaximumBulkSegmentLength = 16384
+
+	// MaximumBulkFramePayloadLength is the length of the maximum allowed
+	// payload per frame, when bulk mode is enabled.
+	MaximumBulkFramePayloadLength = MaximumBulkSegmentLength - FrameOverhead
+
 	// KeyLength is the length of the Encoder/Decoder secret key.
 	KeyLength = keyLength + noncePrefixLength + drbg.SeedLength
 
-	maxFrameLength = MaximumSegmentLength - lengthLength
-	minFrameLength = FrameOverhead - lengthLength
+	maxFrameLength     = MaximumSegmentLength - lengthLength
+	maxBulkFrameLength = MaximumBulkSegmentLength - lengthLength
+	minFrameLength     = FrameOverhead - lengthLength
 
 	keyLength = 32
 
@@ -153,6 +163,8 @@ type Encoder struct {
 	key   [keyLength]byte
 	nonce boxNonce
 	drbg  *drbg.HashDrbg
+
+	maxPayloadLength int
 }
 
 // NewEncoder creates a new Encoder instance.  It must be supplied a slice
@@ -170,16 +182,25 @@ func NewEncoder(key []byte) *Encoder {
 		panic(fmt.Sprintf("BUG: Failed to initialize DRBG: %s", err))
 	}
 	encoder.drbg, _ = drbg.NewHashDrbg(seed)
+	encoder.maxPayloadLength = MaximumFramePayloadLength
 
 	return encoder
 }
 
+// EnableBulk raises the maximum payload length per frame to
+// MaximumBulkFramePayloadLength, reducing the per-byte overhead at the cost
+// of making the traffic more distinctive.  The peer's Decoder MUST also have
+// bulk mode enabled.
+func (encoder *Encoder) EnableBulk() {
+	encoder.maxPayloadLength = MaximumBulkFramePayloadLength
+}
+
 // Encode encodes a single frame worth of payload and returns the encoded
 // length.  InvalidPayloadLengthError is recoverable, all other errors MUST be
 // treated as fatal and the session aborted.
 func (encoder *Encoder) Encode(frame, payload []byte) (int, error) {
 	payloadLen := len(payload)
-	if MaximumFramePayloadLength < payloadLen {
+	if encoder.maxPayloadLength < payloadLen {
 		return 0, InvalidPayloadLengthError(payloadLen)
 	}
 	if len(frame) < payloadLen+FrameOverhead {
@@ -212,9 +233,17 @@ type Decoder struct {
 	nonce boxNonce
 	drbg  *drbg.HashDrbg
 
+	// The state of the frame being decoded, which persists across calls to
+	// Decode that return ErrAgain.  nextLength is 0 until the frame's length
+	// field has been read, at which point the length mask has been consumed
+	// and nextNonce derived.  The nonce counter is only advanced once the
+	// frame has been decoded, so the nonce of a partially received frame is
+	// never skipped.
 	nextNonce         [nonceLength]byte
 	nextLength        uint16
 	nextLengthInvalid bool
+
+	maxFrameLength uint16
 }
 
 // NewDecoder creates a new Decoder instance.  It must be supplied a slice
@@ -232,13 +261,38 @@ func NewDecoder(key []byte) *Decoder {
 		panic(fmt.Sprintf("BUG: Failed to initialize DRBG: %s", err))
 	}
 	decoder.drbg, _ = drbg.NewHashDrbg(seed)
+	decoder.maxFrameLength = maxFrameLength
 
 	return decoder
 }
 
+// EnableBulk allows frames with up to MaximumBulkFramePayloadLength bytes of
+// payload to be decoded.
+func (decoder *Decoder) EnableBulk() {
+	decoder.maxFrameLength = maxBulkFrameLength
+}
+
+// NewDecoderFromSeed creates a new Decoder instance from the KEY_SEED
+// negotiated by the obfs4 handshake, for decoding the frames received by the
+// server (isServer) or client side of the session.  This allows tools with
+// access to the seed to decode captured traffic offline.
+func NewDecoderFromSeed(seed []byte, isServer bool) *Decoder {
+	// The handshake derives the client to server keys first, followed by
+	// the server to client keys.
+	okm := ntor.Kdf(seed, KeyLength*2)
+	if isServer {
+		return NewDecoder(okm[:KeyLength])
+	}
+	return NewDecoder(okm[KeyLength:])
+}
+
 // Decode decodes a stream of data and returns the length if any.  ErrAgain is
 // a temporary failure, all other errors MUST be treated as fatal and the
 // session aborted.
+//
+// Only one frame is decoded per call.  On ErrAgain, the partial frame is left
+// in frames, except for the length field which is retained by the Decoder
+// once read, so further data MUST be appended to the same buffer.
 func (decoder *Decoder) Decode(data []byte, frames *bytes.Buffer) (int, error) {
 	// A length of 0 indicates that we do not know how big the next frame is
 	// going to be.
@@ -264,7 +318,7 @@ func (decoder *Decoder) Decode(data []byte, frames *bytes.Buffer) (int, error) {
 		length := binary.BigEndian.Uint16(obfsLen[:])
 		lengthMask := decoder.drbg.NextBlock()
 		length ^= binary.BigEndian.Uint16(lengthMask)
-		if maxFrameLength < length || minFrameLength > length {
+		if decoder.maxFrameLength < length || minFrameLength > length {
 			// Per "Plaintext Recovery Attacks Against SSH" by
 			// Martin R. Albrecht, Kenneth G. Paterson and Gaven J. Watson,
 			// there are a class of attacks againt protocols that use similar
@@ -277,7 +331,7 @@ func (decoder *Decoder) Decode(data []byte, frames *bytes.Buffer) (int, error) {
 			// paper.
 
 			decoder.nextLengthInvalid = true
-			length = uint16(csrand.IntRange(minFrameLength, maxFrameLength))
+			length = uint16(csrand.IntRange(minFrameLength, int(decoder.maxFrameLength)))
 		}
 		decoder.nextLength = length
 	}
@@ -287,7 +341,7 @@ func (decoder *Decoder) Decode(data []byte, frames *bytes.Buffer) (int, error) {
 	}
 
 	// Unseal the frame.
-	var box [maxFrameLength]byte
+	var box [maxBulkFrameLength]byte
 	n, err := io.ReadFull(frames, box[:decoder.nextLength])
 	if err != nil {
 		return 0, err
@@ -30,8 +30,15 @@ package framing
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"testing"
+
+	"golang.org/x/crypto/nacl/secretbox"
+
+	"gitlab.com/yawning/obfs4.git/common/drbg"
+	"gitlab.com/yawning/obfs4.git/common/ntor"
 )
 
 func generateRandomKey() []byte {
@@ -106,6 +113,45 @@ func TestNewDecoder(t *testing.T) {
 	}
 }
 
+// TestNewDecoderFromSeed tests decoding frames with a Decoder derived from
+// the handshake KEY_SEED.
+func TestNewDecoderFromSeed(t *testing.T) {
+	seed := generateRandomKey()[:32]
+	okm := ntor.Kdf(seed, KeyLength*2)
+
+	for _, v := range []struct {
+		isServer bool
+		key      []byte
+	}{
+		{true, okm[:KeyLength]},  // Client encoder.
+		{false, okm[KeyLength:]}, // Server encoder.
+	} {
+		encoder := NewEncoder(v.key)
+		decoder := NewDecoderFromSeed(seed, v.isServer)
+
+		var frames bytes.Buffer
+		msgs := [][]byte{[]byte("hello"), []byte("world")}
+		for _, msg := range msgs {
+			var frame [MaximumSegmentLength]byte
+			n, err := encoder.Encode(frame[:], msg)
+			if err != nil {
+				t.Fatalf("Encoder.Encode() failed: %s", err)
+			}
+			frames.Write(frame[:n])
+		}
+		for _, msg := range msgs {
+			var decoded [MaximumFramePayloadLength]byte
+			n, err := decoder.Decode(decoded[:], &frames)
+			if err != nil {
+				t.Fatalf("[isServer=%v]: Decoder.Decode() failed: %s", v.isServer, err)
+			}
+			if !bytes.Equal(decoded[:n], msg) {
+				t.Fatalf("[isServer=%v]: frame mismatch", v.isServer)
+			}
+		}
+	}
+}
+
 // TestDecoder_Decode tests Decoder.Decode.
 func TestDecoder_Decode(t *testing.T) {
 	key := generateRandomKey()
@@ -143,29 +189,331 @@ func TestDecoder_Decode(t *testing.T) {
 	}
 }
 
+// vectorKey is the fixed key material used for the test vectors
+// (0x00, 0x01, ..., 0x47).
+func vectorKey() []byte {
+	key := make([]byte, KeyLength)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	return key
+}
+
+// frameVectors are the frames produced by an Encoder keyed with vectorKey,
+// for consecutive payloads.  Any change to these is a change to the wire
+// format.
+var frameVectors = []struct {
+	payload string
+	frame   string
+}{
+	{
+		"",
+		"034ec8dfc78459aa307f6cde8c0938c745ec",
+	},
+	{
+		"68656c6c6f20776f726c64", // "hello world"
+		"266d5699755ea6837bcb9195deaf3e79e1fd3bd14ff528f0257246696f",
+	},
+	{
+		"0000000000000000000000000000000000000000000000000000000000000000",
+		"4aed1df6e44383ce83917c3cd03e2eae1eb340922b6456e0dc181c641d49c98f0d37a7cb105cb7e2d0abb883313b14f7ba46",
+	},
+}
+
+// TestEncoder_Vectors tests Encoder.Encode against known frames, and
+// checks the frame construction independently of the Encoder.
+func TestEncoder_Vectors(t *testing.T) {
+	key := vectorKey()
+	encoder := NewEncoder(key)
+
+	// The length masks are the leading bytes of the SipHash-2-4 OFB output,
+	// and the secretbox nonce is the prefix followed by the counter, which
+	// starts at 1.
+	seed, _ := drbg.SeedFromBytes(key[keyLength+noncePrefixLength:])
+	maskDrbg, _ := drbg.NewHashDrbg(seed)
+	var boxKey [keyLength]byte
+	copy(boxKey[:], key[:keyLength])
+
+	for i, v := range frameVectors {
+		payload, _ := hex.DecodeString(v.payload)
+		var frame [MaximumSegmentLength]byte
+		n, err := encoder.Encode(frame[:], payload)
+		if err != nil {
+			t.Fatalf("Encoder.Encode(vector %d) failed: %s", i, err)
+		}
+		if got := hex.EncodeToString(frame[:n]); got != v.frame {
+			t.Fatalf("Encoder.Encode(vector %d) = %s, expected %s", i, got, v.frame)
+		}
+
+		mask := binary.BigEndian.Uint16(maskDrbg.NextBlock())
+		if length := binary.BigEndian.Uint16(frame[:lengthLength]) ^ mask; int(length) != n-lengthLength {
+			t.Fatalf("vector %d: deobfuscated length %d, expected %d", i, length, n-lengthLength)
+		}
+
+		var nonce [nonceLength]byte
+		copy(nonce[:], key[keyLength:keyLength+noncePrefixLength])
+		binary.BigEndian.PutUint64(nonce[noncePrefixLength:], uint64(i+1))
+		opened, ok := secretbox.Open(nil, frame[lengthLength:n], &nonce, &boxKey)
+		if !ok || !bytes.Equal(opened, payload) {
+			t.Fatalf("vector %d: secretbox.Open() failed with counter %d", i, i+1)
+		}
+	}
+}
+
+// TestDecoder_Vectors tests Decoder.Decode against known frames, including
+// partial input.
+func TestDecoder_Vectors(t *testing.T) {
+	decoder := NewDecoder(vectorKey())
+
+	var frames bytes.Buffer
+	for i, v := range frameVectors {
+		frame, _ := hex.DecodeString(v.frame)
+		payload, _ := hex.DecodeString(v.payload)
+
+		// Feed the frame a byte at a time, every call prior to the last
+		// byte must return ErrAgain.
+		var decoded [MaximumFramePayloadLength]byte
+		for j := range frame {
+			frames.WriteByte(frame[j])
+			n, err := decoder.Decode(decoded[:], &frames)
+			if j < len(frame)-1 {
+				if !errors.Is(err, ErrAgain) {
+					t.Fatalf("vector %d: Decoder.Decode(%d/%d bytes) returned %v", i, j+1, len(frame), err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("vector %d: Decoder.Decode() failed: %s", i, err)
+			}
+			if !bytes.Equal(decoded[:n], payload) {
+				t.Fatalf("vector %d: decoded payload mismatch", i)
+			}
+		}
+	}
+}
+
+// TestDecoder_Decode_Concatenated tests decoding a buffer containing several
+// frames followed by a partial frame, as is done when consuming a stream.
+func TestDecoder_Decode_Concatenated(t *testing.T) {
+	for _, partialLen := range []int{1, lengthLength, lengthLength + 1, 20} {
+		key := generateRandomKey()
+		encoder := NewEncoder(key)
+		decoder := NewDecoder(key)
+
+		var (
+			frames   bytes.Buffer
+			payloads [][]byte
+			last     []byte
+		)
+		for i := 0; i < 4; i++ {
+			payload := make([]byte, 100*i+1)
+			_, _ = rand.Read(payload)
+			payloads = append(payloads, payload)
+
+			var frame [MaximumSegmentLength]byte
+			n, err := encoder.Encode(frame[:], payload)
+			if err != nil {
+				t.Fatalf("Encoder.Encode() failed: %s", err)
+			}
+			if i < 3 {
+				frames.Write(frame[:n])
+			} else {
+				frames.Write(frame[:partialLen])
+				last = bytes.Clone(frame[partialLen:n])
+			}
+		}
+
+		var decoded [MaximumFramePayloadLength]byte
+		for i := 0; i < 3; i++ {
+			n, err := decoder.Decode(decoded[:], &frames)
+			if err != nil {
+				t.Fatalf("partial %d: Decoder.Decode(frame %d) failed: %s", partialLen, i, err)
+			}
+			if !bytes.Equal(decoded[:n], payloads[i]) {
+				t.Fatalf("partial %d: frame %d payload mismatch", partialLen, i)
+			}
+		}
+
+		// The partial frame must remain buffered, less the length field
+		// once it has been consumed, across repeated calls.
+		expectedLen := partialLen
+		if partialLen >= lengthLength {
+			expectedLen -= lengthLength
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := decoder.Decode(decoded[:], &frames); !errors.Is(err, ErrAgain) {
+				t.Fatalf("partial %d: Decoder.Decode(partial) returned %v", partialLen, err)
+			}
+			if frames.Len() != expectedLen {
+				t.Fatalf("partial %d: %d bytes buffered, expected %d", partialLen, frames.Len(), expectedLen)
+			}
+		}
+
+		frames.Write(last)
+		n, err := decoder.Decode(decoded[:], &frames)
+		if err != nil {
+			t.Fatalf("partial %d: Decoder.Decode(completed) failed: %s", partialLen, err)
+		}
+		if !bytes.Equal(decoded[:n], payloads[3]) || frames.Len() != 0 {
+			t.Fatalf("partial %d: completed frame mismatch", partialLen)
+		}
+	}
+}
+
+// TestDecoder_Decode_Split tests decoding frames split across three calls:
+// the length field, part of the secretbox, and the rest.
+func TestDecoder_Decode_Split(t *testing.T) {
+	key := generateRandomKey()
+	encoder := NewEncoder(key)
+	decoder := NewDecoder(key)
+
+	var frames bytes.Buffer
+	for i := 0; i < 8; i++ {
+		payload := make([]byte, 64+i)
+		_, _ = rand.Read(payload)
+		var frame [MaximumSegmentLength]byte
+		n, err := encoder.Encode(frame[:], payload)
+		if err != nil {
+			t.Fatalf("Encoder.Encode() failed: %s", err)
+		}
+
+		var decoded [MaximumFramePayloadLength]byte
+		for j, split := range [][]byte{frame[:lengthLength], frame[lengthLength : n/2], frame[n/2 : n]} {
+			frames.Write(split)
+			decLen, err := decoder.Decode(decoded[:], &frames)
+			if j < 2 {
+				if !errors.Is(err, ErrAgain) {
+					t.Fatalf("frame %d: Decoder.Decode(part %d) returned %v", i, j, err)
+				}
+				if decoder.nonce.counter != uint64(i+1) {
+					t.Fatalf("frame %d: nonce counter advanced to %d on a partial frame", i, decoder.nonce.counter)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("frame %d: Decoder.Decode(part %d) failed: %s", i, j, err)
+			}
+			if !bytes.Equal(decoded[:decLen], payload) {
+				t.Fatalf("frame %d: payload mismatch", i)
+			}
+		}
+	}
+}
+
+// TestDecoder_Decode_Corrupt tests that corrupted frames are rejected.
+func TestDecoder_Decode_Corrupt(t *testing.T) {
+	frame, _ := hex.DecodeString(frameVectors[0].frame)
+
+	// Flipping any bit in the secretbox must fail authentication.
+	for i := lengthLength; i < len(frame); i++ {
+		corrupted := bytes.Clone(frame)
+		corrupted[i] ^= 0x01
+		var decoded [MaximumFramePayloadLength]byte
+		if _, err := NewDecoder(vectorKey()).Decode(decoded[:], bytes.NewBuffer(corrupted)); !errors.Is(err, ErrTagMismatch) {
+			t.Fatalf("Decoder.Decode(corrupted byte %d) returned %v", i, err)
+		}
+	}
+
+	// Out of range lengths are replaced with a random valid length, and the
+	// frame is then rejected as if it failed authentication, rather than
+	// immediately.
+	key := vectorKey()
+	seed, _ := drbg.SeedFromBytes(key[keyLength+noncePrefixLength:])
+	maskDrbg, _ := drbg.NewHashDrbg(seed)
+	mask := binary.BigEndian.Uint16(maskDrbg.NextBlock())
+	for _, length := range []uint16{0, minFrameLength - 1, maxFrameLength + 1, 0xffff} {
+		corrupted := make([]byte, lengthLength+maxFrameLength)
+		binary.BigEndian.PutUint16(corrupted, length^mask)
+		var decoded [MaximumFramePayloadLength]byte
+		if _, err := NewDecoder(key).Decode(decoded[:], bytes.NewBuffer(corrupted)); !errors.Is(err, ErrTagMismatch) {
+			t.Fatalf("Decoder.Decode(length %d) returned %v", length, err)
+		}
+	}
+}
+
+// TestEncoder_EnableBulk tests bulk mode frames.
+func TestEncoder_EnableBulk(t *testing.T) {
+	key := generateRandomKey()
+	encoder := NewEncoder(key)
+	encoder.EnableBulk()
+
+	var frame [MaximumBulkSegmentLength]byte
+	var buf [MaximumBulkFramePayloadLength + 1]byte
+	_, _ = rand.Read(buf[:])
+	var payloadErr InvalidPayloadLengthError
+	if _, err := encoder.Encode(frame[:], buf[:]); !errors.As(err, &payloadErr) {
+		t.Fatalf("Encoder.Encode(oversized) returned unexpected error: %v", err)
+	}
+	n, err := encoder.Encode(frame[:], buf[:MaximumBulkFramePayloadLength])
+	if err != nil {
+		t.Fatalf("Encoder.Encode() failed: %s", err)
+	}
+	if n != MaximumBulkSegmentLength {
+		t.Fatalf("Unexpected encoded framesize: %d, expecting %d", n, MaximumBulkSegmentLength)
+	}
+
+	// A bulk mode decoder accepts the frame.
+	decoder := NewDecoder(key)
+	decoder.EnableBulk()
+	var decoded [MaximumBulkFramePayloadLength]byte
+	decLen, err := decoder.Decode(decoded[:], bytes.NewBuffer(frame[:n]))
+	if err != nil {
+		t.Fatalf("Decoder.Decode() failed: %s", err)
+	}
+	if !bytes.Equal(decoded[:decLen], buf[:MaximumBulkFramePayloadLength]) {
+		t.Fatalf("Frame payload mismatch")
+	}
+
+	// A regular decoder rejects it.
+	decoder = NewDecoder(key)
+	if _, err = decoder.Decode(decoded[:], bytes.NewBuffer(frame[:n])); !errors.Is(err, ErrTagMismatch) {
+		t.Fatalf("Decoder.Decode() returned unexpected error: %v", err)
+	}
+}
+
 // BencharkEncoder_Encode benchmarks Encoder.Encode processing 1 MiB
 // of payload.
 func BenchmarkEncoder_Encode(b *testing.B) {
-	var chopBuf [MaximumFramePayloadLength]byte
-	var frame [MaximumSegmentLength]byte
+	benchmarkEncode(b, false)
+}
+
+// BenchmarkEncoder_EncodeBulk benchmarks Encoder.Encode processing 1 MiB
+// of payload in bulk mode.
+func BenchmarkEncoder_EncodeBulk(b *testing.B) {
+	benchmarkEncode(b, true)
+}
+
+func benchmarkEncode(b *testing.B, bulk bool) {
+	var chopBuf [MaximumBulkFramePayloadLength]byte
+	var frame [MaximumBulkSegmentLength]byte
 	payload := make([]byte, 1024*1024)
 	encoder := NewEncoder(generateRandomKey())
+	chopLen := MaximumFramePayloadLength
+	if bulk {
+		encoder.EnableBulk()
+		chopLen = MaximumBulkFramePayloadLength
+	}
+	b.SetBytes(int64(len(payload)))
 	b.ResetTimer()
 
+	var overhead int
 	for i := 0; i < b.N; i++ {
 		var xfered int
+		overhead = 0
 		buffer := bytes.NewBuffer(payload)
 		for 0 < buffer.Len() {
-			n, err := buffer.Read(chopBuf[:])
+			n, err := buffer.Read(chopBuf[:chopLen])
 			if err != nil {
 				b.Fatal("buffer.Read() failed:", err)
 			}
 
 			n, _ = encoder.Encode(frame[:], chopBuf[:n])
 			xfered += n - FrameOverhead
+			overhead += FrameOverhead
 		}
 		if xfered != len(payload) {
 			b.Fatalf("Xfered length mismatch: %d != %d", xfered, len(payload))
 		}
 	}
+	b.ReportMetric(float64(overhead), "overhead-B/MiB")
 }
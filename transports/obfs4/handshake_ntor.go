@@ -31,16 +31,17 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"hash"
+	"io"
 	"strconv"
 	"time"
 
 	"gitlab.com/yawning/obfs4.git/common/csrand"
 	"gitlab.com/yawning/obfs4.git/common/ntor"
-	"gitlab.com/yawning/obfs4.git/common/replayfilter"
 	"gitlab.com/yawning/obfs4.git/transports/obfs4/framing"
 )
 
@@ -58,12 +59,57 @@ const (
 	serverMinHandshakeLength = ntor.RepresentativeLength + ntor.AuthLength +
 		markLength + macLength
 
+	// The server padding is not rebalanced when the PRNG seed is sent
+	// separately (See setSeparateSeed).
+	serverMaxSeparateSeedPadLength = maxHandshakeLength - serverMinHandshakeLength
+
+	// The bounds for the fixed handshake lengths (See setHandshakeLength).
+	// The server length includes the inline PRNG seed frame, and always
+	// leaves room for the version tag, which may replace the start of P_S
+	// depending on what the client offers.
+	clientMinFixedHandshakeLength = clientMinHandshakeLength + clientMinPadLength
+	clientMaxFixedHandshakeLength = clientMinHandshakeLength + clientMaxPadLength
+	serverMinFixedHandshakeLength = serverMinHandshakeLength + inlineSeedFrameLength + serverMinPadLength + versionTagLength
+	serverMaxFixedHandshakeLength = serverMinHandshakeLength + inlineSeedFrameLength + serverMaxPadLength
+
 	markLength = sha256.Size / 2
 	macLength  = sha256.Size / 2
 
 	inlineSeedFrameLength = framing.FrameOverhead + packetOverhead + seedPacketPayloadLength
+
+	versionTagLength = sha256.Size / 2
+	versionLabel     = "obfs4-protocol-version"
+
+	// protocolVersion1 is the original obfs4 protocol, and is what is
+	// assumed when the peer does not indicate a version.
+	protocolVersion1 = 1
+
+	// protocolVersionCompression is protocolVersion1 with compressed
+	// payload (See compress.go).  It is only offered when compression is
+	// explicitly enabled.
+	protocolVersionCompression = 2
+
+	// maxProtocolVersion is the highest protocol version offered by default
+	// by this implementation.
+	maxProtocolVersion = protocolVersion1
+
+	// protocolFeatureMask is the part of the version tag value used for
+	// optional features, that are negotiated independently of the protocol
+	// version.  The client offers a set of features, and the server echoes
+	// the subset that it accepts.
+	protocolFeatureMask = 0xf0
+
+	// protocolFeatureEarlyPadding sends a padding-only burst immediately
+	// after the handshake (See sendEarlyPadding).
+	protocolFeatureEarlyPadding = 0x10
 )
 
+// randReader is the entropy source used for the handshake padding and the
+// session keys.  It is only ever overridden by tests, to produce
+// deterministic handshakes, and MUST be csrand.Reader (crypto/rand, with
+// transient failures retried) otherwise.
+var randReader = csrand.Reader
+
 // ErrMarkNotFoundYet is the error returned when the obfs4 handshake is
 // incomplete and requires more data to continue.  This error is non-fatal and
 // is the equivalent to EAGAIN/EWOULDBLOCK.
@@ -79,6 +125,22 @@ var ErrInvalidHandshake = errors.New("handshake: Failed to find M_[C,S]")
 // dropped.
 var ErrReplayedHandshake = errors.New("handshake: Replay detected")
 
+// ErrServerKeyMismatch is the error returned when the server closes the
+// connection (or lets it time out) without responding to the client
+// handshake.  Servers do this when the handshake was not made with their
+// identity key, Node ID, and password, so this usually means that the bridge
+// line is stale (eg: the bridge's keys were rotated), and should be
+// refreshed.  This error is fatal and the connection MUST be dropped.
+var ErrServerKeyMismatch = errors.New("handshake: no response from server, bridge line likely stale")
+
+// ErrTooManyHandshakes is the error returned when the server rejects a
+// connection because the limit on concurrent handshakes was reached.
+var ErrTooManyHandshakes = errors.New("handshake: too many concurrent handshakes")
+
+// ErrHandshakeNotComplete is the error returned when reading from or writing
+// to a connection before its handshake has completed.
+var ErrHandshakeNotComplete = errors.New("handshake: not complete")
+
 // ErrNtorFailed is the error returned when the ntor handshake fails.  This
 // error is fatal and the connection MUST be dropped.
 var ErrNtorFailed = errors.New("handshake: ntor handshake failure")
@@ -113,10 +175,15 @@ type clientHandshake struct {
 	nodeID         *ntor.NodeID
 	serverIdentity *ntor.PublicKey
 	epochHour      []byte
+	epochPeriod    time.Duration
 
 	padLen int
 	mac    hash.Hash
 
+	maxVersion int
+	version    int
+	features   int
+
 	serverRepresentative *ntor.Representative
 	serverAuth           *ntor.Auth
 	serverMark           []byte
@@ -128,12 +195,52 @@ func newClientHandshake(nodeID *ntor.NodeID, serverIdentity *ntor.PublicKey, ses
 	hs.nodeID = nodeID
 	hs.serverIdentity = serverIdentity
 	hs.padLen = csrand.IntRange(clientMinPadLength, clientMaxPadLength)
-	hs.mac = hmac.New(sha256.New, append(hs.serverIdentity.Bytes()[:], hs.nodeID.Bytes()[:]...))
+	hs.mac = newHandshakeMAC(hs.serverIdentity, hs.nodeID, nil)
+	hs.epochPeriod = defaultEpochPeriod
+	hs.maxVersion = maxProtocolVersion
+	hs.version = protocolVersion1
 
 	return hs
 }
 
+// setPassword folds the shared password into the handshake MAC key.
+func (hs *clientHandshake) setPassword(password []byte) {
+	hs.mac = newHandshakeMAC(hs.serverIdentity, hs.nodeID, password)
+}
+
+// setHandshakeLength sets the padding length such that the client handshake
+// is exactly length bytes.
+func (hs *clientHandshake) setHandshakeLength(length int) {
+	if length < clientMinFixedHandshakeLength || length > clientMaxFixedHandshakeLength {
+		panic(fmt.Sprintf("BUG: Invalid client handshake length: %d", length))
+	}
+	hs.padLen = length - clientMinHandshakeLength
+}
+
+// setCompression offers the compression protocol version.
+func (hs *clientHandshake) setCompression() {
+	hs.maxVersion = protocolVersionCompression
+}
+
+// setEpochPeriod sets the length of the epochs covered by the MACs, which
+// must match the server's.
+func (hs *clientHandshake) setEpochPeriod(period time.Duration) {
+	if period < minEpochPeriod || period > maxEpochPeriod {
+		panic(fmt.Sprintf("BUG: Invalid epoch period: %v", period))
+	}
+	hs.epochPeriod = period
+}
+
+// setFeatures offers the optional features, in addition to the version.
+func (hs *clientHandshake) setFeatures(features int) {
+	hs.features = features & protocolFeatureMask
+}
+
 func (hs *clientHandshake) generateHandshake() ([]byte, error) {
+	return hs.generateHandshakeAt(time.Now())
+}
+
+func (hs *clientHandshake) generateHandshakeAt(now time.Time) ([]byte, error) {
 	var buf bytes.Buffer
 
 	hs.mac.Reset()
@@ -145,14 +252,21 @@ func (hs *clientHandshake) generateHandshake() ([]byte, error) {
 	//  * P_C is [clientMinPadLength,clientMaxPadLength] bytes of random padding.
 	//  * M_C is HMAC-SHA256-128(serverIdentity | NodeID, X)
 	//  * MAC is HMAC-SHA256-128(serverIdentity | NodeID, X .... E)
-	//  * E is the string representation of the number of hours since the UNIX
-	//    epoch.
+	//  * E is the string representation of the number of epochs (hours,
+	//    unless "epoch-period" is set) since the UNIX epoch.
+	//
+	// If the client supports protocol versions past the original, or
+	// optional features, the first versionTagLength bytes of P_C are
+	// replaced with V_C (See makeVersionTag).
 
 	// Generate the padding
 	pad, err := makePad(hs.padLen)
 	if err != nil {
 		return nil, err
 	}
+	if hs.maxVersion > protocolVersion1 || hs.features != 0 {
+		copy(pad, makeVersionTag(hs.mac, hs.keypair.Representative(), hs.maxVersion|hs.features))
+	}
 
 	// Write X, P_C, M_C.
 	buf.Write(hs.keypair.Representative().Bytes()[:])
@@ -162,7 +276,7 @@ func (hs *clientHandshake) generateHandshake() ([]byte, error) {
 	// Calculate and write the MAC.
 	hs.mac.Reset()
 	_, _ = hs.mac.Write(buf.Bytes())
-	hs.epochHour = []byte(strconv.FormatInt(getEpochHour(), 10))
+	hs.epochHour = []byte(strconv.FormatInt(epochAt(now, hs.epochPeriod), 10))
 	_, _ = hs.mac.Write(hs.epochHour)
 	buf.Write(hs.mac.Sum(nil)[:macLength])
 
@@ -205,7 +319,7 @@ func (hs *clientHandshake) parseServerHandshake(resp []byte) (int, []byte, error
 	_, _ = hs.mac.Write(hs.epochHour)
 	macCmp := hs.mac.Sum(nil)[:macLength]
 	macRx := resp[pos+markLength : pos+markLength+macLength]
-	if !hmac.Equal(macCmp, macRx) {
+	if !ctEqual(macCmp, macRx) {
 		return 0, nil, &InvalidMacError{macCmp, macRx}
 	}
 
@@ -220,35 +334,69 @@ func (hs *clientHandshake) parseServerHandshake(resp []byte) (int, []byte, error
 		return 0, nil, &InvalidAuthError{auth, hs.serverAuth}
 	}
 
+	// Determine the protocol version and features the server selected, if
+	// any.  Servers that do not understand version negotiation will never
+	// echo a tag, and the original protocol is used without any features.
+	offered := hs.features
+	hs.features = 0
+	padStart := ntor.RepresentativeLength + ntor.AuthLength
+	if (hs.maxVersion > protocolVersion1 || offered != 0) && pos-padStart >= versionTagLength {
+		tag := resp[padStart : padStart+versionTagLength]
+		if value, ok := parseVersionTag(hs.mac, hs.serverRepresentative, tag); ok {
+			version, features := value&^protocolFeatureMask, value&protocolFeatureMask
+			if version < protocolVersion1 || version > hs.maxVersion || features&^offered != 0 {
+				return 0, nil, ErrInvalidHandshake
+			}
+			hs.version = version
+			hs.features = features
+		}
+	}
+
 	return pos + markLength + macLength, seed.Bytes()[:], nil
 }
 
 type serverHandshake struct {
 	keypair        *ntor.Keypair
 	nodeID         *ntor.NodeID
-	serverIdentity *ntor.Keypair
+	serverIdentity ntor.IdentityKey
 	epochHour      []byte
+	epochOffset    int64
+	epochTolerance int64
+	epochPeriod    time.Duration
 	serverAuth     *ntor.Auth
 
-	padLen int
-	mac    hash.Hash
+	padLen       int
+	mac          hash.Hash
+	separateSeed bool
+
+	maxVersion int
+	version    int
+	features   int
 
 	clientRepresentative *ntor.Representative
 	clientMark           []byte
 }
 
-func newServerHandshake(nodeID *ntor.NodeID, serverIdentity *ntor.Keypair, sessionKey *ntor.Keypair) *serverHandshake {
+func newServerHandshake(nodeID *ntor.NodeID, serverIdentity ntor.IdentityKey, sessionKey *ntor.Keypair) *serverHandshake {
 	hs := new(serverHandshake)
 	hs.keypair = sessionKey
 	hs.nodeID = nodeID
 	hs.serverIdentity = serverIdentity
 	hs.padLen = csrand.IntRange(serverMinPadLength, serverMaxPadLength)
-	hs.mac = hmac.New(sha256.New, append(hs.serverIdentity.Public().Bytes()[:], hs.nodeID.Bytes()[:]...))
+	hs.mac = newHandshakeMAC(hs.serverIdentity.Public(), hs.nodeID, nil)
+	hs.epochTolerance = defaultEpochTolerance
+	hs.epochPeriod = defaultEpochPeriod
+	hs.maxVersion = maxProtocolVersion
+	hs.version = protocolVersion1
 
 	return hs
 }
 
-func (hs *serverHandshake) parseClientHandshake(filter *replayfilter.ReplayFilter, resp []byte) ([]byte, error) {
+func (hs *serverHandshake) parseClientHandshake(filter ReplayBackend, resp []byte) ([]byte, error) {
+	return hs.parseClientHandshakeAt(filter, resp, time.Now())
+}
+
+func (hs *serverHandshake) parseClientHandshakeAt(filter ReplayBackend, resp []byte, now time.Time) ([]byte, error) {
 	// No point in examining the data unless the miminum plausible response has
 	// been received.
 	if clientMinHandshakeLength > len(resp) {
@@ -277,18 +425,24 @@ func (hs *serverHandshake) parseClientHandshake(filter *replayfilter.ReplayFilte
 	}
 
 	// Validate the MAC.
+	//
+	// Note: As the MAC for a given handshake is accepted for 2 * tolerance
+	// + 1 consecutive epochs, the replay filter TTL MUST be at least
+	// that long (See epochReplayTTL), so that a handshake captured at the
+	// very start of the window is still in the filter if it is replayed at
+	// the very end.
 	macFound := false
-	for _, off := range []int64{0, -1, 1} {
-		// Allow epoch to be off by up to a hour in either direction.
-		epochHour := []byte(strconv.FormatInt(getEpochHour()+off, 10))
+	for off := -hs.epochTolerance; off <= hs.epochTolerance; off++ {
+		// Allow epoch to be off by up to tolerance epochs in either direction.
+		epochHour := []byte(strconv.FormatInt(epochAt(now, hs.epochPeriod)+off, 10))
 		hs.mac.Reset()
 		_, _ = hs.mac.Write(resp[:pos+markLength])
 		_, _ = hs.mac.Write(epochHour)
 		macCmp := hs.mac.Sum(nil)[:macLength]
 		macRx := resp[pos+markLength : pos+markLength+macLength]
-		if hmac.Equal(macCmp, macRx) {
+		if ctEqual(macCmp, macRx) {
 			// Ensure that this handshake has not been seen previously.
-			if filter.TestAndSet(time.Now(), macRx) {
+			if filter.TestAndSet(now, macRx) {
 				// The client either happened to generate exactly the same
 				// session key and padding, or someone is replaying a previous
 				// handshake.  In either case, fuck them.
@@ -297,13 +451,14 @@ func (hs *serverHandshake) parseClientHandshake(filter *replayfilter.ReplayFilte
 
 			macFound = true
 			hs.epochHour = epochHour
+			hs.epochOffset = off
 
 			// We could break out here, but in the name of reducing timing
-			// variation, evaluate all 3 MACs.
+			// variation, evaluate all the MACs.
 		}
 	}
 	if !macFound {
-		// This probably should be an InvalidMacError, but conveying the 3 MACS
+		// This probably should be an InvalidMacError, but conveying the MACs
 		// that would be accepted is annoying so just return a generic fatal
 		// failure.
 		return nil, ErrInvalidHandshake
@@ -314,9 +469,30 @@ func (hs *serverHandshake) parseClientHandshake(filter *replayfilter.ReplayFilte
 		return nil, ErrInvalidHandshake
 	}
 
+	// Pick the protocol version and features.  Clients that only support
+	// the original protocol send random padding that will fail to parse as
+	// a tag.
+	accepted := hs.features
+	hs.features = 0
+	if hs.maxVersion > protocolVersion1 || accepted != 0 {
+		tag := resp[ntor.RepresentativeLength : ntor.RepresentativeLength+versionTagLength]
+		if value, ok := parseVersionTag(hs.mac, hs.clientRepresentative, tag); ok {
+			if version := value &^ protocolFeatureMask; version > protocolVersion1 {
+				hs.version = version
+				if hs.version > hs.maxVersion {
+					hs.version = hs.maxVersion
+				}
+			}
+			hs.features = value & protocolFeatureMask & accepted
+		}
+	}
+
 	clientPublic := hs.clientRepresentative.ToPublic()
-	ok, seed, auth := ntor.ServerHandshake(clientPublic, hs.keypair,
+	ok, seed, auth, err := ntor.ServerHandshakeWithIdentity(clientPublic, hs.keypair,
 		hs.serverIdentity, hs.nodeID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: identity key: %w", ErrNtorFailed, err)
+	}
 	if !ok {
 		return nil, ErrNtorFailed
 	}
@@ -325,6 +501,59 @@ func (hs *serverHandshake) parseClientHandshake(filter *replayfilter.ReplayFilte
 	return seed.Bytes()[:], nil
 }
 
+// setPassword folds the shared password into the handshake MAC key.
+func (hs *serverHandshake) setPassword(password []byte) {
+	hs.mac = newHandshakeMAC(hs.serverIdentity.Public(), hs.nodeID, password)
+}
+
+// setSeparateSeed indicates that the PRNG seed frame is sent separately from
+// the handshake, and resamples the padding length accordingly.
+func (hs *serverHandshake) setSeparateSeed() {
+	hs.separateSeed = true
+	hs.padLen = csrand.IntRange(serverMinPadLength, serverMaxSeparateSeedPadLength)
+}
+
+// setHandshakeLength sets the padding length such that the server handshake,
+// including the inline PRNG seed frame if any, is exactly length bytes.
+func (hs *serverHandshake) setHandshakeLength(length int) {
+	if length < serverMinFixedHandshakeLength || length > serverMaxFixedHandshakeLength {
+		panic(fmt.Sprintf("BUG: Invalid server handshake length: %d", length))
+	}
+	hs.padLen = length - serverMinHandshakeLength
+	if !hs.separateSeed {
+		hs.padLen -= inlineSeedFrameLength
+	}
+}
+
+// setCompression accepts the compression protocol version, if offered by the
+// client.
+func (hs *serverHandshake) setCompression() {
+	hs.maxVersion = protocolVersionCompression
+}
+
+// setEpochTolerance sets the number of epochs that the client's clock may be
+// off by in either direction.
+func (hs *serverHandshake) setEpochTolerance(tolerance int) {
+	if tolerance < defaultEpochTolerance || tolerance > maxEpochTolerance {
+		panic(fmt.Sprintf("BUG: Invalid epoch tolerance: %d", tolerance))
+	}
+	hs.epochTolerance = int64(tolerance)
+}
+
+// setEpochPeriod sets the length of the epochs covered by the MACs, which
+// must match the client's.
+func (hs *serverHandshake) setEpochPeriod(period time.Duration) {
+	if period < minEpochPeriod || period > maxEpochPeriod {
+		panic(fmt.Sprintf("BUG: Invalid epoch period: %v", period))
+	}
+	hs.epochPeriod = period
+}
+
+// setFeatures accepts the optional features, if offered by the client.
+func (hs *serverHandshake) setFeatures(features int) {
+	hs.features = features & protocolFeatureMask
+}
+
 func (hs *serverHandshake) generateHandshake() ([]byte, error) {
 	var buf bytes.Buffer
 
@@ -338,14 +567,25 @@ func (hs *serverHandshake) generateHandshake() ([]byte, error) {
 	//  * P_S is [serverMinPadLength,serverMaxPadLength] bytes of random padding.
 	//  * M_S is HMAC-SHA256-128(serverIdentity | NodeID, Y)
 	//  * MAC is HMAC-SHA256-128(serverIdentity | NodeID, Y .... E)
-	//  * E is the string representation of the number of hours since the UNIX
-	//    epoch.
+	//  * E is the string representation of the number of epochs (hours,
+	//    unless "epoch-period" is set) since the UNIX epoch.
+	//
+	// If a protocol version past the original, or any optional features
+	// were negotiated, the first versionTagLength bytes of P_S are replaced
+	// with V_S (See makeVersionTag).
 
 	// Generate the padding
+	echoTag := hs.version > protocolVersion1 || hs.features != 0
+	if echoTag && hs.padLen < versionTagLength {
+		hs.padLen = versionTagLength
+	}
 	pad, err := makePad(hs.padLen)
 	if err != nil {
 		return nil, err
 	}
+	if echoTag {
+		copy(pad, makeVersionTag(hs.mac, hs.keypair.Representative(), hs.version|hs.features))
+	}
 
 	// Write Y, AUTH, P_S, M_S.
 	buf.Write(hs.keypair.Representative().Bytes()[:])
@@ -362,9 +602,31 @@ func (hs *serverHandshake) generateHandshake() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// getEpochHour returns the number of hours since the UNIX epoch.
-func getEpochHour() int64 {
-	return time.Now().Unix() / 3600
+// newHandshakeMAC returns the HMAC-SHA256 instance used for the marks, MACs,
+// and version tags.  The key is serverIdentity | NodeID, with
+// SHA256(password) appended if a shared password is in use, so that clients
+// that do not know the password can not produce a mark that the server will
+// find, and the server will never respond.
+func newHandshakeMAC(serverIdentity *ntor.PublicKey, nodeID *ntor.NodeID, password []byte) hash.Hash {
+	key := append(serverIdentity.Bytes()[:], nodeID.Bytes()[:]...)
+	if password != nil {
+		pwHash := sha256.Sum256(password)
+		key = append(key, pwHash[:]...)
+	}
+	return hmac.New(sha256.New, key)
+}
+
+// epochAt returns the number of epochs of the specified length since the
+// UNIX epoch at t.  With the default period, this is the number of hours.
+func epochAt(t time.Time, period time.Duration) int64 {
+	return t.Unix() / int64(period/time.Second)
+}
+
+// epochReplayTTL returns the replay filter TTL required when the MAC is
+// accepted for tolerance epochs of the specified length in either
+// direction, which is the span of the whole window.
+func epochReplayTTL(tolerance int, period time.Duration) time.Duration {
+	return time.Duration(2*tolerance+1) * period
 }
 
 func findMarkMac(mark, buf []byte, startPos, maxPos int, fromTail bool) int {
@@ -388,7 +650,7 @@ func findMarkMac(mark, buf []byte, startPos, maxPos int, fromTail bool) int {
 		// tail of the buffer.  The client can't send valid data past M_C |
 		// MAC_C as it does not have the server's public key yet.
 		pos := endPos - (markLength + macLength)
-		if !hmac.Equal(buf[pos:pos+markLength], mark) {
+		if !ctEqual(buf[pos:pos+markLength], mark) {
 			return -1
 		}
 
@@ -414,9 +676,53 @@ func findMarkMac(mark, buf []byte, startPos, maxPos int, fromTail bool) int {
 	return pos
 }
 
+// makeVersionTag returns the protocol version indicator V that is placed at
+// the start of the handshake padding, where:
+//
+//	T = HMAC-SHA256-128(serverIdentity | NodeID, R | "obfs4-protocol-version")
+//	V = T[0:15] | (T[15] ^ version)
+//
+// R is the representative of the sender's ephemeral key.  Without the server's
+// identity key and Node ID, V is indistinguishable from the random padding
+// that it replaces.
+func makeVersionTag(mac hash.Hash, repr *ntor.Representative, version int) []byte {
+	if version < 0 || version > 0xff {
+		panic(fmt.Sprintf("BUG: Invalid protocol version: %d", version))
+	}
+
+	mac.Reset()
+	_, _ = mac.Write(repr.Bytes()[:])
+	_, _ = mac.Write([]byte(versionLabel))
+	tag := mac.Sum(nil)[:versionTagLength]
+	tag[versionTagLength-1] ^= byte(version)
+
+	return tag
+}
+
+// parseVersionTag attempts to extract the protocol version from a version
+// indicator created by makeVersionTag.
+func parseVersionTag(mac hash.Hash, repr *ntor.Representative, tag []byte) (int, bool) {
+	expected := makeVersionTag(mac, repr, 0)
+	if !ctEqual(expected[:versionTagLength-1], tag[:versionTagLength-1]) {
+		return 0, false
+	}
+
+	return int(expected[versionTagLength-1] ^ tag[versionTagLength-1]), true
+}
+
+// ctEqual returns true iff a and b are equal, in constant time (with respect
+// to the contents, the lengths are not considered secret).
+//
+// Invariant: All comparisons of secret-dependent material in the handshake
+// (marks, MACs, version tags, ntor AUTH) MUST go through this (or an
+// equivalent constant time comparison), and never bytes.Equal/bytes.Compare.
+func ctEqual(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
+
 func makePad(padLen int) ([]byte, error) {
 	pad := make([]byte, padLen)
-	if err := csrand.Bytes(pad); err != nil {
+	if _, err := io.ReadFull(randReader, pad); err != nil {
 		return nil, err
 	}
 
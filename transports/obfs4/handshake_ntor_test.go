@@ -29,7 +29,15 @@ package obfs4
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strconv"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
 
 	"gitlab.com/yawning/obfs4.git/common/ntor"
 	"gitlab.com/yawning/obfs4.git/common/replayfilter"
@@ -39,7 +47,7 @@ func TestHandshakeNtorClient(t *testing.T) {
 	// Generate the server node id and id keypair, and ephemeral session keys.
 	nodeID, _ := ntor.NewNodeID([]byte("\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10\x11\x12\x13"))
 	idKeypair, _ := ntor.NewKeypair(false)
-	serverFilter, _ := replayfilter.New(replayTTL)
+	serverFilter, _ := replayfilter.New(epochReplayTTL(defaultEpochTolerance, defaultEpochPeriod))
 	clientKeypair, err := ntor.NewKeypair(true)
 	if err != nil {
 		t.Fatalf("client: ntor.NewKeypair failed: %s", err)
@@ -135,7 +143,7 @@ func TestHandshakeNtorServer(t *testing.T) {
 	// Generate the server node id and id keypair, and ephemeral session keys.
 	nodeID, _ := ntor.NewNodeID([]byte("\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10\x11\x12\x13"))
 	idKeypair, _ := ntor.NewKeypair(false)
-	serverFilter, _ := replayfilter.New(replayTTL)
+	serverFilter, _ := replayfilter.New(epochReplayTTL(defaultEpochTolerance, defaultEpochPeriod))
 	clientKeypair, err := ntor.NewKeypair(true)
 	if err != nil {
 		t.Fatalf("client: ntor.NewKeypair failed: %s", err)
@@ -246,3 +254,426 @@ func TestHandshakeNtorServer(t *testing.T) {
 		t.Fatalf("clientHandshake.parseServerHandshake() succeeded (oversized)")
 	}
 }
+
+func TestHandshakeNtorVersion(t *testing.T) {
+	// Generate the server node id and id keypair.
+	nodeID, _ := ntor.NewNodeID([]byte("\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10\x11\x12\x13"))
+	idKeypair, _ := ntor.NewKeypair(false)
+	serverFilter, _ := replayfilter.New(epochReplayTTL(defaultEpochTolerance, defaultEpochPeriod))
+
+	// A maximum version of protocolVersion1 behaves identically to
+	// implementations that predate version negotiation.
+	for _, v := range []struct {
+		clientMax, serverMax, expected int
+	}{
+		{protocolVersion1, protocolVersion1, protocolVersion1}, // Old client, old server.
+		{2, protocolVersion1, protocolVersion1},                // New client, old server.
+		{protocolVersion1, 2, protocolVersion1},                // Old client, new server.
+		{2, 2, 2},
+		{3, 2, 2},
+		{2, 3, 2},
+	} {
+		clientKeypair, err := ntor.NewKeypair(true)
+		if err != nil {
+			t.Fatalf("client: ntor.NewKeypair failed: %s", err)
+		}
+		serverKeypair, err := ntor.NewKeypair(true)
+		if err != nil {
+			t.Fatalf("server: ntor.NewKeypair failed: %s", err)
+		}
+
+		clientHs := newClientHandshake(nodeID, idKeypair.Public(), clientKeypair)
+		clientHs.maxVersion = v.clientMax
+		clientBlob, err := clientHs.generateHandshake()
+		if err != nil {
+			t.Fatalf("[%d:%d] clientHandshake.generateHandshake() failed: %s", v.clientMax, v.serverMax, err)
+		}
+
+		serverHs := newServerHandshake(nodeID, idKeypair, serverKeypair)
+		serverHs.maxVersion = v.serverMax
+		serverHs.padLen = serverMinPadLength // Ensure the tag forces padding.
+		serverSeed, err := serverHs.parseClientHandshake(serverFilter, clientBlob)
+		if err != nil {
+			t.Fatalf("[%d:%d] serverHandshake.parseClientHandshake() failed: %s", v.clientMax, v.serverMax, err)
+		}
+		serverBlob, err := serverHs.generateHandshake()
+		if err != nil {
+			t.Fatalf("[%d:%d] serverHandshake.generateHandshake() failed: %s", v.clientMax, v.serverMax, err)
+		}
+
+		n, clientSeed, err := clientHs.parseServerHandshake(serverBlob)
+		if err != nil {
+			t.Fatalf("[%d:%d] clientHandshake.parseServerHandshake() failed: %s", v.clientMax, v.serverMax, err)
+		}
+		if n != len(serverBlob) {
+			t.Fatalf("[%d:%d] clientHandshake.parseServerHandshake() has bytes remaining: %d", v.clientMax, v.serverMax, n)
+		}
+		if !bytes.Equal(clientSeed, serverSeed) {
+			t.Fatalf("[%d:%d] client/server seed mismatch", v.clientMax, v.serverMax)
+		}
+
+		if serverHs.version != v.expected {
+			t.Fatalf("[%d:%d] server negotiated version %d, expected %d", v.clientMax, v.serverMax, serverHs.version, v.expected)
+		}
+		if clientHs.version != v.expected {
+			t.Fatalf("[%d:%d] client negotiated version %d, expected %d", v.clientMax, v.serverMax, clientHs.version, v.expected)
+		}
+	}
+}
+
+func TestHandshakeNtorFeatures(t *testing.T) {
+	nodeID, _ := ntor.NewNodeID([]byte("\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10\x11\x12\x13"))
+	idKeypair, _ := ntor.NewKeypair(false)
+	serverFilter, _ := replayfilter.New(epochReplayTTL(defaultEpochTolerance, defaultEpochPeriod))
+
+	const early = protocolFeatureEarlyPadding
+	for i, v := range []struct {
+		clientMax, clientFeatures int
+		serverMax, serverFeatures int
+		version, features         int
+	}{
+		{protocolVersion1, early, protocolVersion1, 0, protocolVersion1, 0}, // New client, old server.
+		{protocolVersion1, 0, protocolVersion1, early, protocolVersion1, 0}, // Old client, new server.
+		{protocolVersion1, early, protocolVersion1, early, protocolVersion1, early},
+		{2, early, 2, early, 2, early},
+		{2, early, protocolVersion1, early, protocolVersion1, early},
+		{protocolVersion1, early, 2, early, protocolVersion1, early},
+		{2, 0, 2, early, 2, 0},
+		{2, early, 2, 0, 2, 0},
+		{protocolVersion1, early | 0x20, protocolVersion1, early | 0x40, protocolVersion1, early},
+	} {
+		clientKeypair, _ := ntor.NewKeypair(true)
+		serverKeypair, _ := ntor.NewKeypair(true)
+
+		clientHs := newClientHandshake(nodeID, idKeypair.Public(), clientKeypair)
+		clientHs.maxVersion = v.clientMax
+		clientHs.setFeatures(v.clientFeatures)
+		clientBlob, err := clientHs.generateHandshake()
+		if err != nil {
+			t.Fatalf("[%d] clientHandshake.generateHandshake() failed: %s", i, err)
+		}
+
+		serverHs := newServerHandshake(nodeID, idKeypair, serverKeypair)
+		serverHs.maxVersion = v.serverMax
+		serverHs.setFeatures(v.serverFeatures)
+		serverHs.padLen = serverMinPadLength // Ensure the tag forces padding.
+		if _, err = serverHs.parseClientHandshake(serverFilter, clientBlob); err != nil {
+			t.Fatalf("[%d] serverHandshake.parseClientHandshake() failed: %s", i, err)
+		}
+		serverBlob, err := serverHs.generateHandshake()
+		if err != nil {
+			t.Fatalf("[%d] serverHandshake.generateHandshake() failed: %s", i, err)
+		}
+		if _, _, err = clientHs.parseServerHandshake(serverBlob); err != nil {
+			t.Fatalf("[%d] clientHandshake.parseServerHandshake() failed: %s", i, err)
+		}
+
+		for _, hs := range []struct {
+			side              string
+			version, features int
+		}{
+			{"client", clientHs.version, clientHs.features},
+			{"server", serverHs.version, serverHs.features},
+		} {
+			if hs.version != v.version || hs.features != v.features {
+				t.Fatalf("[%d] %s negotiated %d/%#x, expected %d/%#x", i, hs.side, hs.version, hs.features, v.version, v.features)
+			}
+		}
+	}
+}
+
+func TestCtEqual(t *testing.T) {
+	for _, v := range []struct {
+		a, b  []byte
+		equal bool
+	}{
+		{nil, nil, true},
+		{[]byte{}, nil, true},
+		{[]byte("mark"), []byte("mark"), true},
+		{[]byte("mark"), []byte("marK"), false},
+		{[]byte("mark"), []byte("mar"), false},
+		{[]byte("mar"), []byte("mark"), false},
+		{[]byte{0x00}, []byte{0x80}, false},
+	} {
+		if ctEqual(v.a, v.b) != v.equal {
+			t.Fatalf("ctEqual(%x, %x) != %v", v.a, v.b, v.equal)
+		}
+	}
+}
+
+func TestHandshakeNtorFixedLength(t *testing.T) {
+	nodeID, _ := ntor.NewNodeID([]byte("\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10\x11\x12\x13"))
+	idKeypair, _ := ntor.NewKeypair(false)
+	serverFilter, _ := replayfilter.New(epochReplayTTL(defaultEpochTolerance, defaultEpochPeriod))
+
+	for _, v := range []struct {
+		clientLength int
+		serverLength int
+		negotiate    bool
+	}{
+		{clientMinFixedHandshakeLength, serverMinFixedHandshakeLength, false},
+		{1024, 1024, false},
+		{clientMaxFixedHandshakeLength, serverMaxFixedHandshakeLength, false},
+
+		// The version tag echoed by the server must fit in the padding.
+		{clientMinFixedHandshakeLength, serverMinFixedHandshakeLength, true},
+		{clientMaxFixedHandshakeLength, serverMaxFixedHandshakeLength, true},
+	} {
+		clientKeypair, _ := ntor.NewKeypair(true)
+		serverKeypair, _ := ntor.NewKeypair(true)
+
+		clientHs := newClientHandshake(nodeID, idKeypair.Public(), clientKeypair)
+		clientHs.setHandshakeLength(v.clientLength)
+		if v.negotiate {
+			clientHs.setCompression()
+			clientHs.setFeatures(protocolFeatureEarlyPadding)
+		}
+		clientBlob, err := clientHs.generateHandshake()
+		if err != nil {
+			t.Fatalf("[%d] clientHandshake.generateHandshake() failed: %s", v.clientLength, err)
+		}
+		if len(clientBlob) != v.clientLength {
+			t.Fatalf("[%d] client handshake length: %d", v.clientLength, len(clientBlob))
+		}
+
+		serverHs := newServerHandshake(nodeID, idKeypair, serverKeypair)
+		serverHs.setHandshakeLength(v.serverLength)
+		if v.negotiate {
+			serverHs.setCompression()
+			serverHs.setFeatures(protocolFeatureEarlyPadding)
+		}
+		if _, err = serverHs.parseClientHandshake(serverFilter, clientBlob); err != nil {
+			t.Fatalf("[%d] serverHandshake.parseClientHandshake() failed: %s", v.clientLength, err)
+		}
+		if negotiated := serverHs.version > protocolVersion1 && serverHs.features != 0; negotiated != v.negotiate {
+			t.Fatalf("[%d] negotiated version %d, features %d", v.serverLength, serverHs.version, serverHs.features)
+		}
+		serverBlob, err := serverHs.generateHandshake()
+		if err != nil {
+			t.Fatalf("[%d] serverHandshake.generateHandshake() failed: %s", v.serverLength, err)
+		}
+		if len(serverBlob)+inlineSeedFrameLength != v.serverLength {
+			t.Fatalf("[%d] server handshake length: %d", v.serverLength, len(serverBlob)+inlineSeedFrameLength)
+		}
+
+		if _, _, err = clientHs.parseServerHandshake(serverBlob); err != nil {
+			t.Fatalf("[%d] clientHandshake.parseServerHandshake() failed: %s", v.serverLength, err)
+		}
+	}
+}
+
+func TestHandshakeNtorSeparateSeed(t *testing.T) {
+	nodeID, _ := ntor.NewNodeID([]byte("\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10\x11\x12\x13"))
+	idKeypair, _ := ntor.NewKeypair(false)
+	serverFilter, _ := replayfilter.New(epochReplayTTL(defaultEpochTolerance, defaultEpochPeriod))
+
+	// The fixed length includes the seed frame only when it is inlined.
+	for _, v := range []int{0, serverMinFixedHandshakeLength, serverMaxFixedHandshakeLength} {
+		for i := 0; i < 16; i++ {
+			clientKeypair, _ := ntor.NewKeypair(true)
+			serverKeypair, _ := ntor.NewKeypair(true)
+
+			clientHs := newClientHandshake(nodeID, idKeypair.Public(), clientKeypair)
+			clientBlob, err := clientHs.generateHandshake()
+			if err != nil {
+				t.Fatalf("[%d] clientHandshake.generateHandshake() failed: %s", v, err)
+			}
+
+			serverHs := newServerHandshake(nodeID, idKeypair, serverKeypair)
+			serverHs.setSeparateSeed()
+			if v > 0 {
+				serverHs.setHandshakeLength(v)
+			}
+			if _, err = serverHs.parseClientHandshake(serverFilter, clientBlob); err != nil {
+				t.Fatalf("[%d] serverHandshake.parseClientHandshake() failed: %s", v, err)
+			}
+			serverBlob, err := serverHs.generateHandshake()
+			if err != nil {
+				t.Fatalf("[%d] serverHandshake.generateHandshake() failed: %s", v, err)
+			}
+			if len(serverBlob) > maxHandshakeLength || (v > 0 && len(serverBlob) != v) {
+				t.Fatalf("[%d] server handshake length: %d", v, len(serverBlob))
+			}
+
+			if _, _, err = clientHs.parseServerHandshake(serverBlob); err != nil {
+				t.Fatalf("[%d] clientHandshake.parseServerHandshake() failed: %s", v, err)
+			}
+		}
+	}
+}
+
+func TestHandshakeNtorReplayEpochWindow(t *testing.T) {
+	nodeID, _ := ntor.NewNodeID([]byte("\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10\x11\x12\x13"))
+	idKeypair, _ := ntor.NewKeypair(false)
+
+	for _, period := range []time.Duration{defaultEpochPeriod, 30 * time.Minute, 2 * time.Hour} {
+		for tolerance := defaultEpochTolerance; tolerance <= maxEpochTolerance; tolerance++ {
+			testHandshakeNtorReplayEpochWindow(t, nodeID, idKeypair, tolerance, period)
+		}
+	}
+}
+
+func testHandshakeNtorReplayEpochWindow(t *testing.T, nodeID *ntor.NodeID, idKeypair *ntor.Keypair, tolerance int, period time.Duration) {
+	// The MAC is accepted for tolerance epochs on either side of the
+	// current one, so the replay filter must remember handshakes for the
+	// whole window.
+	ttl := epochReplayTTL(tolerance, period)
+	if macWindow := time.Duration(2*tolerance+1) * period; ttl < macWindow {
+		t.Fatalf("[%d, %v]: replay TTL %v does not cover the MAC acceptance window %v", tolerance, period, ttl, macWindow)
+	}
+
+	clientKeypair, _ := ntor.NewKeypair(true)
+	clientHs := newClientHandshake(nodeID, idKeypair.Public(), clientKeypair)
+	clientHs.setEpochPeriod(period)
+	clientBlob, err := clientHs.generateHandshake()
+	if err != nil {
+		t.Fatalf("[%d, %v]: clientHandshake.generateHandshake() failed: %s", tolerance, period, err)
+	}
+	epoch, _ := strconv.ParseInt(string(clientHs.epochHour), 10, 64)
+
+	// The first and last instants where the server will accept the MAC.
+	secs := int64(period / time.Second)
+	first := time.Unix((epoch-int64(tolerance))*secs, 0)
+	last := time.Unix((epoch+int64(tolerance)+1)*secs-1, 0)
+
+	parse := func(filter *replayfilter.ReplayFilter, now time.Time) error {
+		serverKeypair, _ := ntor.NewKeypair(true)
+		serverHs := newServerHandshake(nodeID, idKeypair, serverKeypair)
+		serverHs.setEpochTolerance(tolerance)
+		serverHs.setEpochPeriod(period)
+		_, err := serverHs.parseClientHandshakeAt(filter, clientBlob, now)
+		return err
+	}
+
+	// Sanity check the window boundaries with fresh filters.
+	for _, now := range []time.Time{first, last} {
+		filter, _ := replayfilter.New(ttl)
+		if err = parse(filter, now); err != nil {
+			t.Fatalf("[%d, %v, %v]: parseClientHandshake() failed: %s", tolerance, period, now, err)
+		}
+	}
+	for _, now := range []time.Time{first.Add(-time.Second), last.Add(time.Second)} {
+		filter, _ := replayfilter.New(ttl)
+		if err = parse(filter, now); !errors.Is(err, ErrInvalidHandshake) {
+			t.Fatalf("[%d, %v, %v]: parseClientHandshake() outside the window: %v", tolerance, period, now, err)
+		}
+	}
+
+	// A byte-identical handshake seen at the start of the window, and
+	// replayed at the end must be rejected.
+	filter, _ := replayfilter.New(ttl)
+	if err = parse(filter, first); err != nil {
+		t.Fatalf("[%d, %v]: parseClientHandshake() failed: %s", tolerance, period, err)
+	}
+	if err = parse(filter, last); !errors.Is(err, ErrReplayedHandshake) {
+		t.Fatalf("[%d, %v]: replayed parseClientHandshake(): %v", tolerance, period, err)
+	}
+
+	// A server with the default period rejects the handshake.
+	if period != defaultEpochPeriod {
+		serverKeypair, _ := ntor.NewKeypair(true)
+		serverHs := newServerHandshake(nodeID, idKeypair, serverKeypair)
+		filter, _ := replayfilter.New(ttl)
+		if _, err = serverHs.parseClientHandshakeAt(filter, clientBlob, first.Add(time.Duration(tolerance)*period)); !errors.Is(err, ErrInvalidHandshake) {
+			t.Fatalf("[%d, %v]: parseClientHandshake() with the default period: %v", tolerance, period, err)
+		}
+	}
+}
+
+func TestHandshakeNtorPassword(t *testing.T) {
+	nodeID, _ := ntor.NewNodeID([]byte("\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10\x11\x12\x13"))
+	idKeypair, _ := ntor.NewKeypair(false)
+	serverFilter, _ := replayfilter.New(epochReplayTTL(defaultEpochTolerance, defaultEpochPeriod))
+	serverPassword := []byte("hunter2")
+
+	for _, v := range []struct {
+		password []byte
+		ok       bool
+	}{
+		{serverPassword, true},
+		{[]byte("hunter3"), false},
+		{nil, false},
+	} {
+		clientKeypair, _ := ntor.NewKeypair(true)
+		serverKeypair, _ := ntor.NewKeypair(true)
+
+		// Use the maximum length so that the server gives up immediately
+		// instead of waiting for more data, if the mark is not found.
+		clientHs := newClientHandshake(nodeID, idKeypair.Public(), clientKeypair)
+		if v.password != nil {
+			clientHs.setPassword(v.password)
+		}
+		clientHs.setHandshakeLength(maxHandshakeLength)
+		clientBlob, err := clientHs.generateHandshake()
+		if err != nil {
+			t.Fatalf("[%q]: clientHandshake.generateHandshake() failed: %s", v.password, err)
+		}
+
+		serverHs := newServerHandshake(nodeID, idKeypair, serverKeypair)
+		serverHs.setPassword(serverPassword)
+		_, err = serverHs.parseClientHandshake(serverFilter, clientBlob)
+		if !v.ok {
+			if !errors.Is(err, ErrInvalidHandshake) {
+				t.Fatalf("[%q]: serverHandshake.parseClientHandshake(): %v", v.password, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("[%q]: serverHandshake.parseClientHandshake() failed: %s", v.password, err)
+		}
+
+		serverBlob, err := serverHs.generateHandshake()
+		if err != nil {
+			t.Fatalf("[%q]: serverHandshake.generateHandshake() failed: %s", v.password, err)
+		}
+		if _, _, err = clientHs.parseServerHandshake(serverBlob); err != nil {
+			t.Fatalf("[%q]: clientHandshake.parseServerHandshake() failed: %s", v.password, err)
+		}
+	}
+}
+
+func TestHandshakeNtorGolden(t *testing.T) {
+	// Swap in a deterministic entropy source.
+	defer func(r io.Reader) {
+		randReader = r
+	}(randReader)
+	randReader = hkdf.New(sha256.New, []byte("obfs4 deterministic handshake test"), nil, nil)
+
+	nodeID, _ := ntor.NewNodeID([]byte("\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10\x11\x12\x13"))
+	idKeypair, err := ntor.NewKeypairFromReader(randReader, false)
+	if err != nil {
+		t.Fatalf("ntor.NewKeypairFromReader() failed: %s", err)
+	}
+	clientKeypair, err := ntor.NewKeypairFromReader(randReader, true)
+	if err != nil {
+		t.Fatalf("ntor.NewKeypairFromReader() failed: %s", err)
+	}
+
+	clientHs := newClientHandshake(nodeID, idKeypair.Public(), clientKeypair)
+	clientHs.padLen = clientMinPadLength
+	clientBlob, err := clientHs.generateHandshake()
+	if err != nil {
+		t.Fatalf("clientHandshake.generateHandshake() failed: %s", err)
+	}
+
+	// X | P_C | M_C | MAC, where everything but the MAC (which covers the
+	// epoch) is deterministic.
+	const (
+		reprEnd = ntor.RepresentativeLength
+		padEnd  = reprEnd + clientMinPadLength
+		markEnd = padEnd + markLength
+	)
+	if len(clientBlob) != markEnd+macLength {
+		t.Fatalf("unexpected client handshake length: %d", len(clientBlob))
+	}
+	if !bytes.Equal(clientBlob[:reprEnd], clientKeypair.Representative().Bytes()[:]) {
+		t.Fatalf("client handshake does not start with X")
+	}
+	golden := "275a010e780ed736daf0578ea1b456cc6fd311da16f0bd3e578a0975ba9a216f" +
+		"9a3b081e5e900071782c664d2bc645e5540d5746a18ae1cce5416e3b88ffe253" +
+		"741b6c875e33119850366c563a4fd058d98a5d297f0e66bd92f2fec086574254" +
+		"6c8df48998fecffb0132706af50413be89df260f764d88a7a9f7005739"
+	if got := hex.EncodeToString(clientBlob[:markEnd]); got != golden {
+		t.Fatalf("client handshake mismatch:\n got: %s\nwant: %s", got, golden)
+	}
+}
@@ -0,0 +1,636 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package obfs4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+
+	"gitlab.com/yawning/obfs4.git/common/csrand"
+)
+
+const (
+	recordTypeChangeCipherSpec = 0x14
+	recordTypeHandshake        = 0x16
+	recordVersionHello         = 0x0301 // As sent in the ClientHello.
+
+	handshakeTypeClientHello = 0x01
+	handshakeTypeServerHello = 0x02
+
+	helloRandomLength    = 32
+	helloSessionIDLength = 32
+
+	extServerName           = 0x0000
+	extSupportedGroups      = 0x000a
+	extECPointFormats       = 0x000b
+	extSignatureAlgorithms  = 0x000d
+	extALPN                 = 0x0010
+	extExtendedMasterSecret = 0x0017
+	extPreSharedKey         = 0x0029
+	extSupportedVersions    = 0x002b
+	extPSKKeyExchangeModes  = 0x002d
+	extKeyShare             = 0x0033
+	extRenegotiationInfo    = 0xff01
+
+	cipherSuiteAES128GCMSHA256 = 0x1301
+	groupX25519MLKEM768        = 0x11ec
+	versionTLS13               = 0x0304
+
+	// The X25519MLKEM768 key shares are always exactly these lengths.
+	clientKeyShareLength = 1216
+	serverKeyShareLength = 1120
+
+	helloBinderLength    = 32 // HMAC-SHA256.
+	helloMinTicketLength = 128
+	helloMaxTicketLength = 256
+	helloMinFlightLength = 1024
+	helloMaxFlightLength = 2048
+	helloLengthMaskSize  = 4
+)
+
+// ErrInvalidHello is the error returned when the fake TLS ClientHello or
+// ServerHello is malformed.  This error is fatal and the connection MUST be
+// dropped.
+var ErrInvalidHello = errors.New("obfs4: invalid TLS hello")
+
+// helloCipherSuites is the list of cipher suites offered in the fake
+// ClientHello, which is the TLS 1.3 suites followed by the common TLS 1.2
+// ECDHE suites.
+var helloCipherSuites = []uint16{
+	0x1301, 0x1302, 0x1303,
+	0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8,
+}
+
+// helloSupportedGroups, helloSignatureAlgorithms and helloALPNProtocols are
+// offered in the fake ClientHello, as a current browser would.
+var (
+	helloSupportedGroups = []uint16{
+		groupX25519MLKEM768, 0x001d, 0x0017, 0x0018,
+	}
+	helloSignatureAlgorithms = []uint16{
+		0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601,
+	}
+	helloALPNProtocols = []string{"h2", "http/1.1"}
+)
+
+// changeCipherSpecRecord is the (middlebox compatibility mode) TLS 1.3
+// ChangeCipherSpec record sent by the server after the ServerHello.
+var changeCipherSpecRecord = []byte{recordTypeChangeCipherSpec, 0x03, 0x03, 0x00, 0x01, 0x01}
+
+// helloConn is an optional shaping layer that disguises the start of the
+// connection as a TLS 1.3 handshake, for traversing middleboxes that only
+// pass connections that start like TLS.  The first Write from the client is
+// carried in the X25519MLKEM768 key share of a fake ClientHello with a
+// random SNI, and what does not fit in the key share in a resumption PSK
+// identity.  The first Write from the server is carried in the key share of
+// a fake ServerHello, and what does not fit in the key share in an
+// application data record that stands in for the encrypted server flight.
+// Key shares are always the real lengths, and are padded with random data.
+// Everything after that is passed through as-is, including the tail of a
+// first Write too long to fit in the hello.  Like recordConn, it provides no
+// additional security, and is transparent to the rest of the protocol.
+type helloConn struct {
+	net.Conn
+
+	isServer  bool
+	sessionID []byte
+
+	pending    bytes.Buffer
+	wroteHello bool
+	readHello  bool
+}
+
+func newHelloConn(conn net.Conn, isServer bool) *helloConn {
+	return &helloConn{Conn: conn, isServer: isServer}
+}
+
+func (c *helloConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	if !c.readHello {
+		if err := c.readPeerHello(); err != nil {
+			return 0, err
+		}
+		c.readHello = true
+	}
+	if c.pending.Len() > 0 {
+		return c.pending.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *helloConn) Write(b []byte) (int, error) {
+	if len(b) == 0 || c.wroteHello {
+		return c.Conn.Write(b)
+	}
+
+	// The server can only echo the session ID once the ClientHello is read,
+	// which is always the case as the server never writes first.
+	if c.isServer && !c.readHello {
+		return 0, ErrInvalidHello
+	}
+
+	var (
+		buf bytes.Buffer
+		n   int
+		err error
+	)
+	if c.isServer {
+		n, err = writeServerHello(&buf, c.sessionID, b)
+	} else {
+		sessionID := make([]byte, helloSessionIDLength)
+		if err = csrand.Bytes(sessionID); err != nil {
+			return 0, err
+		}
+		n, err = writeClientHello(&buf, randomServerName(), sessionID, b)
+	}
+	if err != nil {
+		return 0, err
+	}
+	buf.Write(b[n:])
+	if _, err := c.Conn.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	c.wroteHello = true
+	return len(b), nil
+}
+
+func (c *helloConn) readPeerHello() error {
+	record, err := c.readRecord(recordTypeHandshake)
+	if err != nil {
+		return err
+	}
+
+	if c.isServer {
+		sessionID, data, err := parseClientHello(record)
+		if err != nil {
+			return err
+		}
+		c.sessionID = sessionID
+		c.pending.Write(data)
+		return nil
+	}
+
+	share, mask, err := parseServerHello(record)
+	if err != nil {
+		return err
+	}
+	var ccs [6]byte
+	if _, err = io.ReadFull(c.Conn, ccs[:]); err != nil {
+		return err
+	}
+	if !bytes.Equal(ccs[:], changeCipherSpecRecord) {
+		return ErrInvalidHello
+	}
+	flight, err := c.readRecord(recordTypeAppData)
+	if err != nil {
+		return err
+	}
+	data, err := parseServerFlight(share, flight, mask)
+	if err != nil {
+		return err
+	}
+	c.pending.Write(data)
+	return nil
+}
+
+func (c *helloConn) readRecord(recordType byte) ([]byte, error) {
+	var hdr [recordHeaderLength]byte
+	if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != recordType {
+		return nil, ErrInvalidHello
+	}
+	length := int(binary.BigEndian.Uint16(hdr[3:]))
+	if length > maxRecordPayloadLength {
+		return nil, ErrInvalidHello
+	}
+	record := make([]byte, length)
+	if _, err := io.ReadFull(c.Conn, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// writeClientHello writes a ClientHello record to w, carrying as much of
+// data as will fit in the key share and the PSK identity, and returns the
+// amount of data that was consumed.
+func writeClientHello(w *bytes.Buffer, serverName string, sessionID, data []byte) (int, error) {
+	var random [helloRandomLength]byte
+	if err := csrand.Bytes(random[:]); err != nil {
+		return 0, err
+	}
+
+	var body helloBuilder
+	body.putUint16(recordVersion)
+	body.Write(random[:])
+	body.putVector8(sessionID)
+	body.putUint16(uint16(2 * len(helloCipherSuites)))
+	for _, suite := range helloCipherSuites {
+		body.putUint16(suite)
+	}
+	body.putVector8([]byte{0x00}) // Compression methods: null.
+
+	var exts helloBuilder
+	var sni helloBuilder
+	sni.putUint16(uint16(3 + len(serverName)))
+	sni.WriteByte(0x00) // Name type: host_name.
+	sni.putVector16([]byte(serverName))
+	exts.putExtension(extServerName, sni.Bytes())
+	exts.putExtension(extExtendedMasterSecret, nil)
+	exts.putExtension(extRenegotiationInfo, []byte{0x00})
+	exts.putExtension(extSupportedGroups, uint16List(helloSupportedGroups))
+	exts.putExtension(extECPointFormats, []byte{0x01, 0x00})
+	var alpn helloBuilder
+	for _, proto := range helloALPNProtocols {
+		alpn.putVector8([]byte(proto))
+	}
+	exts.putExtension(extALPN, vector16(alpn.Bytes()))
+	exts.putExtension(extSignatureAlgorithms, uint16List(helloSignatureAlgorithms))
+
+	// The key share is always the real length, so the data that does not
+	// fit in it is carried in the identity of the PSK extension, which
+	// takes whatever room is left in the record.
+	share, overflow, n, err := splitHelloData(data, clientKeyShareLength)
+	if err != nil {
+		return 0, err
+	}
+	var keyShare helloBuilder
+	keyShare.putUint16(uint16(4 + len(share)))
+	keyShare.putUint16(groupX25519MLKEM768)
+	keyShare.putVector16(share)
+	exts.putExtension(extKeyShare, keyShare.Bytes())
+	exts.putExtension(extPSKKeyExchangeModes, []byte{0x01, 0x01}) // psk_dhe_ke.
+	exts.putExtension(extSupportedVersions, []byte{0x04, 0x03, 0x04, 0x03, 0x03})
+
+	const pskOverhead = 4 + 2 + 2 + 4 + 2 + 1 + helloBinderLength
+	room := maxRecordPayloadLength - (handshakeHeaderLength + body.Len() + 2 + exts.Len() + pskOverhead)
+	if len(overflow) > room {
+		n -= len(overflow) - room
+		overflow = overflow[:room]
+	}
+	ticketLength := csrand.IntRange(helloMinTicketLength, helloMaxTicketLength)
+	if ticketLength > room {
+		ticketLength = room
+	}
+	identity, err := padRandom(overflow, ticketLength)
+	if err != nil {
+		return 0, err
+	}
+	binder := make([]byte, helloBinderLength)
+	if err = csrand.Bytes(binder); err != nil {
+		return 0, err
+	}
+
+	// The amount of data carried is masked by the random, and sent as the
+	// obfuscated ticket age, which is random looking in real resumptions.
+	var psk helloBuilder
+	psk.putUint16(uint16(2 + len(identity) + 4))
+	psk.putVector16(identity)
+	psk.putUint32(uint32(n) ^ binary.BigEndian.Uint32(random[:]))
+	psk.putUint16(uint16(1 + len(binder)))
+	psk.putVector8(binder)
+	exts.putExtension(extPreSharedKey, psk.Bytes()) // Always last.
+	body.putVector16(exts.Bytes())
+
+	writeHandshakeRecord(w, handshakeTypeClientHello, recordVersionHello, body.Bytes())
+	return n, nil
+}
+
+// writeServerHello writes a ServerHello record, a ChangeCipherSpec record,
+// and an application data record to w, carrying as much of data as will fit
+// in the key share and the application data record, and returns the amount
+// of data that was consumed.
+func writeServerHello(w *bytes.Buffer, sessionID, data []byte) (int, error) {
+	var random [helloRandomLength]byte
+	if err := csrand.Bytes(random[:]); err != nil {
+		return 0, err
+	}
+
+	var body helloBuilder
+	body.putUint16(recordVersion)
+	body.Write(random[:])
+	body.putVector8(sessionID)
+	body.putUint16(cipherSuiteAES128GCMSHA256)
+	body.WriteByte(0x00) // Compression method: null.
+
+	share, overflow, n, err := splitHelloData(data, serverKeyShareLength)
+	if err != nil {
+		return 0, err
+	}
+	var exts helloBuilder
+	exts.putExtension(extSupportedVersions, []byte{0x03, 0x04})
+	var keyShare helloBuilder
+	keyShare.putUint16(groupX25519MLKEM768)
+	keyShare.putVector16(share)
+	exts.putExtension(extKeyShare, keyShare.Bytes())
+	body.putVector16(exts.Bytes())
+
+	writeHandshakeRecord(w, handshakeTypeServerHello, recordVersion, body.Bytes())
+	w.Write(changeCipherSpecRecord)
+
+	// The data that does not fit in the key share is carried in a record
+	// standing in for the encrypted server flight, prefixed by the masked
+	// amount of data carried.
+	if room := maxRecordPayloadLength - helloLengthMaskSize; len(overflow) > room {
+		n -= len(overflow) - room
+		overflow = overflow[:room]
+	}
+	var flight helloBuilder
+	flight.putUint32(uint32(n) ^ binary.BigEndian.Uint32(random[:]))
+	flight.Write(overflow)
+	padded, err := padRandom(flight.Bytes(), csrand.IntRange(helloMinFlightLength, helloMaxFlightLength))
+	if err != nil {
+		return 0, err
+	}
+	w.Write(makeRecordHeader(len(padded)))
+	w.Write(padded)
+	return n, nil
+}
+
+// splitHelloData splits data into a key share of exactly shareLength bytes,
+// padded with random data if needed, and the data that does not fit in the
+// key share, and returns the amount of data consumed by both.
+func splitHelloData(data []byte, shareLength int) ([]byte, []byte, int, error) {
+	if len(data) <= shareLength {
+		share, err := padRandom(data, shareLength)
+		return share, nil, len(data), err
+	}
+	return data[:shareLength], data[shareLength:], len(data), nil
+}
+
+// padRandom returns b, padded to length with random data if it is shorter.
+func padRandom(b []byte, length int) ([]byte, error) {
+	if len(b) >= length {
+		return b, nil
+	}
+	padded := make([]byte, length)
+	copy(padded, b)
+	if err := csrand.Bytes(padded[len(b):]); err != nil {
+		return nil, err
+	}
+	return padded, nil
+}
+
+const handshakeHeaderLength = 4
+
+func writeHandshakeRecord(w *bytes.Buffer, msgType byte, version uint16, body []byte) {
+	var hdr [recordHeaderLength + handshakeHeaderLength]byte
+	hdr[0] = recordTypeHandshake
+	binary.BigEndian.PutUint16(hdr[1:], version)
+	binary.BigEndian.PutUint16(hdr[3:], uint16(handshakeHeaderLength+len(body)))
+	hdr[5] = msgType
+	hdr[6] = byte(len(body) >> 16)
+	binary.BigEndian.PutUint16(hdr[7:], uint16(len(body)))
+	w.Write(hdr[:])
+	w.Write(body)
+}
+
+// parseClientHello returns the session ID and the data carried in the key
+// share and PSK identity of a ClientHello record written by
+// writeClientHello.
+func parseClientHello(record []byte) ([]byte, []byte, error) {
+	r, err := newHelloReader(record, handshakeTypeClientHello)
+	if err != nil {
+		return nil, nil, err
+	}
+	r.skip(2)
+	random := r.next(helloRandomLength)
+	sessionID := r.vector8()
+	r.skip(int(r.uint16())) // Cipher suites.
+	r.vector8()             // Compression methods.
+	exts := r.extensions()
+	keyShare, psk := exts[extKeyShare], exts[extPreSharedKey]
+	if keyShare == nil || psk == nil || r.err != nil {
+		return nil, nil, ErrInvalidHello
+	}
+
+	s := helloReader{b: keyShare}
+	s.skip(2) // Client shares length.
+	s.skip(2) // Group.
+	share := s.vector16()
+	p := helloReader{b: psk}
+	p.skip(2) // Identities length.
+	identity := p.vector16()
+	age := p.uint32()
+	if s.err != nil || p.err != nil || len(share) != clientKeyShareLength {
+		return nil, nil, ErrInvalidHello
+	}
+
+	data, err := joinHelloData(share, identity, age^binary.BigEndian.Uint32(random))
+	if err != nil {
+		return nil, nil, err
+	}
+	return sessionID, data, nil
+}
+
+// parseServerHello returns the key share of a ServerHello record written by
+// writeServerHello, and the mask for the amount of data carried.
+func parseServerHello(record []byte) ([]byte, uint32, error) {
+	r, err := newHelloReader(record, handshakeTypeServerHello)
+	if err != nil {
+		return nil, 0, err
+	}
+	r.skip(2)
+	random := r.next(helloRandomLength)
+	r.vector8()   // Session ID.
+	r.skip(2 + 1) // Cipher suite, compression method.
+	keyShare := r.extensions()[extKeyShare]
+	if keyShare == nil || r.err != nil {
+		return nil, 0, ErrInvalidHello
+	}
+
+	s := helloReader{b: keyShare}
+	s.skip(2) // Group.
+	share := s.vector16()
+	if s.err != nil || len(share) != serverKeyShareLength {
+		return nil, 0, ErrInvalidHello
+	}
+	return share, binary.BigEndian.Uint32(random), nil
+}
+
+// parseServerFlight returns the data carried in the key share of a
+// ServerHello record and the application data record that follows it, as
+// written by writeServerHello.
+func parseServerFlight(share, flight []byte, mask uint32) ([]byte, error) {
+	f := helloReader{b: flight}
+	masked := f.uint32()
+	if f.err != nil {
+		return nil, ErrInvalidHello
+	}
+	return joinHelloData(share, f.b, masked^mask)
+}
+
+// joinHelloData returns the length bytes of data carried in share and
+// overflow, ignoring the random padding.
+func joinHelloData(share, overflow []byte, length uint32) ([]byte, error) {
+	if uint64(length) > uint64(len(share)+len(overflow)) {
+		return nil, ErrInvalidHello
+	}
+	data := append(bytes.Clone(share), overflow...)
+	return data[:length], nil
+}
+
+// randomServerName returns a random plausible looking host name for the
+// SNI extension, like Tor does for its TLS certificates.
+func randomServerName() string {
+	const alphabet = "abcdefghijklmnopqrstuvwxyz"
+	name := make([]byte, csrand.IntRange(8, 20))
+	for i := range name {
+		name[i] = alphabet[csrand.Intn(len(alphabet))]
+	}
+	return "www." + string(name) + ".com"
+}
+
+type helloBuilder struct {
+	bytes.Buffer
+}
+
+func (b *helloBuilder) putUint16(v uint16) {
+	var tmp [2]byte
+	binary.BigEndian.PutUint16(tmp[:], v)
+	b.Write(tmp[:])
+}
+
+func (b *helloBuilder) putUint32(v uint32) {
+	var tmp [4]byte
+	binary.BigEndian.PutUint32(tmp[:], v)
+	b.Write(tmp[:])
+}
+
+func (b *helloBuilder) putVector8(v []byte) {
+	b.WriteByte(byte(len(v)))
+	b.Write(v)
+}
+
+func (b *helloBuilder) putVector16(v []byte) {
+	b.putUint16(uint16(len(v)))
+	b.Write(v)
+}
+
+func (b *helloBuilder) putExtension(extType uint16, data []byte) {
+	b.putUint16(extType)
+	b.putVector16(data)
+}
+
+// vector16 returns v prefixed by its 16 bit length.
+func vector16(v []byte) []byte {
+	var b helloBuilder
+	b.putVector16(v)
+	return b.Bytes()
+}
+
+// uint16List returns vs as a vector of 16 bit values, prefixed by its 16 bit
+// length.
+func uint16List(vs []uint16) []byte {
+	var b helloBuilder
+	b.putUint16(uint16(2 * len(vs)))
+	for _, v := range vs {
+		b.putUint16(v)
+	}
+	return b.Bytes()
+}
+
+// helloReader is a minimal bounds checked TLS message parser.  The first
+// error is sticky, and all subsequent reads return zero values.
+type helloReader struct {
+	b   []byte
+	err error
+}
+
+func newHelloReader(record []byte, msgType byte) (*helloReader, error) {
+	if len(record) < handshakeHeaderLength || record[0] != msgType {
+		return nil, ErrInvalidHello
+	}
+	length := int(record[1])<<16 | int(binary.BigEndian.Uint16(record[2:]))
+	if length != len(record)-handshakeHeaderLength {
+		return nil, ErrInvalidHello
+	}
+	return &helloReader{b: record[handshakeHeaderLength:]}, nil
+}
+
+func (r *helloReader) next(n int) []byte {
+	if r.err != nil || n > len(r.b) {
+		r.err = ErrInvalidHello
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *helloReader) skip(n int) {
+	r.next(n)
+}
+
+func (r *helloReader) uint16() uint16 {
+	if v := r.next(2); v != nil {
+		return binary.BigEndian.Uint16(v)
+	}
+	return 0
+}
+
+func (r *helloReader) uint32() uint32 {
+	if v := r.next(4); v != nil {
+		return binary.BigEndian.Uint32(v)
+	}
+	return 0
+}
+
+func (r *helloReader) vector8() []byte {
+	if v := r.next(1); v != nil {
+		return r.next(int(v[0]))
+	}
+	return nil
+}
+
+func (r *helloReader) vector16() []byte {
+	return r.next(int(r.uint16()))
+}
+
+// extensions returns the bodies of the extensions, by type.
+func (r *helloReader) extensions() map[uint16][]byte {
+	exts := helloReader{b: r.vector16()}
+	m := make(map[uint16][]byte)
+	for r.err == nil && len(exts.b) > 0 {
+		t := exts.uint16()
+		data := exts.vector16()
+		if exts.err != nil {
+			r.err = exts.err
+			return nil
+		}
+		m[t] = data
+	}
+	return m
+}
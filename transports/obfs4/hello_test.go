@@ -0,0 +1,200 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package obfs4
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+)
+
+func TestHelloConn_RoundTrip(t *testing.T) {
+	for _, size := range []int{1, maxHandshakeLength, 2 * maxRecordPayloadLength} {
+		clientRaw, serverRaw := net.Pipe()
+		client, server := newHelloConn(clientRaw, false), newHelloConn(serverRaw, true)
+
+		// The largest first write does not fit in the hello, and the tail
+		// is sent as-is.
+		msg := make([]byte, size)
+		for i := range msg {
+			msg[i] = byte(i)
+		}
+		for step, v := range []struct {
+			src, dst *helloConn
+		}{
+			{client, server},
+			{server, client},
+			{client, server},
+		} {
+			writeCh := make(chan error, 1)
+			go func(src *helloConn) {
+				_, err := src.Write(msg)
+				writeCh <- err
+			}(v.src)
+			buf := make([]byte, len(msg))
+			if _, err := io.ReadFull(v.dst, buf); err != nil {
+				t.Fatalf("[%d, %d]: Read() failed: %s", size, step, err)
+			}
+			if err := <-writeCh; err != nil {
+				t.Fatalf("[%d, %d]: Write() failed: %s", size, step, err)
+			}
+			if !bytes.Equal(buf, msg) {
+				t.Fatalf("[%d, %d]: payload mismatch", size, step)
+			}
+		}
+		if len(server.sessionID) != helloSessionIDLength {
+			t.Fatalf("[%d]: session ID not recorded by the server", size)
+		}
+		clientRaw.Close()
+		serverRaw.Close()
+	}
+}
+
+func TestHelloConn_Framing(t *testing.T) {
+	clientRaw, serverRaw := net.Pipe()
+	defer clientRaw.Close()
+	defer serverRaw.Close()
+	client := newHelloConn(clientRaw, false)
+
+	msg := []byte("hello")
+	go func() {
+		_, _ = client.Write(msg)
+	}()
+	var hdr [recordHeaderLength + handshakeHeaderLength]byte
+	if _, err := io.ReadFull(serverRaw, hdr[:]); err != nil {
+		t.Fatalf("Read() failed: %s", err)
+	}
+	if !bytes.Equal(hdr[:3], []byte{0x16, 0x03, 0x01}) || hdr[5] != handshakeTypeClientHello {
+		t.Fatalf("unexpected ClientHello header: %x", hdr)
+	}
+	record := make([]byte, int(hdr[3])<<8|int(hdr[4]))
+	copy(record, hdr[recordHeaderLength:])
+	if _, err := io.ReadFull(serverRaw, record[handshakeHeaderLength:]); err != nil {
+		t.Fatalf("Read() failed: %s", err)
+	}
+
+	// The SNI is present, and the payload is carried in the key share.
+	r, err := newHelloReader(record, handshakeTypeClientHello)
+	if err != nil {
+		t.Fatalf("newHelloReader() failed: %s", err)
+	}
+	r.skip(2 + helloRandomLength)
+	r.vector8()
+	r.skip(int(r.uint16()))
+	r.vector8()
+	exts := r.extensions()
+	if sni := exts[extServerName]; r.err != nil || !bytes.Contains(sni, []byte("www.")) {
+		t.Fatalf("SNI extension missing: %x", sni)
+	}
+	for _, ext := range []uint16{extSupportedGroups, extSignatureAlgorithms, extALPN, extSupportedVersions} {
+		if exts[ext] == nil {
+			t.Fatalf("extension %#04x missing", ext)
+		}
+	}
+
+	// The key share is the real X25519MLKEM768 length, regardless of the
+	// payload length.
+	if share := exts[extKeyShare]; len(share) != 2+2+2+clientKeyShareLength {
+		t.Fatalf("unexpected key share length: %d", len(share))
+	}
+	_, data, err := parseClientHello(record)
+	if err != nil {
+		t.Fatalf("parseClientHello() failed: %s", err)
+	}
+	if !bytes.Equal(data, msg) {
+		t.Fatalf("unexpected key share payload: %x", data)
+	}
+}
+
+func TestHelloConn_Malformed(t *testing.T) {
+	for _, v := range []struct {
+		name     string
+		isServer bool
+		data     []byte
+	}{
+		{"record type", true, []byte{0x17, 0x03, 0x03, 0x00, 0x01, 0x00}},
+		{"record length", true, []byte{0x16, 0x03, 0x01, 0x40, 0x01, 0x00}},
+		{"message type", true, []byte{0x16, 0x03, 0x01, 0x00, 0x04, 0x02, 0x00, 0x00, 0x00}},
+		{"truncated", true, []byte{0x16, 0x03, 0x01, 0x00, 0x06, 0x01, 0x00, 0x00, 0x02, 0x03, 0x03}},
+		{"server hello", false, []byte{0x16, 0x03, 0x03, 0x00, 0x04, 0x01, 0x00, 0x00, 0x00}},
+	} {
+		clientRaw, serverRaw := net.Pipe()
+		go func() {
+			_, _ = clientRaw.Write(v.data)
+		}()
+		_, err := newHelloConn(serverRaw, v.isServer).Read(make([]byte, 16))
+		if !errors.Is(err, ErrInvalidHello) {
+			t.Errorf("%s: Read() returned %v, expected ErrInvalidHello", v.name, err)
+		}
+		clientRaw.Close()
+		serverRaw.Close()
+	}
+}
+
+func TestObfs4Conn_TLSHello(t *testing.T) {
+	// Off by default.
+	client, server := newTestConnPair(t, iatNone, nil)
+	if _, ok := client.Conn.(*helloConn); ok {
+		t.Fatalf("client connection wrapped by default")
+	}
+	if _, ok := server.Conn.(*helloConn); ok {
+		t.Fatalf("server connection wrapped by default")
+	}
+	client.Close()
+	server.Close()
+
+	for _, records := range []bool{false, true} {
+		serverArgs := &pt.Args{}
+		serverArgs.Add(tlsHelloArg, "true")
+		if records {
+			serverArgs.Add(tlsRecordsArg, "true")
+		}
+		client, server := newTestConnPair(t, iatNone, serverArgs)
+		if _, ok := client.rawConn().(*helloConn); ok {
+			t.Fatalf("rawConn() did not unwrap the hello")
+		}
+
+		msg := []byte("hello")
+		go func() {
+			_, _ = client.Write(msg)
+		}()
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(server, buf); err != nil {
+			t.Fatalf("[%v]: Read() failed: %s", records, err)
+		}
+		if !bytes.Equal(buf, msg) {
+			t.Fatalf("[%v]: payload mismatch", records)
+		}
+		client.Close()
+		server.Close()
+	}
+}
@@ -0,0 +1,89 @@
+//go:build obfs4_debug
+
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package obfs4
+
+// DEBUG BUILDS ONLY.
+//
+// Builds with the obfs4_debug tag append the key material of every obfs4
+// session to the file named by the OBFS4_KEYLOGFILE environment variable,
+// if set, à la SSLKEYLOGFILE.  Anyone with the file can decrypt the logged
+// sessions, so this is only for developers debugging their own traffic, and
+// such builds MUST NEVER be deployed or distributed.
+//
+// Each line is "OBFS4_SESSION <X'> <OKM>", in hex, where X' is the client's
+// Elligator 2 representative (the first 32 bytes of the connection), and
+// OKM the 2 * framing.KeyLength bytes of key material, of which the first
+// half keys the client to server direction, and the second half the server
+// to client direction.  A process that is both client and server logs each
+// session twice.
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+
+	"gitlab.com/yawning/obfs4.git/common/log"
+	"gitlab.com/yawning/obfs4.git/common/ntor"
+)
+
+const keyLogEnv = "OBFS4_KEYLOGFILE"
+
+var (
+	keyLogLock   sync.Mutex
+	keyLogWarned bool
+)
+
+// writeKeyLog appends the session's key material to the key log file, if
+// enabled.
+func writeKeyLog(clientRepresentative *ntor.Representative, okm []byte) {
+	path := os.Getenv(keyLogEnv)
+	if path == "" {
+		return
+	}
+
+	keyLogLock.Lock()
+	defer keyLogLock.Unlock()
+
+	if !keyLogWarned {
+		log.Warnf("%s - DEBUG BUILD, logging the session keys to %s", transportName, path)
+		keyLogWarned = true
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		log.Errorf("%s - failed to open the key log: %s", transportName, err)
+		return
+	}
+	defer f.Close()
+	if _, err = fmt.Fprintf(f, "OBFS4_SESSION %s %s\n", hex.EncodeToString(clientRepresentative.Bytes()[:]), hex.EncodeToString(okm)); err != nil {
+		log.Errorf("%s - failed to write the key log: %s", transportName, err)
+	}
+}
@@ -0,0 +1,99 @@
+//go:build obfs4_debug
+
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package obfs4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.com/yawning/obfs4.git/common/ntor"
+	"gitlab.com/yawning/obfs4.git/transports/obfs4/framing"
+)
+
+func TestKeyLog(t *testing.T) {
+	keyLogPath := filepath.Join(t.TempDir(), "keylog.txt")
+	t.Setenv(keyLogEnv, keyLogPath)
+
+	client, server := newTestConnPair(t, iatNone, nil)
+
+	// Both sides of the session log the same key material.
+	raw, err := os.ReadFile(keyLogPath)
+	if err != nil {
+		t.Fatalf("os.ReadFile() failed: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	if len(lines) != 2 || lines[0] != lines[1] {
+		t.Fatalf("unexpected key log: %q", raw)
+	}
+	fields := strings.Fields(lines[0])
+	if len(fields) != 3 || fields[0] != "OBFS4_SESSION" {
+		t.Fatalf("malformed key log line: %q", lines[0])
+	}
+	if repr, err := hex.DecodeString(fields[1]); err != nil || len(repr) != ntor.RepresentativeLength {
+		t.Fatalf("malformed client representative: %q", fields[1])
+	}
+	okm, err := hex.DecodeString(fields[2])
+	if err != nil || len(okm) != 2*framing.KeyLength {
+		t.Fatalf("malformed key material: %q", fields[2])
+	}
+
+	// Capture the client's traffic past the handshake, and decode it with
+	// the logged client to server key material.
+	rec := &captureConn{Conn: server.Conn}
+	server.Conn = rec
+	msg := []byte("decrypt me, I'm a debug build")
+	go func() {
+		_, _ = client.Write(msg)
+	}()
+	buf := make([]byte, len(msg))
+	if _, err = server.Read(buf); err != nil {
+		t.Fatalf("Read() failed: %s", err)
+	}
+
+	decoder := framing.NewDecoder(okm[:framing.KeyLength])
+	var decoded [framing.MaximumFramePayloadLength]byte
+	n, err := decoder.Decode(decoded[:], bytes.NewBuffer(rec.ReadBytes()))
+	if err != nil {
+		t.Fatalf("Decode() of the captured stream failed: %s", err)
+	}
+	pkt := decoded[:n]
+	if pkt[0] != packetTypePayload {
+		t.Fatalf("captured packet type %d", pkt[0])
+	}
+	payloadLen := binary.BigEndian.Uint16(pkt[1:])
+	if payload := pkt[packetOverhead : packetOverhead+int(payloadLen)]; !bytes.Equal(payload, msg) {
+		t.Fatalf("captured payload %q, expected %q", payload, msg)
+	}
+}
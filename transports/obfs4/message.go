@@ -0,0 +1,178 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package obfs4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"gitlab.com/yawning/obfs4.git/transports/obfs4/framing"
+)
+
+const (
+	messageHeaderLength = 4
+
+	// MaximumMessageLength is the length of the largest message that can be
+	// sent when message mode is enabled.
+	MaximumMessageLength = 1024 * 1024
+)
+
+// ErrNotMessageMode is the error returned when ReadMessage is called on a
+// connection that does not have message mode enabled.
+var ErrNotMessageMode = errors.New("obfs4: message mode not enabled")
+
+// InvalidMessageLengthError is the error returned when a message exceeds
+// MaximumMessageLength.
+type InvalidMessageLengthError int
+
+func (e InvalidMessageLengthError) Error() string {
+	return fmt.Sprintf("obfs4: Invalid message length: %d", int(e))
+}
+
+// MessageConn is a net.Conn that can preserve Write boundaries.
+//
+// When message mode is enabled (via the "message-mode=1" argument on both the
+// client and the server), each Write is sent as a discrete record that
+// ReadMessage returns in its entirety.  Read will also never return data
+// spanning more than one record.  Records are carried as regular payload, so
+// message mode is invisible on the wire.
+type MessageConn interface {
+	net.Conn
+
+	// ReadMessage returns the next message, or the remainder of the current
+	// message if it was partially consumed by Read.
+	ReadMessage() ([]byte, error)
+}
+
+func (conn *obfs4Conn) ReadMessage() ([]byte, error) {
+	if !conn.messageMode {
+		return nil, ErrNotMessageMode
+	}
+
+	defer conn.lockRead()()
+
+	if conn.messageRemaining == 0 {
+		if err := conn.readMessageHeader(); err != nil {
+			return nil, err
+		}
+	}
+	if err := conn.fillDecoded(conn.messageRemaining); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, conn.messageRemaining)
+	_, _ = conn.receiveDecodedBuffer.Read(msg)
+	conn.messageRemaining = 0
+
+	return msg, nil
+}
+
+func (conn *obfs4Conn) readMessagePart(b []byte) (int, error) {
+	if conn.messageRemaining == 0 {
+		if err := conn.readMessageHeader(); err != nil {
+			return 0, err
+		}
+		if conn.messageRemaining == 0 {
+			// Empty message.
+			return 0, nil
+		}
+	}
+	if err := conn.fillDecoded(1); err != nil {
+		return 0, err
+	}
+
+	toRead := len(b)
+	if toRead > conn.messageRemaining {
+		toRead = conn.messageRemaining
+	}
+	n, _ := conn.receiveDecodedBuffer.Read(b[:toRead])
+	conn.messageRemaining -= n
+
+	return n, nil
+}
+
+func (conn *obfs4Conn) readMessageHeader() error {
+	if err := conn.fillDecoded(messageHeaderLength); err != nil {
+		return err
+	}
+
+	msgLen := binary.BigEndian.Uint32(conn.receiveDecodedBuffer.Next(messageHeaderLength))
+	if msgLen > MaximumMessageLength {
+		return InvalidMessageLengthError(msgLen)
+	}
+	if conn.receiveLimit > 0 && int(msgLen) > conn.receiveLimit {
+		// The entire message needs to be buffered, which is not possible.
+		return InvalidMessageLengthError(msgLen)
+	}
+	conn.messageRemaining = int(msgLen)
+
+	return nil
+}
+
+func (conn *obfs4Conn) writeMessage(b []byte) (int, error) {
+	if len(b) > MaximumMessageLength {
+		return 0, InvalidMessageLengthError(len(b))
+	}
+
+	// Messages are sent as a 32 bit big endian length followed by the
+	// message body.  Unlike the stream case, empty messages are meaningful
+	// and are sent.
+	record := make([]byte, messageHeaderLength+len(b))
+	binary.BigEndian.PutUint32(record, uint32(len(b)))
+	copy(record[messageHeaderLength:], b)
+
+	n, err := conn.write(record)
+	n -= messageHeaderLength
+	if n < 0 {
+		n = 0
+	}
+
+	return n, err
+}
+
+// fillDecoded consumes data off the network till at least n bytes of payload
+// are buffered, or an error occurs.
+func (conn *obfs4Conn) fillDecoded(n int) error {
+	for conn.receiveDecodedBuffer.Len() < n {
+		err := conn.readPackets()
+		if errors.Is(err, framing.ErrAgain) {
+			continue
+		} else if err != nil {
+			if conn.receiveDecodedBuffer.Len() >= n {
+				// Relay the data that was decoded before the error, the
+				// error will be seen on the next call.
+				return nil
+			}
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,296 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package obfs4
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+
+	"gitlab.com/yawning/obfs4.git/transports/base"
+)
+
+// Bridge is an obfs4 bridge that a MultiDialer connects to.
+type Bridge struct {
+	// Address is the "host:port" of the bridge.
+	Address string
+
+	// Args are the bridge line arguments (cert, iat-mode, ...).
+	Args *pt.Args
+}
+
+// ParseBridgeLine parses a torrc style obfs4 bridge line, of the form
+// "[Bridge] obfs4 host:port [fingerprint] key=value ...", where IPv6
+// addresses are enclosed in brackets.  The address and the server's
+// arguments (cert, iat-mode) are validated, so the returned Args can be
+// passed to the client factory's ParseArgs.
+func ParseBridgeLine(line string) (*Bridge, error) {
+	fields := strings.Fields(line)
+	if len(fields) > 0 && strings.EqualFold(fields[0], "Bridge") {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 || fields[0] != transportName {
+		return nil, fmt.Errorf("invalid obfs4 bridge line: '%s'", line)
+	}
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("invalid obfs4 bridge line: missing address")
+	}
+	if err := validateBridgeAddress(fields[1]); err != nil {
+		return nil, err
+	}
+
+	b := &Bridge{
+		Address: fields[1],
+		Args:    &pt.Args{},
+	}
+	for i, kv := range fields[2:] {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			// The (optional) fingerprint comes before the arguments.
+			if i == 0 {
+				continue
+			}
+			return nil, fmt.Errorf("invalid bridge argument: '%s'", kv)
+		}
+		b.Args.Add(k, v)
+	}
+	if _, _, _, err := parseBridgeArgs(b.Args); err != nil {
+		return nil, fmt.Errorf("invalid obfs4 bridge line: %w", err)
+	}
+	return b, nil
+}
+
+func validateBridgeAddress(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid bridge address '%s': %w", addr, err)
+	}
+	if host == "" {
+		return fmt.Errorf("invalid bridge address '%s': missing host", addr)
+	}
+	if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+		return fmt.Errorf("invalid bridge address '%s': invalid IPv6 address", addr)
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+		return fmt.Errorf("invalid bridge address '%s': invalid port '%s'", addr, port)
+	}
+	return nil
+}
+
+// BridgeError is the error returned when connecting to a bridge fails.
+type BridgeError struct {
+	// Address is the address of the bridge.
+	Address string
+
+	// Err is the underlying error.
+	Err error
+}
+
+// Error returns the string representation of the error.
+func (e *BridgeError) Error() string {
+	return e.Address + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *BridgeError) Unwrap() error {
+	return e.Err
+}
+
+// MultiDialError is the error returned when connecting to every bridge of a
+// MultiDialer fails.
+type MultiDialError []*BridgeError
+
+// Error returns the string representation of the error.
+func (e MultiDialError) Error() string {
+	strs := make([]string, 0, len(e))
+	for _, err := range e {
+		strs = append(strs, err.Error())
+	}
+	return "obfs4: all bridges failed: " + strings.Join(strs, "; ")
+}
+
+// Unwrap returns the per-bridge errors.
+func (e MultiDialError) Unwrap() []error {
+	errs := make([]error, 0, len(e))
+	for _, err := range e {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// BridgeStatus is the dial history of a MultiDialer bridge.
+type BridgeStatus struct {
+	// Address is the address of the bridge.
+	Address string
+
+	// Successes and Failures are the number of successful and failed
+	// connection attempts.
+	Successes int
+	Failures  int
+
+	// LastErr is the error from the most recent failed attempt, if any.
+	LastErr error
+}
+
+// MultiDialer connects to one of several obfs4 bridges, for redundancy.
+type MultiDialer struct {
+	cf      base.ClientFactory
+	dialFn  base.DialFunc
+	bridges []Bridge
+	race    bool
+
+	lock   sync.Mutex
+	next   int
+	status []BridgeStatus
+}
+
+// NewMultiDialer returns a MultiDialer that connects to the bridges with
+// dialFn.  Each Dial tries the bridges in turn (round-robin, starting with
+// the one after the bridge used for the previous Dial), until a handshake
+// succeeds, or if race is set, handshakes with all of them concurrently,
+// and uses the first to succeed.
+func NewMultiDialer(bridges []Bridge, dialFn base.DialFunc, race bool) (*MultiDialer, error) {
+	if len(bridges) == 0 {
+		return nil, errors.New("obfs4: no bridges")
+	}
+
+	cf, err := new(Transport).ClientFactory("")
+	if err != nil {
+		return nil, err
+	}
+	d := &MultiDialer{
+		cf:      cf,
+		dialFn:  dialFn,
+		bridges: append([]Bridge{}, bridges...),
+		race:    race,
+		status:  make([]BridgeStatus, len(bridges)),
+	}
+	for i, b := range d.bridges {
+		// Validate the arguments up front, rather than on each Dial.
+		if _, err = cf.ParseArgs(b.Args); err != nil {
+			return nil, &BridgeError{Address: b.Address, Err: err}
+		}
+		d.status[i].Address = b.Address
+	}
+	return d, nil
+}
+
+// Dial connects to one of the bridges.  If all of them fail, the returned
+// error is a MultiDialError.
+func (d *MultiDialer) Dial() (net.Conn, error) {
+	if d.race {
+		return d.dialRace()
+	}
+
+	d.lock.Lock()
+	start := d.next
+	d.next = (d.next + 1) % len(d.bridges)
+	d.lock.Unlock()
+
+	var errs MultiDialError
+	for i := 0; i < len(d.bridges); i++ {
+		idx := (start + i) % len(d.bridges)
+		conn, err := d.dialBridge(idx)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errs
+}
+
+func (d *MultiDialer) dialRace() (net.Conn, error) {
+	type dialResult struct {
+		conn net.Conn
+		err  *BridgeError
+	}
+	resultChan := make(chan dialResult, len(d.bridges))
+	for i := range d.bridges {
+		go func(idx int) {
+			conn, err := d.dialBridge(idx)
+			resultChan <- dialResult{conn, err}
+		}(i)
+	}
+
+	var errs MultiDialError
+	for n := 1; n <= len(d.bridges); n++ {
+		res := <-resultChan
+		if res.err != nil {
+			errs = append(errs, res.err)
+			continue
+		}
+
+		// Close the losers in the background, as they complete.
+		go func(remaining int) {
+			for i := 0; i < remaining; i++ {
+				if res := <-resultChan; res.err == nil {
+					res.conn.Close()
+				}
+			}
+		}(len(d.bridges) - n)
+		return res.conn, nil
+	}
+	return nil, errs
+}
+
+func (d *MultiDialer) dialBridge(idx int) (net.Conn, *BridgeError) {
+	b := d.bridges[idx]
+
+	// Each attempt needs a fresh session key, so parse the arguments again.
+	args, err := d.cf.ParseArgs(b.Args)
+	var conn net.Conn
+	if err == nil {
+		conn, err = d.cf.Dial("tcp", b.Address, d.dialFn, args)
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	st := &d.status[idx]
+	if err != nil {
+		st.Failures++
+		st.LastErr = err
+		return nil, &BridgeError{Address: b.Address, Err: err}
+	}
+	st.Successes++
+	return conn, nil
+}
+
+// Status returns the dial history of each bridge, in the order the bridges
+// were provided.
+func (d *MultiDialer) Status() []BridgeStatus {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return append([]BridgeStatus{}, d.status...)
+}
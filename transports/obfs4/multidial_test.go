@@ -0,0 +1,184 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package obfs4
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+
+	"gitlab.com/yawning/obfs4.git/transports/base"
+)
+
+func TestParseBridgeLine(t *testing.T) {
+	const cert = "ssH+9rP8dG2NLDN2XuFw63hIO/9MNNinLmxQDpVa+7kTOa9/m+tGWT1SmSYpQ9uTBGa6Hw"
+	for _, v := range []struct {
+		line    string
+		address string
+		err     string
+	}{
+		{"obfs4 192.0.2.1:443 cert=" + cert + " iat-mode=0", "192.0.2.1:443", ""},
+		{"Bridge obfs4 192.0.2.1:443 0123456789ABCDEF0123456789ABCDEF01234567 cert=" + cert + " iat-mode=0", "192.0.2.1:443", ""},
+		{"obfs4 [2001:db8::1]:443 cert=" + cert + " iat-mode=2", "[2001:db8::1]:443", ""},
+		{"obfs4 bridge.example.com:443 cert=" + cert + " iat-mode=1", "bridge.example.com:443", ""},
+		{"meek_lite 192.0.2.1:443 url=https://example.com/", "", "invalid obfs4 bridge line"},
+		{"obfs4", "", "missing address"},
+		{"obfs4 192.0.2.1 cert=" + cert + " iat-mode=0", "", "missing port"},
+		{"obfs4 192.0.2.1:https cert=" + cert + " iat-mode=0", "", "invalid port"},
+		{"obfs4 :443 cert=" + cert + " iat-mode=0", "", "missing host"},
+		{"obfs4 2001:db8::1:443 cert=" + cert + " iat-mode=0", "", "too many colons"},
+		{"obfs4 [2001:db8::zz]:443 cert=" + cert + " iat-mode=0", "", "invalid IPv6 address"},
+		{"obfs4 192.0.2.1:443 iat-mode=0", "", "missing argument 'cert'"},
+		{"obfs4 192.0.2.1:443 cert=AAAAAA iat-mode=0", "", "cert length"},
+		{"obfs4 192.0.2.1:443 cert=!!!! iat-mode=0", "", "failed to decode cert"},
+		{"obfs4 192.0.2.1:443 cert=" + cert, "", "missing argument 'iat-mode'"},
+		{"obfs4 192.0.2.1:443 cert=" + cert + " iat-mode=fast", "", "invalid iat-mode 'fast'"},
+		{"obfs4 192.0.2.1:443 cert=" + cert + " iat-mode=3", "", "invalid iat-mode '3'"},
+		{"obfs4 192.0.2.1:443 cert=" + cert + " iat-mode=0 bogus", "", "invalid bridge argument"},
+	} {
+		b, err := ParseBridgeLine(v.line)
+		if v.err != "" {
+			if err == nil || !strings.Contains(err.Error(), v.err) {
+				t.Fatalf("ParseBridgeLine(%q): %v, expected '%s'", v.line, err, v.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("ParseBridgeLine(%q) failed: %s", v.line, err)
+		}
+		if b.Address != v.address {
+			t.Fatalf("ParseBridgeLine(%q): address '%s'", v.line, b.Address)
+		}
+		if s, _ := b.Args.Get(certArg); s != cert {
+			t.Fatalf("ParseBridgeLine(%q): cert '%s'", v.line, s)
+		}
+		if _, err = new(obfs4ClientFactory).ParseArgs(b.Args); err != nil {
+			t.Fatalf("ParseBridgeLine(%q): ParseArgs() failed: %s", v.line, err)
+		}
+	}
+}
+
+// newTestBridges returns a bridge that handshakes and echoes, and one that
+// always fails the handshake by closing the connection.
+func newTestBridges(t *testing.T) (good, bad Bridge) {
+	sf, err := new(Transport).ServerFactory(t.TempDir(), &pt.Args{})
+	if err != nil {
+		t.Fatalf("ServerFactory() failed: %s", err)
+	}
+	goodLn, _ := newTestHandshakeListener(t, func(_ int, conn net.Conn) {
+		defer conn.Close()
+		c, err := sf.WrapConn(conn)
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(c, c)
+	})
+	badLn, _ := newTestHandshakeListener(t, func(_ int, conn net.Conn) {
+		var buf [64]byte
+		_, _ = io.ReadFull(conn, buf[:])
+		conn.Close()
+	})
+
+	args := &pt.Args{}
+	for k, v := range *sf.Args() {
+		(*args)[k] = v
+	}
+	return Bridge{goodLn.Addr().String(), args}, Bridge{badLn.Addr().String(), args}
+}
+
+func testMultiDialerEcho(t *testing.T, d *MultiDialer) {
+	conn, err := d.Dial()
+	if err != nil {
+		t.Fatalf("Dial() failed: %s", err)
+	}
+	defer conn.Close()
+
+	msg := []byte("failover")
+	if _, err = conn.Write(msg); err != nil {
+		t.Fatalf("Write() failed: %s", err)
+	}
+	echoed := make([]byte, len(msg))
+	if _, err = io.ReadFull(conn, echoed); err != nil || !bytes.Equal(msg, echoed) {
+		t.Fatalf("Read() failed: %q, %v", echoed, err)
+	}
+}
+
+func TestMultiDialer(t *testing.T) {
+	good, bad := newTestBridges(t)
+
+	// Round-robin, starting with the bad bridge, fails over to the good one
+	// every time.
+	d, err := NewMultiDialer([]Bridge{bad, good}, net.Dial, false)
+	if err != nil {
+		t.Fatalf("NewMultiDialer() failed: %s", err)
+	}
+	for i := 0; i < 4; i++ {
+		testMultiDialerEcho(t, d)
+	}
+	status := d.Status()
+	if status[0].Address != bad.Address || status[0].Failures != 2 || status[0].Successes != 0 || status[0].LastErr == nil {
+		t.Fatalf("bad bridge status: %+v", status[0])
+	}
+	if status[1].Address != good.Address || status[1].Failures != 0 || status[1].Successes != 4 {
+		t.Fatalf("good bridge status: %+v", status[1])
+	}
+
+	// Racing returns the good bridge.
+	if d, err = NewMultiDialer([]Bridge{bad, good}, net.Dial, true); err != nil {
+		t.Fatalf("NewMultiDialer() failed: %s", err)
+	}
+	testMultiDialerEcho(t, d)
+
+	// If all of the bridges fail, each failure is reported.
+	for _, race := range []bool{false, true} {
+		if d, err = NewMultiDialer([]Bridge{bad, bad}, net.Dial, race); err != nil {
+			t.Fatalf("NewMultiDialer() failed: %s", err)
+		}
+		_, err = d.Dial()
+		var multiErr MultiDialError
+		if !errors.As(err, &multiErr) || len(multiErr) != 2 {
+			t.Fatalf("race=%v: Dial() returned %v", race, err)
+		}
+		var hsErr *base.HandshakeError
+		if !errors.As(err, &hsErr) {
+			t.Fatalf("race=%v: Dial() error does not wrap the handshake failure", race)
+		}
+	}
+
+	if _, err = NewMultiDialer(nil, net.Dial, false); err == nil {
+		t.Fatalf("NewMultiDialer() accepted no bridges")
+	}
+	if _, err = NewMultiDialer([]Bridge{{good.Address, &pt.Args{}}}, net.Dial, false); err == nil {
+		t.Fatalf("NewMultiDialer() accepted invalid arguments")
+	}
+}
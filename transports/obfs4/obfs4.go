@@ -27,24 +27,35 @@
 
 // Package obfs4 provides an implementation of the Tor Project's obfs4
 // obfuscation protocol.
+//
+// Writes to a connection are serialized internally, and may be concurrent
+// with a read.  Concurrent reads are unsafe, and corrupt the connection
+// state, unless the "thread-safe=1" argument is set to serialize them.
 package obfs4 // import "gitlab.com/yawning/obfs4.git/transports/obfs4"
 
 import (
 	"bytes"
+	"compress/flate"
 	"crypto/sha256"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"net"
+	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
 
+	"gitlab.com/yawning/obfs4.git/common/csrand"
 	"gitlab.com/yawning/obfs4.git/common/drbg"
+	"gitlab.com/yawning/obfs4.git/common/metrics"
 	"gitlab.com/yawning/obfs4.git/common/ntor"
 	"gitlab.com/yawning/obfs4.git/common/probdist"
 	"gitlab.com/yawning/obfs4.git/common/replayfilter"
@@ -55,12 +66,39 @@ import (
 const (
 	transportName = "obfs4"
 
-	nodeIDArg     = "node-id"
-	publicKeyArg  = "public-key"
-	privateKeyArg = "private-key"
-	seedArg       = "drbg-seed"
-	iatArg        = "iat-mode"
-	certArg       = "cert"
+	nodeIDArg       = "node-id"
+	publicKeyArg    = "public-key"
+	privateKeyArg   = "private-key"
+	seedArg         = "drbg-seed"
+	iatArg          = "iat-mode"
+	certArg         = "cert"
+	keepaliveArg    = "keepalive"
+	messageArg      = "message-mode"
+	rxLimitArg      = "max-receive-buffer"
+	hsLengthArg     = "handshake-length"
+	passwordArg     = "password"
+	tlsRecordsArg   = "tls-records"
+	tlsHelloArg     = "tls-hello"
+	bulkArg         = "bulk"
+	separateSeedArg = "separate-seed"
+	hsRetriesArg    = "handshake-retries"
+	padFramesArg    = "max-padding-frames"
+	compressArg     = "compress"
+	versionArg      = "report-version"
+	earlyPadArg     = "early-padding"
+	epochPeriodArg  = "epoch-period"
+	closePadArg     = "close-padding"
+	jitterArg       = "connect-jitter"
+	threadSafeArg   = "thread-safe"
+	decodeFramesArg = "max-decode-frames"
+
+	deriveNodeIDArg = "derive-node-id"
+	wideReplayArg   = "replay-filter-128"
+	closeDelaysArg  = "max-close-delays"
+	handshakesArg   = "max-handshakes"
+	delayWorkersArg = "close-delay-workers"
+	clockSkewArg    = "log-clock-skew"
+	epochTolArg     = "epoch-tolerance"
 
 	biasCmdArg = "obfs4-distBias"
 
@@ -68,10 +106,48 @@ const (
 	headerLength           = framing.FrameOverhead + packetOverhead
 	clientHandshakeTimeout = time.Duration(60) * time.Second
 	serverHandshakeTimeout = time.Duration(30) * time.Second
-	replayTTL              = time.Duration(3) * time.Hour
+	closeDrainTimeout      = time.Duration(1) * time.Second
+
+	// The receive buffer never holds more than one segment past the longest
+	// valid handshake while handshaking.
+	maxHandshakeBufferLength = maxHandshakeLength + framing.MaximumSegmentLength
 
 	maxIATDelay   = 100
 	maxCloseDelay = 60
+
+	// padBurst never emits more than this many padding frames.
+	maxPaddingFrames = 2
+
+	// The client handshake is retried at most this many times, to bound
+	// the time spent dialing an unreachable (or hostile) bridge.
+	maxHandshakeRetries = 5
+
+	// The client connect jitter is at most this many milliseconds, to bound
+	// the added connection latency.
+	maxConnectJitter = 5000
+
+	// The server accepts handshake MACs made with a clock that is off by
+	// this many epochs in either direction by default, and at most
+	// maxEpochTolerance epochs if configured, as every additional epoch
+	// also lengthens the replay filter TTL.
+	defaultEpochTolerance = 1
+	maxEpochTolerance     = 3
+
+	// The handshake MACs cover the number of epochs since the UNIX epoch,
+	// which are an hour long by default, and optionally [15,240] minutes.
+	// As the tolerance is in epochs, shorter epochs shrink the window in
+	// which a captured handshake is accepted (and replayed to probe the
+	// server), and the replay filter TTL, but reject clients with smaller
+	// clock skew.  Longer epochs accept more skewed clocks, at the cost of
+	// a longer replay window, and more replay filter memory.
+	defaultEpochPeriod = time.Hour
+	minEpochPeriod     = 15 * time.Minute
+	maxEpochPeriod     = 4 * time.Hour
+
+	// The padding-only burst sent after the handshake, when early padding
+	// is negotiated, includes up to this many full sized frames in addition
+	// to the sampled padding.
+	maxEarlyPaddingFrames = 3
 )
 
 const (
@@ -84,11 +160,166 @@ const (
 // uniformly distributed.
 var biasedDist = flag.Bool(biasCmdArg, false, "Enable obfs4 using ScrambleSuit style table generation")
 
+var (
+	// ConnectLatency is the histogram of the client TCP/IP connection
+	// establishment times.
+	ConnectLatency = metrics.NewHistogram("obfs4_connect", metrics.DefaultLatencyBuckets)
+
+	// HandshakeLatency is the histogram of the obfs4 handshake round trip
+	// times, for successful handshakes.
+	HandshakeLatency = metrics.NewHistogram("obfs4_handshake", metrics.DefaultLatencyBuckets)
+
+	// TotalLatency is the histogram of the total time taken to establish
+	// a connection, ready to relay data.
+	TotalLatency = metrics.NewHistogram("obfs4_total", metrics.DefaultLatencyBuckets)
+)
+
+// writeBufferPool is the pool of frame buffers used by Write.  Buffers that
+// grew past maxPooledWriteBuffer are dropped instead of being returned to the
+// pool, so that a few large writes do not pin memory.
+var writeBufferPool = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
+const maxPooledWriteBuffer = 64 * framing.MaximumSegmentLength
+
+func getWriteBuffer() *bytes.Buffer {
+	buf, _ := writeBufferPool.Get().(*bytes.Buffer)
+	return buf
+}
+
+func putWriteBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledWriteBuffer {
+		return
+	}
+	buf.Reset()
+	writeBufferPool.Put(buf)
+}
+
 type obfs4ClientArgs struct {
-	nodeID     *ntor.NodeID
-	publicKey  *ntor.PublicKey
-	sessionKey *ntor.Keypair
-	iatMode    int
+	nodeID       *ntor.NodeID
+	publicKey    *ntor.PublicKey
+	sessionKey   *ntor.Keypair
+	iatMode      int
+	password     []byte
+	tlsRecords   bool
+	tlsHello     bool
+	bulk         bool
+	compress     bool
+	earlyPadding bool
+	epochPeriod  time.Duration
+	opts         *connOptions
+}
+
+// connOptions are the local per-connection options, that are not part of the
+// server's descriptor.
+type connOptions struct {
+	keepalive    time.Duration
+	messageMode  bool
+	receiveLimit int
+
+	// handshakeLength is the fixed total length of the handshake sent by
+	// this side of the connection, or 0 for a random length.
+	handshakeLength int
+
+	// separateSeed (server only) sends the PRNG seed in a separate, padded
+	// burst, instead of inline with the handshake response.
+	separateSeed bool
+
+	// handshakeRetries (client only) is the number of times the connection
+	// is re-established after a transient network error mid-handshake.
+	handshakeRetries int
+
+	// paddingFrames is the maximum number of padding frames appended to
+	// each Write, in the range [0,maxPaddingFrames].
+	paddingFrames int
+
+	// lengthSeed (client only), if set, seeds the initial length (and IAT)
+	// distribution instead of a random seed.  The server's PRNG seed
+	// replaces the distribution once received, so this only governs the
+	// traffic sent before then.
+	lengthSeed *drbg.Seed
+
+	// reportVersion sends ReportedVersion to the peer after the handshake
+	// (See version.go).
+	reportVersion bool
+
+	// closePadding sends a final padding-only burst when the connection is
+	// closed.
+	closePadding bool
+
+	// connectJitter (client only) is the upper bound of the random delay
+	// before each connection is established, so that many clients that
+	// reconnect at the same instant (eg: after a network outage) do not
+	// produce a synchronized burst of handshakes.  This adds up to the
+	// bound to the connection establishment latency.
+	connectJitter time.Duration
+
+	// threadSafe serializes the reads (Read, WriteTo, and ReadMessage).
+	// Writes are always serialized, and may be concurrent with a read, but
+	// without this, concurrent reads corrupt the receive state.
+	threadSafe bool
+
+	// decodeFrames is the maximum number of frames decoded per read off
+	// the network, or 0 for no limit.  Frames past the limit are left
+	// buffered, and decoded by the following reads before reading off the
+	// network again, so that a large burst is handed to the caller in
+	// pieces, instead of all at once.
+	decodeFrames int
+}
+
+func parseConnOptions(args *pt.Args, isServer bool) (*connOptions, error) {
+	var (
+		opts connOptions
+		err  error
+	)
+	if opts.keepalive, err = parseKeepaliveArg(args); err != nil {
+		return nil, err
+	}
+	if opts.messageMode, err = parseBoolArg(args, messageArg); err != nil {
+		return nil, err
+	}
+	if opts.receiveLimit, err = parseReceiveLimitArg(args); err != nil {
+		return nil, err
+	}
+	if opts.handshakeLength, err = parseHandshakeLengthArg(args, isServer); err != nil {
+		return nil, err
+	}
+	if opts.paddingFrames, err = parsePaddingFramesArg(args); err != nil {
+		return nil, err
+	}
+	if opts.reportVersion, err = parseBoolArg(args, versionArg); err != nil {
+		return nil, err
+	}
+	if opts.closePadding, err = parseBoolArg(args, closePadArg); err != nil {
+		return nil, err
+	}
+	if opts.threadSafe, err = parseBoolArg(args, threadSafeArg); err != nil {
+		return nil, err
+	}
+	if opts.decodeFrames, err = parseDecodeFramesArg(args); err != nil {
+		return nil, err
+	}
+	if isServer {
+		if opts.separateSeed, err = parseBoolArg(args, separateSeedArg); err != nil {
+			return nil, err
+		}
+	} else {
+		if opts.handshakeRetries, err = parseHandshakeRetriesArg(args); err != nil {
+			return nil, err
+		}
+		if opts.connectJitter, err = parseConnectJitterArg(args); err != nil {
+			return nil, err
+		}
+		if str, ok := args.Get(seedArg); ok {
+			if opts.lengthSeed, err = drbg.SeedFromHex(str); err != nil {
+				return nil, fmt.Errorf("invalid %s '%s'", seedArg, str)
+			}
+		}
+	}
+	return &opts, nil
 }
 
 // Transport is the obfs4 implementation of the base.Transport interface.
@@ -112,6 +343,83 @@ func (t *Transport) ServerFactory(stateDir string, args *pt.Args) (base.ServerFa
 		return nil, err
 	}
 
+	return t.newServerFactory(st, args, nil)
+}
+
+// ServerConfig is the configuration of an obfs4 server, for embedders that
+// do not use the pluggable transport configuration protocol.
+type ServerConfig struct {
+	// NodeID and IdentityKey are the long term node ID and identity key of
+	// the server, that the clients are configured with.  IdentityKey is
+	// usually a *ntor.Keypair, but may be any ntor.IdentityKey, to keep the
+	// private key outside of the process.
+	NodeID      *ntor.NodeID
+	IdentityKey ntor.IdentityKey
+
+	// DrbgSeed is the seed of the length (and timing) obfuscation.
+	DrbgSeed *drbg.Seed
+
+	// IATMode is the inter-arrival time obfuscation mode (0, 1, or 2).
+	IATMode int
+
+	// Args are the optional arguments (eg: "password"), in the same format
+	// as the ServerTransportOptions, and may be nil.  Any state arguments
+	// are ignored.
+	Args *pt.Args
+
+	// ReplayBackend is the replay filter used to reject replayed client
+	// handshakes, and may be nil to use a per-process in-memory filter.
+	ReplayBackend ReplayBackend
+}
+
+// ReplayBackend is a replay filter for client handshakes, that may be
+// shared between several server instances (eg: a cluster of bridges behind
+// a load balancer, that share an identity key).
+//
+// TestAndSet must return true iff buf was already present, and insert it
+// otherwise, as a single atomic operation with respect to all the instances
+// sharing the backend, or a handshake replayed to two instances at once
+// could be accepted by both.  Entries must be retained for at least the span
+// of the epochs accepted by the handshake MAC, which is 2 * N + 1 epochs of
+// P minutes with "epoch-tolerance=N" and "epoch-period=P" (3 epochs of 60
+// minutes by default), measured from now.  Implementations that are unable to reach shared state should
+// fall back to a local filter, as returning false accepts replays, and
+// returning true rejects every client.
+//
+// *replayfilter.ReplayFilter is the default, in-memory implementation.
+type ReplayBackend interface {
+	TestAndSet(now time.Time, buf []byte) bool
+}
+
+// NewServerFactory returns a new obfs4 ServerFactory using the provided
+// configuration.  Unlike Transport.ServerFactory, no state is read from or
+// written to disk, and nothing depends on the pluggable transport
+// environment variables.
+func NewServerFactory(cfg *ServerConfig) (base.ServerFactory, error) {
+	if cfg.NodeID == nil || cfg.IdentityKey == nil || cfg.DrbgSeed == nil {
+		return nil, fmt.Errorf("missing server node ID, identity key, or DRBG seed")
+	}
+	if cfg.IATMode < iatNone || cfg.IATMode > iatParanoid {
+		return nil, fmt.Errorf("invalid iat-mode '%d'", cfg.IATMode)
+	}
+
+	st := &ServerState{
+		nodeID:      cfg.NodeID,
+		identityKey: cfg.IdentityKey,
+		drbgSeed:    cfg.DrbgSeed,
+		iatMode:     cfg.IATMode,
+	}
+	st.cert = serverCertFromState(st)
+
+	args := cfg.Args
+	if args == nil {
+		args = &pt.Args{}
+	}
+
+	return new(Transport).newServerFactory(st, args, cfg.ReplayBackend)
+}
+
+func (t *Transport) newServerFactory(st *ServerState, args *pt.Args, filter ReplayBackend) (base.ServerFactory, error) {
 	var iatSeed *drbg.Seed
 	if st.iatMode != iatNone {
 		iatSeedSrc := sha256.Sum256(st.drbgSeed.Bytes()[:])
@@ -122,30 +430,154 @@ func (t *Transport) ServerFactory(stateDir string, args *pt.Args) (base.ServerFa
 		}
 	}
 
+	opts, err := parseConnOptions(args, true)
+	if err != nil {
+		return nil, err
+	}
+	password, err := parsePasswordArg(args)
+	if err != nil {
+		return nil, err
+	}
+	tlsRecords, err := parseBoolArg(args, tlsRecordsArg)
+	if err != nil {
+		return nil, err
+	}
+	tlsHello, err := parseBoolArg(args, tlsHelloArg)
+	if err != nil {
+		return nil, err
+	}
+	bulk, err := parseBoolArg(args, bulkArg)
+	if err != nil {
+		return nil, err
+	}
+	compress, err := parseBoolArg(args, compressArg)
+	if err != nil {
+		return nil, err
+	}
+	earlyPadding, err := parseBoolArg(args, earlyPadArg)
+	if err != nil {
+		return nil, err
+	}
+	epochPeriod, err := parseEpochPeriodArg(args)
+	if err != nil {
+		return nil, err
+	}
+
 	// Store the arguments that should appear in our descriptor for the clients.
+	// Note that the order of addition is irrelevant (See Args).
 	ptArgs := pt.Args{}
 	ptArgs.Add(certArg, st.cert.String())
 	ptArgs.Add(iatArg, strconv.Itoa(st.iatMode))
+	if password != nil {
+		ptArgs.Add(passwordArg, string(password))
+	}
+	if tlsRecords {
+		ptArgs.Add(tlsRecordsArg, strconv.FormatBool(tlsRecords))
+	}
+	if tlsHello {
+		ptArgs.Add(tlsHelloArg, strconv.FormatBool(tlsHello))
+	}
+	if bulk {
+		ptArgs.Add(bulkArg, strconv.FormatBool(bulk))
+	}
+	if compress {
+		ptArgs.Add(compressArg, strconv.FormatBool(compress))
+	}
+	if earlyPadding {
+		ptArgs.Add(earlyPadArg, strconv.FormatBool(earlyPadding))
+	}
+	if epochPeriod != defaultEpochPeriod {
+		ptArgs.Add(epochPeriodArg, strconv.Itoa(int(epochPeriod/time.Minute)))
+	}
 
-	// Initialize the replay filter.
-	filter, err := replayfilter.New(replayTTL)
+	// Initialize the replay filter, unless one was provided, optionally
+	// with 128-bit digests for bridges that see enough handshakes for 64-bit
+	// collisions to matter.
+	wideReplay, err := parseBoolArg(args, wideReplayArg)
+	if err != nil {
+		return nil, err
+	}
+	epochTolerance, err := parseEpochToleranceArg(args)
+	if err != nil {
+		return nil, err
+	}
+	if filter == nil {
+		newFilter := replayfilter.New
+		if wideReplay {
+			newFilter = replayfilter.New128
+		}
+		if filter, err = newFilter(epochReplayTTL(epochTolerance, epochPeriod)); err != nil {
+			return nil, err
+		}
+	}
+
+	// Parse the (optional) limits on concurrent close delays and
+	// handshakes.
+	maxCloseDelays, err := parseLimitArg(args, closeDelaysArg)
+	if err != nil {
+		return nil, err
+	}
+	maxHandshakes, err := parseLimitArg(args, handshakesArg)
 	if err != nil {
 		return nil, err
 	}
 
-	// Initialize the close thresholds for failed connections.
+	// Parse the (optional) number of close delay workers, and if set, hold
+	// the failed connections open with a worker pool, instead of in the
+	// goroutine calling WrapConn.
+	delayWorkers, err := parseLimitArg(args, delayWorkersArg)
+	if err != nil {
+		return nil, err
+	}
+	var delayPool *closeDelayPool
+	if delayWorkers > 0 {
+		delayPool = newCloseDelayPool(int(delayWorkers))
+	}
+
+	// Parse the (optional) flag for logging clients with skewed clocks.
+	logClockSkew, err := parseBoolArg(args, clockSkewArg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Initialize the source of the close thresholds for failed connections.
 	drbg, err := drbg.NewHashDrbg(st.drbgSeed)
 	if err != nil {
 		return nil, err
 	}
 	rng := rand.New(drbg) //nolint:gosec
 
-	sf := &obfs4ServerFactory{t, &ptArgs, st.nodeID, st.identityKey, st.drbgSeed, iatSeed, st.iatMode, filter, rng.Intn(maxCloseDelay)}
+	sf := &obfs4ServerFactory{
+		transport:     t,
+		args:          &ptArgs,
+		nodeID:        st.nodeID,
+		identityKey:   st.identityKey,
+		lenSeed:       st.drbgSeed,
+		iatSeed:       iatSeed,
+		iatMode:       st.iatMode,
+		password:      password,
+		tlsRecords:    tlsRecords,
+		tlsHello:      tlsHello,
+		bulk:          bulk,
+		compress:      compress,
+		earlyPadding:  earlyPadding,
+		opts:          opts,
+		replayFilter:  filter,
+		closeDelayRng: rng,
+
+		maxCloseDelays: maxCloseDelays,
+		maxHandshakes:  maxHandshakes,
+		closeDelayPool: delayPool,
+		logClockSkew:   logClockSkew,
+		epochTolerance: epochTolerance,
+		epochPeriod:    epochPeriod,
+	}
 	return sf, nil
 }
 
 type obfs4ClientFactory struct {
 	transport base.Transport
+	skew      skewDetector
 }
 
 func (cf *obfs4ClientFactory) Transport() base.Transport {
@@ -153,6 +585,63 @@ func (cf *obfs4ClientFactory) Transport() base.Transport {
 }
 
 func (cf *obfs4ClientFactory) ParseArgs(args *pt.Args) (any, error) {
+	nodeID, publicKey, iatMode, err := parseBridgeArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	// The (optional) shared password, TLS record and hello wrapping, bulk
+	// mode, compression, early padding, and epoch period are also common to
+	// both formats.
+	password, err := parsePasswordArg(args)
+	if err != nil {
+		return nil, err
+	}
+	tlsRecords, err := parseBoolArg(args, tlsRecordsArg)
+	if err != nil {
+		return nil, err
+	}
+	tlsHello, err := parseBoolArg(args, tlsHelloArg)
+	if err != nil {
+		return nil, err
+	}
+	bulk, err := parseBoolArg(args, bulkArg)
+	if err != nil {
+		return nil, err
+	}
+	compress, err := parseBoolArg(args, compressArg)
+	if err != nil {
+		return nil, err
+	}
+	earlyPadding, err := parseBoolArg(args, earlyPadArg)
+	if err != nil {
+		return nil, err
+	}
+	epochPeriod, err := parseEpochPeriodArg(args)
+	if err != nil {
+		return nil, err
+	}
+
+	// The local options are parsed from the same set of arguments, as
+	// there is nowhere else to put them.
+	opts, err := parseConnOptions(args, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Generate the session key pair before connecting to hide the Elligator2
+	// rejection sampling from network observers.
+	sessionKey, err := ntor.NewKeypairFromReader(randReader, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &obfs4ClientArgs{nodeID, publicKey, sessionKey, iatMode, password, tlsRecords, tlsHello, bulk, compress, earlyPadding, epochPeriod, opts}, nil
+}
+
+// parseBridgeArgs parses the server's Node ID, public key, and IAT mode from
+// the bridge line arguments.
+func parseBridgeArgs(args *pt.Args) (*ntor.NodeID, *ntor.PublicKey, int, error) {
 	var nodeID *ntor.NodeID
 	var publicKey *ntor.PublicKey
 
@@ -162,7 +651,7 @@ func (cf *obfs4ClientFactory) ParseArgs(args *pt.Args) (any, error) {
 	if ok { //nolint:nestif
 		cert, err := serverCertFromString(certStr)
 		if err != nil {
-			return nil, err
+			return nil, nil, 0, err
 		}
 		nodeID, publicKey = cert.unpack()
 	} else {
@@ -170,40 +659,33 @@ func (cf *obfs4ClientFactory) ParseArgs(args *pt.Args) (any, error) {
 		// and Public Key arguments in Base16 encoding and are a UX disaster.
 		nodeIDStr, ok := args.Get(nodeIDArg)
 		if !ok {
-			return nil, fmt.Errorf("missing argument '%s'", nodeIDArg)
+			return nil, nil, 0, fmt.Errorf("missing argument '%s' (or '%s')", certArg, nodeIDArg)
 		}
 		var err error
 		if nodeID, err = ntor.NodeIDFromHex(nodeIDStr); err != nil {
-			return nil, err
+			return nil, nil, 0, err
 		}
 
 		publicKeyStr, ok := args.Get(publicKeyArg)
 		if !ok {
-			return nil, fmt.Errorf("missing argument '%s'", publicKeyArg)
+			return nil, nil, 0, fmt.Errorf("missing argument '%s'", publicKeyArg)
 		}
 		if publicKey, err = ntor.PublicKeyFromHex(publicKeyStr); err != nil {
-			return nil, err
+			return nil, nil, 0, err
 		}
 	}
 
 	// IAT config is common across the two bridge line formats.
 	iatStr, ok := args.Get(iatArg)
 	if !ok {
-		return nil, fmt.Errorf("missing argument '%s'", iatArg)
+		return nil, nil, 0, fmt.Errorf("missing argument '%s'", iatArg)
 	}
 	iatMode, err := strconv.Atoi(iatStr)
 	if err != nil || iatMode < iatNone || iatMode > iatParanoid {
-		return nil, fmt.Errorf("invalid iat-mode '%d'", iatMode)
-	}
-
-	// Generate the session key pair before connecting to hide the Elligator2
-	// rejection sampling from network observers.
-	sessionKey, err := ntor.NewKeypair(true)
-	if err != nil {
-		return nil, err
+		return nil, nil, 0, fmt.Errorf("invalid iat-mode '%s'", iatStr)
 	}
 
-	return &obfs4ClientArgs{nodeID, publicKey, sessionKey, iatMode}, nil
+	return nodeID, publicKey, iatMode, nil
 }
 
 func (cf *obfs4ClientFactory) Dial(network, addr string, dialFn base.DialFunc, args any) (net.Conn, error) {
@@ -212,36 +694,124 @@ func (cf *obfs4ClientFactory) Dial(network, addr string, dialFn base.DialFunc, a
 	if !ok {
 		return nil, fmt.Errorf("invalid argument type for args")
 	}
+
+	for retries := 0; ; retries++ {
+		conn, err := cf.dial(network, addr, dialFn, ca)
+		if err == nil || retries >= ca.opts.handshakeRetries || !isTransientHandshakeError(err) {
+			cf.skew.observe(addr, err)
+			return conn, err
+		}
+
+		// Retry with a fresh session key, as reusing the key (and thus the
+		// Elligator2 representative) would link the two attempts.
+		retryArgs := *ca
+		if retryArgs.sessionKey, err = ntor.NewKeypairFromReader(randReader, true); err != nil {
+			return nil, err
+		}
+		ca = &retryArgs
+	}
+}
+
+func (cf *obfs4ClientFactory) dial(network, addr string, dialFn base.DialFunc, ca *obfs4ClientArgs) (net.Conn, error) {
+	if ca.opts.connectJitter > 0 {
+		time.Sleep(sampleConnectJitter(ca.opts.connectJitter))
+	}
+
+	startTime := time.Now()
 	conn, err := dialFn(network, addr)
 	if err != nil {
 		return nil, err
 	}
+	ConnectLatency.Observe(time.Since(startTime))
 	dialConn := conn
 	if conn, err = newObfs4ClientConn(conn, ca); err != nil {
 		dialConn.Close()
 		return nil, err
 	}
+	TotalLatency.Observe(time.Since(startTime))
 	return conn, nil
 }
 
+// sampleConnectJitter returns a random delay in [0,bound], with microsecond
+// granularity.
+func sampleConnectJitter(bound time.Duration) time.Duration {
+	return time.Duration(csrand.Intn(int(bound/time.Microsecond)+1)) * time.Microsecond
+}
+
+// isTransientHandshakeError returns true iff err is a handshake failure due
+// to the connection being closed or reset by the network, which may succeed
+// if retried.  Cryptographic failures and timeouts are never transient, nor
+// is the server closing the connection without responding, as that is how it
+// rejects the handshake.
+func isTransientHandshakeError(err error) bool {
+	var hsErr *base.HandshakeError
+	if !errors.As(err, &hsErr) || errors.Is(hsErr.Err, ErrServerKeyMismatch) {
+		return false
+	}
+	for _, transientErr := range []error{
+		io.EOF,
+		io.ErrUnexpectedEOF,
+		syscall.ECONNRESET,
+		syscall.ECONNABORTED,
+		syscall.EPIPE,
+	} {
+		if errors.Is(hsErr.Err, transientErr) {
+			return true
+		}
+	}
+	return false
+}
+
 type obfs4ServerFactory struct {
 	transport base.Transport
 	args      *pt.Args
 
 	nodeID       *ntor.NodeID
-	identityKey  *ntor.Keypair
+	identityKey  ntor.IdentityKey
 	lenSeed      *drbg.Seed
 	iatSeed      *drbg.Seed
 	iatMode      int
-	replayFilter *replayfilter.ReplayFilter
-
-	closeDelay int
+	password     []byte
+	tlsRecords   bool
+	tlsHello     bool
+	bulk         bool
+	compress     bool
+	earlyPadding bool
+	opts         *connOptions
+	replayFilter ReplayBackend
+
+	closeDelayLock sync.Mutex
+	closeDelayRng  *rand.Rand
+
+	// closeDelays is the number of failed connections currently being held
+	// open by closeAfterDelay, which is limited to maxCloseDelays if it is
+	// non-zero.
+	closeDelays    atomic.Int32
+	maxCloseDelays int32
+	closeDelayPool *closeDelayPool
+
+	// handshakes is the number of handshakes currently in progress, which
+	// is limited to maxHandshakes if it is non-zero.
+	handshakes    atomic.Int32
+	maxHandshakes int32
+
+	// logClockSkew is set if clients with skewed clocks should be logged.
+	logClockSkew bool
+
+	// epochTolerance is the number of epochs that the client's clock may be
+	// off by in either direction, and epochPeriod the length of each.
+	epochTolerance int
+	epochPeriod    time.Duration
 }
 
 func (sf *obfs4ServerFactory) Transport() base.Transport {
 	return sf.transport
 }
 
+// Args returns the arguments that the clients need to connect to the server.
+// pt.Args is a map, and has no order of its own, but the SMETHOD line (and
+// the descriptor) lists them sorted by key, so "cert" always precedes
+// "iat-mode", followed by the optional arguments.
 func (sf *obfs4ServerFactory) Args() *pt.Args {
 	return sf.args
 }
@@ -255,7 +825,7 @@ func (sf *obfs4ServerFactory) WrapConn(conn net.Conn) (net.Conn, error) {
 	// might be futile, but the timing differential isn't very large on modern
 	// hardware, and there are far easier statistical attacks that can be
 	// mounted as a distinguisher.
-	sessionKey, err := ntor.NewKeypair(true)
+	sessionKey, err := ntor.NewKeypairFromReader(randReader, true)
 	if err != nil {
 		return nil, err
 	}
@@ -266,15 +836,47 @@ func (sf *obfs4ServerFactory) WrapConn(conn net.Conn) (net.Conn, error) {
 		iatDist = probdist.New(sf.iatSeed, 0, maxIATDelay, *biasedDist)
 	}
 
-	c := &obfs4Conn{conn, true, lenDist, iatDist, sf.iatMode, bytes.NewBuffer(nil), bytes.NewBuffer(nil), make([]byte, consumeReadSize), nil, nil}
+	if sf.tlsHello {
+		conn = newHelloConn(conn, true)
+	}
+	if sf.tlsRecords {
+		conn = newRecordConn(conn)
+	}
+	c := newObfs4Conn(conn, true, lenDist, iatDist, sf.iatMode, sf.opts)
+	c.bulk = sf.bulk
 
 	startTime := time.Now()
 
-	if err = c.serverHandshake(sf, sessionKey); err != nil {
-		c.closeAfterDelay(sf, startTime)
-		return nil, err
+	if sf.acquireHandshake() {
+		err = c.serverHandshake(sf, sessionKey)
+		sf.handshakes.Add(-1)
+	} else {
+		err = ErrTooManyHandshakes
+	}
+	if err != nil {
+		var detached bool
+		switch {
+		case !sf.acquireCloseDelay():
+			c.Conn.Close()
+		case sf.closeDelayPool != nil:
+			sf.closeDelayPool.add(c, sf.sampleCloseDelay(), startTime, func() {
+				sf.closeDelays.Add(-1)
+			})
+			detached = true
+		default:
+			c.closeAfterDelay(sf.sampleCloseDelay(), startTime)
+			sf.closeDelays.Add(-1)
+		}
+		return nil, &base.HandshakeError{
+			Err:      err,
+			Probe:    errors.Is(err, ErrInvalidHandshake) || errors.Is(err, ErrReplayedHandshake),
+			Detached: detached,
+		}
 	}
 
+	TotalLatency.Observe(time.Since(startTime))
+	c.startKeepalive(sf.opts.keepalive)
+
 	return c, nil
 }
 
@@ -282,17 +884,88 @@ type obfs4Conn struct {
 	net.Conn
 
 	isServer bool
+	version  int
+	features int
 
 	lenDist *probdist.WeightedDist
 	iatDist *probdist.WeightedDist
 	iatMode int
+	shaping ShapingPolicy
 
 	receiveBuffer        *bytes.Buffer
 	receiveDecodedBuffer *bytes.Buffer
 	readBuffer           []byte
 
+	receiveLimit int
+
+	// decodeFrames bounds the frames decoded per readPackets call, and
+	// decodePending is set if frames were left buffered due to the bound.
+	decodeFrames  int
+	decodePending bool
+
+	messageMode      bool
+	messageRemaining int
+
+	paddingFrames int
+	closePadding  bool
+
+	bulk    bool
 	encoder *framing.Encoder
 	decoder *framing.Decoder
+
+	// compress is set iff payload compression was negotiated (See
+	// compress.go).
+	compress         bool
+	compressor       *flate.Writer
+	decompressor     io.ReadCloser
+	compressedBuffer *bytes.Buffer
+
+	// pendingVersion is the version report to send with the next write,
+	// and peerVersion the version reported by the peer, if any.
+	pendingVersion []byte
+	peerVersion    string
+
+	writeLock sync.Mutex
+	lastWrite time.Time
+
+	// readLock serializes the reads, if threadSafe is set.
+	readLock   sync.Mutex
+	threadSafe bool
+
+	closeOnce sync.Once
+	closeChan chan struct{}
+}
+
+func newObfs4Conn(conn net.Conn, isServer bool, lenDist, iatDist *probdist.WeightedDist, iatMode int, opts *connOptions) *obfs4Conn {
+	readBufferSize := consumeReadSize
+	if opts.receiveLimit > 0 && opts.receiveLimit < readBufferSize {
+		readBufferSize = opts.receiveLimit
+	}
+
+	c := &obfs4Conn{
+		Conn:                 conn,
+		isServer:             isServer,
+		version:              protocolVersion1,
+		lenDist:              lenDist,
+		iatDist:              iatDist,
+		iatMode:              iatMode,
+		shaping:              &distShapingPolicy{lenDist: lenDist, iatDist: iatDist},
+		receiveBuffer:        bytes.NewBuffer(nil),
+		receiveDecodedBuffer: bytes.NewBuffer(nil),
+		compressedBuffer:     bytes.NewBuffer(nil),
+		readBuffer:           make([]byte, readBufferSize),
+		receiveLimit:         opts.receiveLimit,
+		decodeFrames:         opts.decodeFrames,
+		messageMode:          opts.messageMode,
+		paddingFrames:        opts.paddingFrames,
+		closePadding:         opts.closePadding,
+		threadSafe:           opts.threadSafe,
+		closeChan:            make(chan struct{}),
+	}
+	if opts.reportVersion {
+		c.queueVersionReport()
+	}
+	return c
 }
 
 func newObfs4ClientConn(conn net.Conn, args *obfs4ClientArgs) (*obfs4Conn, error) {
@@ -301,8 +974,10 @@ func newObfs4ClientConn(conn net.Conn, args *obfs4ClientArgs) (*obfs4Conn, error
 		seed *drbg.Seed
 		err  error
 	)
-	if seed, err = drbg.NewSeed(); err != nil {
-		return nil, err
+	if seed = args.opts.lengthSeed; seed == nil {
+		if seed, err = drbg.NewSeed(); err != nil {
+			return nil, err
+		}
 	}
 	lenDist := probdist.New(seed, 0, framing.MaximumSegmentLength, *biasedDist)
 	var iatDist *probdist.WeightedDist
@@ -316,7 +991,14 @@ func newObfs4ClientConn(conn net.Conn, args *obfs4ClientArgs) (*obfs4Conn, error
 	}
 
 	// Allocate the client structure.
-	c := &obfs4Conn{conn, false, lenDist, iatDist, args.iatMode, bytes.NewBuffer(nil), bytes.NewBuffer(nil), make([]byte, consumeReadSize), nil, nil}
+	if args.tlsHello {
+		conn = newHelloConn(conn, false)
+	}
+	if args.tlsRecords {
+		conn = newRecordConn(conn)
+	}
+	c := newObfs4Conn(conn, false, lenDist, iatDist, args.iatMode, args.opts)
+	c.bulk = args.bulk
 
 	// Start the handshake timeout.
 	deadline := time.Now().Add(clientHandshakeTimeout)
@@ -324,8 +1006,8 @@ func newObfs4ClientConn(conn net.Conn, args *obfs4ClientArgs) (*obfs4Conn, error
 		return nil, err
 	}
 
-	if err = c.clientHandshake(args.nodeID, args.publicKey, args.sessionKey); err != nil {
-		return nil, err
+	if err = c.clientHandshake(args); err != nil {
+		return nil, &base.HandshakeError{Err: err}
 	}
 
 	// Stop the handshake timeout.
@@ -333,17 +1015,35 @@ func newObfs4ClientConn(conn net.Conn, args *obfs4ClientArgs) (*obfs4Conn, error
 		return nil, err
 	}
 
+	c.startKeepalive(args.opts.keepalive)
+
 	return c, nil
 }
 
-func (conn *obfs4Conn) clientHandshake(nodeID *ntor.NodeID, peerIdentityKey *ntor.PublicKey, sessionKey *ntor.Keypair) error {
+func (conn *obfs4Conn) clientHandshake(args *obfs4ClientArgs) error {
 	if conn.isServer {
 		return fmt.Errorf("clientHandshake called on server connection")
 	}
 
 	// Generate and send the client handshake.
-	hs := newClientHandshake(nodeID, peerIdentityKey, sessionKey)
-	blob, err := hs.generateHandshake()
+	startTime := time.Now()
+	hs := newClientHandshake(args.nodeID, args.publicKey, args.sessionKey)
+	if args.password != nil {
+		hs.setPassword(args.password)
+	}
+	if args.opts.handshakeLength > 0 {
+		hs.setHandshakeLength(args.opts.handshakeLength)
+	}
+	if args.compress {
+		hs.setCompression()
+	}
+	if args.earlyPadding {
+		hs.setFeatures(protocolFeatureEarlyPadding)
+	}
+	if args.epochPeriod != defaultEpochPeriod {
+		hs.setEpochPeriod(args.epochPeriod)
+	}
+	blob, err := hs.generateHandshakeAt(clientClock())
 	if err != nil {
 		return err
 	}
@@ -354,13 +1054,14 @@ func (conn *obfs4Conn) clientHandshake(nodeID *ntor.NodeID, peerIdentityKey *nto
 	// Consume the server handshake.
 	var hsBuf [maxHandshakeLength]byte
 	for {
-		n, err := conn.Conn.Read(hsBuf[:])
-		if err != nil {
-			// The Read() could have returned data and an error, but there is
-			// no point in continuing on an EOF or whatever.
+		if err := conn.readHandshakeData(hsBuf[:]); err != nil {
+			// Servers never respond to handshakes that they can not
+			// authenticate, and close the connection after a delay.
+			if conn.receiveBuffer.Len() == 0 && (errors.Is(err, io.EOF) || errors.Is(err, os.ErrDeadlineExceeded)) {
+				return fmt.Errorf("%w: %w", ErrServerKeyMismatch, err)
+			}
 			return err
 		}
-		conn.receiveBuffer.Write(hsBuf[:n])
 
 		n, seed, err := hs.parseServerHandshake(conn.receiveBuffer.Bytes())
 		if errors.Is(err, ErrMarkNotFoundYet) {
@@ -369,13 +1070,23 @@ func (conn *obfs4Conn) clientHandshake(nodeID *ntor.NodeID, peerIdentityKey *nto
 			return err
 		}
 		_ = conn.receiveBuffer.Next(n)
+		conn.version = hs.version
+		conn.features = hs.features
+		conn.compress = hs.version >= protocolVersionCompression
 
 		// Use the derived key material to initialize the link crypto.
 		okm := ntor.Kdf(seed, framing.KeyLength*2)
 		conn.encoder = framing.NewEncoder(okm[:framing.KeyLength])
 		conn.decoder = framing.NewDecoder(okm[framing.KeyLength:])
+		writeKeyLog(hs.keypair.Representative(), okm)
+		if conn.bulk {
+			conn.encoder.EnableBulk()
+			conn.decoder.EnableBulk()
+		}
 
-		return nil
+		HandshakeLatency.Observe(time.Since(startTime))
+
+		return conn.sendEarlyPadding()
 	}
 }
 
@@ -385,7 +1096,29 @@ func (conn *obfs4Conn) serverHandshake(sf *obfs4ServerFactory, sessionKey *ntor.
 	}
 
 	// Generate the server handshake, and arm the base timeout.
+	startTime := time.Now()
 	hs := newServerHandshake(sf.nodeID, sf.identityKey, sessionKey)
+	if sf.password != nil {
+		hs.setPassword(sf.password)
+	}
+	if sf.opts.separateSeed {
+		hs.setSeparateSeed()
+	}
+	if sf.opts.handshakeLength > 0 {
+		hs.setHandshakeLength(sf.opts.handshakeLength)
+	}
+	if sf.compress {
+		hs.setCompression()
+	}
+	if sf.earlyPadding {
+		hs.setFeatures(protocolFeatureEarlyPadding)
+	}
+	if sf.epochTolerance > defaultEpochTolerance {
+		hs.setEpochTolerance(sf.epochTolerance)
+	}
+	if sf.epochPeriod != defaultEpochPeriod {
+		hs.setEpochPeriod(sf.epochPeriod)
+	}
 	if err := conn.Conn.SetDeadline(time.Now().Add(serverHandshakeTimeout)); err != nil {
 		return err
 	}
@@ -393,13 +1126,9 @@ func (conn *obfs4Conn) serverHandshake(sf *obfs4ServerFactory, sessionKey *ntor.
 	// Consume the client handshake.
 	var hsBuf [maxHandshakeLength]byte
 	for {
-		n, err := conn.Conn.Read(hsBuf[:])
-		if err != nil {
-			// The Read() could have returned data and an error, but there is
-			// no point in continuing on an EOF or whatever.
+		if err := conn.readHandshakeData(hsBuf[:]); err != nil {
 			return err
 		}
-		conn.receiveBuffer.Write(hsBuf[:n])
 
 		seed, err := hs.parseClientHandshake(sf.replayFilter, conn.receiveBuffer.Bytes())
 		if errors.Is(err, ErrMarkNotFoundYet) {
@@ -408,6 +1137,12 @@ func (conn *obfs4Conn) serverHandshake(sf *obfs4ServerFactory, sessionKey *ntor.
 			return err
 		}
 		conn.receiveBuffer.Reset()
+		conn.version = hs.version
+		conn.features = hs.features
+		conn.compress = hs.version >= protocolVersionCompression
+		if sf.logClockSkew {
+			conn.logClockSkew(hs.epochOffset, sf.epochPeriod)
+		}
 
 		if err := conn.Conn.SetDeadline(time.Time{}); err != nil {
 			return err
@@ -417,6 +1152,11 @@ func (conn *obfs4Conn) serverHandshake(sf *obfs4ServerFactory, sessionKey *ntor.
 		okm := ntor.Kdf(seed, framing.KeyLength*2)
 		conn.encoder = framing.NewEncoder(okm[framing.KeyLength:])
 		conn.decoder = framing.NewDecoder(okm[:framing.KeyLength])
+		writeKeyLog(hs.clientRepresentative, okm)
+		if conn.bulk {
+			conn.encoder.EnableBulk()
+			conn.decoder.EnableBulk()
+		}
 
 		break
 	}
@@ -429,6 +1169,10 @@ func (conn *obfs4Conn) serverHandshake(sf *obfs4ServerFactory, sessionKey *ntor.
 	// padding, and sending the PRNG seed unpadded (As in, treat the PRNG seed
 	// as part of the server response).  See inlineSeedFrameLength in
 	// handshake_ntor.go.
+	//
+	// Optionally, the PRNG seed is instead sent after the response as a
+	// regular padded burst, and the response padding is not rebalanced.  The
+	// client processes the seed packet the same way in either case.
 
 	// Generate/send the response.
 	blob, err := hs.generateHandshake()
@@ -439,19 +1183,71 @@ func (conn *obfs4Conn) serverHandshake(sf *obfs4ServerFactory, sessionKey *ntor.
 	if _, err = frameBuf.Write(blob); err != nil {
 		return err
 	}
+	if sf.opts.separateSeed {
+		if _, err = conn.Conn.Write(frameBuf.Bytes()); err != nil {
+			return err
+		}
+		frameBuf.Reset()
+	}
 
 	// Send the PRNG seed as the first packet.
 	if err := conn.makePacket(&frameBuf, packetTypePrngSeed, sf.lenSeed.Bytes()[:], 0); err != nil {
 		return err
 	}
+	if sf.opts.separateSeed {
+		if err := conn.padBurst(&frameBuf, conn.nextPadLen(frameBuf.Len())); err != nil {
+			return err
+		}
+	}
 	if _, err = conn.Conn.Write(frameBuf.Bytes()); err != nil {
 		return err
 	}
 
+	HandshakeLatency.Observe(time.Since(startTime))
+
+	return conn.sendEarlyPadding()
+}
+
+// readHandshakeData reads handshake data into the receive buffer, never
+// reading more than maxHandshakeBufferLength bytes in total.  The peer's
+// handshake is rejected well before that, so this bounds the memory used by
+// each handshaking connection, regardless of what the peer sends.
+func (conn *obfs4Conn) readHandshakeData(hsBuf []byte) error {
+	avail := maxHandshakeBufferLength - conn.receiveBuffer.Len()
+	if avail <= 0 {
+		return ErrInvalidHandshake
+	}
+	if len(hsBuf) > avail {
+		hsBuf = hsBuf[:avail]
+	}
+
+	n, err := conn.Conn.Read(hsBuf)
+	if err != nil {
+		// The Read() could have returned data and an error, but there is
+		// no point in continuing on an EOF or whatever.
+		return err
+	}
+	conn.receiveBuffer.Write(hsBuf[:n])
 	return nil
 }
 
+// lockRead acquires the read lock if the connection is thread-safe, and
+// returns the function that releases it.
+func (conn *obfs4Conn) lockRead() func() {
+	if !conn.threadSafe {
+		return func() {}
+	}
+	conn.readLock.Lock()
+	return conn.readLock.Unlock
+}
+
 func (conn *obfs4Conn) Read(b []byte) (int, error) {
+	defer conn.lockRead()()
+
+	if conn.messageMode {
+		return conn.readMessagePart(b)
+	}
+
 	// If there is no payload from the previous Read() calls, consume data off
 	// the network.  Not all data received is guaranteed to be usable payload,
 	// so do this in a loop till data is present or an error occurs.
@@ -484,34 +1280,95 @@ func (conn *obfs4Conn) Read(b []byte) (int, error) {
 	return n, err
 }
 
-func (conn *obfs4Conn) Write(b []byte) (int, error) {
-	chopBuf := bytes.NewBuffer(b)
-	var (
-		payload  [maxPacketPayloadLength]byte
-		frameBuf bytes.Buffer
-		n        int
-	)
+// WriteTo writes decoded payload to w until EOF or an error occurs.  It
+// implements io.WriterTo, so that io.Copy relays data directly out of the
+// receive buffer, without the intermediate buffer and copy of Read.
+func (conn *obfs4Conn) WriteTo(w io.Writer) (int64, error) {
+	if conn.messageMode {
+		// Message boundaries are lost regardless, so just use Read, hiding
+		// this method from io.Copy to avoid recursing.
+		return io.Copy(w, struct{ io.Reader }{conn})
+	}
 
-	// Chop the pending data into payload frames.
-	for chopBuf.Len() > 0 {
-		// Send maximum sized frames.
-		rdLen, err := chopBuf.Read(payload[:])
-		if err != nil {
-			return 0, err
-		} else if rdLen == 0 {
-			panic("BUG: Write(), chopping length was 0")
+	defer conn.lockRead()()
+
+	var n int64
+	for {
+		// Relay any decoded data, including that decoded prior to a fatal
+		// error, before consuming more data off the network.
+		if conn.receiveDecodedBuffer.Len() > 0 {
+			wrLen, err := conn.receiveDecodedBuffer.WriteTo(w)
+			n += wrLen
+			if err != nil {
+				return n, err
+			}
+		}
+
+		err := conn.readPackets()
+		switch {
+		case err == nil, errors.Is(err, framing.ErrAgain):
+		case errors.Is(err, io.EOF):
+			wrLen, err := conn.receiveDecodedBuffer.WriteTo(w)
+			return n + wrLen, err
+		default:
+			wrLen, _ := conn.receiveDecodedBuffer.WriteTo(w)
+			return n + wrLen, err
 		}
-		n += rdLen
+	}
+}
+
+func (conn *obfs4Conn) Write(b []byte) (int, error) {
+	if conn.messageMode {
+		return conn.writeMessage(b)
+	}
+
+	// Empty writes are a no-op.  Sending a padding-only burst here would
+	// expose the caller's write pattern on the wire for no benefit.
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	return conn.write(b)
+}
+
+func (conn *obfs4Conn) write(b []byte) (int, error) {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	if conn.encoder == nil {
+		return 0, ErrHandshakeNotComplete
+	}
+	conn.lastWrite = time.Now()
 
-		if err = conn.makePacket(&frameBuf, packetTypePayload, payload[:rdLen], 0); err != nil {
+	if len(b) <= conn.maxPayloadLength() && conn.iatMode == iatNone && !conn.compress && conn.pendingVersion == nil {
+		return conn.writeSmall(b)
+	}
+
+	// Chop the pending data into payload frames, compressing it first if
+	// enabled.
+	frameBuf := getWriteBuffer()
+	defer putWriteBuffer(frameBuf)
+
+	var err error
+	if conn.pendingVersion != nil {
+		if err = conn.makePacket(frameBuf, packetTypeVersion, conn.pendingVersion, 0); err != nil {
 			return 0, err
 		}
+		conn.pendingVersion = nil
+	}
+	if conn.compress {
+		err = conn.makeCompressedPackets(frameBuf, b)
+	} else {
+		err = conn.makePackets(frameBuf, packetTypePayload, b)
+	}
+	if err != nil {
+		return 0, err
 	}
+	n := len(b)
 
 	if conn.iatMode != iatParanoid {
 		// For non-paranoid IAT, pad once per burst.  Paranoid IAT handles
 		// things differently.
-		if err := conn.padBurst(&frameBuf, conn.lenDist.Sample()); err != nil {
+		if err := conn.padWrite(frameBuf, conn.nextPadLen(frameBuf.Len())); err != nil {
 			return 0, err
 		}
 	}
@@ -520,7 +1377,6 @@ func (conn *obfs4Conn) Write(b []byte) (int, error) {
 	// because the frame encoder state is advanced, and the code doesn't keep
 	// frameBuf around.  In theory, write timeouts and whatnot could be
 	// supported if this wasn't the case, but that complicates the code.
-	var err error
 	if conn.iatMode != iatNone { //nolint:nestif
 		var iatFrame [framing.MaximumSegmentLength]byte
 		for frameBuf.Len() > 0 {
@@ -537,11 +1393,15 @@ func (conn *obfs4Conn) Write(b []byte) (int, error) {
 				// Paranoid IAT obfuscation throws performance out of the
 				// window and will sample the length distribution every time a
 				// write is scheduled.
-				targetLen := conn.lenDist.Sample()
+				targetLen := conn.nextPadLen(frameBuf.Len())
+				if targetLen == 0 {
+					// Nothing can be written, resample.
+					continue
+				}
 				if frameBuf.Len() < targetLen {
 					// There's not enough data buffered for the target write,
 					// so padding must be inserted.
-					if err = conn.padBurst(&frameBuf, targetLen); err != nil {
+					if err = conn.padBurst(frameBuf, targetLen); err != nil {
 						return 0, err
 					}
 					if frameBuf.Len() != targetLen {
@@ -560,15 +1420,14 @@ func (conn *obfs4Conn) Write(b []byte) (int, error) {
 				panic("BUG: Write(), iat length was 0")
 			}
 
-			// Calculate the delay.  The delay resolution is 100 usec, leading
-			// to a maximum delay of 10 msec.
-			iatDelta := time.Duration(conn.iatDist.Sample() * 100)
+			// Calculate the delay.
+			iatDelta := conn.shaping.NextIATDelay()
 
 			// Write then sleep.
 			if _, err = conn.Conn.Write(iatFrame[:iatWrLen]); err != nil {
 				return 0, err
 			}
-			time.Sleep(iatDelta * time.Microsecond)
+			time.Sleep(iatDelta)
 		}
 	} else {
 		_, err = conn.Conn.Write(frameBuf.Bytes())
@@ -577,6 +1436,55 @@ func (conn *obfs4Conn) Write(b []byte) (int, error) {
 	return n, err
 }
 
+// writeSmall is the fast path for writing payloads that fit into a single
+// packet when IAT obfuscation is disabled.  The chop loop is skipped, and the
+// frames are built in a pooled buffer, but the output is otherwise identical
+// to that of the general case.
+func (conn *obfs4Conn) writeSmall(b []byte) (int, error) {
+	frameBuf := getWriteBuffer()
+	defer putWriteBuffer(frameBuf)
+
+	if err := conn.makePacket(frameBuf, packetTypePayload, b, 0); err != nil {
+		return 0, err
+	}
+	if err := conn.padWrite(frameBuf, conn.nextPadLen(frameBuf.Len())); err != nil {
+		return 0, err
+	}
+	_, err := conn.Conn.Write(frameBuf.Bytes())
+
+	return len(b), err
+}
+
+func (conn *obfs4Conn) Close() error {
+	conn.closeOnce.Do(func() {
+		close(conn.closeChan)
+		conn.drain()
+	})
+	return conn.Conn.Close()
+}
+
+// drain waits for any in-progress Write to finish, and optionally sends a
+// final padding-only burst, so that the peer sees the stream end after a
+// complete burst rather than in the middle of one.  This is best-effort,
+// and bounded by closeDrainTimeout via the underlying connection's write
+// deadline.  If that is not supported, the connection is closed
+// immediately as nothing would bound the wait.
+func (conn *obfs4Conn) drain() {
+	if err := conn.Conn.SetWriteDeadline(time.Now().Add(closeDrainTimeout)); err != nil {
+		return
+	}
+
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+
+	if conn.closePadding && conn.encoder != nil {
+		var frameBuf bytes.Buffer
+		if err := conn.makePaddingBurst(&frameBuf); err == nil {
+			_, _ = conn.Conn.Write(frameBuf.Bytes())
+		}
+	}
+}
+
 func (conn *obfs4Conn) SetDeadline(_ time.Time) error {
 	return syscall.ENOTSUP
 }
@@ -585,23 +1493,79 @@ func (conn *obfs4Conn) SetWriteDeadline(_ time.Time) error {
 	return syscall.ENOTSUP
 }
 
-func (conn *obfs4Conn) closeAfterDelay(sf *obfs4ServerFactory, startTime time.Time) {
+// sampleCloseDelay returns how long a connection that failed to handshake
+// should be held open, measured from when it was accepted.  The delay is
+// sampled from the DRBG each time, so that repeated probes do not all see the
+// same teardown timing.
+func (sf *obfs4ServerFactory) sampleCloseDelay() time.Duration {
+	sf.closeDelayLock.Lock()
+	defer sf.closeDelayLock.Unlock()
+
+	delay := time.Duration(sf.closeDelayRng.Int63n(int64(maxCloseDelay * time.Second)))
+	return delay + serverHandshakeTimeout
+}
+
+// acquireCloseDelay returns true iff a failed connection may be held open by
+// closeAfterDelay.  Each delay consumes a goroutine and a socket, so under
+// a flood of failed handshakes, the connections over the limit are closed
+// immediately instead, at the cost of making those distinguishable.
+func (sf *obfs4ServerFactory) acquireCloseDelay() bool {
+	return acquireLimited(&sf.closeDelays, sf.maxCloseDelays)
+}
+
+// acquireHandshake returns true iff another handshake may be started.  Each
+// handshake in progress consumes a goroutine and a socket until it
+// completes or times out, so connections over the limit are rejected
+// without reading from them, and are then held open by the close delay
+// like any other failed handshake.
+func (sf *obfs4ServerFactory) acquireHandshake() bool {
+	return acquireLimited(&sf.handshakes, sf.maxHandshakes)
+}
+
+// acquireLimited increments n, and returns true, iff the result is within
+// limit (or limit is 0).
+func acquireLimited(n *atomic.Int32, limit int32) bool {
+	if v := n.Add(1); limit > 0 && v > limit {
+		n.Add(-1)
+		return false
+	}
+	return true
+}
+
+// rawConn returns the underlying connection, that failed connections are
+// drained from, so that malformed TLS records do not cut the delay short.
+func (conn *obfs4Conn) rawConn() net.Conn {
+	raw := conn.Conn
+	for {
+		switch c := raw.(type) {
+		case *recordConn:
+			raw = c.Conn
+		case *helloConn:
+			raw = c.Conn
+		default:
+			return raw
+		}
+	}
+}
+
+func (conn *obfs4Conn) closeAfterDelay(delay time.Duration, startTime time.Time) {
 	// I-it's not like I w-wanna handshake with you or anything.  B-b-baka!
 	defer conn.Conn.Close()
 
-	delay := time.Duration(sf.closeDelay)*time.Second + serverHandshakeTimeout
+	rawConn := conn.rawConn()
+
 	deadline := startTime.Add(delay)
 	if time.Now().After(deadline) {
 		return
 	}
 
-	if err := conn.Conn.SetReadDeadline(deadline); err != nil {
+	if err := rawConn.SetReadDeadline(deadline); err != nil {
 		return
 	}
 
 	// Consume and discard data on this connection until the specified interval
 	// passes.
-	_, _ = io.Copy(io.Discard, conn.Conn)
+	_, _ = io.Copy(io.Discard, rawConn)
 }
 
 func (conn *obfs4Conn) padBurst(burst *bytes.Buffer, toPadTo int) error {
@@ -630,9 +1594,328 @@ func (conn *obfs4Conn) padBurst(burst *bytes.Buffer, toPadTo int) error {
 	return nil
 }
 
+// padWrite pads the burst for a Write to toPadTo like padBurst, unless
+// that would take more than the configured number of padding frames, in
+// which case the padding is capped at that many maximum length frames.
+//
+// Limiting the padding saves bandwidth, but the lengths of the bursts that
+// are capped are not drawn from the length distribution, and thus are a
+// potential fingerprint.  Paranoid IAT mode pads each write on the wire
+// separately, and ignores the limit.
+func (conn *obfs4Conn) padWrite(burst *bytes.Buffer, toPadTo int) error {
+	if padLen := padBurstLength(burst.Len(), toPadTo); padLen <= conn.paddingFrames*framing.MaximumSegmentLength {
+		return conn.padBurst(burst, toPadTo)
+	}
+
+	for i := 0; i < conn.paddingFrames; i++ {
+		if err := conn.makePacket(burst, packetTypePayload, []byte{}, maxPacketPayloadLength); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// padBurstLength returns the number of bytes that padBurst appends to a
+// burst of burstLen bytes, when padding to toPadTo.
+func padBurstLength(burstLen, toPadTo int) int {
+	tailLen := burstLen % framing.MaximumSegmentLength
+
+	var padLen int
+	if toPadTo >= tailLen {
+		padLen = toPadTo - tailLen
+	} else {
+		padLen = (framing.MaximumSegmentLength - tailLen) + toPadTo
+	}
+
+	switch {
+	case padLen > headerLength:
+		return padLen
+	case padLen > 0:
+		// A maximum length padding packet, followed by one with padLen
+		// bytes of padding.
+		return framing.MaximumSegmentLength + headerLength + padLen
+	default:
+		return 0
+	}
+}
+
+// EstimatePaddingOverhead returns the minimum, maximum and expected number
+// of padding bytes added to a Write of payloadLen bytes, when the length
+// distribution is lenDist.  The estimate assumes the default (non-bulk)
+// frame size, and an IAT mode other than paranoid, where the padding is
+// sampled per write instead of per burst.
+func EstimatePaddingOverhead(payloadLen int, lenDist *probdist.WeightedDist) (min, max, expected int) { //nolint:nonamedreturns
+	values, probs := lenDist.Probabilities()
+	return estimatePaddingOverhead(payloadLen, values, probs)
+}
+
+func estimatePaddingOverhead(payloadLen int, values []int, probs []float64) (int, int, int) {
+	if payloadLen <= 0 {
+		// Zero length writes are a no-op.
+		return 0, 0, 0
+	}
+
+	// Payload is sent in maximum sized packets, with the remainder in the
+	// final packet.
+	nrPackets := (payloadLen + maxPacketPayloadLength - 1) / maxPacketPayloadLength
+	burstLen := payloadLen + nrPackets*headerLength
+
+	minPad, maxPad := math.MaxInt, 0
+	var expected float64
+	for i, v := range values {
+		padLen := padBurstLength(burstLen, v)
+		if padLen < minPad {
+			minPad = padLen
+		}
+		if padLen > maxPad {
+			maxPad = padLen
+		}
+		expected += probs[i] * float64(padLen)
+	}
+	if minPad > maxPad {
+		// Empty distribution.
+		return 0, 0, 0
+	}
+
+	return minPad, maxPad, int(math.Round(expected))
+}
+
+func parseKeepaliveArg(args *pt.Args) (time.Duration, error) {
+	str, ok := args.Get(keepaliveArg)
+	if !ok {
+		return 0, nil
+	}
+	secs, err := strconv.Atoi(str)
+	if err != nil || secs < 0 {
+		return 0, fmt.Errorf("invalid keepalive '%s'", str)
+	}
+	return time.Duration(secs) * time.Second, nil
+}
+
+func parseReceiveLimitArg(args *pt.Args) (int, error) {
+	str, ok := args.Get(rxLimitArg)
+	if !ok {
+		return 0, nil
+	}
+	limit, err := strconv.Atoi(str)
+	if err != nil || limit < 0 || (limit > 0 && limit < framing.MaximumSegmentLength) {
+		return 0, fmt.Errorf("invalid max-receive-buffer '%s'", str)
+	}
+	return limit, nil
+}
+
+func parseDecodeFramesArg(args *pt.Args) (int, error) {
+	str, ok := args.Get(decodeFramesArg)
+	if !ok {
+		return 0, nil
+	}
+	frames, err := strconv.Atoi(str)
+	if err != nil || frames < 0 {
+		return 0, fmt.Errorf("invalid max-decode-frames '%s'", str)
+	}
+	return frames, nil
+}
+
+func parsePasswordArg(args *pt.Args) ([]byte, error) {
+	str, ok := args.Get(passwordArg)
+	if !ok {
+		return nil, nil
+	}
+	if str == "" {
+		return nil, fmt.Errorf("invalid empty %s", passwordArg)
+	}
+	return []byte(str), nil
+}
+
+func parseBoolArg(args *pt.Args, key string) (bool, error) {
+	str, ok := args.Get(key)
+	if !ok {
+		return false, nil
+	}
+	v, err := strconv.ParseBool(str)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s '%s'", key, str)
+	}
+	return v, nil
+}
+
+func parseHandshakeLengthArg(args *pt.Args, isServer bool) (int, error) {
+	str, ok := args.Get(hsLengthArg)
+	if !ok {
+		return 0, nil
+	}
+	minLength, maxLength := clientMinFixedHandshakeLength, clientMaxFixedHandshakeLength
+	if isServer {
+		minLength, maxLength = serverMinFixedHandshakeLength, serverMaxFixedHandshakeLength
+	}
+	length, err := strconv.Atoi(str)
+	if err != nil || length < minLength || length > maxLength {
+		return 0, fmt.Errorf("invalid handshake-length '%s' (valid range [%d,%d])", str, minLength, maxLength)
+	}
+	return length, nil
+}
+
+func parsePaddingFramesArg(args *pt.Args) (int, error) {
+	str, ok := args.Get(padFramesArg)
+	if !ok {
+		return maxPaddingFrames, nil
+	}
+	frames, err := strconv.Atoi(str)
+	if err != nil || frames < 0 || frames > maxPaddingFrames {
+		return 0, fmt.Errorf("invalid max-padding-frames '%s' (valid range [0,%d])", str, maxPaddingFrames)
+	}
+	return frames, nil
+}
+
+func parseLimitArg(args *pt.Args, key string) (int32, error) {
+	str, ok := args.Get(key)
+	if !ok {
+		return 0, nil
+	}
+	limit, err := strconv.ParseInt(str, 10, 32)
+	if err != nil || limit < 0 {
+		return 0, fmt.Errorf("invalid %s '%s'", key, str)
+	}
+	return int32(limit), nil
+}
+
+func parseEpochToleranceArg(args *pt.Args) (int, error) {
+	str, ok := args.Get(epochTolArg)
+	if !ok {
+		return defaultEpochTolerance, nil
+	}
+	epochs, err := strconv.Atoi(str)
+	if err != nil || epochs < defaultEpochTolerance || epochs > maxEpochTolerance {
+		return 0, fmt.Errorf("invalid %s '%s' (valid range [%d,%d])", epochTolArg, str, defaultEpochTolerance, maxEpochTolerance)
+	}
+	return epochs, nil
+}
+
+func parseEpochPeriodArg(args *pt.Args) (time.Duration, error) {
+	str, ok := args.Get(epochPeriodArg)
+	if !ok {
+		return defaultEpochPeriod, nil
+	}
+	mins, err := strconv.Atoi(str)
+	if err != nil || mins < int(minEpochPeriod/time.Minute) || mins > int(maxEpochPeriod/time.Minute) {
+		return 0, fmt.Errorf("invalid %s '%s' (valid range [%d,%d])", epochPeriodArg, str, minEpochPeriod/time.Minute, maxEpochPeriod/time.Minute)
+	}
+	return time.Duration(mins) * time.Minute, nil
+}
+
+func parseConnectJitterArg(args *pt.Args) (time.Duration, error) {
+	str, ok := args.Get(jitterArg)
+	if !ok {
+		return 0, nil
+	}
+	ms, err := strconv.Atoi(str)
+	if err != nil || ms < 0 || ms > maxConnectJitter {
+		return 0, fmt.Errorf("invalid connect-jitter '%s' (valid range [0,%d])", str, maxConnectJitter)
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+func parseHandshakeRetriesArg(args *pt.Args) (int, error) {
+	str, ok := args.Get(hsRetriesArg)
+	if !ok {
+		return 0, nil
+	}
+	retries, err := strconv.Atoi(str)
+	if err != nil || retries < 0 || retries > maxHandshakeRetries {
+		return 0, fmt.Errorf("invalid handshake-retries '%s' (valid range [0,%d])", str, maxHandshakeRetries)
+	}
+	return retries, nil
+}
+
+func (conn *obfs4Conn) startKeepalive(interval time.Duration) {
+	if interval > 0 {
+		conn.lastWrite = time.Now()
+		go conn.keepaliveWorker(interval)
+	}
+}
+
+func (conn *obfs4Conn) keepaliveWorker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-conn.closeChan:
+			return
+		case <-ticker.C:
+		}
+
+		if err := conn.sendKeepalive(interval); err != nil {
+			// Write errors are fatal, and the next Read/Write will notice.
+			return
+		}
+	}
+}
+
+func (conn *obfs4Conn) sendKeepalive(interval time.Duration) error {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+
+	// Only bother if the connection has been idle for the entire interval.
+	if time.Since(conn.lastWrite) < interval {
+		return nil
+	}
+	conn.lastWrite = time.Now()
+
+	// Send a padding-only burst sampled from the length distribution, so that
+	// idle traffic looks like any other short burst.
+	var frameBuf bytes.Buffer
+	if err := conn.makePaddingBurst(&frameBuf); err != nil {
+		return err
+	}
+	_, err := conn.Conn.Write(frameBuf.Bytes())
+	return err
+}
+
+// sendEarlyPadding sends a padding-only burst of random length immediately
+// after the handshake, if early padding was negotiated, so that the first
+// data burst seen on the wire is not the application's first write.
+func (conn *obfs4Conn) sendEarlyPadding() error {
+	if conn.features&protocolFeatureEarlyPadding == 0 {
+		return nil
+	}
+
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	conn.lastWrite = time.Now()
+
+	var frameBuf bytes.Buffer
+	for i := csrand.IntRange(0, maxEarlyPaddingFrames); i > 0; i-- {
+		if err := conn.makePacket(&frameBuf, packetTypePayload, []byte{}, maxPacketPaddingLength); err != nil {
+			return err
+		}
+	}
+	if err := conn.makePaddingBurst(&frameBuf); err != nil {
+		return err
+	}
+	_, err := conn.Conn.Write(frameBuf.Bytes())
+	return err
+}
+
+// makePaddingBurst pads burst to a length sampled from the length
+// distribution.  If the burst is empty, and the sample happens to call for
+// no padding at all, a single empty packet is added instead.
+func (conn *obfs4Conn) makePaddingBurst(burst *bytes.Buffer) error {
+	if err := conn.padBurst(burst, conn.nextPadLen(burst.Len())); err != nil {
+		return err
+	}
+	if burst.Len() == 0 {
+		return conn.makePacket(burst, packetTypePayload, []byte{}, 0)
+	}
+	return nil
+}
+
 var (
+	_ ReplayBackend      = (*replayfilter.ReplayFilter)(nil)
 	_ base.ClientFactory = (*obfs4ClientFactory)(nil)
 	_ base.ServerFactory = (*obfs4ServerFactory)(nil)
 	_ base.Transport     = (*Transport)(nil)
 	_ net.Conn           = (*obfs4Conn)(nil)
+	_ MessageConn        = (*obfs4Conn)(nil)
+	_ io.WriterTo        = (*obfs4Conn)(nil)
 )
@@ -0,0 +1,2100 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package obfs4
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+
+	"gitlab.com/yawning/obfs4.git/common/drbg"
+	"gitlab.com/yawning/obfs4.git/common/ntor"
+	"gitlab.com/yawning/obfs4.git/common/probdist"
+	"gitlab.com/yawning/obfs4.git/common/replayfilter"
+	"gitlab.com/yawning/obfs4.git/transports/base"
+	"gitlab.com/yawning/obfs4.git/transports/obfs4/framing"
+)
+
+// newTestConnPair returns a handshaked client/server obfs4Conn pair connected
+// via a net.Pipe.  The server is configured with serverArgs, which may be
+// nil, and the client uses the descriptor arguments of the server with the
+// provided IAT mode.
+func newTestConnPair(t testing.TB, iatMode int, serverArgs *pt.Args) (*obfs4Conn, *obfs4Conn) {
+	t.Helper()
+
+	if serverArgs == nil {
+		serverArgs = &pt.Args{}
+	}
+
+	tr := new(Transport)
+	sf, err := tr.ServerFactory(t.TempDir(), serverArgs)
+	if err != nil {
+		t.Fatalf("Transport.ServerFactory() failed: %s", err)
+	}
+	cf, err := tr.ClientFactory("")
+	if err != nil {
+		t.Fatalf("Transport.ClientFactory() failed: %s", err)
+	}
+
+	clientArgs := pt.Args{}
+	for k, v := range *sf.Args() {
+		clientArgs[k] = v
+	}
+	clientArgs[iatArg] = []string{strconv.Itoa(iatMode)}
+	ca, err := cf.ParseArgs(&clientArgs)
+	if err != nil {
+		t.Fatalf("obfs4ClientFactory.ParseArgs() failed: %s", err)
+	}
+
+	clientRaw, serverRaw := net.Pipe()
+
+	type wrapResult struct {
+		conn net.Conn
+		err  error
+	}
+	serverCh := make(chan wrapResult, 1)
+	go func() {
+		c, err := sf.WrapConn(serverRaw)
+		serverCh <- wrapResult{c, err}
+	}()
+
+	dialFn := func(string, string) (net.Conn, error) {
+		return clientRaw, nil
+	}
+	client, err := cf.Dial("tcp", "pipe", dialFn, ca)
+	if err != nil {
+		t.Fatalf("obfs4ClientFactory.Dial() failed: %s", err)
+	}
+	res := <-serverCh
+	if res.err != nil {
+		t.Fatalf("obfs4ServerFactory.WrapConn() failed: %s", res.err)
+	}
+
+	t.Cleanup(func() {
+		client.Close()
+		res.conn.Close()
+	})
+
+	return client.(*obfs4Conn), res.conn.(*obfs4Conn) //nolint:forcetypeassert
+}
+
+func TestObfs4Conn_WriteEmpty(t *testing.T) {
+	client, _ := newTestConnPair(t, iatNone, nil)
+
+	// Any frames written to the pipe would block indefinitely as nothing is
+	// reading from the server side, so bound the write.
+	if err := client.Conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+		t.Fatalf("SetWriteDeadline() failed: %s", err)
+	}
+
+	for _, b := range [][]byte{nil, {}} {
+		n, err := client.Write(b)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatalf("Write(%#v) attempted to send frames", b)
+			}
+			t.Fatalf("Write(%#v) failed: %s", b, err)
+		}
+		if n != 0 {
+			t.Fatalf("Write(%#v) returned %d, expected 0", b, n)
+		}
+	}
+}
+
+func TestObfs4Conn_Keepalive(t *testing.T) {
+	const interval = 50 * time.Millisecond
+
+	client, server := newTestConnPair(t, iatNone, nil)
+	client.startKeepalive(interval)
+
+	// The client is otherwise idle, so everything the server receives is
+	// keepalive padding, which should decode cleanly and yield no payload.
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := server.Conn.SetReadDeadline(time.Now().Add(10 * interval)); err != nil {
+			t.Fatalf("SetReadDeadline() failed: %s", err)
+		}
+		if err := server.readPackets(); err != nil && !errors.Is(err, framing.ErrAgain) {
+			t.Fatalf("[%d]: readPackets() failed: %s", i, err)
+		}
+		if server.receiveDecodedBuffer.Len() != 0 {
+			t.Fatalf("[%d]: keepalive contained payload", i)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 2*interval {
+		t.Fatalf("keepalive sent too frequently: 3 reads in %v", elapsed)
+	}
+
+	// Closing the connection must stop the keepalive worker.
+	client.Close()
+	select {
+	case <-client.closeChan:
+	default:
+		t.Fatalf("Close() did not signal the keepalive worker")
+	}
+}
+
+func TestParseKeepaliveArg(t *testing.T) {
+	for _, v := range []struct {
+		str string
+		ok  bool
+		exp time.Duration
+	}{
+		{"", true, 0},
+		{"0", true, 0},
+		{"30", true, 30 * time.Second},
+		{"-1", false, 0},
+		{"bogus", false, 0},
+	} {
+		args := pt.Args{}
+		if v.str != "" {
+			args.Add(keepaliveArg, v.str)
+		}
+		d, err := parseKeepaliveArg(&args)
+		if (err == nil) != v.ok {
+			t.Fatalf("parseKeepaliveArg(%q): unexpected error state: %v", v.str, err)
+		}
+		if d != v.exp {
+			t.Fatalf("parseKeepaliveArg(%q): got %v, expected %v", v.str, d, v.exp)
+		}
+	}
+}
+
+// BenchmarkObfs4Conn_WriteSmall benchmarks obfs4Conn.Write with 64 byte
+// payloads.
+func BenchmarkObfs4Conn_WriteSmall(b *testing.B) {
+	client, server := newTestConnPair(b, iatNone, nil)
+	go func() {
+		_, _ = io.Copy(io.Discard, server.Conn)
+	}()
+
+	payload := make([]byte, 64)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(payload); err != nil {
+			b.Fatalf("Write() failed: %s", err)
+		}
+	}
+}
+
+// BenchmarkObfs4Conn_Write benchmarks obfs4Conn.Write with 1 byte, 100 byte,
+// and MTU sized payloads, to track the per-write allocations.
+func BenchmarkObfs4Conn_Write(b *testing.B) {
+	for _, size := range []int{1, 100, framing.MaximumSegmentLength} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			client, server := newTestConnPair(b, iatNone, nil)
+			go func() {
+				_, _ = io.Copy(io.Discard, server.Conn)
+			}()
+
+			payload := make([]byte, size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := client.Write(payload); err != nil {
+					b.Fatalf("Write() failed: %s", err)
+				}
+			}
+		})
+	}
+}
+
+func TestObfs4Conn_WriteRead(t *testing.T) {
+	for _, iatMode := range []int{iatNone, iatEnabled} {
+		client, server := newTestConnPair(t, iatMode, nil)
+
+		// Continuously drain the server side, so that the trailing padding
+		// does not leave the writer blocked on the synchronous pipe.
+		pr, pw := io.Pipe()
+		go func() {
+			_, err := io.Copy(pw, server)
+			pw.CloseWithError(err)
+		}()
+
+		for _, sz := range []int{1, 64, maxPacketPayloadLength, maxPacketPayloadLength + 1, 64 * 1024} {
+			payload := make([]byte, sz)
+			_, _ = rand.Read(payload)
+
+			errCh := make(chan error, 1)
+			go func() {
+				_, err := client.Write(payload)
+				errCh <- err
+			}()
+
+			received := make([]byte, sz)
+			if _, err := io.ReadFull(pr, received); err != nil {
+				t.Fatalf("[%d:%d]: ReadFull() failed: %s", iatMode, sz, err)
+			}
+			if err := <-errCh; err != nil {
+				t.Fatalf("[%d:%d]: Write() failed: %s", iatMode, sz, err)
+			}
+			if !bytes.Equal(payload, received) {
+				t.Fatalf("[%d:%d]: payload mismatch", iatMode, sz)
+			}
+		}
+	}
+}
+
+func TestObfs4Conn_MessageMode(t *testing.T) {
+	serverArgs := &pt.Args{}
+	serverArgs.Add(messageArg, "1")
+	client, server := newTestConnPair(t, iatNone, serverArgs)
+	if !server.messageMode {
+		t.Fatalf("server message mode not enabled via args")
+	}
+	client.messageMode = true
+
+	// Messages larger than a single packet will be fragmented over multiple
+	// frames, and small messages will be coalesced by the reader's network
+	// reads.  Boundaries must be preserved regardless.
+	sizes := []int{0, 1, 64, maxPacketPayloadLength - messageHeaderLength, maxPacketPayloadLength, 100 * 1024, 3}
+	msgs := make([][]byte, 0, len(sizes))
+	for _, sz := range sizes {
+		msg := make([]byte, sz)
+		_, _ = rand.Read(msg)
+		msgs = append(msgs, msg)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		for _, msg := range msgs {
+			n, err := client.Write(msg)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			if n != len(msg) {
+				errCh <- fmt.Errorf("short write: %d, expected %d", n, len(msg))
+				return
+			}
+		}
+		errCh <- nil
+	}()
+
+	for i, msg := range msgs {
+		received, err := server.ReadMessage()
+		if err != nil {
+			t.Fatalf("[%d]: ReadMessage() failed: %s", i, err)
+		}
+		if !bytes.Equal(msg, received) {
+			t.Fatalf("[%d]: message mismatch, got %d bytes, expected %d", i, len(received), len(msg))
+		}
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("Write() failed: %s", err)
+	}
+
+	// Read must not return data spanning a message boundary.
+	go func() {
+		_, _ = client.Write([]byte("first"))
+		_, _ = client.Write([]byte("second"))
+	}()
+	var buf [64]byte
+	for _, v := range []struct {
+		bufLen   int
+		expected string
+	}{
+		{3, "fir"},
+		{len(buf), "st"},
+		{len(buf), "second"},
+	} {
+		expected := v.expected
+		n, err := server.Read(buf[:v.bufLen])
+		if err != nil {
+			t.Fatalf("Read() failed: %s", err)
+		}
+		if string(buf[:n]) != expected {
+			t.Fatalf("Read() returned %q, expected %q", buf[:n], expected)
+		}
+	}
+}
+
+func TestObfs4Conn_ThreadSafe(t *testing.T) {
+	const (
+		nrGoroutines = 8
+		nrMessages   = 16
+	)
+
+	serverArgs := &pt.Args{}
+	serverArgs.Add(messageArg, "1")
+	serverArgs.Add(threadSafeArg, "1")
+	client, server := newTestConnPair(t, iatNone, serverArgs)
+	if !server.threadSafe {
+		t.Fatalf("server thread-safe mode not enabled via args")
+	}
+	client.messageMode = true
+	client.threadSafe = true
+
+	// Each message is tagged with the writer and sequence number, followed
+	// by a body derived from the tag, so that any corruption or interleaving
+	// is detected.
+	makeMessage := func(id, seq int) []byte {
+		msg := make([]byte, 2+(id*nrMessages+seq)*97)
+		msg[0], msg[1] = byte(id), byte(seq)
+		for i := 2; i < len(msg); i++ {
+			msg[i] = byte(id*31 + seq*7 + i)
+		}
+		return msg
+	}
+
+	errCh := make(chan error, nrGoroutines)
+	for id := 0; id < nrGoroutines; id++ {
+		go func(id int) {
+			for seq := 0; seq < nrMessages; seq++ {
+				if _, err := client.Write(makeMessage(id, seq)); err != nil {
+					errCh <- err
+					return
+				}
+			}
+		}(id)
+	}
+	msgCh := make(chan []byte, nrGoroutines*nrMessages)
+	for i := 0; i < nrGoroutines; i++ {
+		go func() {
+			for {
+				msg, err := server.ReadMessage()
+				if err != nil {
+					return
+				}
+				msgCh <- msg
+			}
+		}()
+	}
+
+	seen := make(map[[2]byte]bool)
+	for len(seen) < nrGoroutines*nrMessages {
+		select {
+		case err := <-errCh:
+			t.Fatalf("Write() failed: %s", err)
+		case msg := <-msgCh:
+			if len(msg) < 2 || int(msg[0]) >= nrGoroutines || int(msg[1]) >= nrMessages {
+				t.Fatalf("received a corrupted message")
+			}
+			tag := [2]byte{msg[0], msg[1]}
+			if seen[tag] || !bytes.Equal(msg, makeMessage(int(msg[0]), int(msg[1]))) {
+				t.Fatalf("received a corrupted or duplicated message %v", tag)
+			}
+			seen[tag] = true
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out after %d messages", len(seen))
+		}
+	}
+	client.Close()
+	server.Close()
+}
+
+func TestObfs4ServerFactory_CloseDelay(t *testing.T) {
+	tr := new(Transport)
+	f, err := tr.ServerFactory(t.TempDir(), &pt.Args{})
+	if err != nil {
+		t.Fatalf("Transport.ServerFactory() failed: %s", err)
+	}
+	sf := f.(*obfs4ServerFactory) //nolint:forcetypeassert
+
+	const nSamples = 32
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < nSamples; i++ {
+		delay := sf.sampleCloseDelay()
+		if delay < serverHandshakeTimeout || delay >= serverHandshakeTimeout+maxCloseDelay*time.Second {
+			t.Fatalf("[%d]: close delay out of range: %v", i, delay)
+		}
+		seen[delay] = true
+	}
+	if len(seen) == 1 {
+		t.Fatalf("close delay did not vary across %d failed connections", nSamples)
+	}
+}
+
+func TestObfs4Conn_ReceiveLimit(t *testing.T) {
+	const limit = 4096
+
+	serverArgs := &pt.Args{}
+	serverArgs.Add(rxLimitArg, strconv.Itoa(limit))
+	client, server := newTestConnPair(t, iatNone, serverArgs)
+	if server.receiveLimit != limit {
+		t.Fatalf("server receive limit not set via args")
+	}
+
+	payload := make([]byte, 256*1024)
+	_, _ = rand.Read(payload)
+	go func() {
+		_, _ = client.Write(payload)
+	}()
+
+	// Read slowly, and ensure that the amount of buffered data never
+	// exceeds the limit plus a single segment.
+	received := make([]byte, 0, len(payload))
+	var buf [512]byte
+	for len(received) < len(payload) {
+		n, err := server.Read(buf[:])
+		if err != nil {
+			t.Fatalf("Read() failed: %s", err)
+		}
+		received = append(received, buf[:n]...)
+
+		buffered := server.receiveDecodedBuffer.Len() + server.receiveBuffer.Len()
+		if buffered > limit+framing.MaximumSegmentLength {
+			t.Fatalf("buffered %d bytes, limit is %d", buffered, limit)
+		}
+	}
+	if !bytes.Equal(payload, received) {
+		t.Fatalf("payload mismatch")
+	}
+}
+
+func TestObfs4Conn_DecodeFrames(t *testing.T) {
+	const frames = 2
+
+	serverArgs := &pt.Args{}
+	serverArgs.Add(decodeFramesArg, strconv.Itoa(frames))
+	client, server := newTestConnPair(t, iatNone, serverArgs)
+	if server.decodeFrames != frames {
+		t.Fatalf("server decode limit not set via args")
+	}
+
+	payload := make([]byte, 16*maxPacketPayloadLength)
+	_, _ = rand.Read(payload)
+	go func() {
+		_, _ = client.Write(payload)
+	}()
+
+	// Each call decodes at most the limit, even though the burst has far
+	// more frames buffered.
+	if err := server.readPackets(); err != nil {
+		t.Fatalf("readPackets() failed: %s", err)
+	}
+	if n := server.receiveDecodedBuffer.Len(); n == 0 || n > frames*maxPacketPayloadLength {
+		t.Fatalf("decoded %d bytes, limit is %d frames", n, frames)
+	}
+	if !server.decodePending || server.receiveBuffer.Len() == 0 {
+		t.Fatalf("no frames left buffered past the limit")
+	}
+
+	// The frames left buffered are decoded without waiting on the network.
+	received := make([]byte, 0, len(payload))
+	var buf [1024]byte
+	for len(received) < len(payload) {
+		n, err := server.Read(buf[:])
+		if err != nil {
+			t.Fatalf("Read() failed: %s", err)
+		}
+		received = append(received, buf[:n]...)
+	}
+	if !bytes.Equal(payload, received) {
+		t.Fatalf("payload mismatch")
+	}
+
+	for _, v := range []string{"-1", "bogus"} {
+		args := &pt.Args{}
+		args.Add(decodeFramesArg, v)
+		if _, err := parseConnOptions(args, false); err == nil {
+			t.Fatalf("parseConnOptions() accepted max-decode-frames %q", v)
+		}
+	}
+}
+
+func TestParseReceiveLimitArg(t *testing.T) {
+	for _, v := range []struct {
+		arg   string
+		limit int
+		ok    bool
+	}{
+		{"", 0, true},
+		{"0", 0, true},
+		{"65536", 65536, true},
+		{strconv.Itoa(framing.MaximumSegmentLength), framing.MaximumSegmentLength, true},
+		{"1", 0, false},
+		{"-1", 0, false},
+		{"bogus", 0, false},
+	} {
+		args := &pt.Args{}
+		if v.arg != "" {
+			args.Add(rxLimitArg, v.arg)
+		}
+		limit, err := parseReceiveLimitArg(args)
+		if (err == nil) != v.ok {
+			t.Fatalf("parseReceiveLimitArg(%q): unexpected error state: %v", v.arg, err)
+		}
+		if v.ok && limit != v.limit {
+			t.Fatalf("parseReceiveLimitArg(%q): got %d, expected %d", v.arg, limit, v.limit)
+		}
+	}
+}
+
+func TestParseHandshakeLengthArg(t *testing.T) {
+	for _, v := range []struct {
+		arg      string
+		isServer bool
+		length   int
+		ok       bool
+	}{
+		{"", false, 0, true},
+		{"", true, 0, true},
+		{"1024", false, 1024, true},
+		{"1024", true, 1024, true},
+		{strconv.Itoa(clientMinFixedHandshakeLength), false, clientMinFixedHandshakeLength, true},
+		{strconv.Itoa(clientMinFixedHandshakeLength - 1), false, 0, false},
+		{strconv.Itoa(serverMinFixedHandshakeLength), true, serverMinFixedHandshakeLength, true},
+		{strconv.Itoa(serverMinFixedHandshakeLength - 1), true, 0, false},
+		{strconv.Itoa(maxHandshakeLength + 1), false, 0, false},
+		{strconv.Itoa(maxHandshakeLength + 1), true, 0, false},
+		{"bogus", false, 0, false},
+	} {
+		args := &pt.Args{}
+		if v.arg != "" {
+			args.Add(hsLengthArg, v.arg)
+		}
+		length, err := parseHandshakeLengthArg(args, v.isServer)
+		if (err == nil) != v.ok {
+			t.Fatalf("parseHandshakeLengthArg(%q, %v): unexpected error state: %v", v.arg, v.isServer, err)
+		}
+		if v.ok && length != v.length {
+			t.Fatalf("parseHandshakeLengthArg(%q, %v): got %d, expected %d", v.arg, v.isServer, length, v.length)
+		}
+	}
+}
+
+func TestObfs4Conn_Password(t *testing.T) {
+	// The client arguments are derived from the server's, and thus include
+	// the correct password.
+	serverArgs := &pt.Args{}
+	serverArgs.Add(passwordArg, "correct horse battery staple")
+	client, server := newTestConnPair(t, iatNone, serverArgs)
+
+	msg := []byte("hello")
+	go func() {
+		_, _ = client.Write(msg)
+	}()
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(server, buf); err != nil {
+		t.Fatalf("Read() failed: %s", err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Fatalf("payload mismatch")
+	}
+}
+
+func TestHandshakeLatencyMetrics(t *testing.T) {
+	before := HandshakeLatency.Snapshot()
+
+	// A synthetic observation.
+	HandshakeLatency.Observe(42 * time.Millisecond)
+	after := HandshakeLatency.Snapshot()
+	if after.Count != before.Count+1 || after.SumMs != before.SumMs+42 {
+		t.Fatalf("synthetic observation not recorded: %+v -> %+v", before, after)
+	}
+
+	// A real handshake records one observation for each side.
+	totalBefore := TotalLatency.Snapshot()
+	_, _ = newTestConnPair(t, iatNone, nil)
+	if n := HandshakeLatency.Snapshot().Count; n != after.Count+2 {
+		t.Fatalf("handshake observations: got %d, expected %d", n, after.Count+2)
+	}
+	if n := TotalLatency.Snapshot().Count; n != totalBefore.Count+2 {
+		t.Fatalf("total observations: got %d, expected %d", n, totalBefore.Count+2)
+	}
+}
+
+func TestObfs4Conn_HandshakeNotComplete(t *testing.T) {
+	seed, err := drbg.NewSeed()
+	if err != nil {
+		t.Fatalf("drbg.NewSeed() failed: %s", err)
+	}
+	lenDist := probdist.New(seed, 0, framing.MaximumSegmentLength, false)
+
+	// Without a handshake, there are no keys to encode or decode frames
+	// with, which must be a clear error rather than a nil dereference.
+	for _, messageMode := range []bool{false, true} {
+		clientRaw, serverRaw := net.Pipe()
+		conn := newObfs4Conn(clientRaw, false, lenDist, nil, iatNone, &connOptions{messageMode: messageMode})
+		if _, err = conn.Write([]byte("hello")); !errors.Is(err, ErrHandshakeNotComplete) {
+			t.Fatalf("[%v]: Write() returned %v, expected ErrHandshakeNotComplete", messageMode, err)
+		}
+		if _, err = conn.Read(make([]byte, 16)); !errors.Is(err, ErrHandshakeNotComplete) {
+			t.Fatalf("[%v]: Read() returned %v, expected ErrHandshakeNotComplete", messageMode, err)
+		}
+		if _, err = conn.WriteTo(io.Discard); !errors.Is(err, ErrHandshakeNotComplete) {
+			t.Fatalf("[%v]: WriteTo() returned %v, expected ErrHandshakeNotComplete", messageMode, err)
+		}
+		if messageMode {
+			if _, err = conn.ReadMessage(); !errors.Is(err, ErrHandshakeNotComplete) {
+				t.Fatalf("ReadMessage() returned %v, expected ErrHandshakeNotComplete", err)
+			}
+		}
+		clientRaw.Close()
+		serverRaw.Close()
+	}
+}
+
+func TestObfs4Conn_HandshakeBufferLimit(t *testing.T) {
+	tr := new(Transport)
+	f, err := tr.ServerFactory(t.TempDir(), &pt.Args{})
+	if err != nil {
+		t.Fatalf("Transport.ServerFactory() failed: %s", err)
+	}
+	sf := f.(*obfs4ServerFactory) //nolint:forcetypeassert
+	sessionKey, err := ntor.NewKeypair(true)
+	if err != nil {
+		t.Fatalf("ntor.NewKeypair() failed: %s", err)
+	}
+
+	clientRaw, serverRaw := net.Pipe()
+	defer clientRaw.Close()
+	lenDist := probdist.New(sf.lenSeed, 0, framing.MaximumSegmentLength, false)
+	conn := newObfs4Conn(serverRaw, true, lenDist, nil, iatNone, sf.opts)
+
+	// Stream junk that never contains a valid mark, in writes sized such
+	// that an unbounded read would overshoot the limit.
+	go func() {
+		junk := make([]byte, maxHandshakeLength)
+		_, _ = rand.Read(junk)
+		if _, err := clientRaw.Write(junk[:maxHandshakeLength-1]); err != nil {
+			return
+		}
+		for {
+			_, _ = rand.Read(junk)
+			if _, err := clientRaw.Write(junk); err != nil {
+				return
+			}
+		}
+	}()
+
+	if err = conn.serverHandshake(sf, sessionKey); !errors.Is(err, ErrInvalidHandshake) {
+		t.Fatalf("serverHandshake() returned %v, expected ErrInvalidHandshake", err)
+	}
+	if n := conn.receiveBuffer.Len(); n > maxHandshakeBufferLength {
+		t.Fatalf("receive buffer grew to %d bytes, limit is %d", n, maxHandshakeBufferLength)
+	}
+	serverRaw.Close()
+}
+
+func TestMaxCloseDelays(t *testing.T) {
+	const (
+		maxCloseDelays = 2
+		nrConns        = 6
+	)
+
+	serverArgs := &pt.Args{}
+	serverArgs.Add(closeDelaysArg, strconv.Itoa(maxCloseDelays))
+	f, err := new(Transport).ServerFactory(t.TempDir(), serverArgs)
+	if err != nil {
+		t.Fatalf("Transport.ServerFactory() failed: %s", err)
+	}
+	sf := f.(*obfs4ServerFactory) //nolint:forcetypeassert
+
+	// Fail all of the handshakes at once.  The close delay is always longer
+	// than the test, so only the connections over the limit can return.
+	doneCh := make(chan error, nrConns)
+	var clients []net.Conn
+	for i := 0; i < nrConns; i++ {
+		clientRaw, serverRaw := net.Pipe()
+		clients = append(clients, clientRaw)
+		go func() {
+			_, _ = clientRaw.Write(make([]byte, maxHandshakeBufferLength))
+		}()
+		go func() {
+			_, err := sf.WrapConn(serverRaw)
+			doneCh <- err
+		}()
+	}
+	for i := 0; i < nrConns-maxCloseDelays; i++ {
+		if err = <-doneCh; !errors.Is(err, ErrInvalidHandshake) {
+			t.Fatalf("WrapConn() returned %v, expected ErrInvalidHandshake", err)
+		}
+	}
+	if n := sf.closeDelays.Load(); n != maxCloseDelays {
+		t.Fatalf("%d concurrent close delays, expected %d", n, maxCloseDelays)
+	}
+
+	// Hanging up ends the remaining delays early.
+	for _, c := range clients {
+		c.Close()
+	}
+	for i := 0; i < maxCloseDelays; i++ {
+		<-doneCh
+	}
+	if n := sf.closeDelays.Load(); n != 0 {
+		t.Fatalf("%d close delays after completion, expected 0", n)
+	}
+
+	(*serverArgs)[closeDelaysArg] = []string{"-1"}
+	if _, err = new(Transport).ServerFactory(t.TempDir(), serverArgs); err == nil {
+		t.Fatalf("ServerFactory() accepted a negative close delay limit")
+	}
+}
+
+func TestCloseDelayWorkers(t *testing.T) {
+	const (
+		nrWorkers = 2
+		nrConns   = 50
+	)
+
+	serverArgs := &pt.Args{}
+	serverArgs.Add(delayWorkersArg, strconv.Itoa(nrWorkers))
+	f, err := new(Transport).ServerFactory(t.TempDir(), serverArgs)
+	if err != nil {
+		t.Fatalf("Transport.ServerFactory() failed: %s", err)
+	}
+	sf := f.(*obfs4ServerFactory) //nolint:forcetypeassert
+	baseline := runtime.NumGoroutine()
+
+	// Fail many handshakes.  WrapConn must return immediately, leaving the
+	// connections to be held open by the pool.
+	var clients []net.Conn
+	for i := 0; i < nrConns; i++ {
+		clientRaw, serverRaw := net.Pipe()
+		clients = append(clients, clientRaw)
+		go func() {
+			_, _ = clientRaw.Write(make([]byte, maxHandshakeBufferLength))
+		}()
+		_, err = sf.WrapConn(serverRaw)
+		var hsErr *base.HandshakeError
+		if !errors.As(err, &hsErr) || !hsErr.Detached || !errors.Is(err, ErrInvalidHandshake) {
+			t.Fatalf("WrapConn() returned %v, expected a detached ErrInvalidHandshake", err)
+		}
+	}
+	if n := sf.closeDelays.Load(); n != nrConns {
+		t.Fatalf("%d concurrent close delays, expected %d", n, nrConns)
+	}
+
+	// The pool drains what the clients sent, so only the fixed number of
+	// workers should remain, instead of a goroutine per connection.
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline+nrWorkers {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines, expected at most %d", runtime.NumGoroutine(), baseline+nrWorkers)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Hanging up ends the delays early.
+	for _, c := range clients {
+		c.Close()
+	}
+	for sf.closeDelays.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d close delays after hanging up, expected 0", sf.closeDelays.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The workers exit once there is nothing left to drain.
+	for {
+		sf.closeDelayPool.Lock()
+		workers := sf.closeDelayPool.workers
+		sf.closeDelayPool.Unlock()
+		if workers == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d close delay workers running with an empty queue", workers)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	(*serverArgs)[delayWorkersArg] = []string{"-1"}
+	if _, err = new(Transport).ServerFactory(t.TempDir(), serverArgs); err == nil {
+		t.Fatalf("ServerFactory() accepted a negative number of close delay workers")
+	}
+}
+
+func TestMaxHandshakes(t *testing.T) {
+	const (
+		maxHandshakes = 2
+		nrConns       = 6
+	)
+
+	serverArgs := &pt.Args{}
+	serverArgs.Add(handshakesArg, strconv.Itoa(maxHandshakes))
+	f, err := new(Transport).ServerFactory(t.TempDir(), serverArgs)
+	if err != nil {
+		t.Fatalf("Transport.ServerFactory() failed: %s", err)
+	}
+	sf := f.(*obfs4ServerFactory) //nolint:forcetypeassert
+
+	// Flood the server with connections that never send a handshake.
+	doneCh := make(chan error, nrConns)
+	var clients []net.Conn
+	for i := 0; i < nrConns; i++ {
+		clientRaw, serverRaw := net.Pipe()
+		clients = append(clients, clientRaw)
+		go func() {
+			_, err := sf.WrapConn(serverRaw)
+			doneCh <- err
+		}()
+	}
+
+	// The connections over the limit are rejected, and held open by the
+	// close delay.
+	deadline := time.Now().Add(5 * time.Second)
+	for sf.handshakes.Load() != maxHandshakes || sf.closeDelays.Load() != nrConns-maxHandshakes {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d handshakes and %d close delays, expected %d and %d",
+				sf.handshakes.Load(), sf.closeDelays.Load(), maxHandshakes, nrConns-maxHandshakes)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Hanging up ends everything early.
+	for _, c := range clients {
+		c.Close()
+	}
+	var nrRejected int
+	for i := 0; i < nrConns; i++ {
+		if err = <-doneCh; errors.Is(err, ErrTooManyHandshakes) {
+			nrRejected++
+		} else if err == nil {
+			t.Fatalf("WrapConn() succeeded")
+		}
+	}
+	if nrRejected != nrConns-maxHandshakes {
+		t.Fatalf("%d connections rejected, expected %d", nrRejected, nrConns-maxHandshakes)
+	}
+	if n := sf.handshakes.Load(); n != 0 {
+		t.Fatalf("%d handshakes after completion, expected 0", n)
+	}
+
+	(*serverArgs)[handshakesArg] = []string{"-1"}
+	if _, err = new(Transport).ServerFactory(t.TempDir(), serverArgs); err == nil {
+		t.Fatalf("ServerFactory() accepted a negative handshake limit")
+	}
+}
+
+func TestNewServerFactory(t *testing.T) {
+	identityKey, err := ntor.NewKeypair(false)
+	if err != nil {
+		t.Fatalf("ntor.NewKeypair() failed: %s", err)
+	}
+	nodeID := ntor.NodeIDFromPublicKey(identityKey.Public())
+	seed, err := drbg.NewSeed()
+	if err != nil {
+		t.Fatalf("drbg.NewSeed() failed: %s", err)
+	}
+
+	for _, cfg := range []*ServerConfig{
+		{IdentityKey: identityKey, DrbgSeed: seed},
+		{NodeID: nodeID, DrbgSeed: seed},
+		{NodeID: nodeID, IdentityKey: identityKey},
+		{NodeID: nodeID, IdentityKey: identityKey, DrbgSeed: seed, IATMode: iatParanoid + 1},
+	} {
+		if _, err = NewServerFactory(cfg); err == nil {
+			t.Fatalf("NewServerFactory(%+v) succeeded", cfg)
+		}
+	}
+
+	args := &pt.Args{}
+	args.Add(passwordArg, "hunter2")
+	f, err := NewServerFactory(&ServerConfig{
+		NodeID:      nodeID,
+		IdentityKey: identityKey,
+		DrbgSeed:    seed,
+		IATMode:     iatEnabled,
+		Args:        args,
+	})
+	if err != nil {
+		t.Fatalf("NewServerFactory() failed: %s", err)
+	}
+	sf := f.(*obfs4ServerFactory) //nolint:forcetypeassert
+	if sf.iatMode != iatEnabled || sf.iatSeed == nil || string(sf.password) != "hunter2" {
+		t.Fatalf("NewServerFactory(): configuration not applied")
+	}
+	expectedCert := serverCertFromState(&ServerState{nodeID: nodeID, identityKey: identityKey})
+	if cert, _ := sf.Args().Get(certArg); cert != expectedCert.String() {
+		t.Fatalf("NewServerFactory(): cert mismatch")
+	}
+}
+
+// fakeReplayBackend is a ReplayBackend standing in for a shared store.
+type fakeReplayBackend struct {
+	sync.Mutex
+	seen  map[string]bool
+	calls int
+}
+
+func (b *fakeReplayBackend) TestAndSet(_ time.Time, buf []byte) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	b.calls++
+	if b.seen[string(buf)] {
+		return true
+	}
+	b.seen[string(buf)] = true
+	return false
+}
+
+func TestReplayBackend(t *testing.T) {
+	identityKey, err := ntor.NewKeypair(false)
+	if err != nil {
+		t.Fatalf("ntor.NewKeypair() failed: %s", err)
+	}
+	seed, err := drbg.NewSeed()
+	if err != nil {
+		t.Fatalf("drbg.NewSeed() failed: %s", err)
+	}
+
+	// Two instances of the same bridge, sharing a replay backend.
+	backend := &fakeReplayBackend{seen: make(map[string]bool)}
+	var factories []base.ServerFactory
+	for i := 0; i < 2; i++ {
+		f, err := NewServerFactory(&ServerConfig{
+			NodeID:        ntor.NodeIDFromPublicKey(identityKey.Public()),
+			IdentityKey:   identityKey,
+			DrbgSeed:      seed,
+			ReplayBackend: backend,
+		})
+		if err != nil {
+			t.Fatalf("NewServerFactory() failed: %s", err)
+		}
+		if f.(*obfs4ServerFactory).replayFilter != backend { //nolint:forcetypeassert
+			t.Fatalf("NewServerFactory(): replay backend not used")
+		}
+		factories = append(factories, f)
+	}
+
+	// Handshake with the first instance, recording the client handshake.
+	cf, err := new(Transport).ClientFactory("")
+	if err != nil {
+		t.Fatalf("Transport.ClientFactory() failed: %s", err)
+	}
+	ca, err := cf.ParseArgs(factories[0].Args())
+	if err != nil {
+		t.Fatalf("obfs4ClientFactory.ParseArgs() failed: %s", err)
+	}
+	clientRaw, serverRaw := net.Pipe()
+	capture := &captureConn{Conn: clientRaw}
+	go func() {
+		if c, err := factories[0].WrapConn(serverRaw); err == nil {
+			defer c.Close()
+			_, _ = io.Copy(io.Discard, c)
+		}
+	}()
+	client, err := cf.Dial("tcp", "pipe", func(string, string) (net.Conn, error) {
+		return capture, nil
+	}, ca)
+	if err != nil {
+		t.Fatalf("obfs4ClientFactory.Dial() failed: %s", err)
+	}
+	client.Close()
+
+	// Replaying it to the second instance is detected via the backend.
+	replayRaw, serverRaw := net.Pipe()
+	go func() {
+		_, _ = replayRaw.Write(capture.Bytes())
+		replayRaw.Close()
+	}()
+	if _, err = factories[1].WrapConn(serverRaw); !errors.Is(err, ErrReplayedHandshake) {
+		t.Fatalf("replayed handshake: %v", err)
+	}
+	if backend.calls != 2 {
+		t.Fatalf("backend queried %d times, expected 2", backend.calls)
+	}
+}
+
+// externalIdentity is a ntor.IdentityKey that keeps the private key to
+// itself, like a hardware token or key server would.
+type externalIdentity struct {
+	keypair *ntor.Keypair
+	calls   atomic.Int32
+}
+
+func (id *externalIdentity) Public() *ntor.PublicKey {
+	return id.keypair.Public()
+}
+
+func (id *externalIdentity) SharedSecret(peer *ntor.PublicKey) (*[ntor.SharedSecretLength]byte, error) {
+	id.calls.Add(1)
+	return id.keypair.SharedSecret(peer)
+}
+
+func TestNewServerFactory_ExternalIdentity(t *testing.T) {
+	keypair, err := ntor.NewKeypair(false)
+	if err != nil {
+		t.Fatalf("ntor.NewKeypair() failed: %s", err)
+	}
+	identity := &externalIdentity{keypair: keypair}
+	seed, err := drbg.NewSeed()
+	if err != nil {
+		t.Fatalf("drbg.NewSeed() failed: %s", err)
+	}
+	sf, err := NewServerFactory(&ServerConfig{
+		NodeID:      ntor.NodeIDFromPublicKey(keypair.Public()),
+		IdentityKey: identity,
+		DrbgSeed:    seed,
+	})
+	if err != nil {
+		t.Fatalf("NewServerFactory() failed: %s", err)
+	}
+
+	cf, err := new(Transport).ClientFactory("")
+	if err != nil {
+		t.Fatalf("Transport.ClientFactory() failed: %s", err)
+	}
+	ca, err := cf.ParseArgs(sf.Args())
+	if err != nil {
+		t.Fatalf("obfs4ClientFactory.ParseArgs() failed: %s", err)
+	}
+	clientRaw, serverRaw := net.Pipe()
+	serverCh := make(chan net.Conn, 1)
+	go func() {
+		c, err := sf.WrapConn(serverRaw)
+		if err != nil {
+			t.Errorf("obfs4ServerFactory.WrapConn() failed: %s", err)
+		}
+		serverCh <- c
+	}()
+	client, err := cf.Dial("tcp", "pipe", func(string, string) (net.Conn, error) {
+		return clientRaw, nil
+	}, ca)
+	if err != nil {
+		t.Fatalf("obfs4ClientFactory.Dial() failed: %s", err)
+	}
+	defer client.Close()
+	server := <-serverCh
+	if server == nil {
+		t.FailNow()
+	}
+	defer server.Close()
+	if n := identity.calls.Load(); n != 1 {
+		t.Fatalf("identity key used %d times, expected 1", n)
+	}
+
+	msg := []byte("hello")
+	go func() {
+		_, _ = client.Write(msg)
+	}()
+	buf := make([]byte, len(msg))
+	if _, err = io.ReadFull(server, buf); err != nil || !bytes.Equal(buf, msg) {
+		t.Fatalf("Read() returned %q, %v", buf, err)
+	}
+
+	// The private key is not available to be serialized.
+	st := &ServerState{nodeID: ntor.NodeIDFromPublicKey(keypair.Public()), identityKey: identity, drbgSeed: seed}
+	if err = MarshalServerState(io.Discard, st); err == nil {
+		t.Fatalf("MarshalServerState() succeeded with an external identity key")
+	}
+}
+
+func TestObfs4Conn_Bulk(t *testing.T) {
+	serverArgs := &pt.Args{}
+	serverArgs.Add(bulkArg, "true")
+
+	for _, iatMode := range []int{iatNone, iatEnabled} {
+		client, server := newTestConnPair(t, iatMode, serverArgs)
+		if !client.bulk || !server.bulk {
+			t.Fatalf("[%d]: bulk mode not enabled", iatMode)
+		}
+
+		// Exercise both directions, with writes spanning multiple frames.
+		for _, v := range []struct {
+			w, r *obfs4Conn
+		}{
+			{client, server},
+			{server, client},
+		} {
+			payload := make([]byte, 3*maxBulkPayloadLength+1)
+			_, _ = rand.Read(payload)
+			go func(w *obfs4Conn) {
+				_, _ = w.Write(payload)
+			}(v.w)
+			buf := make([]byte, len(payload))
+			if _, err := io.ReadFull(v.r, buf); err != nil {
+				t.Fatalf("[%d]: ReadFull() failed: %s", iatMode, err)
+			}
+			if !bytes.Equal(buf, payload) {
+				t.Fatalf("[%d]: payload mismatch", iatMode)
+			}
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+// BenchmarkObfs4Conn_WriteBulk benchmarks obfs4Conn.Write with 64 KiB
+// payloads, with and without bulk mode, and reports the number of bytes sent
+// on the wire per byte of payload.
+func BenchmarkObfs4Conn_WriteBulk(b *testing.B) {
+	for _, bulk := range []bool{false, true} {
+		b.Run(fmt.Sprintf("bulk=%v", bulk), func(b *testing.B) {
+			serverArgs := &pt.Args{}
+			serverArgs.Add(bulkArg, strconv.FormatBool(bulk))
+			client, server := newTestConnPair(b, iatNone, serverArgs)
+
+			var wireBytes int64
+			done := make(chan struct{})
+			go func() {
+				wireBytes, _ = io.Copy(io.Discard, server.Conn)
+				close(done)
+			}()
+
+			payload := make([]byte, 64*1024)
+			b.SetBytes(int64(len(payload)))
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := client.Write(payload); err != nil {
+					b.Fatalf("Write() failed: %s", err)
+				}
+			}
+			b.StopTimer()
+			client.Conn.Close()
+			<-done
+			b.ReportMetric(float64(wireBytes)/float64(b.N*len(payload)), "wire/payload")
+		})
+	}
+}
+
+func TestReplayFilterArg(t *testing.T) {
+	tr := new(Transport)
+	for _, v := range []struct {
+		arg   string
+		bits  int
+		valid bool
+	}{
+		{"", 64, true},
+		{"true", 128, true},
+		{"false", 64, true},
+		{"bogus", 0, false},
+	} {
+		args := &pt.Args{}
+		if v.arg != "" {
+			args.Add(wideReplayArg, v.arg)
+		}
+		f, err := tr.ServerFactory(t.TempDir(), args)
+		if (err == nil) != v.valid {
+			t.Fatalf("ServerFactory(%s=%q): %v", wideReplayArg, v.arg, err)
+		}
+		if err != nil {
+			continue
+		}
+		sf := f.(*obfs4ServerFactory) //nolint:forcetypeassert
+		filter, _ := sf.replayFilter.(*replayfilter.ReplayFilter)
+		if bits := filter.Stats().DigestBits; bits != v.bits {
+			t.Fatalf("ServerFactory(%s=%q): %d-bit digests, expected %d", wideReplayArg, v.arg, bits, v.bits)
+		}
+		if _, ok := sf.Args().Get(wideReplayArg); ok {
+			t.Fatalf("%s leaked into the client arguments", wideReplayArg)
+		}
+	}
+}
+
+func TestObfs4Conn_SeedDelivery(t *testing.T) {
+	tr := new(Transport)
+	cf, err := tr.ClientFactory("")
+	if err != nil {
+		t.Fatalf("Transport.ClientFactory() failed: %s", err)
+	}
+
+	for _, separate := range []bool{false, true} {
+		args := &pt.Args{}
+		args.Add(separateSeedArg, strconv.FormatBool(separate))
+		f, err := tr.ServerFactory(t.TempDir(), args)
+		if err != nil {
+			t.Fatalf("Transport.ServerFactory() failed: %s", err)
+		}
+		sf := f.(*obfs4ServerFactory) //nolint:forcetypeassert
+		ca, err := cf.ParseArgs(sf.Args())
+		if err != nil {
+			t.Fatalf("obfs4ClientFactory.ParseArgs() failed: %s", err)
+		}
+
+		// The server can not finish sending the separate seed until the
+		// client reads, so it sends data after, and the client reads it.
+		clientRaw, serverRaw := net.Pipe()
+		serverConn := &captureConn{Conn: serverRaw}
+		serverCh := make(chan error, 1)
+		go func() {
+			c, err := sf.WrapConn(serverConn)
+			if err == nil {
+				_, err = c.Write([]byte("hello"))
+			}
+			serverCh <- err
+		}()
+		dialFn := func(string, string) (net.Conn, error) {
+			return clientRaw, nil
+		}
+		c, err := cf.Dial("tcp", "pipe", dialFn, ca)
+		if err != nil {
+			t.Fatalf("[%v]: obfs4ClientFactory.Dial() failed: %s", separate, err)
+		}
+		client := c.(*obfs4Conn) //nolint:forcetypeassert
+		buf := make([]byte, 5)
+		if _, err = io.ReadFull(client, buf); err != nil {
+			t.Fatalf("[%v]: ReadFull() failed: %s", separate, err)
+		}
+		if err = <-serverCh; err != nil {
+			t.Fatalf("[%v]: server failed: %s", separate, err)
+		}
+
+		// The handshake response, the separate seed burst if any, then the
+		// payload.
+		expectedWrites := 2
+		if separate {
+			expectedWrites = 3
+		}
+		if writes := len(serverConn.Lengths()); writes != expectedWrites {
+			t.Fatalf("[%v]: server made %d writes, expected %d", separate, writes, expectedWrites)
+		}
+
+		// Either way, the client must have picked up the server's seed.
+		expected := probdist.New(sf.lenSeed, 0, framing.MaximumSegmentLength, *biasedDist)
+		if !reflect.DeepEqual(client.lenDist, expected) {
+			t.Fatalf("[%v]: client length distribution not reset", separate)
+		}
+
+		client.Close()
+		serverRaw.Close()
+	}
+}
+
+type recordingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(b)
+}
+
+func TestObfs4Conn_WriteTo(t *testing.T) {
+	client, server := newTestConnPair(t, iatNone, nil)
+
+	payload := make([]byte, 256*1024)
+	_, _ = rand.Read(payload)
+	go func() {
+		for off := 0; off < len(payload); off += 16 * 1024 {
+			if _, err := client.Write(payload[off : off+16*1024]); err != nil {
+				return
+			}
+		}
+		client.Close()
+	}()
+
+	// io.Copy uses WriteTo, and returns no error at EOF.
+	var w recordingWriter
+	n, err := io.Copy(&w, server)
+	if err != nil {
+		t.Fatalf("io.Copy() failed: %s", err)
+	}
+	if n != int64(len(payload)) || !bytes.Equal(w.Bytes(), payload) {
+		t.Fatalf("io.Copy() relayed %d bytes, payload mismatch", n)
+	}
+	if w.writes == 0 {
+		t.Fatalf("no writes recorded")
+	}
+}
+
+// BenchmarkObfs4Conn_WriteTo benchmarks relaying 64 KiB payloads with
+// io.Copy, with and without obfs4Conn.WriteTo.
+func BenchmarkObfs4Conn_WriteTo(b *testing.B) {
+	for _, useWriteTo := range []bool{false, true} {
+		b.Run(fmt.Sprintf("WriteTo=%v", useWriteTo), func(b *testing.B) {
+			client, server := newTestConnPair(b, iatNone, nil)
+
+			var src io.Reader = server
+			if !useWriteTo {
+				src = struct{ io.Reader }{server}
+			}
+			done := make(chan int64)
+			go func() {
+				n, _ := io.Copy(io.Discard, src)
+				done <- n
+			}()
+
+			payload := make([]byte, 64*1024)
+			b.SetBytes(int64(len(payload)))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := client.Write(payload); err != nil {
+					b.Fatalf("Write() failed: %s", err)
+				}
+			}
+			client.Close()
+			if n := <-done; n != int64(b.N*len(payload)) {
+				b.Fatalf("relayed %d bytes, expected %d", n, b.N*len(payload))
+			}
+		})
+	}
+}
+
+func TestPadBurstLength(t *testing.T) {
+	client, _ := newTestConnPair(t, iatNone, nil)
+
+	// The computed length must match what padBurst actually appends.
+	for _, burstLen := range []int{0, 1, headerLength, 121, framing.MaximumSegmentLength - 1, framing.MaximumSegmentLength, 3000} {
+		for toPadTo := 0; toPadTo <= framing.MaximumSegmentLength; toPadTo++ {
+			burst := bytes.NewBuffer(make([]byte, burstLen))
+			if err := client.padBurst(burst, toPadTo); err != nil {
+				t.Fatalf("padBurst(%d, %d) failed: %s", burstLen, toPadTo, err)
+			}
+			if padLen := padBurstLength(burstLen, toPadTo); burst.Len()-burstLen != padLen {
+				t.Fatalf("padBurstLength(%d, %d) = %d, padBurst appended %d", burstLen, toPadTo, padLen, burst.Len()-burstLen)
+			}
+		}
+	}
+}
+
+func TestEstimatePaddingOverhead(t *testing.T) {
+	// A 100 byte write is sent as a single 121 byte packet.  Padding to:
+	//   0:   1448 - 121             = 1327
+	//   100: 1448 - 121 + 100       = 1427
+	//   130: 9 bytes, which is too short for a packet, so a full packet,
+	//        and a 9 + 21 byte packet = 1478
+	//   200: 200 - 121              = 79
+	values := []int{0, 100, 130, 200}
+	probs := []float64{0.25, 0.25, 0.25, 0.25}
+	for _, v := range []struct {
+		payloadLen                 int
+		minPad, maxPad, expPadding int
+	}{
+		{0, 0, 0, 0},
+		{100, 79, 1478, 1078}, // (1327 + 1427 + 1478 + 79) / 4 = 1077.75
+		{2 * maxPacketPayloadLength, 0, 200, 108},
+	} {
+		minPad, maxPad, expPadding := estimatePaddingOverhead(v.payloadLen, values, probs)
+		if minPad != v.minPad || maxPad != v.maxPad || expPadding != v.expPadding {
+			t.Fatalf("estimatePaddingOverhead(%d) = %d, %d, %d, expected %d, %d, %d",
+				v.payloadLen, minPad, maxPad, expPadding, v.minPad, v.maxPad, v.expPadding)
+		}
+	}
+
+	seed, err := drbg.NewSeed()
+	if err != nil {
+		t.Fatalf("drbg.NewSeed() failed: %s", err)
+	}
+	lenDist := probdist.New(seed, 0, framing.MaximumSegmentLength, false)
+	minPad, maxPad, expPadding := EstimatePaddingOverhead(1000, lenDist)
+	if minPad > expPadding || expPadding > maxPad {
+		t.Fatalf("EstimatePaddingOverhead() = %d, %d, %d", minPad, maxPad, expPadding)
+	}
+	for i := 0; i < 100; i++ {
+		if padLen := padBurstLength(1000+headerLength, lenDist.Sample()); padLen < minPad || padLen > maxPad {
+			t.Fatalf("sampled padding %d outside of [%d, %d]", padLen, minPad, maxPad)
+		}
+	}
+}
+
+// newTestHandshakeListener returns a listener that calls handler with the
+// index of each accepted connection, and a function that returns the number
+// of connections accepted so far.
+func newTestHandshakeListener(t *testing.T, handler func(int, net.Conn)) (net.Listener, func() int) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() failed: %s", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var (
+		lock       sync.Mutex
+		nrAccepted int
+	)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			idx := nrAccepted
+			nrAccepted++
+			lock.Unlock()
+			go handler(idx, conn)
+		}
+	}()
+
+	return ln, func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return nrAccepted
+	}
+}
+
+// captureConn records everything written to and read from the underlying
+// connection, and the length of each write.  If discard is set, writes are
+// recorded but not sent.
+type captureConn struct {
+	net.Conn
+	discard bool
+
+	sync.Mutex
+	written bytes.Buffer
+	read    bytes.Buffer
+	lengths []int
+}
+
+func (c *captureConn) Write(b []byte) (int, error) {
+	c.Lock()
+	c.written.Write(b)
+	c.lengths = append(c.lengths, len(b))
+	c.Unlock()
+	if c.discard {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *captureConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.Lock()
+	c.read.Write(b[:n])
+	c.Unlock()
+	return n, err
+}
+
+func (c *captureConn) Lengths() []int {
+	c.Lock()
+	defer c.Unlock()
+	return append([]int(nil), c.lengths...)
+}
+
+func (c *captureConn) Bytes() []byte {
+	c.Lock()
+	defer c.Unlock()
+	return bytes.Clone(c.written.Bytes())
+}
+
+func (c *captureConn) ReadBytes() []byte {
+	c.Lock()
+	defer c.Unlock()
+	return bytes.Clone(c.read.Bytes())
+}
+
+func TestObfs4Conn_EarlyPadding(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		serverArgs := &pt.Args{}
+		if enabled {
+			serverArgs.Add(earlyPadArg, "1")
+		}
+		tr := new(Transport)
+		sf, err := tr.ServerFactory(t.TempDir(), serverArgs)
+		if err != nil {
+			t.Fatalf("[%v]: Transport.ServerFactory() failed: %s", enabled, err)
+		}
+		if _, ok := sf.Args().Get(earlyPadArg); ok != enabled {
+			t.Fatalf("[%v]: %s published: %v", enabled, earlyPadArg, ok)
+		}
+		cf, err := tr.ClientFactory("")
+		if err != nil {
+			t.Fatalf("[%v]: Transport.ClientFactory() failed: %s", enabled, err)
+		}
+		ca, err := cf.ParseArgs(sf.Args())
+		if err != nil {
+			t.Fatalf("[%v]: obfs4ClientFactory.ParseArgs() failed: %s", enabled, err)
+		}
+
+		// Use loopback TCP rather than a pipe, as each side sends the
+		// padding without waiting for the peer to read it.
+		serverCapture := new(captureConn)
+		serverCh := make(chan net.Conn, 1)
+		ln, _ := newTestHandshakeListener(t, func(_ int, conn net.Conn) {
+			serverCapture.Conn = conn
+			c, err := sf.WrapConn(serverCapture)
+			if err != nil {
+				t.Errorf("[%v]: obfs4ServerFactory.WrapConn() failed: %s", enabled, err)
+			}
+			serverCh <- c
+		})
+		clientCapture := new(captureConn)
+		dialFn := func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			clientCapture.Conn = conn
+			return clientCapture, err
+		}
+		c, err := cf.Dial("tcp", ln.Addr().String(), dialFn, ca)
+		if err != nil {
+			t.Fatalf("[%v]: obfs4ClientFactory.Dial() failed: %s", enabled, err)
+		}
+		client := c.(*obfs4Conn) //nolint:forcetypeassert
+		defer client.Close()
+		server, _ := (<-serverCh).(*obfs4Conn)
+		if server == nil {
+			t.FailNow()
+		}
+		defer server.Close()
+
+		// The handshake (and PRNG seed) is followed by an extra burst from
+		// each side iff early padding is enabled.
+		expectedWrites := 1
+		if enabled {
+			expectedWrites = 2
+		}
+		for _, v := range []struct {
+			side    string
+			conn    *obfs4Conn
+			capture *captureConn
+		}{
+			{"client", client, clientCapture},
+			{"server", server, serverCapture},
+		} {
+			if (v.conn.features&protocolFeatureEarlyPadding != 0) != enabled {
+				t.Fatalf("[%v]: %s negotiated features %#x", enabled, v.side, v.conn.features)
+			}
+			lengths := v.capture.Lengths()
+			if len(lengths) != expectedWrites {
+				t.Fatalf("[%v]: %s sent %d bursts before any data, expected %d", enabled, v.side, len(lengths), expectedWrites)
+			}
+			if enabled && lengths[1] < headerLength {
+				t.Fatalf("[%v]: %s sent a %d byte early burst", enabled, v.side, lengths[1])
+			}
+		}
+
+		// The early padding carries no payload.
+		for _, v := range []struct {
+			src, dst *obfs4Conn
+		}{
+			{client, server},
+			{server, client},
+		} {
+			msg := []byte("first write")
+			if _, err = v.src.Write(msg); err != nil {
+				t.Fatalf("[%v]: Write() failed: %s", enabled, err)
+			}
+			buf := make([]byte, len(msg))
+			if _, err = io.ReadFull(v.dst, buf); err != nil {
+				t.Fatalf("[%v]: Read() failed: %s", enabled, err)
+			}
+			if !bytes.Equal(buf, msg) {
+				t.Fatalf("[%v]: payload corrupted: %q", enabled, buf)
+			}
+		}
+	}
+}
+
+func TestObfs4Conn_CloseDrain(t *testing.T) {
+	serverArgs := &pt.Args{}
+	serverArgs.Add(iatArg, strconv.Itoa(iatParanoid))
+	client, server := newTestConnPair(t, iatParanoid, serverArgs)
+
+	readCh := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(server)
+		readCh <- b
+	}()
+
+	// Paranoid IAT mode writes slowly, so the Write is still in progress
+	// when Close is called.
+	payload := make([]byte, 32*1024)
+	_, _ = rand.Read(payload)
+	writeCh := make(chan error, 1)
+	go func() {
+		_, err := client.Write(payload)
+		writeCh <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	client.Close()
+
+	if err := <-writeCh; err != nil {
+		t.Fatalf("Write() failed: %s", err)
+	}
+	if b := <-readCh; !bytes.Equal(b, payload) {
+		t.Fatalf("received %d bytes, expected %d", len(b), len(payload))
+	}
+}
+
+func TestObfs4Conn_ClosePadding(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		client, server := newTestConnPair(t, iatNone, nil)
+		client.closePadding = enabled
+		capture := &captureConn{Conn: client.Conn}
+		client.Conn = capture
+
+		readCh := make(chan []byte, 1)
+		go func() {
+			b, _ := io.ReadAll(server)
+			readCh <- b
+		}()
+
+		msg := []byte("goodbye")
+		if _, err := client.Write(msg); err != nil {
+			t.Fatalf("[%v]: Write() failed: %s", enabled, err)
+		}
+		client.Close()
+		if b := <-readCh; !bytes.Equal(b, msg) {
+			t.Fatalf("[%v]: received %q", enabled, b)
+		}
+
+		expectedWrites := 1
+		if enabled {
+			expectedWrites = 2
+		}
+		if lengths := capture.Lengths(); len(lengths) != expectedWrites {
+			t.Fatalf("[%v]: %d bursts written, expected %d", enabled, len(lengths), expectedWrites)
+		}
+	}
+}
+
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func TestHandshakeRetries(t *testing.T) {
+	tr := new(Transport)
+	sf, err := tr.ServerFactory(t.TempDir(), &pt.Args{})
+	if err != nil {
+		t.Fatalf("ServerFactory() failed: %s", err)
+	}
+	cf, _ := tr.ClientFactory("")
+
+	// The first connection is reset after the client's representative is
+	// received, the second is handshaked normally.  Each attempt's
+	// representative is handed back to the test once captured.
+	firstCh := make(chan [ntor.RepresentativeLength]byte, 1)
+	secondCh := make(chan [ntor.RepresentativeLength]byte, 1)
+	ln, nrAccepted := newTestHandshakeListener(t, func(idx int, conn net.Conn) {
+		defer conn.Close()
+		var representative [ntor.RepresentativeLength]byte
+		if _, err := io.ReadFull(conn, representative[:]); err != nil {
+			return
+		}
+		switch idx {
+		case 0:
+			firstCh <- representative
+			_ = conn.(*net.TCPConn).SetLinger(0) //nolint:forcetypeassert
+			return
+		case 1:
+			secondCh <- representative
+		default:
+			return
+		}
+		c, err := sf.WrapConn(&prefixConn{conn, io.MultiReader(bytes.NewReader(representative[:]), conn)})
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(c, c)
+	})
+
+	dial := func(retries int) (net.Conn, error) {
+		clientArgs := pt.Args{}
+		for k, v := range *sf.Args() {
+			clientArgs[k] = v
+		}
+		clientArgs.Add(hsRetriesArg, strconv.Itoa(retries))
+		args, err := cf.ParseArgs(&clientArgs)
+		if err != nil {
+			t.Fatalf("ParseArgs() failed: %s", err)
+		}
+		return cf.Dial("tcp", ln.Addr().String(), net.Dial, args)
+	}
+
+	conn, err := dial(1)
+	if err != nil {
+		t.Fatalf("Dial() failed: %s", err)
+	}
+	defer conn.Close()
+	if nrAccepted() != 2 {
+		t.Fatalf("server accepted %d connections, expected 2", nrAccepted())
+	}
+	if first, second := <-firstCh, <-secondCh; first == second {
+		t.Fatalf("session key reused for the retry")
+	}
+	msg := []byte("retried")
+	if _, err = conn.Write(msg); err != nil {
+		t.Fatalf("Write() failed: %s", err)
+	}
+	echoed := make([]byte, len(msg))
+	if _, err = io.ReadFull(conn, echoed); err != nil || !bytes.Equal(msg, echoed) {
+		t.Fatalf("Read() failed: %q, %v", echoed, err)
+	}
+}
+
+func TestHandshakeRetriesNonTransient(t *testing.T) {
+	tr := new(Transport)
+	sf, err := tr.ServerFactory(t.TempDir(), &pt.Args{})
+	if err != nil {
+		t.Fatalf("ServerFactory() failed: %s", err)
+	}
+	cf, _ := tr.ClientFactory("")
+
+	// Respond with garbage, which the client rejects as an invalid
+	// handshake, which must not be retried.
+	ln, nrAccepted := newTestHandshakeListener(t, func(_ int, conn net.Conn) {
+		defer conn.Close()
+		_, _ = conn.Write(make([]byte, maxHandshakeBufferLength))
+		_, _ = io.Copy(io.Discard, conn)
+	})
+
+	clientArgs := pt.Args{}
+	for k, v := range *sf.Args() {
+		clientArgs[k] = v
+	}
+	clientArgs.Add(hsRetriesArg, "3")
+	args, err := cf.ParseArgs(&clientArgs)
+	if err != nil {
+		t.Fatalf("ParseArgs() failed: %s", err)
+	}
+	_, err = cf.Dial("tcp", ln.Addr().String(), net.Dial, args)
+	if !errors.Is(err, ErrInvalidHandshake) {
+		t.Fatalf("Dial() returned %v, expected ErrInvalidHandshake", err)
+	}
+	if isTransientHandshakeError(err) || nrAccepted() != 1 {
+		t.Fatalf("invalid handshake retried (%d connections)", nrAccepted())
+	}
+
+	clientArgs[hsRetriesArg] = []string{strconv.Itoa(maxHandshakeRetries + 1)}
+	if _, err = cf.ParseArgs(&clientArgs); err == nil {
+		t.Fatalf("ParseArgs() accepted too many handshake retries")
+	}
+}
+
+func TestConnectJitter(t *testing.T) {
+	const bound = 2 * time.Millisecond
+	var lo, hi time.Duration = bound, 0
+	for i := 0; i < 1000; i++ {
+		d := sampleConnectJitter(bound)
+		if d < 0 || d > bound {
+			t.Fatalf("sampleConnectJitter() = %s, outside [0,%s]", d, bound)
+		}
+		if d < lo {
+			lo = d
+		}
+		if d > hi {
+			hi = d
+		}
+	}
+	if lo == hi {
+		t.Fatalf("sampleConnectJitter() always returned %s", lo)
+	}
+
+	tr := new(Transport)
+	sf, err := tr.ServerFactory(t.TempDir(), &pt.Args{})
+	if err != nil {
+		t.Fatalf("ServerFactory() failed: %s", err)
+	}
+	cf, _ := tr.ClientFactory("")
+	clientArgs := pt.Args{}
+	for k, v := range *sf.Args() {
+		clientArgs[k] = v
+	}
+	clientArgs.Add(jitterArg, "20")
+	args, err := cf.ParseArgs(&clientArgs)
+	if err != nil {
+		t.Fatalf("ParseArgs() failed: %s", err)
+	}
+	if j := args.(*obfs4ClientArgs).opts.connectJitter; j != 20*time.Millisecond { //nolint:forcetypeassert
+		t.Fatalf("connect jitter %s, expected 20ms", j)
+	}
+
+	// The delay is before the connection is established, and within the
+	// bound (allowing for the scheduler).
+	errDial := errors.New("dial refused")
+	for i := 0; i < 5; i++ {
+		var delay time.Duration
+		start := time.Now()
+		_, err = cf.Dial("tcp", "192.0.2.1:443", func(_, _ string) (net.Conn, error) {
+			delay = time.Since(start)
+			return nil, errDial
+		}, args)
+		if !errors.Is(err, errDial) {
+			t.Fatalf("Dial() returned %v", err)
+		}
+		if delay > 20*time.Millisecond+50*time.Millisecond {
+			t.Fatalf("connect jitter of %s exceeds the bound", delay)
+		}
+	}
+
+	for _, v := range []string{"-1", "x", strconv.Itoa(maxConnectJitter + 1)} {
+		clientArgs[jitterArg] = []string{v}
+		if _, err = cf.ParseArgs(&clientArgs); err == nil {
+			t.Fatalf("ParseArgs() accepted connect-jitter '%s'", v)
+		}
+	}
+}
+
+func TestServerKeyMismatch(t *testing.T) {
+	tr := new(Transport)
+	staleSf, err := tr.ServerFactory(t.TempDir(), &pt.Args{})
+	if err != nil {
+		t.Fatalf("ServerFactory() failed: %s", err)
+	}
+	rotatedSf, err := tr.ServerFactory(t.TempDir(), &pt.Args{})
+	if err != nil {
+		t.Fatalf("ServerFactory() failed: %s", err)
+	}
+	cf, _ := tr.ClientFactory("")
+
+	clientArgs := pt.Args{}
+	for k, v := range *staleSf.Args() {
+		clientArgs[k] = v
+	}
+	clientArgs.Add(hsRetriesArg, "2")
+	args, err := cf.ParseArgs(&clientArgs)
+	if err != nil {
+		t.Fatalf("ParseArgs() failed: %s", err)
+	}
+
+	// A server with rotated keys never finds the mark in a handshake made
+	// with the stale ones, so it never responds.
+	ca := args.(*obfs4ClientArgs) //nolint:forcetypeassert
+	clientBlob, err := newClientHandshake(ca.nodeID, ca.publicKey, ca.sessionKey).generateHandshake()
+	if err != nil {
+		t.Fatalf("clientHandshake.generateHandshake() failed: %s", err)
+	}
+	rsf := rotatedSf.(*obfs4ServerFactory) //nolint:forcetypeassert
+	serverKeypair, _ := ntor.NewKeypair(true)
+	serverHs := newServerHandshake(rsf.nodeID, rsf.identityKey, serverKeypair)
+	if _, err = serverHs.parseClientHandshake(rsf.replayFilter, clientBlob); !errors.Is(err, ErrMarkNotFoundYet) {
+		t.Fatalf("serverHandshake.parseClientHandshake() returned %v", err)
+	}
+
+	// Instead, it drains and closes the connection after a (here, shortened)
+	// delay.
+	ln, nrAccepted := newTestHandshakeListener(t, func(_ int, conn net.Conn) {
+		defer conn.Close()
+		_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, _ = io.Copy(io.Discard, conn)
+	})
+	_, err = cf.Dial("tcp", ln.Addr().String(), net.Dial, args)
+	if !errors.Is(err, ErrServerKeyMismatch) {
+		t.Fatalf("Dial() returned %v, expected ErrServerKeyMismatch", err)
+	}
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("Dial() returned %v, expected the underlying io.EOF", err)
+	}
+	if nrAccepted() != 1 {
+		t.Fatalf("stale bridge line retried (%d connections)", nrAccepted())
+	}
+}
+
+func TestObfs4Conn_PaddingFrames(t *testing.T) {
+	for frames := 0; frames <= maxPaddingFrames; frames++ {
+		args := &pt.Args{}
+		args.Add(padFramesArg, strconv.Itoa(frames))
+		_, server := newTestConnPair(t, iatNone, args)
+		if server.paddingFrames != frames {
+			t.Fatalf("frames=%d: server conn limit is %d", frames, server.paddingFrames)
+		}
+
+		// Record the bursts instead of sending them.
+		rec := &captureConn{Conn: server.Conn, discard: true}
+		server.Conn = rec
+
+		// Pad to a fixed length per write, so that the padded lengths are
+		// known.
+		policy := &stubShapingPolicy{}
+		server.SetShapingPolicy(policy)
+
+		var nrCapped int
+		for i := 0; i < 2000; i++ {
+			payloadLen := 1 + i%(3*maxPacketPayloadLength)
+			policy.padLen = (i * 7) % (framing.MaximumSegmentLength + 1)
+			if _, err := server.Write(make([]byte, payloadLen)); err != nil {
+				t.Fatalf("frames=%d: Write() failed: %s", frames, err)
+			}
+
+			// The padding is never dropped, only capped at the limit.
+			nrPackets := (payloadLen + maxPacketPayloadLength - 1) / maxPacketPayloadLength
+			burstLen := payloadLen + nrPackets*headerLength
+			expectedPadLen := padBurstLength(burstLen, policy.padLen)
+			if limit := frames * framing.MaximumSegmentLength; expectedPadLen > limit {
+				expectedPadLen = limit
+				nrCapped++
+			}
+			lengths := rec.Lengths()
+			if padLen := lengths[len(lengths)-1] - burstLen; padLen != expectedPadLen {
+				t.Fatalf("frames=%d: write of %d bytes padded to %d with %d bytes, expected %d", frames, payloadLen, policy.padLen, padLen, expectedPadLen)
+			}
+		}
+		if frames < maxPaddingFrames && nrCapped == 0 {
+			t.Fatalf("frames=%d: no writes were capped", frames)
+		}
+	}
+
+	args := &pt.Args{}
+	args.Add(padFramesArg, strconv.Itoa(maxPaddingFrames+1))
+	if _, err := parseConnOptions(args, false); err == nil {
+		t.Fatalf("parseConnOptions() accepted too many padding frames")
+	}
+}
+
+// newTestSeed returns a deterministic DRBG seed derived from b.
+func newTestSeed(t testing.TB, b byte) *drbg.Seed {
+	t.Helper()
+
+	var raw [drbg.SeedLength]byte
+	for i := range raw {
+		raw[i] = b + byte(i)
+	}
+	seed, err := drbg.SeedFromBytes(raw[:])
+	if err != nil {
+		t.Fatalf("drbg.SeedFromBytes() failed: %s", err)
+	}
+	return seed
+}
+
+func TestObfs4Conn_SeedSync(t *testing.T) {
+	identityKey, err := ntor.NewKeypair(false)
+	if err != nil {
+		t.Fatalf("ntor.NewKeypair() failed: %s", err)
+	}
+	serverSeed := newTestSeed(t, 0x42)
+
+	for _, iatMode := range []int{iatNone, iatEnabled, iatParanoid} {
+		serverArgs := &pt.Args{}
+		serverArgs.Add(nodeIDArg, ntor.NodeIDFromPublicKey(identityKey.Public()).Hex())
+		serverArgs.Add(privateKeyArg, identityKey.Private().Hex())
+		serverArgs.Add(seedArg, serverSeed.Hex())
+		serverArgs.Add(iatArg, strconv.Itoa(iatMode))
+		client, server := newTestConnPair(t, iatMode, serverArgs)
+
+		// The server's distributions are the ones from the fixed seed.
+		expected := probdist.New(serverSeed, 0, framing.MaximumSegmentLength, *biasedDist)
+		if !reflect.DeepEqual(server.lenDist, expected) {
+			t.Fatalf("[%d]: server length distribution does not match the seed", iatMode)
+		}
+		if reflect.DeepEqual(client.lenDist, server.lenDist) {
+			t.Fatalf("[%d]: client length distribution matches before the seed packet", iatMode)
+		}
+
+		// The seed packet is processed with the first data received.
+		go func() {
+			_, _ = server.Write([]byte("x"))
+		}()
+		if _, err = io.ReadFull(client, make([]byte, 1)); err != nil {
+			t.Fatalf("[%d]: Read() failed: %s", iatMode, err)
+		}
+
+		for _, v := range []struct {
+			name           string
+			client, server *probdist.WeightedDist
+		}{
+			{"length", client.lenDist, server.lenDist},
+			{"IAT", client.iatDist, server.iatDist},
+		} {
+			if (v.client == nil) != (v.server == nil) {
+				t.Fatalf("[%d]: %s distribution present on only one side", iatMode, v.name)
+			}
+			if v.client == nil {
+				continue
+			}
+			clientValues, clientProbs := v.client.Probabilities()
+			serverValues, serverProbs := v.server.Probabilities()
+			if !reflect.DeepEqual(clientValues, serverValues) || !reflect.DeepEqual(clientProbs, serverProbs) {
+				t.Fatalf("[%d]: %s distributions differ after the seed packet", iatMode, v.name)
+			}
+			if v.client.String() != v.server.String() {
+				t.Fatalf("[%d]: %s distribution tables differ after the seed packet", iatMode, v.name)
+			}
+		}
+	}
+}
+
+func TestClientLengthSeed(t *testing.T) {
+	tr := new(Transport)
+	sf, err := tr.ServerFactory(t.TempDir(), &pt.Args{})
+	if err != nil {
+		t.Fatalf("ServerFactory() failed: %s", err)
+	}
+	cf, _ := tr.ClientFactory("")
+
+	seed, err := drbg.NewSeed()
+	if err != nil {
+		t.Fatalf("drbg.NewSeed() failed: %s", err)
+	}
+
+	dial := func(seedStr string) *obfs4Conn {
+		clientArgs := pt.Args{}
+		for k, v := range *sf.Args() {
+			clientArgs[k] = v
+		}
+		clientArgs[iatArg] = []string{strconv.Itoa(iatEnabled)}
+		if seedStr != "" {
+			clientArgs.Add(seedArg, seedStr)
+		}
+		args, err := cf.ParseArgs(&clientArgs)
+		if err != nil {
+			t.Fatalf("ParseArgs() failed: %s", err)
+		}
+
+		clientRaw, serverRaw := net.Pipe()
+		go func() {
+			if c, err := sf.WrapConn(serverRaw); err == nil {
+				_, _ = io.Copy(io.Discard, c)
+			}
+		}()
+		conn, err := cf.Dial("tcp", "pipe", func(string, string) (net.Conn, error) {
+			return clientRaw, nil
+		}, args)
+		if err != nil {
+			t.Fatalf("Dial() failed: %s", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn.(*obfs4Conn) //nolint:forcetypeassert
+	}
+
+	// Until the server's seed is received, the supplied seed determines
+	// the distributions.
+	a, b, c := dial(seed.Hex()), dial(seed.Hex()), dial("")
+	for _, dist := range []func(*obfs4Conn) *probdist.WeightedDist{
+		func(conn *obfs4Conn) *probdist.WeightedDist { return conn.lenDist },
+		func(conn *obfs4Conn) *probdist.WeightedDist { return conn.iatDist },
+	} {
+		aValues, aProbs := dist(a).Probabilities()
+		bValues, bProbs := dist(b).Probabilities()
+		cValues, _ := dist(c).Probabilities()
+		if !reflect.DeepEqual(aValues, bValues) || !reflect.DeepEqual(aProbs, bProbs) {
+			t.Fatalf("distributions with the same seed differ")
+		}
+		if reflect.DeepEqual(aValues, cValues) {
+			t.Fatalf("distribution with a random seed matches the supplied seed")
+		}
+	}
+
+	clientArgs := pt.Args{}
+	for k, v := range *sf.Args() {
+		clientArgs[k] = v
+	}
+	clientArgs.Add(seedArg, "not-hex")
+	if _, err = cf.ParseArgs(&clientArgs); err == nil {
+		t.Fatalf("ParseArgs() accepted an invalid seed")
+	}
+}
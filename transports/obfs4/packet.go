@@ -28,6 +28,7 @@
 package obfs4
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
 	"errors"
@@ -41,6 +42,7 @@ import (
 const (
 	packetOverhead          = 2 + 1
 	maxPacketPayloadLength  = framing.MaximumFramePayloadLength - packetOverhead
+	maxBulkPayloadLength    = framing.MaximumBulkFramePayloadLength - packetOverhead
 	maxPacketPaddingLength  = maxPacketPayloadLength
 	seedPacketPayloadLength = seedLength
 
@@ -50,6 +52,8 @@ const (
 const (
 	packetTypePayload = iota
 	packetTypePrngSeed
+	packetTypeCompressedPayload
+	packetTypeVersion
 )
 
 // InvalidPacketLengthError is the error returned when decodePacket detects a
@@ -70,12 +74,12 @@ func (e InvalidPayloadLengthError) Error() string {
 
 var zeroPadBytes [maxPacketPaddingLength]byte
 
-func (conn *obfs4Conn) makePacket(w io.Writer, pktType uint8, data []byte, padLen uint16) error {
-	var pkt [framing.MaximumFramePayloadLength]byte
+func (conn *obfs4Conn) makePacket(w *bytes.Buffer, pktType uint8, data []byte, padLen uint16) error {
+	var pkt [framing.MaximumBulkFramePayloadLength]byte
 
-	if len(data)+int(padLen) > maxPacketPayloadLength {
-		panic(fmt.Sprintf("BUG: makePacket() len(data) + padLen > maxPacketPayloadLength: %d + %d > %d",
-			len(data), padLen, maxPacketPayloadLength))
+	if maxLen := conn.maxPayloadLength(); len(data)+int(padLen) > maxLen {
+		panic(fmt.Sprintf("BUG: makePacket() len(data) + padLen > maxPayloadLength: %d + %d > %d",
+			len(data), padLen, maxLen))
 	}
 
 	// Packets are:
@@ -93,7 +97,7 @@ func (conn *obfs4Conn) makePacket(w io.Writer, pktType uint8, data []byte, padLe
 	pktLen := packetOverhead + len(data) + int(padLen)
 
 	// Encode the packet in an AEAD frame.
-	var frame [framing.MaximumSegmentLength]byte
+	var frame [framing.MaximumBulkSegmentLength]byte
 	frameLen, err := conn.encoder.Encode(frame[:], pkt[:pktLen])
 	if err != nil {
 		// All encoder errors are fatal.
@@ -109,17 +113,84 @@ func (conn *obfs4Conn) makePacket(w io.Writer, pktType uint8, data []byte, padLe
 	return nil
 }
 
+// makePackets chops data into maximum sized packets of type pktType, without
+// padding.
+func (conn *obfs4Conn) makePackets(w *bytes.Buffer, pktType uint8, data []byte) error {
+	maxLen := conn.maxPayloadLength()
+	for len(data) > 0 {
+		pktLen := len(data)
+		if pktLen > maxLen {
+			pktLen = maxLen
+		}
+		if err := conn.makePacket(w, pktType, data[:pktLen], 0); err != nil {
+			return err
+		}
+		data = data[pktLen:]
+	}
+
+	return nil
+}
+
+// maxPayloadLength returns the maximum payload length per packet.
+func (conn *obfs4Conn) maxPayloadLength() int {
+	if conn.bulk {
+		return maxBulkPayloadLength
+	}
+	return maxPacketPayloadLength
+}
+
 func (conn *obfs4Conn) readPackets() error {
-	// Attempt to read off the network.
-	rdLen, rdErr := conn.Conn.Read(conn.readBuffer)
-	conn.receiveBuffer.Write(conn.readBuffer[:rdLen])
+	if conn.decoder == nil {
+		return ErrHandshakeNotComplete
+	}
+
+	// Inflate the compressed payload that was previously deferred, if any,
+	// before consuming more data off the network.
+	if conn.compress {
+		if inflated, err := conn.inflateRecords(); inflated || err != nil {
+			return err
+		}
+	}
+
+	// Attempt to read off the network, while keeping the amount of buffered
+	// data under the limit if one is set.  At least one full segment is
+	// always read so that progress can be made.  Frames left buffered by
+	// the previous call due to the decode limit are decoded first, as the
+	// network may have nothing more to read.
+	var rdErr error
+	if !conn.decodePending {
+		rdBuf := conn.readBuffer
+		if conn.receiveLimit > 0 {
+			avail := conn.receiveLimit - (conn.receiveDecodedBuffer.Len() + conn.receiveBuffer.Len())
+			if avail < framing.MaximumSegmentLength {
+				avail = framing.MaximumSegmentLength
+			}
+			if avail < len(rdBuf) {
+				rdBuf = rdBuf[:avail]
+			}
+		}
+		var rdLen int
+		rdLen, rdErr = conn.Conn.Read(rdBuf)
+		conn.receiveBuffer.Write(conn.readBuffer[:rdLen])
+	}
+	conn.decodePending = false
 
 	var (
-		decoded [framing.MaximumFramePayloadLength]byte
+		decoded [framing.MaximumBulkFramePayloadLength]byte
+		nFrames int
 		err     error
 	)
 bufferLoop:
 	for conn.receiveBuffer.Len() > 0 {
+		// Yield to the caller once enough frames were decoded, unless the
+		// read failed, as there will not be another chance to decode the
+		// remainder.
+		if conn.decodeFrames > 0 && nFrames >= conn.decodeFrames && rdErr == nil {
+			conn.decodePending = true
+			break
+		}
+		nFrames++
+
 		// Decrypt an AEAD frame.
 		var decLen int
 		decLen, err = conn.decoder.Decode(decoded[:], conn.receiveBuffer)
@@ -148,6 +219,12 @@ bufferLoop:
 			if payloadLen > 0 {
 				conn.receiveDecodedBuffer.Write(payload)
 			}
+		case packetTypeCompressedPayload:
+			// Ignored unless compression was negotiated, like any other
+			// unknown packet type.
+			if conn.compress {
+				conn.compressedBuffer.Write(payload)
+			}
 		case packetTypePrngSeed:
 			// Only regenerate the distribution if we are the client.
 			if len(payload) == seedPacketPayloadLength && !conn.isServer {
@@ -166,11 +243,19 @@ bufferLoop:
 					conn.iatDist.Reset(iatSeed)
 				}
 			}
+		case packetTypeVersion:
+			conn.onVersionReport(payload)
 		default:
 			// Ignore unknown packet types.
 		}
 	}
 
+	if conn.compress && (err == nil || errors.Is(err, framing.ErrAgain)) {
+		if _, ierr := conn.inflateRecords(); ierr != nil {
+			err = ierr
+		}
+	}
+
 	// Read errors (all fatal) take priority over various frame processing
 	// errors.
 	if rdErr != nil {
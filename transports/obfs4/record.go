@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package obfs4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+const (
+	recordHeaderLength     = 5
+	recordTypeAppData      = 0x17
+	recordVersion          = 0x0303 // TLS 1.2, as used by TLS 1.3 as well.
+	maxRecordPayloadLength = 1 << 14
+)
+
+// ErrInvalidRecord is the error returned when a TLS record header is
+// malformed.  This error is fatal and the connection MUST be dropped.
+var ErrInvalidRecord = errors.New("obfs4: invalid TLS record header")
+
+// recordConn is an optional shaping layer that wraps everything sent over
+// the underlying connection in fake TLS application data records, for
+// traversing middleboxes that only pass traffic that looks like TLS.  It
+// provides no additional security, and is transparent to the rest of the
+// protocol.
+type recordConn struct {
+	net.Conn
+
+	hdr       [recordHeaderLength]byte
+	remaining int
+}
+
+func newRecordConn(conn net.Conn) *recordConn {
+	return &recordConn{Conn: conn}
+}
+
+func (c *recordConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	// Consume record headers until there is payload to read.
+	for c.remaining == 0 {
+		if _, err := io.ReadFull(c.Conn, c.hdr[:]); err != nil {
+			return 0, err
+		}
+		length, err := parseRecordHeader(c.hdr[:])
+		if err != nil {
+			return 0, err
+		}
+		c.remaining = length
+	}
+
+	if len(b) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.Conn.Read(b)
+	c.remaining -= n
+	return n, err
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	var buf bytes.Buffer
+	for off := 0; off < len(b); off += maxRecordPayloadLength {
+		chunk := b[off:]
+		if len(chunk) > maxRecordPayloadLength {
+			chunk = chunk[:maxRecordPayloadLength]
+		}
+		buf.Write(makeRecordHeader(len(chunk)))
+		buf.Write(chunk)
+	}
+	if _, err := c.Conn.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func makeRecordHeader(length int) []byte {
+	hdr := make([]byte, recordHeaderLength)
+	hdr[0] = recordTypeAppData
+	binary.BigEndian.PutUint16(hdr[1:], recordVersion)
+	binary.BigEndian.PutUint16(hdr[3:], uint16(length))
+	return hdr
+}
+
+func parseRecordHeader(hdr []byte) (int, error) {
+	if hdr[0] != recordTypeAppData || binary.BigEndian.Uint16(hdr[1:]) != recordVersion {
+		return 0, ErrInvalidRecord
+	}
+	length := int(binary.BigEndian.Uint16(hdr[3:]))
+	if length > maxRecordPayloadLength {
+		return 0, ErrInvalidRecord
+	}
+	return length, nil
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package obfs4
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+)
+
+func TestRecordConn_RoundTrip(t *testing.T) {
+	clientRaw, serverRaw := net.Pipe()
+	defer clientRaw.Close()
+	defer serverRaw.Close()
+	client, server := newRecordConn(clientRaw), newRecordConn(serverRaw)
+
+	// Large enough to span multiple records.
+	msg := make([]byte, 3*maxRecordPayloadLength+123)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	go func() {
+		_, _ = client.Write(msg)
+	}()
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(server, buf); err != nil {
+		t.Fatalf("Read() failed: %s", err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Fatalf("payload mismatch")
+	}
+}
+
+func TestRecordConn_Framing(t *testing.T) {
+	clientRaw, serverRaw := net.Pipe()
+	defer clientRaw.Close()
+	defer serverRaw.Close()
+	client := newRecordConn(clientRaw)
+
+	msg := []byte("hello")
+	go func() {
+		_, _ = client.Write(msg)
+	}()
+	buf := make([]byte, recordHeaderLength+len(msg))
+	if _, err := io.ReadFull(serverRaw, buf); err != nil {
+		t.Fatalf("Read() failed: %s", err)
+	}
+	expected := append([]byte{0x17, 0x03, 0x03, 0x00, byte(len(msg))}, msg...)
+	if !bytes.Equal(buf, expected) {
+		t.Fatalf("unexpected record: %x", buf)
+	}
+}
+
+func TestRecordConn_Malformed(t *testing.T) {
+	for _, v := range []struct {
+		name string
+		hdr  []byte
+	}{
+		{"type", []byte{0x16, 0x03, 0x03, 0x00, 0x01}},
+		{"version", []byte{0x17, 0x03, 0x01, 0x00, 0x01}},
+		{"length", []byte{0x17, 0x03, 0x03, 0x40, 0x01}},
+	} {
+		clientRaw, serverRaw := net.Pipe()
+		go func() {
+			_, _ = clientRaw.Write(append(v.hdr, 0x00))
+		}()
+		_, err := newRecordConn(serverRaw).Read(make([]byte, 16))
+		if !errors.Is(err, ErrInvalidRecord) {
+			t.Errorf("%s: Read() returned %v, expected ErrInvalidRecord", v.name, err)
+		}
+		clientRaw.Close()
+		serverRaw.Close()
+	}
+}
+
+func TestObfs4Conn_TLSRecords(t *testing.T) {
+	serverArgs := &pt.Args{}
+	serverArgs.Add(tlsRecordsArg, "true")
+	client, server := newTestConnPair(t, iatNone, serverArgs)
+	if _, ok := client.Conn.(*recordConn); !ok {
+		t.Fatalf("client connection is not wrapped")
+	}
+	if _, ok := server.Conn.(*recordConn); !ok {
+		t.Fatalf("server connection is not wrapped")
+	}
+
+	msg := []byte("hello")
+	go func() {
+		_, _ = client.Write(msg)
+	}()
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(server, buf); err != nil {
+		t.Fatalf("Read() failed: %s", err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Fatalf("payload mismatch")
+	}
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package obfs4
+
+import (
+	"net"
+	"time"
+
+	"gitlab.com/yawning/obfs4.git/common/probdist"
+	"gitlab.com/yawning/obfs4.git/transports/obfs4/framing"
+)
+
+// ShapingPolicy determines the lengths and timing of the bursts sent on a
+// connection.  The default policy samples the length and IAT distributions
+// derived from the server's PRNG seed, and alternative policies (eg: ones
+// that mimic a specific application's traffic) can be installed on a
+// connection via ShapingConn.
+//
+// The policy is only ever called with the connection's write lock held, so
+// a policy that is not shared between connections does not need to be safe
+// for concurrent use.
+type ShapingPolicy interface {
+	// NextPadLen returns the length that a burst currently currentLen bytes
+	// long should be padded to, modulo framing.MaximumSegmentLength.  The
+	// return value is clamped to [0, framing.MaximumSegmentLength].
+	NextPadLen(currentLen int) int
+
+	// NextIATDelay returns the delay before the next write, when IAT
+	// obfuscation is enabled.
+	NextIATDelay() time.Duration
+}
+
+// ShapingConn is a net.Conn that supports replacing the traffic shaping
+// policy.
+type ShapingConn interface {
+	net.Conn
+
+	// SetShapingPolicy sets the policy used for subsequent writes.  A nil
+	// policy restores the default.
+	SetShapingPolicy(ShapingPolicy)
+}
+
+type distShapingPolicy struct {
+	lenDist *probdist.WeightedDist
+	iatDist *probdist.WeightedDist
+}
+
+func (p *distShapingPolicy) NextPadLen(_ int) int {
+	return p.lenDist.Sample()
+}
+
+func (p *distShapingPolicy) NextIATDelay() time.Duration {
+	// The delay resolution is 100 usec, leading to a maximum delay of
+	// 10 msec.
+	return time.Duration(p.iatDist.Sample()*100) * time.Microsecond
+}
+
+func (conn *obfs4Conn) SetShapingPolicy(p ShapingPolicy) {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+
+	if p == nil {
+		p = &distShapingPolicy{lenDist: conn.lenDist, iatDist: conn.iatDist}
+	}
+	conn.shaping = p
+}
+
+// nextPadLen returns the length to pad a burst currently currentLen bytes
+// long to, as determined by the shaping policy.
+func (conn *obfs4Conn) nextPadLen(currentLen int) int {
+	padLen := conn.shaping.NextPadLen(currentLen)
+	switch {
+	case padLen < 0:
+		return 0
+	case padLen > framing.MaximumSegmentLength:
+		return framing.MaximumSegmentLength
+	default:
+		return padLen
+	}
+}
+
+var _ ShapingConn = (*obfs4Conn)(nil)
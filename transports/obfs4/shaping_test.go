@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package obfs4
+
+import (
+	"testing"
+	"time"
+
+	"gitlab.com/yawning/obfs4.git/transports/obfs4/framing"
+)
+
+type stubShapingPolicy struct {
+	padLen      int
+	iatDelay    time.Duration
+	currentLens []int
+	nrIATDelays int
+}
+
+func (p *stubShapingPolicy) NextPadLen(currentLen int) int {
+	p.currentLens = append(p.currentLens, currentLen)
+	return p.padLen
+}
+
+func (p *stubShapingPolicy) NextIATDelay() time.Duration {
+	p.nrIATDelays++
+	return p.iatDelay
+}
+
+func TestShapingPolicy(t *testing.T) {
+	for _, iatMode := range []int{iatNone, iatEnabled} {
+		client, _ := newTestConnPair(t, iatMode, nil)
+
+		rec := &captureConn{Conn: client.Conn, discard: true}
+		client.Conn = rec
+		policy := &stubShapingPolicy{padLen: 500}
+		client.SetShapingPolicy(policy)
+
+		// Every burst is padded to the fixed length, modulo the segment
+		// length.
+		const nrWrites = 10
+		var expectedTotal int
+		for i := 0; i < nrWrites; i++ {
+			payloadLen := 100 * (i + 1)
+			if _, err := client.Write(make([]byte, payloadLen)); err != nil {
+				t.Fatalf("iat=%d: Write() failed: %s", iatMode, err)
+			}
+			if policy.currentLens[i] != payloadLen+headerLength {
+				t.Fatalf("iat=%d: NextPadLen(%d), expected %d", iatMode, policy.currentLens[i], payloadLen+headerLength)
+			}
+			if burstLen := payloadLen + headerLength; burstLen < 500 {
+				expectedTotal += 500
+			} else {
+				expectedTotal += framing.MaximumSegmentLength + 500
+			}
+		}
+		var total int
+		for _, l := range rec.Lengths() {
+			total += l
+		}
+		if len(policy.currentLens) != nrWrites || total != expectedTotal {
+			t.Fatalf("iat=%d: %d bursts, %d bytes written", iatMode, len(policy.currentLens), total)
+		}
+		if (policy.nrIATDelays > 0) != (iatMode != iatNone) {
+			t.Fatalf("iat=%d: NextIATDelay() called %d times", iatMode, policy.nrIATDelays)
+		}
+
+		// Out of range lengths are clamped, and a nil policy restores the
+		// default.
+		policy.padLen = -1
+		if padLen := client.nextPadLen(0); padLen != 0 {
+			t.Fatalf("iat=%d: negative pad length clamped to %d", iatMode, padLen)
+		}
+		policy.padLen = framing.MaximumSegmentLength + 1
+		if padLen := client.nextPadLen(0); padLen != framing.MaximumSegmentLength {
+			t.Fatalf("iat=%d: oversized pad length clamped to %d", iatMode, padLen)
+		}
+		client.SetShapingPolicy(nil)
+		if _, ok := client.shaping.(*distShapingPolicy); !ok {
+			t.Fatalf("iat=%d: SetShapingPolicy(nil) did not restore the default", iatMode)
+		}
+	}
+}
+
+func TestShapingPolicyIATDelay(t *testing.T) {
+	const iatDelay = 5 * time.Millisecond
+
+	client, _ := newTestConnPair(t, iatEnabled, nil)
+	client.Conn = &captureConn{Conn: client.Conn, discard: true}
+	policy := &stubShapingPolicy{padLen: 500, iatDelay: iatDelay}
+	client.SetShapingPolicy(policy)
+
+	// The policy's delay is slept as is, not scaled.
+	start := time.Now()
+	if _, err := client.Write(make([]byte, 100)); err != nil {
+		t.Fatalf("Write() failed: %s", err)
+	}
+	elapsed := time.Since(start)
+	expected := time.Duration(policy.nrIATDelays) * iatDelay
+	if policy.nrIATDelays == 0 || elapsed < expected || elapsed > expected+time.Second {
+		t.Fatalf("%d delays of %v took %v", policy.nrIATDelays, iatDelay, elapsed)
+	}
+
+	// The default policy's delays are at most 10 ms.
+	client.SetShapingPolicy(nil)
+	for i := 0; i < 1000; i++ {
+		if d := client.shaping.NextIATDelay(); d < 0 || d > 10*time.Millisecond {
+			t.Fatalf("default policy delay %v", d)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package obfs4
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gitlab.com/yawning/obfs4.git/common/log"
+)
+
+// clockSkewHintThreshold is the number of consecutive handshakes to a bridge
+// that must fail authentication before the clock skew hint is logged.
+const clockSkewHintThreshold = 3
+
+// The handshake MACs cover the number of epochs (of "epoch-period" minutes,
+// an hour by default) since the UNIX epoch, and the server accepts MACs made
+// within "epoch-tolerance" epochs (1 by default) of its own clock.  A client
+// with a clock that is off by more than that has every handshake silently
+// ignored by the server, which is indistinguishable on the wire from the
+// bridge line being stale, so all the client can do is log a hint once
+// enough handshakes to the same bridge have failed that way.
+//
+// Servers can (via the "log-clock-skew=1" argument) log when a client's MAC
+// is only accepted at an epoch other than the server's current one, which
+// indicates a client with a skewed clock that is not yet off by enough to
+// fail.
+
+// clientClock is the source of the time used to generate the client
+// handshake, and is only overridden by the tests.
+var clientClock = time.Now
+
+// skewDetector tracks the consecutive handshake authentication failures
+// per bridge address, for the clock skew hint.
+type skewDetector struct {
+	sync.Mutex
+	failures map[string]int
+}
+
+// observe records the result of a handshake to addr, and returns true iff
+// the clock skew hint was logged as a result.  Only failures that can be
+// caused by clock skew are counted, and a successful handshake resets the
+// count.
+func (d *skewDetector) observe(addr string, err error) bool {
+	var macErr *InvalidMacError
+	isAuthFailure := errors.Is(err, ErrServerKeyMismatch) || errors.As(err, &macErr)
+
+	d.Lock()
+	defer d.Unlock()
+
+	switch {
+	case err == nil:
+		delete(d.failures, addr)
+		return false
+	case !isAuthFailure:
+		return false
+	}
+
+	if d.failures == nil {
+		d.failures = make(map[string]int)
+	}
+	d.failures[addr]++
+	if d.failures[addr] != clockSkewHintThreshold {
+		return false
+	}
+	log.Warnf("%s(%s) - %d consecutive handshakes failed authentication, possible clock skew (check that the system clock is accurate), or the bridge line is stale",
+		transportName, log.ElideAddr(addr), clockSkewHintThreshold)
+	return true
+}
+
+func (conn *obfs4Conn) logClockSkew(offset int64, period time.Duration) {
+	if offset == 0 {
+		return
+	}
+	log.Infof("%s(%s) - client handshake accepted at epoch offset %+d (of %s), possible client clock skew",
+		transportName, log.ElideAddr(conn.RemoteAddr().String()), offset, period)
+}
@@ -0,0 +1,339 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package obfs4
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+
+	"gitlab.com/yawning/obfs4.git/common/log"
+	"gitlab.com/yawning/obfs4.git/common/ntor"
+	"gitlab.com/yawning/obfs4.git/common/replayfilter"
+)
+
+func TestHandshakeClockSkew(t *testing.T) {
+	nodeID, _ := ntor.NewNodeID([]byte("\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10\x11\x12\x13"))
+	idKeypair, _ := ntor.NewKeypair(false)
+	now := time.Now()
+
+	for _, v := range []struct {
+		skew   int64
+		offset int64
+		ok     bool
+	}{
+		{0, 0, true},
+		{-1, -1, true},
+		{1, 1, true},
+		{-2, 0, false},
+		{2, 0, false},
+	} {
+		clientKeypair, _ := ntor.NewKeypair(true)
+		clientHs := newClientHandshake(nodeID, idKeypair.Public(), clientKeypair)
+		clientBlob, err := clientHs.generateHandshakeAt(now.Add(time.Duration(v.skew) * time.Hour))
+		if err != nil {
+			t.Fatalf("[%+d]: clientHandshake.generateHandshakeAt() failed: %s", v.skew, err)
+		}
+
+		filter, _ := replayfilter.New(epochReplayTTL(defaultEpochTolerance, defaultEpochPeriod))
+		serverKeypair, _ := ntor.NewKeypair(true)
+		serverHs := newServerHandshake(nodeID, idKeypair, serverKeypair)
+		_, err = serverHs.parseClientHandshakeAt(filter, clientBlob, now)
+		if !v.ok {
+			if !errors.Is(err, ErrInvalidHandshake) {
+				t.Fatalf("[%+d]: serverHandshake.parseClientHandshakeAt() returned %v, expected ErrInvalidHandshake", v.skew, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("[%+d]: serverHandshake.parseClientHandshakeAt() failed: %s", v.skew, err)
+		}
+		if serverHs.epochOffset != v.offset {
+			t.Fatalf("[%+d]: epoch offset %d, expected %d", v.skew, serverHs.epochOffset, v.offset)
+		}
+
+		// The server responds with the epoch that it accepted, so the
+		// skewed client can still validate the response.
+		serverBlob, err := serverHs.generateHandshake()
+		if err != nil {
+			t.Fatalf("[%+d]: serverHandshake.generateHandshake() failed: %s", v.skew, err)
+		}
+		if _, _, err = clientHs.parseServerHandshake(serverBlob); err != nil {
+			t.Fatalf("[%+d]: clientHandshake.parseServerHandshake() failed: %s", v.skew, err)
+		}
+	}
+}
+
+func TestClockSkewLogging(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "test.log")
+	if err := log.Init(true, logPath, true); err != nil {
+		t.Fatalf("log.Init() failed: %s", err)
+	}
+	if err := log.SetLogLevel("INFO"); err != nil {
+		t.Fatalf("log.SetLogLevel() failed: %s", err)
+	}
+	defer func() {
+		_ = log.Init(false, "", false)
+		clientClock = time.Now
+	}()
+
+	// A client within the window is logged by the server, if asked to.
+	clientClock = func() time.Time { return time.Now().Add(-time.Hour) }
+	serverArgs := &pt.Args{}
+	serverArgs.Add(clockSkewArg, "1")
+	client, server := newTestConnPair(t, iatNone, serverArgs)
+	client.Close()
+	server.Close()
+
+	b, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("os.ReadFile() failed: %s", err)
+	}
+	if !strings.Contains(string(b), "epoch offset -1 (of 1h0m0s)") {
+		t.Fatalf("clock skew not logged by the server: %q", b)
+	}
+
+	// A client outside the window has every handshake ignored, and logs a
+	// hint after enough of them.
+	tr := new(Transport)
+	sf, err := tr.ServerFactory(t.TempDir(), &pt.Args{})
+	if err != nil {
+		t.Fatalf("ServerFactory() failed: %s", err)
+	}
+	rsf := sf.(*obfs4ServerFactory) //nolint:forcetypeassert
+	ln, _ := newTestHandshakeListener(t, func(idx int, conn net.Conn) {
+		defer conn.Close()
+		if idx >= clockSkewHintThreshold {
+			c, err := sf.WrapConn(conn)
+			if err != nil {
+				return
+			}
+			_, _ = io.Copy(c, c)
+			return
+		}
+
+		_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		blob, _ := io.ReadAll(conn)
+		serverKeypair, _ := ntor.NewKeypair(true)
+		serverHs := newServerHandshake(rsf.nodeID, rsf.identityKey, serverKeypair)
+		if _, err := serverHs.parseClientHandshake(rsf.replayFilter, blob); !errors.Is(err, ErrInvalidHandshake) {
+			t.Errorf("serverHandshake.parseClientHandshake() returned %v, expected ErrInvalidHandshake", err)
+		}
+	})
+	cf, _ := tr.ClientFactory("")
+	args, err := cf.ParseArgs(sf.Args())
+	if err != nil {
+		t.Fatalf("ParseArgs() failed: %s", err)
+	}
+	skew := &cf.(*obfs4ClientFactory).skew //nolint:forcetypeassert
+	addr := ln.Addr().String()
+
+	clientClock = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	for i := 1; i <= clockSkewHintThreshold; i++ {
+		if _, err = cf.Dial("tcp", addr, net.Dial, args); !errors.Is(err, ErrServerKeyMismatch) {
+			t.Fatalf("Dial() returned %v, expected ErrServerKeyMismatch", err)
+		}
+		if skew.failures[addr] != i {
+			t.Fatalf("%d failures recorded, expected %d", skew.failures[addr], i)
+		}
+	}
+	if b, err = os.ReadFile(logPath); err != nil {
+		t.Fatalf("os.ReadFile() failed: %s", err)
+	}
+	if !strings.Contains(string(b), "possible clock skew") {
+		t.Fatalf("clock skew hint not logged by the client: %q", b)
+	}
+
+	// Once the clock is fixed, the handshake succeeds and resets the count.
+	clientClock = time.Now
+	conn, err := cf.Dial("tcp", addr, net.Dial, args)
+	if err != nil {
+		t.Fatalf("Dial() failed: %s", err)
+	}
+	conn.Close()
+	if _, ok := skew.failures[addr]; ok {
+		t.Fatalf("failures not reset by a successful handshake")
+	}
+}
+
+func TestSkewDetector(t *testing.T) {
+	var d skewDetector
+	const addr = "192.0.2.1:443"
+
+	// Only failures that can be caused by clock skew are counted, and the
+	// hint is logged once per run of failures.
+	if d.observe(addr, io.ErrUnexpectedEOF) {
+		t.Fatalf("hint logged for an unrelated failure")
+	}
+	for i := 1; i <= clockSkewHintThreshold+1; i++ {
+		var err error = &InvalidMacError{}
+		if i%2 == 0 {
+			err = ErrServerKeyMismatch
+		}
+		if hinted := d.observe(addr, err); hinted != (i == clockSkewHintThreshold) {
+			t.Fatalf("[%d]: observe() returned %v", i, hinted)
+		}
+	}
+	if d.observe("192.0.2.2:443", ErrServerKeyMismatch) {
+		t.Fatalf("failures counted across addresses")
+	}
+	d.observe(addr, nil)
+	if d.failures[addr] != 0 {
+		t.Fatalf("failures not reset by a successful handshake")
+	}
+}
+
+func TestEpochTolerance(t *testing.T) {
+	tr := new(Transport)
+	for _, v := range []struct {
+		value     string
+		tolerance int
+		ok        bool
+	}{
+		{"", defaultEpochTolerance, true},
+		{"1", 1, true},
+		{"2", 2, true},
+		{"3", 3, true},
+		{"0", 0, false},
+		{"4", 0, false},
+		{"bogus", 0, false},
+	} {
+		args := &pt.Args{}
+		if v.value != "" {
+			args.Add(epochTolArg, v.value)
+		}
+		sf, err := tr.ServerFactory(t.TempDir(), args)
+		if !v.ok {
+			if err == nil {
+				t.Fatalf("[%q]: ServerFactory() accepted an invalid tolerance", v.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("[%q]: ServerFactory() failed: %s", v.value, err)
+		}
+		if tolerance := sf.(*obfs4ServerFactory).epochTolerance; tolerance != v.tolerance { //nolint:forcetypeassert
+			t.Fatalf("[%q]: tolerance %d, expected %d", v.value, tolerance, v.tolerance)
+		}
+		if _, ok := sf.Args().Get(epochTolArg); ok {
+			t.Fatalf("[%q]: %s published in the server arguments", v.value, epochTolArg)
+		}
+	}
+
+	// A client that is 2 hours behind is accepted by a server with the
+	// widened window.
+	defer func() {
+		clientClock = time.Now
+	}()
+	clientClock = func() time.Time { return time.Now().Add(-2 * time.Hour) }
+	serverArgs := &pt.Args{}
+	serverArgs.Add(epochTolArg, "2")
+	client, server := newTestConnPair(t, iatNone, serverArgs)
+	defer client.Close()
+	defer server.Close()
+
+	msg := []byte("skewed")
+	go func() {
+		_, _ = client.Write(msg)
+	}()
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(server, buf); err != nil || !bytes.Equal(msg, buf) {
+		t.Fatalf("Read() failed: %q, %v", buf, err)
+	}
+}
+
+func TestEpochPeriod(t *testing.T) {
+	tr := new(Transport)
+	for _, v := range []struct {
+		value  string
+		period time.Duration
+		ok     bool
+	}{
+		{"", defaultEpochPeriod, true},
+		{"60", time.Hour, true},
+		{"15", 15 * time.Minute, true},
+		{"30", 30 * time.Minute, true},
+		{"240", 4 * time.Hour, true},
+		{"14", 0, false},
+		{"241", 0, false},
+		{"bogus", 0, false},
+	} {
+		args := &pt.Args{}
+		if v.value != "" {
+			args.Add(epochPeriodArg, v.value)
+		}
+		sf, err := tr.ServerFactory(t.TempDir(), args)
+		if !v.ok {
+			if err == nil {
+				t.Fatalf("[%q]: ServerFactory() accepted an invalid period", v.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("[%q]: ServerFactory() failed: %s", v.value, err)
+		}
+		if period := sf.(*obfs4ServerFactory).epochPeriod; period != v.period { //nolint:forcetypeassert
+			t.Fatalf("[%q]: period %v, expected %v", v.value, period, v.period)
+		}
+
+		// The clients need the period, unless it is the default.
+		published, ok := sf.Args().Get(epochPeriodArg)
+		if ok != (v.period != defaultEpochPeriod) || (ok && published != v.value) {
+			t.Fatalf("[%q]: %s published as %q", v.value, epochPeriodArg, published)
+		}
+	}
+
+	// A client that is an epoch behind is accepted by a server with shorter
+	// epochs, as the client picks up the period from the server arguments.
+	defer func() {
+		clientClock = time.Now
+	}()
+	clientClock = func() time.Time { return time.Now().Add(-30 * time.Minute) }
+	serverArgs := &pt.Args{}
+	serverArgs.Add(epochPeriodArg, "30")
+	client, server := newTestConnPair(t, iatNone, serverArgs)
+	defer client.Close()
+	defer server.Close()
+
+	msg := []byte("shorter epochs")
+	go func() {
+		_, _ = client.Write(msg)
+	}()
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(server, buf); err != nil || !bytes.Equal(msg, buf) {
+		t.Fatalf("Read() failed: %q, %v", buf, err)
+	}
+}
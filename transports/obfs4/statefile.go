@@ -32,6 +32,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"strconv"
@@ -92,7 +93,7 @@ func serverCertFromString(encoded string) (*obfs4ServerCert, error) {
 	return &obfs4ServerCert{raw: decoded}, nil
 }
 
-func serverCertFromState(st *obfs4ServerState) *obfs4ServerCert {
+func serverCertFromState(st *ServerState) *obfs4ServerCert {
 	cert := new(obfs4ServerCert)
 
 	cert.raw = bytes.Clone(st.nodeID.Bytes()[:])
@@ -101,20 +102,65 @@ func serverCertFromState(st *obfs4ServerState) *obfs4ServerCert {
 	return cert
 }
 
-type obfs4ServerState struct {
+// ServerState is a server's long term state (node ID, identity key, DRBG
+// seed, and IAT mode), that the clients' bridge lines are derived from.
+type ServerState struct {
 	nodeID      *ntor.NodeID
-	identityKey *ntor.Keypair
+	identityKey ntor.IdentityKey
 	drbgSeed    *drbg.Seed
 	iatMode     int
 
 	cert *obfs4ServerCert
 }
 
-func (st *obfs4ServerState) clientString() string {
+func (st *ServerState) clientString() string {
 	return fmt.Sprintf("%s=%s %s=%d", certArg, st.cert, iatArg, st.iatMode)
 }
 
-func serverStateFromArgs(stateDir string, args *pt.Args) (*obfs4ServerState, error) {
+// Args returns the arguments that the clients need to connect to the server
+// (cert, iat-mode).
+func (st *ServerState) Args() *pt.Args {
+	args := &pt.Args{}
+	args.Add(certArg, st.cert.String())
+	args.Add(iatArg, strconv.Itoa(st.iatMode))
+	return args
+}
+
+// ServerArgs returns the server arguments (node-id, private-key, public-key,
+// drbg-seed, iat-mode) that reproduce the state when passed to the server,
+// eg: via ServerTransportOptions, without a state file.
+func (st *ServerState) ServerArgs() (*pt.Args, error) {
+	js, err := st.toJSON()
+	if err != nil {
+		return nil, err
+	}
+	args := &pt.Args{}
+	args.Add(nodeIDArg, js.NodeID)
+	args.Add(privateKeyArg, js.PrivateKey)
+	args.Add(publicKeyArg, js.PublicKey)
+	args.Add(seedArg, js.DrbgSeed)
+	args.Add(iatArg, strconv.Itoa(js.IATMode))
+	return args, nil
+}
+
+// Config returns the ServerConfig for running a server with the state via
+// NewServerFactory.
+func (st *ServerState) Config() *ServerConfig {
+	return &ServerConfig{
+		NodeID:      st.nodeID,
+		IdentityKey: st.identityKey,
+		DrbgSeed:    st.drbgSeed,
+		IATMode:     st.iatMode,
+	}
+}
+
+// BridgeLine returns the obfs4 bridge line for the server listening on addr
+// (host:port), without the optional fingerprint.
+func (st *ServerState) BridgeLine(addr string) string {
+	return fmt.Sprintf("%s %s %s", transportName, addr, st.clientString())
+}
+
+func serverStateFromArgs(stateDir string, args *pt.Args) (*ServerState, error) {
 	var js jsonServerState
 	var nodeIDOk, privKeyOk, seedOk bool
 
@@ -123,11 +169,21 @@ func serverStateFromArgs(stateDir string, args *pt.Args) (*obfs4ServerState, err
 	js.DrbgSeed, seedOk = args.Get(seedArg)
 	iatStr, iatOk := args.Get(iatArg)
 
+	// Deriving the node ID from the identity key is opt-in, and only
+	// applies when a new state is generated.
+	var deriveNodeID bool
+	if str, ok := args.Get(deriveNodeIDArg); ok {
+		var err error
+		if deriveNodeID, err = strconv.ParseBool(str); err != nil {
+			return nil, fmt.Errorf("malformed %s '%s'", deriveNodeIDArg, str)
+		}
+	}
+
 	// Either a private key, node id, and seed are ALL specified, or
 	// they should be loaded from the state file.
 	switch {
 	case !privKeyOk && !nodeIDOk && !seedOk:
-		if err := jsonServerStateFromFile(stateDir, &js); err != nil {
+		if err := jsonServerStateFromFile(stateDir, &js, deriveNodeID); err != nil {
 			return nil, err
 		}
 	case !privKeyOk:
@@ -152,10 +208,25 @@ func serverStateFromArgs(stateDir string, args *pt.Args) (*obfs4ServerState, err
 	return serverStateFromJSONServerState(stateDir, &js)
 }
 
-func serverStateFromJSONServerState(stateDir string, js *jsonServerState) (*obfs4ServerState, error) {
+func serverStateFromJSONServerState(stateDir string, js *jsonServerState) (*ServerState, error) {
+	st, err := serverStateFromJSON(js)
+	if err != nil {
+		return nil, err
+	}
+
+	// Generate a human readable summary of the configured endpoint.
+	if err = newBridgeFile(stateDir, st); err != nil {
+		return nil, err
+	}
+
+	// Write back the possibly updated server state.
+	return st, writeServerStateFile(stateDir, st)
+}
+
+func serverStateFromJSON(js *jsonServerState) (*ServerState, error) {
 	var err error
 
-	st := new(obfs4ServerState)
+	st := new(ServerState)
 	if st.nodeID, err = ntor.NodeIDFromHex(js.NodeID); err != nil {
 		return nil, err
 	}
@@ -171,74 +242,128 @@ func serverStateFromJSONServerState(stateDir string, js *jsonServerState) (*obfs
 	st.iatMode = js.IATMode
 	st.cert = serverCertFromState(st)
 
-	// Generate a human readable summary of the configured endpoint.
-	if err = newBridgeFile(stateDir, st); err != nil {
-		return nil, err
+	return st, nil
+}
+
+func (st *ServerState) toJSON() (*jsonServerState, error) {
+	keypair, ok := st.identityKey.(*ntor.Keypair)
+	if !ok {
+		return nil, fmt.Errorf("identity key can not be serialized")
 	}
+	return &jsonServerState{
+		NodeID:     st.nodeID.Hex(),
+		PrivateKey: keypair.Private().Hex(),
+		PublicKey:  keypair.Public().Hex(),
+		DrbgSeed:   st.drbgSeed.Hex(),
+		IATMode:    st.iatMode,
+	}, nil
+}
 
-	// Write back the possibly updated server state.
-	return st, writeJSONServerState(stateDir, js)
+// LoadServerState loads a server state serialized by MarshalServerState
+// (or the contents of a state file) from r.
+func LoadServerState(r io.Reader) (*ServerState, error) {
+	var js jsonServerState
+	if err := json.NewDecoder(r).Decode(&js); err != nil {
+		return nil, fmt.Errorf("failed to load server state: %w", err)
+	}
+	return serverStateFromJSON(&js)
+}
+
+// MarshalServerState serializes the server state to w, in the same JSON
+// format that is used for the state file.
+func MarshalServerState(w io.Writer, st *ServerState) error {
+	js, err := st.toJSON()
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(js)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(encoded)
+	return err
 }
 
-func jsonServerStateFromFile(stateDir string, js *jsonServerState) error {
+func jsonServerStateFromFile(stateDir string, js *jsonServerState, deriveNodeID bool) error {
 	fPath := path.Join(stateDir, stateFile)
-	f, err := os.ReadFile(fPath)
+	f, err := os.Open(fPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			if err = newJSONServerState(stateDir, js); err == nil {
+			if err = newJSONServerState(stateDir, js, deriveNodeID); err == nil {
 				return nil
 			}
 		}
 		return err
 	}
+	defer f.Close()
 
-	if err := json.Unmarshal(f, js); err != nil {
+	if err := json.NewDecoder(f).Decode(js); err != nil {
 		return fmt.Errorf("failed to load statefile '%s': %w", fPath, err)
 	}
 
 	return nil
 }
 
-func newJSONServerState(stateDir string, js *jsonServerState) error {
-	// Generate everything a server needs, using the cryptographic PRNG.
-	var st obfs4ServerState
-	rawID := make([]byte, ntor.NodeIDLength)
-	if err := csrand.Bytes(rawID); err != nil {
+func newJSONServerState(stateDir string, js *jsonServerState, deriveNodeID bool) error {
+	st, err := newServerState(deriveNodeID)
+	if err != nil {
 		return err
 	}
 
-	var err error
-	if st.nodeID, err = ntor.NewNodeID(rawID); err != nil {
+	// Encode it into JSON format and write the state file.
+	encoded, err := st.toJSON()
+	if err != nil {
 		return err
 	}
+	*js = *encoded
+
+	return writeServerStateFile(stateDir, st)
+}
+
+// GenerateServerState generates a new server state, without a state
+// directory, eg: for provisioning bridges offline.  The state can be
+// serialized with MarshalServerState.
+func GenerateServerState() (*ServerState, error) {
+	return newServerState(false)
+}
+
+func newServerState(deriveNodeID bool) (*ServerState, error) {
+	// Generate everything a server needs, using the cryptographic PRNG.
+	st := new(ServerState)
+	var err error
 	if st.identityKey, err = ntor.NewKeypair(false); err != nil {
-		return err
+		return nil, err
+	}
+	if deriveNodeID {
+		// Note: This links the node ID to the identity key.
+		st.nodeID = ntor.NodeIDFromPublicKey(st.identityKey.Public())
+	} else {
+		rawID := make([]byte, ntor.NodeIDLength)
+		if err = csrand.Bytes(rawID); err != nil {
+			return nil, err
+		}
+		if st.nodeID, err = ntor.NewNodeID(rawID); err != nil {
+			return nil, err
+		}
 	}
 	if st.drbgSeed, err = drbg.NewSeed(); err != nil {
-		return err
+		return nil, err
 	}
 	st.iatMode = iatNone
+	st.cert = serverCertFromState(st)
 
-	// Encode it into JSON format and write the state file.
-	js.NodeID = st.nodeID.Hex()
-	js.PrivateKey = st.identityKey.Private().Hex()
-	js.PublicKey = st.identityKey.Public().Hex()
-	js.DrbgSeed = st.drbgSeed.Hex()
-	js.IATMode = st.iatMode
-
-	return writeJSONServerState(stateDir, js)
+	return st, nil
 }
 
-func writeJSONServerState(stateDir string, js *jsonServerState) error {
-	var err error
-	var encoded []byte
-	if encoded, err = json.Marshal(js); err != nil {
+func writeServerStateFile(stateDir string, st *ServerState) error {
+	var buf bytes.Buffer
+	if err := MarshalServerState(&buf, st); err != nil {
 		return err
 	}
-	return os.WriteFile(path.Join(stateDir, stateFile), encoded, 0o600)
+	return os.WriteFile(path.Join(stateDir, stateFile), buf.Bytes(), 0o600)
 }
 
-func newBridgeFile(stateDir string, st *obfs4ServerState) error {
+func newBridgeFile(stateDir string, st *ServerState) error {
 	const prefix = "# obfs4 torrc client bridge line\n" +
 		"#\n" +
 		"# This file is an automatically generated bridge line based on\n" +
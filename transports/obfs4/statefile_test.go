@@ -0,0 +1,198 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package obfs4
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+
+	"gitlab.com/yawning/obfs4.git/common/ntor"
+)
+
+func TestServerStateRoundTrip(t *testing.T) {
+	// Generate a state file the normal way.
+	stateDir := t.TempDir()
+	if _, err := serverStateFromArgs(stateDir, &pt.Args{}); err != nil {
+		t.Fatalf("serverStateFromArgs() failed: %s", err)
+	}
+	raw, err := os.ReadFile(path.Join(stateDir, stateFile))
+	if err != nil {
+		t.Fatalf("failed to read state file: %s", err)
+	}
+
+	st, err := LoadServerState(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("LoadServerState() failed: %s", err)
+	}
+
+	// The serialized form must be byte-identical to the state file.
+	var buf bytes.Buffer
+	if err = MarshalServerState(&buf, st); err != nil {
+		t.Fatalf("MarshalServerState() failed: %s", err)
+	}
+	if !bytes.Equal(buf.Bytes(), raw) {
+		t.Fatalf("serialized state mismatch:\n got: %s\nwant: %s", buf.Bytes(), raw)
+	}
+
+	st2, err := LoadServerState(&buf)
+	if err != nil {
+		t.Fatalf("LoadServerState() (round trip) failed: %s", err)
+	}
+	if st2.cert.String() != st.cert.String() || st2.iatMode != st.iatMode ||
+		st2.drbgSeed.Hex() != st.drbgSeed.Hex() ||
+		!reflect.DeepEqual(st2.identityKey, st.identityKey) {
+		t.Fatalf("round tripped state mismatch")
+	}
+
+	for _, v := range []string{
+		"",
+		"not json",
+		strings.Replace(string(raw), `"iat-mode":0`, `"iat-mode":7`, 1),
+	} {
+		if _, err = LoadServerState(strings.NewReader(v)); err == nil {
+			t.Fatalf("LoadServerState(%q) succeeded", v)
+		}
+	}
+}
+
+func TestServerStateDeriveNodeID(t *testing.T) {
+	args := &pt.Args{}
+	args.Add(deriveNodeIDArg, "true")
+	st, err := serverStateFromArgs(t.TempDir(), args)
+	if err != nil {
+		t.Fatalf("serverStateFromArgs() failed: %s", err)
+	}
+	expected := ntor.NodeIDFromPublicKey(st.identityKey.Public())
+	if st.nodeID.Hex() != expected.Hex() {
+		t.Fatalf("node ID not derived from the identity key")
+	}
+
+	// The default is a random node ID.
+	st, err = serverStateFromArgs(t.TempDir(), &pt.Args{})
+	if err != nil {
+		t.Fatalf("serverStateFromArgs() failed: %s", err)
+	}
+	if st.nodeID.Hex() == ntor.NodeIDFromPublicKey(st.identityKey.Public()).Hex() {
+		t.Fatalf("node ID unexpectedly derived from the identity key")
+	}
+
+	args = &pt.Args{}
+	args.Add(deriveNodeIDArg, "bogus")
+	if _, err = serverStateFromArgs(t.TempDir(), args); err == nil {
+		t.Fatalf("serverStateFromArgs(bogus) succeeded")
+	}
+}
+
+func TestGenerateServerState(t *testing.T) {
+	st, err := GenerateServerState()
+	if err != nil {
+		t.Fatalf("GenerateServerState() failed: %s", err)
+	}
+
+	// Writing the generated state, and reloading it via the state file,
+	// must not change anything.
+	stateDir := t.TempDir()
+	if err = writeServerStateFile(stateDir, st); err != nil {
+		t.Fatalf("writeServerStateFile() failed: %s", err)
+	}
+	raw, err := os.ReadFile(path.Join(stateDir, stateFile))
+	if err != nil {
+		t.Fatalf("ReadFile() failed: %s", err)
+	}
+	loaded, err := serverStateFromArgs(stateDir, &pt.Args{})
+	if err != nil {
+		t.Fatalf("serverStateFromArgs() failed: %s", err)
+	}
+	reloaded, err := os.ReadFile(path.Join(stateDir, stateFile))
+	if err != nil {
+		t.Fatalf("ReadFile() failed: %s", err)
+	}
+	if !bytes.Equal(raw, reloaded) {
+		t.Fatalf("state file changed on reload: %s != %s", raw, reloaded)
+	}
+	if !reflect.DeepEqual(st, loaded) {
+		t.Fatalf("reloaded state does not match the generated state")
+	}
+
+	// The client arguments and bridge line match those written to the
+	// bridge file, and are accepted by the client.
+	bridgeFileRaw, err := os.ReadFile(path.Join(stateDir, bridgeFile))
+	if err != nil {
+		t.Fatalf("ReadFile() failed: %s", err)
+	}
+	line := st.BridgeLine("192.0.2.1:443")
+	if !strings.Contains(string(bridgeFileRaw), strings.TrimPrefix(line, "obfs4 192.0.2.1:443 ")) {
+		t.Fatalf("bridge line %q does not match the bridge file", line)
+	}
+	b, err := ParseBridgeLine(line)
+	if err != nil {
+		t.Fatalf("ParseBridgeLine(%q) failed: %s", line, err)
+	}
+	if !reflect.DeepEqual(b.Args, st.Args()) {
+		t.Fatalf("bridge line args %v != %v", b.Args, st.Args())
+	}
+
+	f, err := NewServerFactory(st.Config())
+	if err != nil {
+		t.Fatalf("NewServerFactory() failed: %s", err)
+	}
+	if cert, _ := f.Args().Get(certArg); cert != st.cert.String() {
+		t.Fatalf("server factory cert mismatch")
+	}
+
+	// The server arguments reproduce the state without a state file, both
+	// directly and via the JSON state.
+	args, err := st.ServerArgs()
+	if err != nil {
+		t.Fatalf("ServerArgs() failed: %s", err)
+	}
+	fromArgs, err := serverStateFromArgs(t.TempDir(), args)
+	if err != nil {
+		t.Fatalf("serverStateFromArgs() failed: %s", err)
+	}
+	if !reflect.DeepEqual(st, fromArgs) {
+		t.Fatalf("state from the server arguments does not match the generated state")
+	}
+	js, err := st.toJSON()
+	if err != nil {
+		t.Fatalf("toJSON() failed: %s", err)
+	}
+	fromJSON, err := serverStateFromJSONServerState(t.TempDir(), js)
+	if err != nil {
+		t.Fatalf("serverStateFromJSONServerState() failed: %s", err)
+	}
+	if !reflect.DeepEqual(st, fromJSON) {
+		t.Fatalf("state from the JSON state does not match the generated state")
+	}
+}
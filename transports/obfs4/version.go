@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package obfs4
+
+import (
+	"gitlab.com/yawning/obfs4.git/common/log"
+)
+
+// maxReportedVersionLength is the maximum length of a reported version
+// string, longer strings are truncated.
+const maxReportedVersionLength = 64
+
+// ReportedVersion is the version string sent to the peer when the
+// "report-version" argument is set.  Applications embedding the transport
+// should set it to something that identifies their build.
+var ReportedVersion = "unknown"
+
+// The version report is a diagnostic aid for debugging interoperability
+// between different builds.  When enabled (via the "report-version=1"
+// argument, on either or both of the client and the server), the version
+// string is sent as a packetTypeVersion packet along with the first data
+// written after the handshake, and the peer's version is logged at the DEBUG
+// level when received.
+//
+// The packet is encrypted and authenticated like any other, and does not
+// alter the size or timing of the handshake, so it is not visible on the
+// wire.  Peers that do not support it ignore it as an unknown packet type.
+
+func (conn *obfs4Conn) queueVersionReport() {
+	v := ReportedVersion
+	if len(v) > maxReportedVersionLength {
+		v = v[:maxReportedVersionLength]
+	}
+	conn.pendingVersion = []byte(v)
+}
+
+func (conn *obfs4Conn) onVersionReport(payload []byte) {
+	if len(payload) == 0 || conn.peerVersion != "" {
+		return
+	}
+	if len(payload) > maxReportedVersionLength {
+		payload = payload[:maxReportedVersionLength]
+	}
+	conn.peerVersion = string(payload)
+
+	peer := "server"
+	if conn.isServer {
+		peer = "client"
+	}
+	log.Debugf("%s(%s) - %s reports version %q", transportName, log.ElideAddr(conn.RemoteAddr().String()), peer, conn.peerVersion)
+}
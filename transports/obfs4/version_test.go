@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2014, Yawning Angel <yawning at schwanenlied dot me>
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package obfs4
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+
+	"gitlab.com/yawning/obfs4.git/common/log"
+)
+
+func TestVersionReport(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "test.log")
+	if err := log.Init(true, logPath, true); err != nil {
+		t.Fatalf("log.Init() failed: %s", err)
+	}
+	if err := log.SetLogLevel("DEBUG"); err != nil {
+		t.Fatalf("log.SetLogLevel() failed: %s", err)
+	}
+	oldVersion := ReportedVersion
+	defer func() {
+		_ = log.Init(false, "", false)
+		_ = log.SetLogLevel("INFO")
+		ReportedVersion = oldVersion
+	}()
+	ReportedVersion = "obfs4proxy-test-version"
+
+	serverArgs := &pt.Args{}
+	serverArgs.Add(versionArg, "1")
+	tr := new(Transport)
+	sf, err := tr.ServerFactory(t.TempDir(), serverArgs)
+	if err != nil {
+		t.Fatalf("Transport.ServerFactory() failed: %s", err)
+	}
+	if _, ok := sf.Args().Get(versionArg); ok {
+		t.Fatalf("%s published in the server arguments", versionArg)
+	}
+	cf, err := tr.ClientFactory("")
+	if err != nil {
+		t.Fatalf("Transport.ClientFactory() failed: %s", err)
+	}
+	clientArgs := pt.Args{}
+	for k, v := range *sf.Args() {
+		clientArgs[k] = v
+	}
+	clientArgs.Add(versionArg, "1")
+	ca, err := cf.ParseArgs(&clientArgs)
+	if err != nil {
+		t.Fatalf("obfs4ClientFactory.ParseArgs() failed: %s", err)
+	}
+
+	clientRaw, serverRaw := net.Pipe()
+	clientCapture := &captureConn{Conn: clientRaw}
+	serverCapture := &captureConn{Conn: serverRaw}
+
+	serverCh := make(chan net.Conn, 1)
+	go func() {
+		c, err := sf.WrapConn(serverCapture)
+		if err != nil {
+			t.Errorf("obfs4ServerFactory.WrapConn() failed: %s", err)
+		}
+		serverCh <- c
+	}()
+	dialFn := func(string, string) (net.Conn, error) {
+		return clientCapture, nil
+	}
+	c, err := cf.Dial("tcp", "pipe", dialFn, ca)
+	if err != nil {
+		t.Fatalf("obfs4ClientFactory.Dial() failed: %s", err)
+	}
+	client := c.(*obfs4Conn)
+	server, _ := (<-serverCh).(*obfs4Conn)
+	if server == nil {
+		t.FailNow()
+	}
+	defer client.Close()
+	defer server.Close()
+
+	// The report is sent with the first data in each direction.
+	msg := []byte("hello")
+	for _, v := range []struct {
+		src, dst *obfs4Conn
+	}{
+		{client, server},
+		{server, client},
+	} {
+		go func(src *obfs4Conn) {
+			_, _ = src.Write(msg)
+		}(v.src)
+		buf := make([]byte, len(msg))
+		if _, err = io.ReadFull(v.dst, buf); err != nil {
+			t.Fatalf("Read() failed: %s", err)
+		}
+		if !bytes.Equal(buf, msg) {
+			t.Fatalf("payload corrupted: %q", buf)
+		}
+		if v.dst.peerVersion != ReportedVersion {
+			t.Fatalf("peer version %q, expected %q", v.dst.peerVersion, ReportedVersion)
+		}
+	}
+
+	b, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("ReadFile() failed: %s", err)
+	}
+	for _, peer := range []string{"client", "server"} {
+		expected := peer + ` reports version "` + ReportedVersion + `"`
+		if !strings.Contains(string(b), expected) {
+			t.Fatalf("%s version not logged: %s", peer, b)
+		}
+	}
+
+	// Nothing about the report is visible on the wire.
+	for _, captured := range [][]byte{clientCapture.Bytes(), serverCapture.Bytes()} {
+		if bytes.Contains(captured, []byte(ReportedVersion)) {
+			t.Fatalf("version sent in the clear")
+		}
+	}
+}
+
+func TestVersionReportDisabledByDefault(t *testing.T) {
+	client, server := newTestConnPair(t, iatNone, nil)
+	if client.pendingVersion != nil || server.pendingVersion != nil {
+		t.Fatalf("version report enabled by default")
+	}
+}